@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,15 +16,26 @@ import (
 
 	"github.com/mpesa-gateway/internal/config"
 	"github.com/mpesa-gateway/internal/database"
+	"github.com/mpesa-gateway/internal/handlers"
+	"github.com/mpesa-gateway/internal/httpclient"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
+	"github.com/mpesa-gateway/internal/middleware"
 	"github.com/mpesa-gateway/internal/mpesa"
 	"github.com/mpesa-gateway/internal/payment"
 	"github.com/mpesa-gateway/internal/queue"
 	"github.com/mpesa-gateway/internal/server"
-	"github.com/mpesa-gateway/internal/handlers"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/mpesa-gateway/internal/txcache"
+	"github.com/mpesa-gateway/internal/urlguard"
 	"github.com/mpesa-gateway/internal/worker"
+	"github.com/mpesa-gateway/migrations"
 )
 
 func main() {
+	migrate := flag.Bool("migrate", false, "apply pending database migrations before starting")
+	flag.Parse()
+
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.Println("M-Pesa Payment Gateway starting...")
 
@@ -29,17 +44,42 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	logging.SetRedaction(cfg.LogRedactPII)
+	for _, warning := range cfg.Warnings() {
+		log.Printf("WARNING: %s", warning)
+	}
 	cfg.LogSafeConfig()
 
-	// Create context
-	ctx := context.Background()
+	// Create context (cancelled on shutdown to stop background goroutines)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// Initialize tracing (no-op without MPESA_OTLP_ENDPOINT)
+	shutdownTracing, err := tracing.Init(ctx, "mpesa-gateway-api", cfg.OTLPEndpoint)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
 
 	// Initialize database
-	db, err := database.NewDatabase(ctx, cfg.DatabaseURL, cfg.DBMinConns, cfg.DBMaxConns)
+	db, err := database.NewDatabase(ctx, cfg.DatabaseURL, database.PoolConfig{
+		MinConns:         cfg.DBMinConns,
+		MaxConns:         cfg.DBMaxConns,
+		MaxConnLifetime:  time.Duration(cfg.DBMaxConnLifetime) * time.Second,
+		MaxConnIdleTime:  time.Duration(cfg.DBMaxConnIdleTime) * time.Second,
+		StatementTimeout: time.Duration(cfg.DBStatementTimeout) * time.Second,
+	})
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	defer db.Close()
+	metrics.RegisterDBPool(db.Pool)
+
+	// Apply embedded schema migrations
+	if *migrate {
+		if err := migrations.Run(ctx, db.Pool); err != nil {
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+	}
 
 	// Initialize queue
 	q, err := queue.NewQueue(cfg.RedisURL, cfg.WorkerConcurrency)
@@ -48,43 +88,200 @@ func main() {
 	}
 	defer q.Close()
 
-	// Initialize token service
-	tokenService := mpesa.NewTokenService(
-		cfg.SafaricomConsumerKey,
-		cfg.SafaricomConsumerSecret,
-		cfg.SafaricomAuthURL,
-	)
+	// Shared outbound connection pools
+	transportCfg := httpclient.TransportConfig{
+		MaxIdleConns:        cfg.HTTPMaxIdleConns,
+		MaxIdleConnsPerHost: cfg.HTTPMaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(cfg.HTTPIdleConnTimeout) * time.Second,
+		MinTLSVersion:       httpclient.TLSVersions[cfg.TLSMinVersion],
+	}
+
+	// Only Safaricom calls present the client certificate
+	safaricomTransportCfg := transportCfg
+	if cfg.SafaricomClientCert != nil {
+		safaricomTransportCfg.ClientCertificates = []tls.Certificate{*cfg.SafaricomClientCert}
+	}
+
+	// Safaricom API client shared by every credential set
+	safaricom := mpesa.NewClient(mpesa.ClientConfig{
+		Endpoints: mpesa.Endpoints{
+			Auth:        cfg.SafaricomAuthURL,
+			STKPush:     cfg.SafaricomSTKPushURL,
+			STKQuery:    cfg.SafaricomSTKQueryURL,
+			B2C:         cfg.B2CURL,
+			C2BRegister: cfg.C2BRegisterURL,
+		},
+		HTTPClient:     &http.Client{Transport: httpclient.NewTransport(safaricomTransportCfg, nil)},
+		RequestTimeout: time.Duration(cfg.SafaricomRequestTimeout) * time.Second,
+		TokenTimeout:   time.Duration(cfg.TokenRequestTimeout) * time.Second,
+
+		TokenRefreshBuffer: time.Duration(cfg.TokenRefreshBuffer) * time.Second,
+	})
+
+	// In simulation mode nothing is sent to Safaricom: STK Pushes are
+	// answered locally and their callbacks queued after a delay
+	var safaricomAPI payment.SafaricomAPI = safaricom
+	newTokens := safaricom.NewTokenService
+	if cfg.Simulate {
+		safaricomAPI = &mpesa.Simulator{
+			ResultCode: cfg.SimulateResultCode,
+			OnSTKPush:  worker.SimulatedCallbackScheduler(q.Client, cfg.CallbackQueue, time.Duration(cfg.SimulateCallbackDelay)*time.Second, cfg.SimulateResultCode),
+		}
+		newTokens = func(_, _ string) *mpesa.TokenService { return mpesa.NewStaticTokenService(mpesa.SimulatedToken) }
+	}
+
+	// Initialize Safaricom credential sets (default plus per-tenant)
+	credentials := payment.NewCredentialStore(&payment.Credentials{
+		ShortCode:       cfg.SafaricomShortCode,
+		TillNumber:      cfg.SafaricomTillNumber,
+		TransactionType: cfg.SafaricomTxnType,
+		Passkey:         cfg.SafaricomPasskey,
+		DescTemplate:    cfg.SafaricomDescTemplate,
+		Tokens:          newTokens(cfg.SafaricomConsumerKey, cfg.SafaricomConsumerSecret),
+	})
+	for tenantID, tc := range cfg.TenantCredentials {
+		descTemplate := tc.TransactionDescTemplate
+		if descTemplate == "" {
+			descTemplate = cfg.SafaricomDescTemplate
+		}
+		credentials.Add(tenantID, &payment.Credentials{
+			ShortCode:       tc.ShortCode,
+			TillNumber:      tc.TillNumber,
+			TransactionType: tc.TransactionType,
+			Passkey:         tc.Passkey,
+			CallbackURL:     tc.CallbackURL,
+			DescTemplate:    descTemplate,
+			Tokens:          newTokens(tc.ConsumerKey, tc.ConsumerSecret),
+		})
+	}
+	if cfg.TokenAutoRefresh {
+		credentials.StartAutoRefresh(ctx)
+	}
 
 	// Initialize payment service
+	webhookPolicy := urlguard.Policy{
+		RequireHTTPS: cfg.WebhookRequireHTTPS,
+		AllowPrivate: cfg.WebhookAllowPrivate,
+	}
+
+	// Callback transaction lookups; shared by the callback handler and the
+	// embedded worker so the worker's invalidations reach both (nil when
+	// MPESA_TX_CACHE_SIZE is 0)
+	txCache := txcache.New(cfg.TxCacheSize, time.Duration(cfg.TxCacheTTL)*time.Second)
+
+	amountPolicy := payment.AmountPolicy{
+		Rounding:   payment.AmountRounding(cfg.AmountRounding),
+		MinorUnits: cfg.AmountMinorUnits,
+	}
+
 	paymentService := payment.NewService(
 		db.Pool,
-		tokenService,
+		credentials,
+		safaricomAPI,
 		payment.PaymentConfig{
-			ShortCode:   cfg.SafaricomShortCode,
-			Passkey:     cfg.SafaricomPasskey,
-			STKPushURL:  cfg.SafaricomSTKPushURL,
 			CallbackURL: cfg.SafaricomCallbackURL,
+
+			BreakerMaxFailures: uint32(cfg.STKBreakerMaxFailures),
+			BreakerCooldown:    time.Duration(cfg.STKBreakerCooldown) * time.Second,
+			MaxInFlight:        int64(cfg.STKMaxInFlight),
+			InFlightWait:       time.Duration(cfg.STKInFlightWait) * time.Second,
+			WebhookPolicy:      webhookPolicy,
+			SanitizeReferences: cfg.SanitizeSTKReferences,
+			LogAPICalls:        cfg.LogAPICalls,
+			DebugSTKPassword:   cfg.DebugSTKPassword,
+			AmountPolicy:       amountPolicy,
+			B2C: payment.B2CConfig{
+				ShortCode:          cfg.B2CShortCode,
+				InitiatorName:      cfg.B2CInitiatorName,
+				SecurityCredential: cfg.B2CSecurityCredential,
+				CommandID:          cfg.B2CCommandID,
+				ResultURL:          cfg.B2CResultURL,
+				QueueTimeoutURL:    cfg.B2CQueueTimeoutURL,
+			},
+			C2B: payment.C2BConfig{
+				ShortCode:       cfg.C2BShortCode,
+				ValidationURL:   cfg.C2BValidationURL,
+				ConfirmationURL: cfg.C2BConfirmationURL,
+				ResponseType:    cfg.C2BResponseType,
+			},
 		},
 	)
 
-	// Initialize HTTP handlers
-	httpHandlers := handlers.NewHandler(db.Pool, paymentService, q.Client)
+	// Initialize HTTP handlers. /initiate/batch shares the initiate rate
+	// limit, taking a token per payment.
+	initiateLimiter := middleware.NewRateLimiter(q.Redis, cfg.InitiateRateLimit, cfg.InitiateRateBurst)
+	httpHandlers := handlers.NewHandler(db.Pool, paymentService, q.Client, q.Inspector, handlers.HandlerConfig{
+		VerifyCallbackCheckoutID: cfg.VerifyCallbackCheckoutID,
+		CallbackReplayWindow:     time.Duration(cfg.CallbackReplayWindow) * time.Second,
+		CallbackUniqueTTL:        time.Duration(cfg.CallbackUniqueTTL) * time.Second,
+		CallbackQueue:            cfg.CallbackQueue,
+		MinAmount:                cfg.MinAmount,
+		MaxAmount:                cfg.MaxAmount,
+		AmountPolicy:             amountPolicy,
+		SanitizeReferences:       cfg.SanitizeSTKReferences,
+		TxCache:                  txCache,
+
+		InitiateLimiter: initiateLimiter,
+		InitiateTimeout: time.Duration(cfg.InitiateTimeout) * time.Second,
+	})
 
 	// Initialize worker processor
-	processor := worker.NewProcessor(db.Pool)
+	processor := worker.NewProcessor(db.Pool, q.Client, paymentService, worker.ReconcileConfig{
+		PendingAge: time.Duration(cfg.ReconcilePendingAge) * time.Second,
+		BatchSize:  cfg.ReconcileBatchSize,
+	}, worker.RetentionConfig{
+		IdempotencyKeyTTL: time.Duration(cfg.IdempotencyKeyTTL) * time.Second,
+		ArchiveAfter:      time.Duration(cfg.ArchiveAfter) * time.Second,
+		ArchiveBatchSize:  cfg.ArchiveBatchSize,
+		APILogTTL:         time.Duration(cfg.APILogTTL) * time.Second,
+	}, worker.WebhookConfig{
+		MaxRetries:    cfg.WebhookMaxRetries,
+		BackoffBase:   time.Duration(cfg.WebhookBackoffBase) * time.Second,
+		BackoffMax:    time.Duration(cfg.WebhookBackoffMax) * time.Second,
+		Timeout:       time.Duration(cfg.WebhookTimeout) * time.Second,
+		MaxBody:       int64(cfg.WebhookMaxResponseBody),
+		DefaultSecret: cfg.WebhookSecret,
+		Policy:        webhookPolicy,
+		MaxPerHost:    cfg.WebhookMaxPerHost,
+		TenantHeaders: cfg.TenantWebhookHeaders(),
+		C2BWebhookURL: cfg.C2BWebhookURL,
+
+		TenantSignatureAlgorithms: cfg.TenantWebhookSignatureAlgorithms(),
+
+		// Re-check every dialled address to defeat DNS rebinding
+		Transport: httpclient.NewTransport(transportCfg, webhookPolicy.DialControl),
+	}, worker.CallbackConfig{
+		Redis:    q.Redis,
+		DedupTTL: time.Duration(cfg.CallbackDedupTTL) * time.Second,
+
+		DBRetries:    cfg.CallbackDBRetries,
+		DBRetryDelay: time.Duration(cfg.CallbackDBRetryDelay) * time.Millisecond,
+
+		CheckMerchantID:          cfg.CallbackMerchantIDCheck != config.MerchantIDCheckOff,
+		RejectMerchantIDMismatch: cfg.CallbackMerchantIDCheck == config.MerchantIDCheckReject,
+
+		TxCache: txCache,
+	})
 
 	// Register worker handlers
 	q.Server.HandleFunc(worker.TypeProcessCallback, processor.ProcessCallback)
+	q.Server.HandleFunc(worker.TypeReconcilePending, processor.ReconcilePending)
+	q.Server.HandleFunc(worker.TypeDeliverWebhook, processor.DeliverWebhook)
+	q.Server.HandleFunc(worker.TypeProcessB2CResult, processor.ProcessB2CResult)
+	q.Server.HandleFunc(worker.TypeNotifyPending, processor.NotifyPending)
+	q.Server.HandleFunc(worker.TypePurgeIdempotencyKeys, processor.PurgeIdempotencyKeys)
+	q.Server.HandleFunc(worker.TypeArchiveTransactions, processor.ArchiveTransactions)
+	q.Server.HandleFunc(worker.TypePurgeAPILogs, processor.PurgeAPILogs)
+	q.Server.HandleFunc(worker.TypeProcessC2BConfirmation, processor.ProcessC2BConfirmation)
 
 	// Start Asynq worker in background
-	redisOpt, serverConfig, err := q.GetServerConfig(cfg.RedisURL, cfg.WorkerConcurrency)
-	if err != nil {
-		log.Fatalf("Failed to create worker config: %v", err)
-	}
+	serverConfig := q.GetServerConfig(cfg.QueueWeights)
+	serverConfig.RetryDelayFunc = processor.RetryDelay
+	serverConfig.IsFailure = processor.IsFailure
 
 	asynqServer := asynq.NewServer(
-		redisOpt,
-		*serverConfig,
+		q.RedisOpt,
+		serverConfig,
 	)
 
 	go func() {
@@ -94,12 +291,18 @@ func main() {
 		}
 	}()
 
+	// Load API keys when MPESA_AUTH_MODE accepts them
+	apiKeys, err := server.LoadAPIKeys(ctx, cfg, db.Pool)
+	if err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+
 	// Initialize HTTP server
-	httpServer := server.NewServer(cfg, httpHandlers)
+	httpServer := server.NewServer(cfg, httpHandlers, initiateLimiter, apiKeys)
 
 	// Start HTTP server in background
 	go func() {
-		if err := httpServer.Start(); err != nil {
+		if err := httpServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("HTTP server failed: %v", err)
 		}
 	}()
@@ -111,8 +314,21 @@ func main() {
 
 	log.Println("Shutting down gracefully...")
 
-	// Shutdown Asynq worker
+	// Drain in-flight HTTP requests
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
+	}
+
+	// Shutdown Asynq worker and background refresh
 	asynqServer.Shutdown()
+	stop()
+
+	// Flush buffered spans
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Tracing shutdown error: %v", err)
+	}
 
 	// Give time for cleanup
 	time.Sleep(2 * time.Second)
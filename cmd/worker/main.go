@@ -2,16 +2,28 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/hibiken/asynq"
 
 	"github.com/mpesa-gateway/internal/config"
 	"github.com/mpesa-gateway/internal/database"
+	"github.com/mpesa-gateway/internal/httpclient"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/payment"
 	"github.com/mpesa-gateway/internal/queue"
+	"github.com/mpesa-gateway/internal/server"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/mpesa-gateway/internal/txcache"
+	"github.com/mpesa-gateway/internal/urlguard"
 	"github.com/mpesa-gateway/internal/worker"
 )
 
@@ -24,16 +36,34 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	logging.SetRedaction(cfg.LogRedactPII)
+	for _, warning := range cfg.Warnings() {
+		log.Printf("WARNING: %s", warning)
+	}
 
-	// Create context
-	ctx := context.Background()
+	// Create context (cancelled on shutdown to stop background goroutines)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// Initialize tracing (no-op without MPESA_OTLP_ENDPOINT)
+	shutdownTracing, err := tracing.Init(ctx, "mpesa-gateway-worker", cfg.OTLPEndpoint)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
 
 	// Initialize database
-	db, err := database.NewDatabase(ctx, cfg.DatabaseURL, cfg.DBMinConns, cfg.DBMaxConns)
+	db, err := database.NewDatabase(ctx, cfg.DatabaseURL, database.PoolConfig{
+		MinConns:         cfg.DBMinConns,
+		MaxConns:         cfg.DBMaxConns,
+		MaxConnLifetime:  time.Duration(cfg.DBMaxConnLifetime) * time.Second,
+		MaxConnIdleTime:  time.Duration(cfg.DBMaxConnIdleTime) * time.Second,
+		StatementTimeout: time.Duration(cfg.DBStatementTimeout) * time.Second,
+	})
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	defer db.Close()
+	metrics.RegisterDBPool(db.Pool)
 
 	// Initialize queue
 	q, err := queue.NewQueue(cfg.RedisURL, cfg.WorkerConcurrency)
@@ -42,23 +72,243 @@ func main() {
 	}
 	defer q.Close()
 
+	// Shared outbound connection pools
+	transportCfg := httpclient.TransportConfig{
+		MaxIdleConns:        cfg.HTTPMaxIdleConns,
+		MaxIdleConnsPerHost: cfg.HTTPMaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(cfg.HTTPIdleConnTimeout) * time.Second,
+		MinTLSVersion:       httpclient.TLSVersions[cfg.TLSMinVersion],
+	}
+
+	// Only Safaricom calls present the client certificate
+	safaricomTransportCfg := transportCfg
+	if cfg.SafaricomClientCert != nil {
+		safaricomTransportCfg.ClientCertificates = []tls.Certificate{*cfg.SafaricomClientCert}
+	}
+
+	// Safaricom API client shared by every credential set
+	safaricom := mpesa.NewClient(mpesa.ClientConfig{
+		Endpoints: mpesa.Endpoints{
+			Auth:        cfg.SafaricomAuthURL,
+			STKPush:     cfg.SafaricomSTKPushURL,
+			STKQuery:    cfg.SafaricomSTKQueryURL,
+			B2C:         cfg.B2CURL,
+			C2BRegister: cfg.C2BRegisterURL,
+		},
+		HTTPClient:     &http.Client{Transport: httpclient.NewTransport(safaricomTransportCfg, nil)},
+		RequestTimeout: time.Duration(cfg.SafaricomRequestTimeout) * time.Second,
+		TokenTimeout:   time.Duration(cfg.TokenRequestTimeout) * time.Second,
+
+		TokenRefreshBuffer: time.Duration(cfg.TokenRefreshBuffer) * time.Second,
+	})
+
+	// In simulation mode nothing is sent to Safaricom: STK Pushes are
+	// answered locally and their callbacks queued after a delay
+	var safaricomAPI payment.SafaricomAPI = safaricom
+	newTokens := safaricom.NewTokenService
+	if cfg.Simulate {
+		safaricomAPI = &mpesa.Simulator{
+			ResultCode: cfg.SimulateResultCode,
+			OnSTKPush:  worker.SimulatedCallbackScheduler(q.Client, cfg.CallbackQueue, time.Duration(cfg.SimulateCallbackDelay)*time.Second, cfg.SimulateResultCode),
+		}
+		newTokens = func(_, _ string) *mpesa.TokenService { return mpesa.NewStaticTokenService(mpesa.SimulatedToken) }
+	}
+
+	// Initialize Safaricom credential sets (default plus per-tenant)
+	credentials := payment.NewCredentialStore(&payment.Credentials{
+		ShortCode:       cfg.SafaricomShortCode,
+		TillNumber:      cfg.SafaricomTillNumber,
+		TransactionType: cfg.SafaricomTxnType,
+		Passkey:         cfg.SafaricomPasskey,
+		DescTemplate:    cfg.SafaricomDescTemplate,
+		Tokens:          newTokens(cfg.SafaricomConsumerKey, cfg.SafaricomConsumerSecret),
+	})
+	for tenantID, tc := range cfg.TenantCredentials {
+		descTemplate := tc.TransactionDescTemplate
+		if descTemplate == "" {
+			descTemplate = cfg.SafaricomDescTemplate
+		}
+		credentials.Add(tenantID, &payment.Credentials{
+			ShortCode:       tc.ShortCode,
+			TillNumber:      tc.TillNumber,
+			TransactionType: tc.TransactionType,
+			Passkey:         tc.Passkey,
+			CallbackURL:     tc.CallbackURL,
+			DescTemplate:    descTemplate,
+			Tokens:          newTokens(tc.ConsumerKey, tc.ConsumerSecret),
+		})
+	}
+	if cfg.TokenAutoRefresh {
+		credentials.StartAutoRefresh(ctx)
+	}
+
+	webhookPolicy := urlguard.Policy{
+		RequireHTTPS: cfg.WebhookRequireHTTPS,
+		AllowPrivate: cfg.WebhookAllowPrivate,
+	}
+
+	// Callback transaction lookups (nil when MPESA_TX_CACHE_SIZE is 0)
+	txCache := txcache.New(cfg.TxCacheSize, time.Duration(cfg.TxCacheTTL)*time.Second)
+
+	amountPolicy := payment.AmountPolicy{
+		Rounding:   payment.AmountRounding(cfg.AmountRounding),
+		MinorUnits: cfg.AmountMinorUnits,
+	}
+
+	paymentService := payment.NewService(
+		db.Pool,
+		credentials,
+		safaricomAPI,
+		payment.PaymentConfig{
+			CallbackURL: cfg.SafaricomCallbackURL,
+
+			BreakerMaxFailures: uint32(cfg.STKBreakerMaxFailures),
+			BreakerCooldown:    time.Duration(cfg.STKBreakerCooldown) * time.Second,
+			MaxInFlight:        int64(cfg.STKMaxInFlight),
+			InFlightWait:       time.Duration(cfg.STKInFlightWait) * time.Second,
+			WebhookPolicy:      webhookPolicy,
+			SanitizeReferences: cfg.SanitizeSTKReferences,
+			LogAPICalls:        cfg.LogAPICalls,
+			DebugSTKPassword:   cfg.DebugSTKPassword,
+			AmountPolicy:       amountPolicy,
+			B2C: payment.B2CConfig{
+				ShortCode:          cfg.B2CShortCode,
+				InitiatorName:      cfg.B2CInitiatorName,
+				SecurityCredential: cfg.B2CSecurityCredential,
+				CommandID:          cfg.B2CCommandID,
+				ResultURL:          cfg.B2CResultURL,
+				QueueTimeoutURL:    cfg.B2CQueueTimeoutURL,
+			},
+			C2B: payment.C2BConfig{
+				ShortCode:       cfg.C2BShortCode,
+				ValidationURL:   cfg.C2BValidationURL,
+				ConfirmationURL: cfg.C2BConfirmationURL,
+				ResponseType:    cfg.C2BResponseType,
+			},
+		},
+	)
+
 	// Initialize worker processor
-	processor := worker.NewProcessor(db.Pool)
+	processor := worker.NewProcessor(db.Pool, q.Client, paymentService, worker.ReconcileConfig{
+		PendingAge: time.Duration(cfg.ReconcilePendingAge) * time.Second,
+		BatchSize:  cfg.ReconcileBatchSize,
+	}, worker.RetentionConfig{
+		IdempotencyKeyTTL: time.Duration(cfg.IdempotencyKeyTTL) * time.Second,
+		ArchiveAfter:      time.Duration(cfg.ArchiveAfter) * time.Second,
+		ArchiveBatchSize:  cfg.ArchiveBatchSize,
+		APILogTTL:         time.Duration(cfg.APILogTTL) * time.Second,
+	}, worker.WebhookConfig{
+		MaxRetries:    cfg.WebhookMaxRetries,
+		BackoffBase:   time.Duration(cfg.WebhookBackoffBase) * time.Second,
+		BackoffMax:    time.Duration(cfg.WebhookBackoffMax) * time.Second,
+		Timeout:       time.Duration(cfg.WebhookTimeout) * time.Second,
+		MaxBody:       int64(cfg.WebhookMaxResponseBody),
+		DefaultSecret: cfg.WebhookSecret,
+		Policy:        webhookPolicy,
+		MaxPerHost:    cfg.WebhookMaxPerHost,
+		TenantHeaders: cfg.TenantWebhookHeaders(),
+		C2BWebhookURL: cfg.C2BWebhookURL,
+
+		TenantSignatureAlgorithms: cfg.TenantWebhookSignatureAlgorithms(),
+
+		// Re-check every dialled address to defeat DNS rebinding
+		Transport: httpclient.NewTransport(transportCfg, webhookPolicy.DialControl),
+	}, worker.CallbackConfig{
+		Redis:    q.Redis,
+		DedupTTL: time.Duration(cfg.CallbackDedupTTL) * time.Second,
+
+		DBRetries:    cfg.CallbackDBRetries,
+		DBRetryDelay: time.Duration(cfg.CallbackDBRetryDelay) * time.Millisecond,
+
+		CheckMerchantID:          cfg.CallbackMerchantIDCheck != config.MerchantIDCheckOff,
+		RejectMerchantIDMismatch: cfg.CallbackMerchantIDCheck == config.MerchantIDCheckReject,
+
+		TxCache: txCache,
+	})
 
 	// Register worker handlers
 	q.Server.HandleFunc(worker.TypeProcessCallback, processor.ProcessCallback)
+	q.Server.HandleFunc(worker.TypeReconcilePending, processor.ReconcilePending)
+	q.Server.HandleFunc(worker.TypeDeliverWebhook, processor.DeliverWebhook)
+	q.Server.HandleFunc(worker.TypeProcessB2CResult, processor.ProcessB2CResult)
+	q.Server.HandleFunc(worker.TypeNotifyPending, processor.NotifyPending)
+	q.Server.HandleFunc(worker.TypePurgeIdempotencyKeys, processor.PurgeIdempotencyKeys)
+	q.Server.HandleFunc(worker.TypeArchiveTransactions, processor.ArchiveTransactions)
+	q.Server.HandleFunc(worker.TypePurgeAPILogs, processor.PurgeAPILogs)
+	q.Server.HandleFunc(worker.TypeProcessC2BConfirmation, processor.ProcessC2BConfirmation)
 
 	// Start Asynq worker
-	redisOpt, serverConfig, err := q.GetServerConfig(cfg.RedisURL, cfg.WorkerConcurrency)
-	if err != nil {
-		log.Fatalf("Failed to create worker config: %v", err)
-	}
+	serverConfig := q.GetServerConfig(cfg.QueueWeights)
+	serverConfig.RetryDelayFunc = processor.RetryDelay
+	serverConfig.IsFailure = processor.IsFailure
 
 	asynqServer := asynq.NewServer(
-		redisOpt,
-		*serverConfig,
+		q.RedisOpt,
+		serverConfig,
 	)
 
+	// Schedule periodic reconciliation of stuck PENDING transactions.
+	// Unique prevents duplicate runs when several workers are deployed.
+	scheduler := asynq.NewScheduler(q.RedisOpt, nil)
+	if _, err := scheduler.Register(
+		cfg.ReconcileInterval,
+		worker.NewReconcilePendingTask(),
+		asynq.Unique(time.Minute),
+	); err != nil {
+		log.Fatalf("Failed to register reconciliation schedule: %v", err)
+	}
+	if cfg.IdempotencyKeyTTL > 0 {
+		if _, err := scheduler.Register(
+			"@every 1h",
+			worker.NewPurgeIdempotencyKeysTask(),
+			asynq.Unique(time.Minute),
+		); err != nil {
+			log.Fatalf("Failed to register idempotency key cleanup schedule: %v", err)
+		}
+	}
+	if cfg.ArchiveAfter > 0 {
+		if _, err := scheduler.Register(
+			"@every 1h",
+			worker.NewArchiveTransactionsTask(),
+			asynq.Unique(time.Hour),
+		); err != nil {
+			log.Fatalf("Failed to register transaction archive schedule: %v", err)
+		}
+	}
+	if cfg.APILogTTL > 0 {
+		if _, err := scheduler.Register(
+			"@every 1h",
+			worker.NewPurgeAPILogsTask(),
+			asynq.Unique(time.Minute),
+		); err != nil {
+			log.Fatalf("Failed to register API log cleanup schedule: %v", err)
+		}
+	}
+	if err := scheduler.Start(); err != nil {
+		log.Fatalf("Failed to start scheduler: %v", err)
+	}
+
+	// Expose worker metrics (callbacks and webhooks are processed here),
+	// behind the same authentication as the API's /metrics
+	if cfg.WorkerMetricsPort != "" {
+		metricsHandler := metrics.Handler()
+		if cfg.MetricsRequireAuth {
+			apiKeys, err := server.LoadAPIKeys(ctx, cfg, db.Pool)
+			if err != nil {
+				log.Fatalf("Failed to load API keys: %v", err)
+			}
+			metricsHandler = server.Auth(cfg, apiKeys, false)(metricsHandler)
+		}
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metricsHandler)
+			log.Printf("Serving worker metrics on :%s", cfg.WorkerMetricsPort)
+			if err := http.ListenAndServe(":"+cfg.WorkerMetricsPort, mux); err != nil {
+				log.Printf("Worker metrics server failed: %v", err)
+			}
+		}()
+	}
+
 	// Handle shutdown signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -66,7 +316,9 @@ func main() {
 	go func() {
 		<-quit
 		log.Println("Shutting down worker...")
+		scheduler.Shutdown()
 		asynqServer.Shutdown()
+		stop()
 	}()
 
 	log.Println("Worker started, processing tasks...")
@@ -74,5 +326,12 @@ func main() {
 		log.Fatalf("Worker failed: %v", err)
 	}
 
+	// Flush buffered spans
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("Tracing shutdown error: %v", err)
+	}
+
 	log.Println("Worker shutdown complete")
 }
@@ -0,0 +1,134 @@
+// Package apikey authenticates callers against the hashed keys in the
+// api_keys table.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/mpesa-gateway/internal/logging"
+)
+
+// keyPrefix marks gateway API keys so leaked ones are easy to grep for
+const keyPrefix = "mpk_"
+
+// Key is an enabled API key
+type Key struct {
+	ID       int64
+	Label    string
+	TenantID string // Empty for keys not pinned to a tenant
+	hash     []byte
+}
+
+// Store caches the enabled keys so authenticating a request does not touch
+// the database. Keys created or disabled elsewhere take effect on the next
+// Refresh.
+type Store struct {
+	db *pgxpool.Pool
+
+	mu   sync.RWMutex
+	keys []Key
+}
+
+// NewStore creates an empty store; call Refresh before serving requests
+func NewStore(db *pgxpool.Pool) *Store {
+	return &Store{db: db}
+}
+
+// Refresh reloads the enabled keys
+func (s *Store) Refresh(ctx context.Context) error {
+	rows, err := s.db.Query(ctx, `SELECT id, label, key_hash, COALESCE(tenant_id, '') FROM api_keys WHERE enabled`)
+	if err != nil {
+		return fmt.Errorf("failed to load API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []Key
+	for rows.Next() {
+		var k Key
+		var hexHash string
+		if err := rows.Scan(&k.ID, &k.Label, &hexHash, &k.TenantID); err != nil {
+			return fmt.Errorf("failed to scan API key: %w", err)
+		}
+		if k.hash, err = hex.DecodeString(hexHash); err != nil {
+			return fmt.Errorf("API key %d has a malformed hash", k.ID)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load API keys: %w", err)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// StartRefresh reloads the keys every interval until ctx is cancelled. A
+// failed reload keeps the previous keys.
+func (s *Store) StartRefresh(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := s.Refresh(ctx); err != nil && ctx.Err() == nil {
+				logging.Printf("API key refresh failed: %v", err)
+			}
+		}
+	}()
+}
+
+// Authenticate returns the enabled key matching raw. Every key is compared
+// in constant time so the response time reveals nothing about which, if
+// any, matched.
+func (s *Store) Authenticate(raw string) (*Key, bool) {
+	if raw == "" {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(raw))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *Key
+	for i := range s.keys {
+		if subtle.ConstantTimeCompare(sum[:], s.keys[i].hash) == 1 {
+			k := s.keys[i]
+			found = &k
+		}
+	}
+	return found, found != nil
+}
+
+// Generate returns a new random API key and the hash to store for it
+func Generate() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	key = keyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, Hash(key), nil
+}
+
+// Hash returns the hex SHA-256 stored in api_keys.key_hash for key
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
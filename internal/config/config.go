@@ -1,85 +1,568 @@
 package config
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/mpesa-gateway/internal/httpclient"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/queue"
+	"github.com/shopspring/decimal"
+)
+
+// Safaricom environments selectable with MPESA_ENVIRONMENT
+const (
+	EnvironmentSandbox    = "sandbox"
+	EnvironmentProduction = "production"
+)
+
+// Authentication modes selectable with MPESA_AUTH_MODE
+const (
+	AuthModeSecret = "secret"  // Shared X-Internal-Secret only
+	AuthModeAPIKey = "api_key" // X-API-Key from the api_keys table only
+	AuthModeBoth   = "both"    // Either, for migrating callers to API keys
+)
+
+// MPESA_CALLBACK_MERCHANT_ID_CHECK values
+const (
+	MerchantIDCheckOff    = "off"    // Match callbacks by CheckoutRequestID only
+	MerchantIDCheckLog    = "log"    // Log callbacks whose MerchantRequestID differs
+	MerchantIDCheckReject = "reject" // Log and drop them
 )
 
+// Tenant webhook_signature_algorithm values
+const (
+	WebhookSignatureHMACSHA256 = "hmac-sha256" // Default
+	WebhookSignatureHMACSHA512 = "hmac-sha512"
+)
+
+// MPESA_AMOUNT_ROUNDING values
+const (
+	AmountRoundingReject = "reject"  // Refuse amounts Safaricom cannot charge exactly
+	AmountRoundingFloor  = "floor"   // Round down
+	AmountRoundingHalfUp = "half_up" // Round to nearest, halves up
+)
+
+// safaricomHosts maps each environment to its Safaricom API base URL
+var safaricomHosts = map[string]string{
+	EnvironmentSandbox:    "https://sandbox.safaricom.co.ke",
+	EnvironmentProduction: "https://api.safaricom.co.ke",
+}
+
+// sandboxShortCode is the public Daraja sandbox test short code
+const sandboxShortCode = "174379"
+
 // Config holds all application configuration
 type Config struct {
 	// Server settings
-	ServerPort string
+	ServerPort      string
+	ShutdownTimeout int // seconds
+
+	// Per-route request deadlines in seconds: Safaricom callbacks and health
+	// probes, the endpoints that call Safaricom inline (/initiate,
+	// /initiate/batch, /payouts), and everything else
+	CallbackTimeout int
+	InitiateTimeout int
+	RequestTimeout  int
+
+	// Every route is served under RoutePrefix (e.g. "/payments", empty for
+	// none); Safaricom callbacks are served under CallbackPath beneath it
+	RoutePrefix  string
+	CallbackPath string
+
+	// Public base URL of the gateway (scheme and host); when set,
+	// SafaricomCallbackURL defaults to it plus RoutePrefix and CallbackPath
+	PublicURL string
 
 	// Database configuration
 	DatabaseURL string
 	DBMaxConns  int
 	DBMinConns  int
 
+	DBMaxConnLifetime  int // seconds
+	DBMaxConnIdleTime  int // seconds
+	DBStatementTimeout int // seconds; 0 uses the server default
+
 	// Redis configuration
 	RedisURL string
 
+	// Safaricom environment (sandbox or production); selects default API URLs
+	Environment string
+
 	// Safaricom API credentials
 	SafaricomConsumerKey    string
 	SafaricomConsumerSecret string
 	SafaricomPasskey        string
 	SafaricomShortCode      string
+	SafaricomTillNumber     string
+	SafaricomTxnType        string
+	SafaricomDescTemplate   string // STK TransactionDesc template using {ref} and {amount}
 	SafaricomAuthURL        string
 	SafaricomSTKPushURL     string
+	SafaricomSTKQueryURL    string
 	SafaricomCallbackURL    string
 
+	// URL prefixes a tenant callback_url must fall under; defaults to the
+	// scheme and host of SafaricomCallbackURL
+	CallbackURLPrefixes []string
+
+	// Answer STK Pushes locally instead of calling Safaricom, queueing a
+	// callback with SimulateResultCode after SimulateCallbackDelay seconds
+	Simulate              bool
+	SimulateResultCode    int
+	SimulateCallbackDelay int // seconds
+
+	// Per-call deadlines for Safaricom APIs (seconds)
+	SafaricomRequestTimeout int
+	TokenRequestTimeout     int
+	TokenAutoRefresh        bool // Refresh the OAuth token in the background before expiry
+	TokenRefreshBuffer      int  // Seconds before Safaricom's expiry a token is refreshed
+
+	// B2C payouts; disabled unless initiator name and credential are set
+	B2CURL                string
+	B2CShortCode          string // Defaults to SafaricomShortCode
+	B2CInitiatorName      string
+	B2CSecurityCredential string
+	B2CCommandID          string
+	B2CResultURL          string
+	B2CQueueTimeoutURL    string
+
+	// C2B URL registration for unsolicited paybill/till payments; disabled
+	// unless the confirmation URL is set
+	C2BRegisterURL     string
+	C2BShortCode       string // Defaults to SafaricomShortCode
+	C2BValidationURL   string
+	C2BConfirmationURL string
+	C2BResponseType    string // Completed or Cancelled when validation is unreachable
+	C2BWebhookURL      string // Tenant URL notified of confirmed payments
+
+	// Per-tenant Safaricom credentials, keyed by tenant ID
+	TenantCredentials map[string]TenantCredentials
+
+	// Clean tenant AccountReference/TransactionDesc to Safaricom's rules
+	SanitizeSTKReferences bool
+
+	// STK Push circuit breaker
+	STKBreakerMaxFailures int
+	STKBreakerCooldown    int // seconds
+
+	// Concurrent STK Push calls per process (0 = unlimited) and seconds a
+	// request waits for a free slot before failing with 503
+	STKMaxInFlight  int
+	STKInFlightWait int
+
 	// Security settings
 	InternalSecret string
+	AuthMode       string // AuthModeSecret, AuthModeAPIKey or AuthModeBoth
+	APIKeyRefresh  int    // Seconds between reloads of the api_keys table
 	SafaricomIPs   []string
+	TrustedProxies []string // Peers whose X-Forwarded-For/X-Real-IP headers are honoured
+
+	// Mask phone numbers in logs; disable only where full logging is acceptable
+	LogRedactPII bool
+
+	// Store every STK Push request and response in mpesa_api_logs (verbose),
+	// and the seconds each row is kept (0 = forever)
+	LogAPICalls bool
+	APILogTTL   int
+
+	// Log the timestamp and a SHA-256 fingerprint of each STK password, to
+	// diagnose password/timestamp mismatches without logging the password
+	DebugSTKPassword bool
+
+	// Asynq queue for callback tasks; must be one the worker serves
+	CallbackQueue string
+
+	// Seconds a processed callback's task ID stays reserved against redeliveries (0 disables)
+	CallbackUniqueTTL int
+
+	// Seconds a CheckoutRequestID stays claimed against duplicate callbacks (0 disables)
+	CallbackDedupTTL int
+
+	// Times a callback's status update is retried on a serialization failure
+	// or deadlock before the task fails, and the first wait in milliseconds
+	CallbackDBRetries    int
+	CallbackDBRetryDelay int // milliseconds
+
+	// In-memory cache of PENDING transactions looked up by callbacks:
+	// entries per process (0 disables) and seconds each is kept
+	TxCacheSize int
+	TxCacheTTL  int
+
+	// Drop callbacks whose CheckoutRequestID is not a known transaction
+	VerifyCallbackCheckoutID bool
+
+	// What to do with a callback whose MerchantRequestID differs from the
+	// stored one: MerchantIDCheckOff, MerchantIDCheckLog or MerchantIDCheckReject
+	CallbackMerchantIDCheck string
+
+	// Drop callbacks for settled transactions or for checkout requests older
+	// than this many seconds (0 disables)
+	CallbackReplayWindow int
+
+	// Require X-Internal-Secret on /metrics
+	MetricsRequireAuth bool
+
+	// Also serve the API without the /v1 prefix, with bare (unenveloped)
+	// responses
+	LegacyRoutes bool
+
+	// Accepted payment amount range (KES, inclusive)
+	MinAmount decimal.Decimal
+	MaxAmount decimal.Decimal
+
+	// How amounts with more decimal places than are charged are handled:
+	// AmountRoundingReject, AmountRoundingFloor or AmountRoundingHalfUp.
+	// AmountMinorUnits sends cents to the provider instead of whole shillings.
+	AmountRounding   string
+	AmountMinorUnits bool
+
+	// OTLP/HTTP endpoint for trace export (empty disables tracing)
+	OTLPEndpoint string
+
+	// Per-tenant rate limit on POST /initiate (0 disables)
+	InitiateRateLimit int // requests per minute
+	InitiateRateBurst int
+
+	// Outbound HTTP connection pool
+	HTTPMaxIdleConns        int
+	HTTPMaxIdleConnsPerHost int
+	HTTPIdleConnTimeout     int // seconds
+
+	// Outbound TLS: minimum version ("1.2" or "1.3") and an optional client
+	// certificate for mTLS to Safaricom, loaded from the PEM file pair
+	TLSMinVersion           string
+	SafaricomClientCertFile string
+	SafaricomClientKeyFile  string
+	SafaricomClientCert     *tls.Certificate
+
+	// Inbound HTTPS. With a certificate pair the server terminates TLS
+	// itself (loaded into ServerCert). RequireHTTPS rejects plain-HTTP API
+	// and callback requests, honouring X-Forwarded-Proto only from
+	// TrustedProxies, and sends HSTS with HSTSMaxAge seconds (0 omits it).
+	TLSCertFile  string
+	TLSKeyFile   string
+	ServerCert   *tls.Certificate
+	RequireHTTPS bool
+	HSTSMaxAge   int
 
 	// Request limits
 	MaxRequestSize int64
 
 	// Worker settings
 	WorkerConcurrency int
+	WorkerMetricsPort string         // Serves /metrics from the worker when set
+	QueueWeights      map[string]int // Served asynq queues and their priorities
+	queueWeightsErr   error          // Why MPESA_QUEUE_WEIGHTS fell back to the defaults
+
+	// Webhook settings
+	WebhookSecret          string // Default HMAC key for webhook signatures
+	WebhookRequireHTTPS    bool
+	WebhookAllowPrivate    bool // Allow private/loopback webhook targets (development only)
+	WebhookMaxRetries      int
+	WebhookBackoffBase     int // seconds; retry n waits up to base*2^n, fully jittered
+	WebhookBackoffMax      int // seconds; caps the exponential growth
+	WebhookTimeout         int // seconds per delivery attempt
+	WebhookMaxResponseBody int // bytes of each tenant response recorded
+	WebhookMaxPerHost      int // concurrent deliveries per webhook host per worker process (0 = unlimited)
+
+	// MPESA_WEBHOOK_BACKOFF_SCHEDULE is set but no longer read
+	webhookScheduleSet bool
+
+	// Reconciliation settings
+	ReconcileInterval   string
+	ReconcilePendingAge int // seconds
+	ReconcileBatchSize  int
+
+	// Seconds a settled transaction keeps its idempotency key (0 = forever)
+	IdempotencyKeyTTL int
+
+	// Seconds after which settled transactions move to transactions_archive
+	// (0 = never), and how many move per database transaction
+	ArchiveAfter     int
+	ArchiveBatchSize int
+}
+
+// TenantCredentials is one tenant's Safaricom credential set, loaded from
+// the JSON file named by MPESA_TENANT_CREDENTIALS_FILE
+type TenantCredentials struct {
+	ConsumerKey     string `json:"consumer_key"`
+	ConsumerSecret  string `json:"consumer_secret"`
+	Passkey         string `json:"passkey"`
+	ShortCode       string `json:"short_code"`
+	TillNumber      string `json:"till_number"`
+	TransactionType string `json:"transaction_type"`
+
+	// STK Push CallBackURL for this tenant's payments, e.g. a tenant-scoped
+	// path on this gateway; defaults to MPESA_SAFARICOM_CALLBACK_URL
+	CallbackURL string `json:"callback_url"`
+
+	// STK TransactionDesc template using {ref} and {amount}; defaults to
+	// MPESA_SAFARICOM_TRANSACTION_DESC_TEMPLATE
+	TransactionDescTemplate string `json:"transaction_desc_template"`
+
+	// Extra headers (e.g. Authorization) sent with webhooks to each URL,
+	// keyed by the exact webhook_url the tenant registers
+	WebhookHeaders map[string]map[string]string `json:"webhook_headers"`
+
+	// HMAC used to sign this tenant's webhooks; defaults to
+	// WebhookSignatureHMACSHA256
+	WebhookSignatureAlgorithm string `json:"webhook_signature_algorithm"`
+}
+
+// reservedWebhookHeaders are set by the worker and cannot be overridden
+var reservedWebhookHeaders = map[string]bool{
+	"Host":                  true,
+	"Content-Length":        true,
+	"X-Signature":           true,
+	"X-Signature-Scheme":    true,
+	"X-Signature-Algorithm": true,
+	"X-Signature-Timestamp": true,
+	"X-Request-Id":          true,
+	"Traceparent":           true,
+	"Tracestate":            true,
 }
 
-// Load reads configuration from environment variables
+// tenantIDPattern restricts tenant IDs to header- and log-safe values
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Load reads configuration from environment variables, falling back to the
+// YAML file named by MPESA_CONFIG_FILE for any that are unset
 func Load() (*Config, error) {
+	fileValues = nil
+	if path := os.Getenv("MPESA_CONFIG_FILE"); path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MPESA_CONFIG_FILE: %w", err)
+		}
+		fileValues = values
+	}
+
+	// MPESA_ENVIRONMENT picks the default Safaricom host; explicit URLs win
+	environment := getEnv("MPESA_ENVIRONMENT", "")
+	safaricomHost, ok := safaricomHosts[environment]
+	if !ok {
+		safaricomHost = safaricomHosts[EnvironmentSandbox]
+	}
+
 	cfg := &Config{
 		// Server
-		ServerPort: getEnv("MPESA_SERVER_PORT", "8080"),
+		ServerPort:      getEnv("MPESA_SERVER_PORT", "8080"),
+		ShutdownTimeout: getEnvInt("MPESA_SHUTDOWN_TIMEOUT", 30),
+		CallbackTimeout: getEnvInt("MPESA_CALLBACK_TIMEOUT", 5),
+		InitiateTimeout: getEnvInt("MPESA_INITIATE_TIMEOUT", 30),
+		RequestTimeout:  getEnvInt("MPESA_REQUEST_TIMEOUT", 30),
+		RoutePrefix:     strings.TrimSuffix(getEnv("MPESA_ROUTE_PREFIX", ""), "/"),
+		CallbackPath:    strings.TrimSuffix(getEnv("MPESA_CALLBACK_PATH", "/callback"), "/"),
+		PublicURL:       strings.TrimSuffix(getEnv("MPESA_PUBLIC_URL", ""), "/"),
 
 		// Database
 		DatabaseURL: getEnv("MPESA_DATABASE_URL", ""),
 		DBMaxConns:  getEnvInt("MPESA_DB_MAX_CONNS", 25),
 		DBMinConns:  getEnvInt("MPESA_DB_MIN_CONNS", 5),
 
+		DBMaxConnLifetime:  getEnvInt("MPESA_DB_MAX_CONN_LIFETIME", 3600),
+		DBMaxConnIdleTime:  getEnvInt("MPESA_DB_MAX_CONN_IDLE_TIME", 1800),
+		DBStatementTimeout: getEnvInt("MPESA_DB_STATEMENT_TIMEOUT", 30),
+
 		// Redis
 		RedisURL: getEnv("MPESA_REDIS_URL", ""),
 
 		// Safaricom
+		Environment:             environment,
 		SafaricomConsumerKey:    getEnv("MPESA_SAFARICOM_CONSUMER_KEY", ""),
 		SafaricomConsumerSecret: getEnv("MPESA_SAFARICOM_CONSUMER_SECRET", ""),
 		SafaricomPasskey:        getEnv("MPESA_SAFARICOM_PASSKEY", ""),
 		SafaricomShortCode:      getEnv("MPESA_SAFARICOM_SHORT_CODE", ""),
-		SafaricomAuthURL:        getEnv("MPESA_SAFARICOM_AUTH_URL", "https://sandbox.safaricom.co.ke/oauth/v1/generate?grant_type=client_credentials"),
-		SafaricomSTKPushURL:     getEnv("MPESA_SAFARICOM_STK_PUSH_URL", "https://sandbox.safaricom.co.ke/mpesa/stkpush/v1/processrequest"),
+		SafaricomTillNumber:     getEnv("MPESA_SAFARICOM_TILL_NUMBER", ""),
+		SafaricomTxnType:        getEnv("MPESA_SAFARICOM_TRANSACTION_TYPE", mpesa.TransactionTypePayBill),
+		SafaricomDescTemplate:   getEnv("MPESA_SAFARICOM_TRANSACTION_DESC_TEMPLATE", ""),
+		SafaricomAuthURL:        getEnv("MPESA_SAFARICOM_AUTH_URL", safaricomHost+"/oauth/v1/generate?grant_type=client_credentials"),
+		SafaricomSTKPushURL:     getEnv("MPESA_SAFARICOM_STK_PUSH_URL", safaricomHost+"/mpesa/stkpush/v1/processrequest"),
+		SafaricomSTKQueryURL:    getEnv("MPESA_SAFARICOM_STK_QUERY_URL", safaricomHost+"/mpesa/stkpushquery/v1/query"),
 		SafaricomCallbackURL:    getEnv("MPESA_SAFARICOM_CALLBACK_URL", ""),
+		TokenAutoRefresh:        getEnvBool("MPESA_TOKEN_AUTO_REFRESH", true),
+		B2CURL:                  getEnv("MPESA_SAFARICOM_B2C_URL", safaricomHost+"/mpesa/b2c/v1/paymentrequest"),
+		B2CShortCode:            getEnv("MPESA_B2C_SHORT_CODE", ""),
+		B2CInitiatorName:        getEnv("MPESA_B2C_INITIATOR_NAME", ""),
+		B2CSecurityCredential:   getEnv("MPESA_B2C_SECURITY_CREDENTIAL", ""),
+		B2CCommandID:            getEnv("MPESA_B2C_COMMAND_ID", "BusinessPayment"),
+		B2CResultURL:            getEnv("MPESA_B2C_RESULT_URL", ""),
+		B2CQueueTimeoutURL:      getEnv("MPESA_B2C_QUEUE_TIMEOUT_URL", ""),
+		C2BRegisterURL:          getEnv("MPESA_SAFARICOM_C2B_REGISTER_URL", safaricomHost+"/mpesa/c2b/v1/registerurl"),
+		C2BShortCode:            getEnv("MPESA_C2B_SHORT_CODE", ""),
+		C2BValidationURL:        getEnv("MPESA_C2B_VALIDATION_URL", ""),
+		C2BConfirmationURL:      getEnv("MPESA_C2B_CONFIRMATION_URL", ""),
+		C2BResponseType:         getEnv("MPESA_C2B_RESPONSE_TYPE", "Completed"),
+		C2BWebhookURL:           getEnv("MPESA_C2B_WEBHOOK_URL", ""),
+		SanitizeSTKReferences:   getEnvBool("MPESA_SANITIZE_STK_REFERENCES", true),
+		STKBreakerMaxFailures:   getEnvInt("MPESA_STK_BREAKER_MAX_FAILURES", 5),
+		STKBreakerCooldown:      getEnvInt("MPESA_STK_BREAKER_COOLDOWN", 30),
+		STKMaxInFlight:          getEnvInt("MPESA_STK_MAX_IN_FLIGHT", 0),
+		STKInFlightWait:         getEnvInt("MPESA_STK_IN_FLIGHT_WAIT", 2),
+		SafaricomRequestTimeout: getEnvInt("MPESA_SAFARICOM_REQUEST_TIMEOUT", 30),
+		TokenRequestTimeout:     getEnvInt("MPESA_TOKEN_REQUEST_TIMEOUT", 15),
+		TokenRefreshBuffer:      getEnvInt("MPESA_TOKEN_REFRESH_BUFFER", 300),
+
+		// Simulation
+		Simulate:              getEnvBool("MPESA_SIMULATE", false),
+		SimulateResultCode:    getEnvInt("MPESA_SIMULATE_RESULT_CODE", 0),
+		SimulateCallbackDelay: getEnvInt("MPESA_SIMULATE_CALLBACK_DELAY", 5),
 
 		// Security
 		InternalSecret: getEnv("MPESA_INTERNAL_SECRET", ""),
+		AuthMode:       getEnv("MPESA_AUTH_MODE", AuthModeSecret),
+		APIKeyRefresh:  getEnvInt("MPESA_API_KEY_REFRESH_INTERVAL", 30),
 		MaxRequestSize: getEnvInt64("MPESA_MAX_REQUEST_SIZE", 1<<20), // 1MB
 
+		VerifyCallbackCheckoutID: getEnvBool("MPESA_VERIFY_CALLBACK_CHECKOUT_ID", true),
+		CallbackReplayWindow:     getEnvInt("MPESA_CALLBACK_REPLAY_WINDOW", 0),
+		CallbackDedupTTL:         getEnvInt("MPESA_CALLBACK_DEDUP_TTL", 600),
+		CallbackUniqueTTL:        getEnvInt("MPESA_CALLBACK_UNIQUE_TTL", 600),
+		CallbackQueue:            getEnv("MPESA_CALLBACK_QUEUE", "critical"),
+		LogRedactPII:             getEnvBool("MPESA_LOG_REDACT_PII", true),
+		LogAPICalls:              getEnvBool("MPESA_LOG_API_CALLS", false),
+		APILogTTL:                getEnvInt("MPESA_API_LOG_TTL", 7*24*3600),
+		DebugSTKPassword:         getEnvBool("MPESA_DEBUG_STK_PASSWORD", false),
+		MetricsRequireAuth:       getEnvBool("MPESA_METRICS_REQUIRE_AUTH", false),
+		LegacyRoutes:             getEnvBool("MPESA_LEGACY_ROUTES", true),
+
+		// Callback contention
+		CallbackDBRetries:    getEnvInt("MPESA_CALLBACK_DB_RETRIES", 3),
+		CallbackDBRetryDelay: getEnvInt("MPESA_CALLBACK_DB_RETRY_DELAY_MS", 50),
+
+		// Callback transaction lookups
+		TxCacheSize: getEnvInt("MPESA_TX_CACHE_SIZE", 0),
+		TxCacheTTL:  getEnvInt("MPESA_TX_CACHE_TTL", 5),
+
+		CallbackMerchantIDCheck: getEnv("MPESA_CALLBACK_MERCHANT_ID_CHECK", MerchantIDCheckLog),
+
 		// Worker
 		WorkerConcurrency: getEnvInt("MPESA_WORKER_CONCURRENCY", 10),
+		WorkerMetricsPort: getEnv("MPESA_WORKER_METRICS_PORT", ""),
+
+		// Webhooks
+		WebhookSecret:          getEnv("MPESA_WEBHOOK_SECRET", ""),
+		WebhookRequireHTTPS:    getEnvBool("MPESA_WEBHOOK_REQUIRE_HTTPS", false),
+		WebhookAllowPrivate:    getEnvBool("MPESA_WEBHOOK_ALLOW_PRIVATE", false),
+		WebhookMaxRetries:      getEnvInt("MPESA_WEBHOOK_MAX_RETRIES", 3),
+		WebhookBackoffBase:     getEnvInt("MPESA_WEBHOOK_BACKOFF_BASE", 60),
+		WebhookBackoffMax:      getEnvInt("MPESA_WEBHOOK_BACKOFF_MAX", 1800),
+		webhookScheduleSet:     lookupEnv("MPESA_WEBHOOK_BACKOFF_SCHEDULE") != "",
+		WebhookTimeout:         getEnvInt("MPESA_WEBHOOK_TIMEOUT", 10),
+		WebhookMaxResponseBody: getEnvInt("MPESA_WEBHOOK_MAX_RESPONSE_BODY", 8192),
+		WebhookMaxPerHost:      getEnvInt("MPESA_WEBHOOK_MAX_PER_HOST", 10),
+
+		// Amounts
+		MinAmount:        getEnvDecimal("MPESA_MIN_AMOUNT", decimal.NewFromInt(1)),
+		MaxAmount:        getEnvDecimal("MPESA_MAX_AMOUNT", decimal.NewFromInt(150000)),
+		AmountRounding:   getEnv("MPESA_AMOUNT_ROUNDING", AmountRoundingReject),
+		AmountMinorUnits: getEnvBool("MPESA_AMOUNT_MINOR_UNITS", false),
+
+		// Tracing
+		OTLPEndpoint: getEnv("MPESA_OTLP_ENDPOINT", ""),
+
+		// Outbound HTTP
+		HTTPMaxIdleConns:        getEnvInt("MPESA_HTTP_MAX_IDLE_CONNS", 100),
+		HTTPMaxIdleConnsPerHost: getEnvInt("MPESA_HTTP_MAX_IDLE_CONNS_PER_HOST", 20),
+		HTTPIdleConnTimeout:     getEnvInt("MPESA_HTTP_IDLE_CONN_TIMEOUT", 90),
+		TLSMinVersion:           getEnv("MPESA_TLS_MIN_VERSION", "1.2"),
+		SafaricomClientCertFile: getEnv("MPESA_SAFARICOM_CLIENT_CERT_FILE", ""),
+		SafaricomClientKeyFile:  getEnv("MPESA_SAFARICOM_CLIENT_KEY_FILE", ""),
+
+		// Inbound HTTPS
+		TLSCertFile:  getEnv("MPESA_TLS_CERT_FILE", ""),
+		TLSKeyFile:   getEnv("MPESA_TLS_KEY_FILE", ""),
+		RequireHTTPS: getEnvBool("MPESA_REQUIRE_HTTPS", false),
+		HSTSMaxAge:   getEnvInt("MPESA_HSTS_MAX_AGE", 31536000),
+
+		// Rate limiting
+		InitiateRateLimit: getEnvInt("MPESA_INITIATE_RATE_LIMIT", 120),
+		InitiateRateBurst: getEnvInt("MPESA_INITIATE_RATE_BURST", 20),
+
+		// Reconciliation
+		ReconcileInterval:   getEnv("MPESA_RECONCILE_INTERVAL", "@every 1m"),
+		ReconcilePendingAge: getEnvInt("MPESA_RECONCILE_PENDING_AGE", 120),
+		ReconcileBatchSize:  getEnvInt("MPESA_RECONCILE_BATCH_SIZE", 50),
+
+		// Retention
+		IdempotencyKeyTTL: getEnvInt("MPESA_IDEMPOTENCY_KEY_TTL", 30*24*3600),
+
+		// Archival
+		ArchiveAfter:     getEnvInt("MPESA_ARCHIVE_AFTER", 0),
+		ArchiveBatchSize: getEnvInt("MPESA_ARCHIVE_BATCH_SIZE", 500),
+	}
+
+	if cfg.B2CShortCode == "" {
+		cfg.B2CShortCode = cfg.SafaricomShortCode
+	}
+	if cfg.C2BShortCode == "" {
+		cfg.C2BShortCode = cfg.SafaricomShortCode
+	}
+
+	// Parse IP allowlist and trusted proxies
+	cfg.SafaricomIPs = getEnvList("MPESA_SAFARICOM_IPS")
+	cfg.TrustedProxies = getEnvList("MPESA_TRUSTED_PROXIES")
+
+	// Build the callback URL from the public URL and routes if not given
+	if cfg.SafaricomCallbackURL == "" && cfg.PublicURL != "" {
+		cfg.SafaricomCallbackURL = cfg.PublicURL + cfg.CallbackRoute()
+	}
+
+	// Tenant callback URLs stay on this gateway's host unless told otherwise
+	cfg.CallbackURLPrefixes = getEnvList("MPESA_CALLBACK_URL_PREFIXES")
+	if len(cfg.CallbackURLPrefixes) == 0 {
+		if u, err := url.Parse(cfg.SafaricomCallbackURL); err == nil && u.Scheme != "" && u.Host != "" {
+			cfg.CallbackURLPrefixes = []string{u.Scheme + "://" + u.Host + "/"}
+		}
+	}
+
+	// Parse queue weights, keeping the defaults if the value is malformed
+	cfg.QueueWeights = queue.DefaultWeights
+	if value := lookupEnv("MPESA_QUEUE_WEIGHTS"); value != "" {
+		if weights, err := parseQueueWeights(value); err != nil {
+			cfg.queueWeightsErr = err
+		} else {
+			cfg.QueueWeights = weights
+		}
 	}
 
-	// Parse IP allowlist
-	ipList := getEnv("MPESA_SAFARICOM_IPS", "")
-	if ipList != "" {
-		cfg.SafaricomIPs = strings.Split(ipList, ",")
-		for i := range cfg.SafaricomIPs {
-			cfg.SafaricomIPs[i] = strings.TrimSpace(cfg.SafaricomIPs[i])
+	// Load per-tenant credentials
+	if path := getEnv("MPESA_TENANT_CREDENTIALS_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MPESA_TENANT_CREDENTIALS_FILE: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg.TenantCredentials); err != nil {
+			return nil, fmt.Errorf("failed to parse MPESA_TENANT_CREDENTIALS_FILE: %w", err)
 		}
 	}
 
+	// Load the Safaricom client certificate now so a bad pair fails startup
+	// rather than the first request
+	if cfg.SafaricomClientCertFile != "" && cfg.SafaricomClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.SafaricomClientCertFile, cfg.SafaricomClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MPESA_SAFARICOM_CLIENT_CERT_FILE/MPESA_SAFARICOM_CLIENT_KEY_FILE: %w", err)
+		}
+		cfg.SafaricomClientCert = &cert
+	}
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MPESA_TLS_CERT_FILE/MPESA_TLS_KEY_FILE: %w", err)
+		}
+		cfg.ServerCert = &cert
+	}
+
 	// Validation
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -93,54 +576,409 @@ func (c *Config) Validate() error {
 	if c.DatabaseURL == "" {
 		return fmt.Errorf("MPESA_DATABASE_URL is required")
 	}
+	if c.DBMinConns < 0 || c.DBMaxConns < 1 || c.DBMinConns > c.DBMaxConns {
+		return fmt.Errorf("MPESA_DB_MIN_CONNS must be between 0 and MPESA_DB_MAX_CONNS, which must be at least 1")
+	}
+	if c.DBMaxConnLifetime < 1 || c.DBMaxConnIdleTime < 1 {
+		return fmt.Errorf("MPESA_DB_MAX_CONN_LIFETIME and MPESA_DB_MAX_CONN_IDLE_TIME must be at least 1 second")
+	}
+	if c.DBStatementTimeout < 0 {
+		return fmt.Errorf("MPESA_DB_STATEMENT_TIMEOUT must not be negative")
+	}
 	if c.RedisURL == "" {
 		return fmt.Errorf("MPESA_REDIS_URL is required")
 	}
-	if c.InternalSecret == "" {
-		return fmt.Errorf("MPESA_INTERNAL_SECRET is required")
+	if c.AuthMode != AuthModeSecret && c.AuthMode != AuthModeAPIKey && c.AuthMode != AuthModeBoth {
+		return fmt.Errorf("MPESA_AUTH_MODE must be %q, %q or %q", AuthModeSecret, AuthModeAPIKey, AuthModeBoth)
+	}
+	if c.InternalSecret == "" && c.AuthMode != AuthModeAPIKey {
+		return fmt.Errorf("MPESA_INTERNAL_SECRET is required unless MPESA_AUTH_MODE=%s", AuthModeAPIKey)
+	}
+	if c.APIKeyRefresh < 1 {
+		return fmt.Errorf("MPESA_API_KEY_REFRESH_INTERVAL must be at least 1 second")
 	}
-	if c.SafaricomConsumerKey == "" {
+	if c.WebhookSecret == "" {
+		return fmt.Errorf("MPESA_WEBHOOK_SECRET is required")
+	}
+	// Simulation never calls Safaricom, so only the short code is needed
+	if c.SafaricomConsumerKey == "" && !c.Simulate {
 		return fmt.Errorf("MPESA_SAFARICOM_CONSUMER_KEY is required")
 	}
-	if c.SafaricomConsumerSecret == "" {
+	if c.SafaricomConsumerSecret == "" && !c.Simulate {
 		return fmt.Errorf("MPESA_SAFARICOM_CONSUMER_SECRET is required")
 	}
-	if c.SafaricomPasskey == "" {
+	if c.SafaricomPasskey == "" && !c.Simulate {
 		return fmt.Errorf("MPESA_SAFARICOM_PASSKEY is required")
 	}
 	if c.SafaricomShortCode == "" {
 		return fmt.Errorf("MPESA_SAFARICOM_SHORT_CODE is required")
 	}
+	if !mpesa.IsValidTransactionType(c.SafaricomTxnType) {
+		return fmt.Errorf("MPESA_SAFARICOM_TRANSACTION_TYPE must be %s or %s", mpesa.TransactionTypePayBill, mpesa.TransactionTypeBuyGoods)
+	}
+	if err := mpesa.ValidateDescTemplate(c.SafaricomDescTemplate); err != nil {
+		return fmt.Errorf("MPESA_SAFARICOM_TRANSACTION_DESC_TEMPLATE: %w", err)
+	}
+	for tenantID, creds := range c.TenantCredentials {
+		if !tenantIDPattern.MatchString(tenantID) {
+			return fmt.Errorf("tenant ID %q must be 1-64 letters, digits, '-' or '_'", tenantID)
+		}
+		if creds.ShortCode == "" {
+			return fmt.Errorf("tenant %s: short_code is required", tenantID)
+		}
+		if (creds.ConsumerKey == "" || creds.ConsumerSecret == "" || creds.Passkey == "") && !c.Simulate {
+			return fmt.Errorf("tenant %s: consumer_key, consumer_secret, passkey and short_code are required", tenantID)
+		}
+		if creds.TransactionType != "" && !mpesa.IsValidTransactionType(creds.TransactionType) {
+			return fmt.Errorf("tenant %s: transaction_type must be %s or %s", tenantID, mpesa.TransactionTypePayBill, mpesa.TransactionTypeBuyGoods)
+		}
+		if err := mpesa.ValidateDescTemplate(creds.TransactionDescTemplate); err != nil {
+			return fmt.Errorf("tenant %s: transaction_desc_template: %w", tenantID, err)
+		}
+		if err := validateWebhookHeaders(creds.WebhookHeaders); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenantID, err)
+		}
+		switch creds.WebhookSignatureAlgorithm {
+		case "", WebhookSignatureHMACSHA256, WebhookSignatureHMACSHA512:
+		default:
+			return fmt.Errorf("tenant %s: webhook_signature_algorithm must be %q or %q", tenantID, WebhookSignatureHMACSHA256, WebhookSignatureHMACSHA512)
+		}
+		if creds.CallbackURL != "" && !callbackURLAllowed(creds.CallbackURL, c.CallbackURLPrefixes) {
+			return fmt.Errorf("tenant %s: callback_url must start with one of MPESA_CALLBACK_URL_PREFIXES %v", tenantID, c.CallbackURLPrefixes)
+		}
+	}
+	if c.WebhookMaxRetries < 0 {
+		return fmt.Errorf("MPESA_WEBHOOK_MAX_RETRIES must not be negative")
+	}
+	if c.WebhookBackoffBase < 1 {
+		return fmt.Errorf("MPESA_WEBHOOK_BACKOFF_BASE must be at least 1 second")
+	}
+	if c.WebhookBackoffMax < c.WebhookBackoffBase {
+		return fmt.Errorf("MPESA_WEBHOOK_BACKOFF_MAX must not be less than MPESA_WEBHOOK_BACKOFF_BASE")
+	}
+	if c.WebhookTimeout < 1 || c.WebhookTimeout > 120 {
+		return fmt.Errorf("MPESA_WEBHOOK_TIMEOUT must be between 1 and 120 seconds")
+	}
+	if c.WebhookMaxResponseBody < 1 || c.WebhookMaxResponseBody > 1<<20 {
+		return fmt.Errorf("MPESA_WEBHOOK_MAX_RESPONSE_BODY must be between 1 and 1048576 bytes")
+	}
+	if c.WebhookMaxPerHost < 0 {
+		return fmt.Errorf("MPESA_WEBHOOK_MAX_PER_HOST must not be negative")
+	}
+	if !c.MinAmount.IsPositive() {
+		return fmt.Errorf("MPESA_MIN_AMOUNT must be greater than zero")
+	}
+	if c.MaxAmount.LessThan(c.MinAmount) {
+		return fmt.Errorf("MPESA_MAX_AMOUNT must not be less than MPESA_MIN_AMOUNT")
+	}
+	switch c.AmountRounding {
+	case AmountRoundingReject, AmountRoundingFloor, AmountRoundingHalfUp:
+	default:
+		return fmt.Errorf("MPESA_AMOUNT_ROUNDING must be %q, %q or %q", AmountRoundingReject, AmountRoundingFloor, AmountRoundingHalfUp)
+	}
+	if c.SafaricomRequestTimeout < 1 || c.TokenRequestTimeout < 1 {
+		return fmt.Errorf("MPESA_SAFARICOM_REQUEST_TIMEOUT and MPESA_TOKEN_REQUEST_TIMEOUT must be at least 1 second")
+	}
+	if c.CallbackTimeout < 1 || c.InitiateTimeout < 1 || c.RequestTimeout < 1 {
+		return fmt.Errorf("MPESA_CALLBACK_TIMEOUT, MPESA_INITIATE_TIMEOUT and MPESA_REQUEST_TIMEOUT must be at least 1 second")
+	}
+	if c.TokenRefreshBuffer < 0 {
+		return fmt.Errorf("MPESA_TOKEN_REFRESH_BUFFER must not be negative")
+	}
+	if _, ok := c.QueueWeights[c.CallbackQueue]; !ok {
+		return fmt.Errorf("MPESA_CALLBACK_QUEUE %q is not in MPESA_QUEUE_WEIGHTS", c.CallbackQueue)
+	}
+	// Webhook deliveries are enqueued on asynq's default queue
+	if _, ok := c.QueueWeights["default"]; !ok {
+		return fmt.Errorf("MPESA_QUEUE_WEIGHTS must include the default queue")
+	}
+	if _, ok := httpclient.TLSVersions[c.TLSMinVersion]; !ok {
+		return fmt.Errorf("MPESA_TLS_MIN_VERSION must be 1.2 or 1.3")
+	}
+	if (c.SafaricomClientCertFile == "") != (c.SafaricomClientKeyFile == "") {
+		return fmt.Errorf("MPESA_SAFARICOM_CLIENT_CERT_FILE and MPESA_SAFARICOM_CLIENT_KEY_FILE must be set together")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("MPESA_TLS_CERT_FILE and MPESA_TLS_KEY_FILE must be set together")
+	}
+	if c.HSTSMaxAge < 0 {
+		return fmt.Errorf("MPESA_HSTS_MAX_AGE must not be negative")
+	}
+	if c.IdempotencyKeyTTL != 0 && c.IdempotencyKeyTTL < 3600 {
+		return fmt.Errorf("MPESA_IDEMPOTENCY_KEY_TTL must be 0 (keep forever) or at least 3600 seconds")
+	}
+	if c.APILogTTL != 0 && c.APILogTTL < 3600 {
+		return fmt.Errorf("MPESA_API_LOG_TTL must be 0 (keep forever) or at least 3600 seconds")
+	}
+	// Archived transactions no longer receive callbacks or webhook retries
+	if c.ArchiveAfter != 0 && c.ArchiveAfter < 86400 {
+		return fmt.Errorf("MPESA_ARCHIVE_AFTER must be 0 (never archive) or at least 86400 seconds")
+	}
+	if c.ArchiveBatchSize < 1 || c.ArchiveBatchSize > 10000 {
+		return fmt.Errorf("MPESA_ARCHIVE_BATCH_SIZE must be between 1 and 10000")
+	}
+	if c.STKMaxInFlight < 0 || c.STKInFlightWait < 0 {
+		return fmt.Errorf("MPESA_STK_MAX_IN_FLIGHT and MPESA_STK_IN_FLIGHT_WAIT must not be negative")
+	}
+	if c.CallbackReplayWindow < 0 {
+		return fmt.Errorf("MPESA_CALLBACK_REPLAY_WINDOW must not be negative")
+	}
+	if c.CallbackDedupTTL < 0 || c.CallbackUniqueTTL < 0 {
+		return fmt.Errorf("MPESA_CALLBACK_DEDUP_TTL and MPESA_CALLBACK_UNIQUE_TTL must not be negative")
+	}
+	if c.CallbackDBRetries < 0 || c.CallbackDBRetryDelay < 0 {
+		return fmt.Errorf("MPESA_CALLBACK_DB_RETRIES and MPESA_CALLBACK_DB_RETRY_DELAY_MS must not be negative")
+	}
+	switch c.CallbackMerchantIDCheck {
+	case MerchantIDCheckOff, MerchantIDCheckLog, MerchantIDCheckReject:
+	default:
+		return fmt.Errorf("MPESA_CALLBACK_MERCHANT_ID_CHECK must be %q, %q or %q", MerchantIDCheckOff, MerchantIDCheckLog, MerchantIDCheckReject)
+	}
+	if c.CallbackDBRetries > 10 {
+		return fmt.Errorf("MPESA_CALLBACK_DB_RETRIES must be at most 10; task retries handle longer contention")
+	}
+	if c.TxCacheSize < 0 {
+		return fmt.Errorf("MPESA_TX_CACHE_SIZE must not be negative")
+	}
+	if c.TxCacheSize > 0 && c.TxCacheTTL < 1 {
+		return fmt.Errorf("MPESA_TX_CACHE_TTL must be at least 1 second when MPESA_TX_CACHE_SIZE is set")
+	}
+	if c.InitiateRateLimit < 0 {
+		return fmt.Errorf("MPESA_INITIATE_RATE_LIMIT must not be negative")
+	}
+	if c.InitiateRateLimit > 0 && c.InitiateRateBurst < 1 {
+		return fmt.Errorf("MPESA_INITIATE_RATE_BURST must be at least 1")
+	}
+	if err := validateIPList(c.SafaricomIPs); err != nil {
+		return fmt.Errorf("MPESA_SAFARICOM_IPS: %w", err)
+	}
+	if err := validateIPList(c.TrustedProxies); err != nil {
+		return fmt.Errorf("MPESA_TRUSTED_PROXIES: %w", err)
+	}
+	if c.RoutePrefix != "" && !strings.HasPrefix(c.RoutePrefix, "/") {
+		return fmt.Errorf("MPESA_ROUTE_PREFIX must start with /")
+	}
+	if !strings.HasPrefix(c.CallbackPath, "/") {
+		return fmt.Errorf("MPESA_CALLBACK_PATH must start with / and not be the root path")
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("MPESA_PUBLIC_URL must be an absolute URL such as https://your-domain.com")
+		}
+	}
 	if c.SafaricomCallbackURL == "" {
-		return fmt.Errorf("MPESA_SAFARICOM_CALLBACK_URL is required (public URL for callbacks)")
+		return fmt.Errorf("MPESA_SAFARICOM_CALLBACK_URL or MPESA_PUBLIC_URL is required (public URL for callbacks)")
+	}
+	if _, ok := safaricomHosts[c.Environment]; c.Environment != "" && !ok {
+		return fmt.Errorf("MPESA_ENVIRONMENT must be %q or %q", EnvironmentSandbox, EnvironmentProduction)
+	}
+	if err := c.validateSimulate(); err != nil {
+		return err
+	}
+	if c.SimulateCallbackDelay < 0 {
+		return fmt.Errorf("MPESA_SIMULATE_CALLBACK_DELAY must not be negative")
+	}
+	if c.B2CInitiatorName != "" || c.B2CSecurityCredential != "" {
+		if c.B2CInitiatorName == "" || c.B2CSecurityCredential == "" {
+			return fmt.Errorf("MPESA_B2C_INITIATOR_NAME and MPESA_B2C_SECURITY_CREDENTIAL must be set together")
+		}
+		if c.B2CResultURL == "" || c.B2CQueueTimeoutURL == "" {
+			return fmt.Errorf("MPESA_B2C_RESULT_URL and MPESA_B2C_QUEUE_TIMEOUT_URL are required when B2C payouts are enabled")
+		}
+	}
+	if c.C2BResponseType != "Completed" && c.C2BResponseType != "Cancelled" {
+		return fmt.Errorf("MPESA_C2B_RESPONSE_TYPE must be Completed or Cancelled")
+	}
+	if c.C2BConfirmationURL == "" && (c.C2BValidationURL != "" || c.C2BWebhookURL != "") {
+		return fmt.Errorf("MPESA_C2B_CONFIRMATION_URL is required when MPESA_C2B_VALIDATION_URL or MPESA_C2B_WEBHOOK_URL is set")
+	}
+
+	return nil
+}
+
+// validateSimulate refuses simulation mode unless the deployment is
+// explicitly labelled sandbox and no Safaricom URL is a production one, so
+// a live deployment cannot mark real payments COMPLETED with fake receipts
+func (c *Config) validateSimulate() error {
+	if !c.Simulate {
+		return nil
+	}
+	if c.Environment != EnvironmentSandbox {
+		return fmt.Errorf("MPESA_SIMULATE requires MPESA_ENVIRONMENT=%s", EnvironmentSandbox)
 	}
 
+	production, _ := url.Parse(safaricomHosts[EnvironmentProduction])
+	for _, setting := range []struct{ name, value string }{
+		{"MPESA_SAFARICOM_AUTH_URL", c.SafaricomAuthURL},
+		{"MPESA_SAFARICOM_STK_PUSH_URL", c.SafaricomSTKPushURL},
+		{"MPESA_SAFARICOM_STK_QUERY_URL", c.SafaricomSTKQueryURL},
+		{"MPESA_SAFARICOM_B2C_URL", c.B2CURL},
+		{"MPESA_SAFARICOM_C2B_REGISTER_URL", c.C2BRegisterURL},
+	} {
+		if u, err := url.Parse(setting.value); err == nil && strings.EqualFold(u.Hostname(), production.Hostname()) {
+			return fmt.Errorf("MPESA_SIMULATE cannot be used with %s pointing at %s", setting.name, production.Hostname())
+		}
+	}
 	return nil
 }
 
+// Warnings reports likely misconfigurations that do not prevent startup,
+// such as production mode pointed at sandbox hosts or credentials
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.queueWeightsErr != nil {
+		warnings = append(warnings, fmt.Sprintf("ignoring MPESA_QUEUE_WEIGHTS (%v), using the default weights", c.queueWeightsErr))
+	}
+	if c.webhookScheduleSet {
+		warnings = append(warnings, "ignoring MPESA_WEBHOOK_BACKOFF_SCHEDULE, webhook retries now use MPESA_WEBHOOK_BACKOFF_BASE and MPESA_WEBHOOK_BACKOFF_MAX")
+	}
+	if c.InitiateTimeout < c.SafaricomRequestTimeout {
+		warnings = append(warnings, fmt.Sprintf("MPESA_INITIATE_TIMEOUT (%ds) is shorter than MPESA_SAFARICOM_REQUEST_TIMEOUT (%ds); slow STK Push calls will be abandoned with 504", c.InitiateTimeout, c.SafaricomRequestTimeout))
+	}
+	if c.ReconcilePendingAge <= c.InitiateTimeout {
+		warnings = append(warnings, fmt.Sprintf("MPESA_RECONCILE_PENDING_AGE (%ds) is not longer than MPESA_INITIATE_TIMEOUT (%ds); reconciliation may expire STK Pushes still waiting on Safaricom", c.ReconcilePendingAge, c.InitiateTimeout))
+	}
+	if c.Environment == EnvironmentProduction && !c.RequireHTTPS {
+		warnings = append(warnings, "MPESA_REQUIRE_HTTPS is off in production; plain-HTTP API and callback requests are accepted")
+	}
+	if c.RequireHTTPS && c.TLSCertFile == "" && len(c.TrustedProxies) == 0 {
+		warnings = append(warnings, "MPESA_REQUIRE_HTTPS is on without MPESA_TLS_CERT_FILE or MPESA_TRUSTED_PROXIES; every API and callback request will be rejected")
+	}
+	if c.DebugSTKPassword && c.Environment == EnvironmentProduction {
+		warnings = append(warnings, "MPESA_DEBUG_STK_PASSWORD is enabled in production; disable it once the password/timestamp issue is diagnosed")
+	}
+	if c.AmountMinorUnits {
+		warnings = append(warnings, "MPESA_AMOUNT_MINOR_UNITS is enabled; Safaricom only accepts whole shillings and will reject amounts with cents")
+	}
+	if c.ArchiveAfter > 0 && (c.IdempotencyKeyTTL == 0 || c.IdempotencyKeyTTL > c.ArchiveAfter) {
+		warnings = append(warnings, "MPESA_ARCHIVE_AFTER is shorter than MPESA_IDEMPOTENCY_KEY_TTL; idempotency keys are forgotten once their transaction is archived")
+	}
+	if c.Simulate {
+		warnings = append(warnings, "MPESA_SIMULATE is set: Safaricom is never called and every payment resolves with a simulated callback")
+	}
+	if u, err := url.Parse(c.SafaricomCallbackURL); err == nil && !strings.HasSuffix(u.Path, c.CallbackPath) {
+		warnings = append(warnings, fmt.Sprintf("MPESA_SAFARICOM_CALLBACK_URL (%s) does not end in MPESA_CALLBACK_PATH (%s); callbacks may not reach %s", c.SafaricomCallbackURL, c.CallbackPath, c.CallbackRoute()))
+	}
+	if c.Environment == "" {
+		return warnings
+	}
+
+	for _, u := range []struct{ key, value string }{
+		{"MPESA_SAFARICOM_AUTH_URL", c.SafaricomAuthURL},
+		{"MPESA_SAFARICOM_STK_PUSH_URL", c.SafaricomSTKPushURL},
+		{"MPESA_SAFARICOM_STK_QUERY_URL", c.SafaricomSTKQueryURL},
+		{"MPESA_SAFARICOM_B2C_URL", c.B2CURL},
+		{"MPESA_SAFARICOM_C2B_REGISTER_URL", c.C2BRegisterURL},
+	} {
+		if !strings.HasPrefix(u.value, safaricomHosts[c.Environment]+"/") {
+			warnings = append(warnings, fmt.Sprintf("%s (%s) does not match MPESA_ENVIRONMENT=%s", u.key, u.value, c.Environment))
+		}
+	}
+
+	if c.Environment == EnvironmentProduction && c.SafaricomShortCode == sandboxShortCode {
+		warnings = append(warnings, fmt.Sprintf("MPESA_SAFARICOM_SHORT_CODE is the sandbox test short code %s in production", sandboxShortCode))
+	}
+
+	return warnings
+}
+
+// CallbackRoute is the path the STK callback route is served on, with the
+// B2C, C2B and tenant callback routes beneath it
+func (c *Config) CallbackRoute() string {
+	return c.RoutePrefix + c.CallbackPath
+}
+
+// TenantWebhookHeaders returns each tenant's custom webhook headers keyed by
+// tenant ID, then webhook URL
+func (c *Config) TenantWebhookHeaders() map[string]map[string]map[string]string {
+	headers := make(map[string]map[string]map[string]string)
+	for tenantID, creds := range c.TenantCredentials {
+		if len(creds.WebhookHeaders) > 0 {
+			headers[tenantID] = creds.WebhookHeaders
+		}
+	}
+	return headers
+}
+
+// TenantWebhookSignatureAlgorithms returns the tenants that sign webhooks
+// with something other than the default, keyed by tenant ID
+func (c *Config) TenantWebhookSignatureAlgorithms() map[string]string {
+	algorithms := make(map[string]string)
+	for tenantID, creds := range c.TenantCredentials {
+		if creds.WebhookSignatureAlgorithm != "" && creds.WebhookSignatureAlgorithm != WebhookSignatureHMACSHA256 {
+			algorithms[tenantID] = creds.WebhookSignatureAlgorithm
+		}
+	}
+	return algorithms
+}
+
 // LogSafeConfig logs configuration without secrets
 func (c *Config) LogSafeConfig() {
 	fmt.Printf("Configuration loaded:\n")
 	fmt.Printf("  Server Port: %s\n", c.ServerPort)
+	fmt.Printf("  Shutdown Timeout: %ds\n", c.ShutdownTimeout)
+	fmt.Printf("  Request Timeouts: %ds callback, %ds initiate, %ds other\n", c.CallbackTimeout, c.InitiateTimeout, c.RequestTimeout)
+	fmt.Printf("  Route Prefix: %q, Callback Path: %s\n", c.RoutePrefix, c.CallbackPath)
 	fmt.Printf("  Database URL: %s\n", maskConnectionString(c.DatabaseURL))
 	fmt.Printf("  Redis URL: %s\n", maskConnectionString(c.RedisURL))
-	fmt.Printf("  DB Pool: %d min, %d max\n", c.DBMinConns, c.DBMaxConns)
+	fmt.Printf("  DB Pool: %d min, %d max, %ds lifetime, %ds idle, %ds statement timeout\n", c.DBMinConns, c.DBMaxConns, c.DBMaxConnLifetime, c.DBMaxConnIdleTime, c.DBStatementTimeout)
 	fmt.Printf("  Worker Concurrency: %d\n", c.WorkerConcurrency)
+	fmt.Printf("  Queue Weights: %v\n", c.QueueWeights)
+	fmt.Printf("  Webhook Require HTTPS: %t, Allow Private: %t\n", c.WebhookRequireHTTPS, c.WebhookAllowPrivate)
+	fmt.Printf("  Webhook Retries: %d (backoff %ds base, %ds max), %ds timeout\n", c.WebhookMaxRetries, c.WebhookBackoffBase, c.WebhookBackoffMax, c.WebhookTimeout)
+	fmt.Printf("  Webhook Max Recorded Response: %d bytes\n", c.WebhookMaxResponseBody)
+	fmt.Printf("  Webhook Max Per Host: %d\n", c.WebhookMaxPerHost)
+	fmt.Printf("  Reconcile: %s (age %ds, batch %d)\n", c.ReconcileInterval, c.ReconcilePendingAge, c.ReconcileBatchSize)
+	fmt.Printf("  Idempotency Key TTL: %ds\n", c.IdempotencyKeyTTL)
+	fmt.Printf("  Archive After: %ds (batches of %d)\n", c.ArchiveAfter, c.ArchiveBatchSize)
+	fmt.Printf("  Safaricom Environment: %s\n", c.Environment)
 	fmt.Printf("  Safaricom Short Code: %s\n", c.SafaricomShortCode)
+	fmt.Printf("  Safaricom Transaction Type: %s\n", c.SafaricomTxnType)
+	fmt.Printf("  Safaricom Transaction Desc Template: %q\n", c.SafaricomDescTemplate)
+	fmt.Printf("  Tenant Credential Sets: %d\n", len(c.TenantCredentials))
+	fmt.Printf("  Callback URL Prefixes: %v\n", c.CallbackURLPrefixes)
+	fmt.Printf("  Simulate: %t (result code %d, callback delay %ds)\n", c.Simulate, c.SimulateResultCode, c.SimulateCallbackDelay)
+	fmt.Printf("  B2C Payouts Enabled: %t (short code %s, %s)\n", c.B2CInitiatorName != "", c.B2CShortCode, c.B2CCommandID)
+	fmt.Printf("  C2B URLs Enabled: %t (short code %s, validation %t, webhook %t)\n", c.C2BConfirmationURL != "", c.C2BShortCode, c.C2BValidationURL != "", c.C2BWebhookURL != "")
+	fmt.Printf("  Safaricom Timeouts: %ds request, %ds token\n", c.SafaricomRequestTimeout, c.TokenRequestTimeout)
+	fmt.Printf("  Token Refresh Buffer: %ds\n", c.TokenRefreshBuffer)
+	fmt.Printf("  STK Circuit Breaker: %d failures, %ds cooldown\n", c.STKBreakerMaxFailures, c.STKBreakerCooldown)
+	fmt.Printf("  STK Max In Flight: %d (wait %ds)\n", c.STKMaxInFlight, c.STKInFlightWait)
 	fmt.Printf("  Safaricom IP Allowlist: %v\n", c.SafaricomIPs)
+	fmt.Printf("  Trusted Proxies: %v\n", c.TrustedProxies)
+	fmt.Printf("  Verify Callback Checkout ID: %t\n", c.VerifyCallbackCheckoutID)
+	fmt.Printf("  Callback Merchant ID Check: %s\n", c.CallbackMerchantIDCheck)
+	fmt.Printf("  Callback Replay Window: %ds\n", c.CallbackReplayWindow)
+	fmt.Printf("  Callback Queue: %s\n", c.CallbackQueue)
+	fmt.Printf("  Callback Dedup TTL: %ds, Unique Task TTL: %ds\n", c.CallbackDedupTTL, c.CallbackUniqueTTL)
+	fmt.Printf("  Callback DB Retries: %d (from %dms)\n", c.CallbackDBRetries, c.CallbackDBRetryDelay)
+	fmt.Printf("  Transaction Cache: %d entries, %ds TTL\n", c.TxCacheSize, c.TxCacheTTL)
+	fmt.Printf("  Log PII Redaction: %t\n", c.LogRedactPII)
+	fmt.Printf("  Log Safaricom API Calls: %t (kept %ds)\n", c.LogAPICalls, c.APILogTTL)
+	fmt.Printf("  Debug STK Password: %t\n", c.DebugSTKPassword)
+	fmt.Printf("  Amount Range: %s - %s\n", c.MinAmount, c.MaxAmount)
+	fmt.Printf("  Amount Rounding: %s, Minor Units: %t\n", c.AmountRounding, c.AmountMinorUnits)
+	fmt.Printf("  OTLP Endpoint: %s\n", c.OTLPEndpoint)
+	fmt.Printf("  HTTP Pool: %d idle, %d per host, %ds idle timeout\n", c.HTTPMaxIdleConns, c.HTTPMaxIdleConnsPerHost, c.HTTPIdleConnTimeout)
+	fmt.Printf("  TLS Min Version: %s, Safaricom mTLS: %t\n", c.TLSMinVersion, c.SafaricomClientCert != nil)
+	fmt.Printf("  Server TLS: %t, Require HTTPS: %t, HSTS Max Age: %ds\n", c.ServerCert != nil, c.RequireHTTPS, c.HSTSMaxAge)
+	fmt.Printf("  Initiate Rate Limit: %d/min per tenant, burst %d\n", c.InitiateRateLimit, c.InitiateRateBurst)
 	fmt.Printf("  Max Request Size: %d bytes\n", c.MaxRequestSize)
+	fmt.Printf("  Metrics Require Auth: %t\n", c.MetricsRequireAuth)
+	fmt.Printf("  Legacy Unversioned Routes: %t\n", c.LegacyRoutes)
+	fmt.Printf("  Auth Mode: %s (API key refresh %ds)\n", c.AuthMode, c.APIKeyRefresh)
 }
 
 // Helper functions
 func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
 
 func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		if intVal, err := strconv.Atoi(value); err == nil {
 			return intVal
 		}
@@ -148,8 +986,41 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := lookupEnv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList parses a comma-separated list, dropping empty entries
+func getEnvList(key string) []string {
+	value := lookupEnv(key)
+	if value == "" {
+		return nil
+	}
+	var list []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
+
+func getEnvDecimal(key string, defaultValue decimal.Decimal) decimal.Decimal {
+	if value := lookupEnv(key); value != "" {
+		if d, err := decimal.NewFromString(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
 func getEnvInt64(key string, defaultValue int64) int64 {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		if intVal, err := strconv.ParseInt(value, 10, 64); err == nil {
 			return intVal
 		}
@@ -157,6 +1028,88 @@ func getEnvInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+// validateWebhookHeaders checks tenant webhook headers are well formed and
+// leave the signature and transport headers alone. Values are never echoed
+// because they usually carry credentials.
+func validateWebhookHeaders(byURL map[string]map[string]string) error {
+	for webhookURL, headers := range byURL {
+		if u, err := url.Parse(webhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("webhook_headers key %q must be an absolute URL", webhookURL)
+		}
+		for name, value := range headers {
+			if !headerNamePattern.MatchString(name) {
+				return fmt.Errorf("webhook_headers for %s: invalid header name %q", webhookURL, name)
+			}
+			if reservedWebhookHeaders[http.CanonicalHeaderKey(name)] {
+				return fmt.Errorf("webhook_headers for %s: %s is set by the gateway", webhookURL, name)
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("webhook_headers for %s: value of %s contains a line break", webhookURL, name)
+			}
+		}
+	}
+	return nil
+}
+
+// callbackURLAllowed reports whether rawURL falls under one of the prefixes.
+// Scheme and host must match exactly so a prefix such as
+// https://gw.example.com cannot be satisfied by gw.example.com.evil.io.
+func callbackURLAllowed(rawURL string, prefixes []string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil {
+		return false
+	}
+	for _, prefix := range prefixes {
+		p, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, p.Scheme) && strings.EqualFold(u.Host, p.Host) && strings.HasPrefix(u.Path, p.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerNamePattern matches RFC 7230 header field names
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// parseQueueWeights parses a comma-separated list of queue:weight pairs
+// (e.g. "critical:6,default:3,low:1")
+func parseQueueWeights(value string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, part := range strings.Split(value, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected queue:weight, got %q", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("weight for queue %q must be a positive integer", name)
+		}
+		if _, dup := weights[name]; dup {
+			return nil, fmt.Errorf("queue %q listed twice", name)
+		}
+		weights[name] = n
+	}
+	return weights, nil
+}
+
+// validateIPList ensures every entry is an IP address or CIDR range
+func validateIPList(entries []string) error {
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("invalid CIDR %q", entry)
+			}
+		} else if net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid IP %q", entry)
+		}
+	}
+	return nil
+}
+
 func maskConnectionString(connStr string) string {
 	if strings.Contains(connStr, "@") {
 		parts := strings.Split(connStr, "@")
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileValues holds the settings read from MPESA_CONFIG_FILE, keyed by
+// environment variable name. It is set by Load before any setting is read.
+var fileValues map[string]string
+
+// lookupEnv returns the environment variable key, falling back to the
+// config file when it is unset or empty
+func lookupEnv(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fileValues[key]
+}
+
+// readConfigFile parses a YAML file mapping environment variable names to
+// values. Lists may be written as YAML sequences; they are joined with
+// commas as the environment variable would be.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(doc))
+	for key, node := range doc {
+		// Catch nested sections and typos rather than silently ignoring them
+		if !strings.HasPrefix(key, "MPESA_") {
+			return nil, fmt.Errorf("key %q is not an MPESA_ setting", key)
+		}
+		switch {
+		case node.Kind == yaml.ScalarNode && node.Tag == "!!null":
+			continue
+		case node.Kind == yaml.ScalarNode:
+			values[key] = node.Value
+		case node.Kind == yaml.SequenceNode:
+			items := make([]string, 0, len(node.Content))
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("%s must be a list of plain values", key)
+				}
+				items = append(items, item.Value)
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("%s must be a value or a list", key)
+		}
+	}
+	return values, nil
+}
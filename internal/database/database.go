@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -14,20 +15,39 @@ type DB struct {
 	Pool *pgxpool.Pool
 }
 
+// PoolConfig sizes the connection pool and bounds how long connections and
+// statements live
+type PoolConfig struct {
+	MinConns        int
+	MaxConns        int
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+
+	// StatementTimeout is set as each connection's statement_timeout so a
+	// runaway query cannot pin a connection; 0 leaves the server default
+	StatementTimeout time.Duration
+}
+
 // NewDatabase creates a new database connection pool
-func NewDatabase(ctx context.Context, databaseURL string, minConns, maxConns int) (*DB, error) {
+func NewDatabase(ctx context.Context, databaseURL string, poolCfg PoolConfig) (*DB, error) {
 	config, err := pgxpool.ParseConfig(databaseURL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse database URL: %w", err)
 	}
 
 	// Configure connection pool
-	config.MinConns = int32(minConns)
-	config.MaxConns = int32(maxConns)
-	config.MaxConnLifetime = time.Hour
-	config.MaxConnIdleTime = 30 * time.Minute
+	config.MinConns = int32(poolCfg.MinConns)
+	config.MaxConns = int32(poolCfg.MaxConns)
+	config.MaxConnLifetime = poolCfg.MaxConnLifetime
+	config.MaxConnIdleTime = poolCfg.MaxConnIdleTime
 	config.HealthCheckPeriod = time.Minute
 
+	// Sent as a startup parameter, so RESET restores it after a session
+	// overrides it
+	if poolCfg.StatementTimeout > 0 {
+		config.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(poolCfg.StatementTimeout.Milliseconds(), 10)
+	}
+
 	// Create pool
 	pool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
@@ -40,7 +60,7 @@ func NewDatabase(ctx context.Context, databaseURL string, minConns, maxConns int
 		return nil, fmt.Errorf("unable to ping database: %w", err)
 	}
 
-	log.Printf("Database connection pool established (min: %d, max: %d)", minConns, maxConns)
+	log.Printf("Database connection pool established (min: %d, max: %d, statement timeout: %s)", poolCfg.MinConns, poolCfg.MaxConns, poolCfg.StatementTimeout)
 
 	return &DB{Pool: pool}, nil
 }
@@ -0,0 +1,441 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/worker"
+)
+
+// auditActionReprocess is the admin_audit_log action for callback reprocessing
+const auditActionReprocess = "callback_reprocess"
+
+// FailedCallback describes a callback task that is awaiting retry or has
+// exhausted its retries and been archived. Type tells STK callbacks, B2C
+// results and C2B confirmations apart; only the matching ID is set.
+type FailedCallback struct {
+	TaskID            string     `json:"task_id"`
+	Type              string     `json:"type"`
+	State             string     `json:"state"`
+	CheckoutRequestID string     `json:"checkout_request_id,omitempty"`
+	ConversationID    string     `json:"conversation_id,omitempty"`
+	TransID           string     `json:"trans_id,omitempty"`
+	Retried           int        `json:"retried"`
+	MaxRetry          int        `json:"max_retry"`
+	LastError         string     `json:"last_error"`
+	LastFailedAt      *time.Time `json:"last_failed_at,omitempty"`
+	NextProcessAt     *time.Time `json:"next_process_at,omitempty"`
+}
+
+// ListFailedCallbacksResponse is the payload for GET /admin/failed-callbacks
+type ListFailedCallbacksResponse struct {
+	Callbacks []FailedCallback `json:"callbacks"`
+	NextPage  int              `json:"next_page,omitempty"` // Set when more callbacks follow
+}
+
+// isCallbackTask reports whether taskType processes a Safaricom callback.
+// Webhook deliveries share the callback queue and are not listed.
+func isCallbackTask(taskType string) bool {
+	switch taskType {
+	case worker.TypeProcessCallback, worker.TypeProcessB2CResult, worker.TypeProcessC2BConfirmation:
+		return true
+	}
+	return false
+}
+
+// taskScanPageSize is how many tasks are read from Redis per request while
+// collecting callbacks
+const taskScanPageSize = 500
+
+// collectCallbacks pages through list, keeping callback tasks, until want
+// have been collected or the tasks run out
+func collectCallbacks(list func(...asynq.ListOption) ([]*asynq.TaskInfo, error), want int) ([]*asynq.TaskInfo, error) {
+	var callbacks []*asynq.TaskInfo
+	for page := 1; len(callbacks) < want; page++ {
+		tasks, err := list(asynq.PageSize(taskScanPageSize), asynq.Page(page))
+		if err != nil {
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				break
+			}
+			return nil, err
+		}
+		for _, t := range tasks {
+			if isCallbackTask(t.Type) {
+				callbacks = append(callbacks, t)
+			}
+		}
+		if len(tasks) < taskScanPageSize {
+			break
+		}
+	}
+	return callbacks, nil
+}
+
+// ListFailedCallbacks handles GET /admin/failed-callbacks. The optional
+// state query parameter restricts results to "retry" or "archived"; retry
+// tasks are listed before archived ones. page and limit select a page of
+// the combined list.
+func (h *Handler) ListFailedCallbacks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	state := q.Get("state")
+	if state != "" && state != "retry" && state != "archived" {
+		respondError(w, http.StatusBadRequest, "Invalid state filter")
+		return
+	}
+
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	page := 1
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, "page must be a positive integer")
+			return
+		}
+		page = n
+	}
+
+	// One more than the page needs tells whether another page follows
+	want := page*limit + 1
+
+	var tasks []*asynq.TaskInfo
+	if state == "" || state == "retry" {
+		retry, err := collectCallbacks(func(opts ...asynq.ListOption) ([]*asynq.TaskInfo, error) {
+			return h.inspector.ListRetryTasks(h.cfg.CallbackQueue, opts...)
+		}, want)
+		if err != nil {
+			logging.Printf("Failed to list retry tasks: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to list failed callbacks")
+			return
+		}
+		tasks = append(tasks, retry...)
+	}
+	if (state == "" || state == "archived") && len(tasks) < want {
+		archived, err := collectCallbacks(func(opts ...asynq.ListOption) ([]*asynq.TaskInfo, error) {
+			return h.inspector.ListArchivedTasks(h.cfg.CallbackQueue, opts...)
+		}, want-len(tasks))
+		if err != nil {
+			logging.Printf("Failed to list archived tasks: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to list failed callbacks")
+			return
+		}
+		tasks = append(tasks, archived...)
+	}
+
+	respondJSON(w, http.StatusOK, failedCallbacksPage(tasks, page, limit))
+}
+
+// failedCallbacksPage returns the page-th run of limit tasks
+func failedCallbacksPage(tasks []*asynq.TaskInfo, page, limit int) ListFailedCallbacksResponse {
+	resp := ListFailedCallbacksResponse{Callbacks: []FailedCallback{}}
+
+	start := (page - 1) * limit
+	if start >= len(tasks) {
+		return resp
+	}
+	end := min(start+limit, len(tasks))
+	for _, t := range tasks[start:end] {
+		resp.Callbacks = append(resp.Callbacks, toFailedCallback(t))
+	}
+	if end < len(tasks) {
+		resp.NextPage = page + 1
+	}
+	return resp
+}
+
+// RequeueFailedCallback handles POST /admin/failed-callbacks/{taskID}/requeue,
+// moving a retry or archived callback task back to pending
+func (h *Handler) RequeueFailedCallback(w http.ResponseWriter, r *http.Request) {
+	taskID := chi.URLParam(r, "taskID")
+
+	info, err := h.inspector.GetTaskInfo(h.cfg.CallbackQueue, taskID)
+	if err != nil {
+		if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+			respondError(w, http.StatusNotFound, "Task not found")
+			return
+		}
+		logging.Printf("Failed to fetch task %s: %v", taskID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch task")
+		return
+	}
+
+	if !isCallbackTask(info.Type) {
+		respondError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+	if info.State != asynq.TaskStateRetry && info.State != asynq.TaskStateArchived {
+		respondError(w, http.StatusConflict, "Task is not in a failed state")
+		return
+	}
+
+	if err := h.inspector.RunTask(h.cfg.CallbackQueue, taskID); err != nil {
+		logging.Printf("Failed to requeue task %s: %v", taskID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to requeue task")
+		return
+	}
+
+	logging.Printf("Requeued failed callback: task_id=%s", taskID)
+
+	respondJSON(w, http.StatusAccepted, map[string]string{
+		"task_id": taskID,
+		"status":  "requeued",
+	})
+}
+
+// GetCallbackTask handles GET /admin/callbacks/{checkoutRequestID}, looking
+// up a Safaricom callback task by its deterministic task ID. The response has
+// the same shape as GET /admin/failed-callbacks entries.
+func (h *Handler) GetCallbackTask(w http.ResponseWriter, r *http.Request) {
+	checkoutRequestID := chi.URLParam(r, "checkoutRequestID")
+
+	info, err := h.inspector.GetTaskInfo(h.cfg.CallbackQueue, worker.CallbackTaskID(checkoutRequestID))
+	if err != nil {
+		if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+			respondError(w, http.StatusNotFound, "Task not found")
+			return
+		}
+		logging.Printf("Failed to fetch callback task for %s: %v", checkoutRequestID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch task")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, toFailedCallback(info))
+}
+
+// toFailedCallback converts an asynq task into its API representation
+func toFailedCallback(t *asynq.TaskInfo) FailedCallback {
+	fc := FailedCallback{
+		TaskID:    t.ID,
+		Type:      t.Type,
+		State:     t.State.String(),
+		Retried:   t.Retried,
+		MaxRetry:  t.MaxRetry,
+		LastError: t.LastErr,
+	}
+
+	if payload, err := worker.ParseProcessCallbackPayload(t.Payload); err == nil {
+		switch t.Type {
+		case worker.TypeProcessB2CResult:
+			var result worker.B2CResultPayload
+			if err := json.Unmarshal(payload.Callback, &result); err == nil {
+				fc.ConversationID = result.Result.ConversationID
+			}
+		case worker.TypeProcessC2BConfirmation:
+			var confirmation worker.C2BPayload
+			if err := json.Unmarshal(payload.Callback, &confirmation); err == nil {
+				fc.TransID = confirmation.TransID
+			}
+		default:
+			var callback worker.CallbackPayload
+			if err := json.Unmarshal(payload.Callback, &callback); err == nil {
+				fc.CheckoutRequestID = callback.Body.StkCallback.CheckoutRequestID
+			}
+		}
+	}
+	if !t.LastFailedAt.IsZero() {
+		fc.LastFailedAt = &t.LastFailedAt
+	}
+	if !t.NextProcessAt.IsZero() {
+		fc.NextProcessAt = &t.NextProcessAt
+	}
+
+	return fc
+}
+
+// ReprocessRequest is the optional body for POST /admin/transactions/{id}/reprocess
+type ReprocessRequest struct {
+	Force  bool   `json:"force"`
+	Reason string `json:"reason" validate:"max=500"`
+}
+
+// ReprocessTransaction handles POST /admin/transactions/{id}/reprocess. It
+// re-enqueues the most recent stored callback for the transaction. Terminal
+// transactions are rejected unless force is set, in which case the
+// transaction is reset to PENDING so the callback is applied again.
+func (h *Handler) ReprocessTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	transactionID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+
+	actor := r.Header.Get("X-Operator")
+	if actor == "" || len(actor) > 100 {
+		respondError(w, http.StatusBadRequest, "X-Operator header is required")
+		return
+	}
+
+	var req ReprocessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON")
+		return
+	}
+	if err := h.validator.Struct(req); err != nil {
+		respondValidationError(w, err)
+		return
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		logging.Printf("Failed to begin transaction: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the row so concurrent reprocess requests serialise
+	var status string
+	var checkoutRequestID *string
+	err = tx.QueryRow(ctx, `
+		SELECT status, checkout_request_id
+		FROM transactions
+		WHERE internal_transaction_id = $1
+		FOR UPDATE
+	`, transactionID).Scan(&status, &checkoutRequestID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			respondError(w, http.StatusNotFound, "Transaction not found")
+			return
+		}
+		logging.Printf("Failed to fetch transaction %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+		return
+	}
+
+	terminal := models.TransactionStatus(status) != models.StatusPending
+	if terminal && !req.Force {
+		respondError(w, http.StatusConflict, "Transaction is already "+status+"; set force to reprocess")
+		return
+	}
+
+	if checkoutRequestID == nil {
+		respondError(w, http.StatusNotFound, "No stored callback for transaction")
+		return
+	}
+
+	var rawPayload []byte
+	err = tx.QueryRow(ctx, `
+		SELECT raw_payload
+		FROM callbacks
+		WHERE checkout_request_id = $1
+		ORDER BY received_at DESC
+		LIMIT 1
+	`, *checkoutRequestID).Scan(&rawPayload)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			respondError(w, http.StatusNotFound, "No stored callback for transaction")
+			return
+		}
+		logging.Printf("Failed to fetch callback for %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+		return
+	}
+
+	// The original callback task is found by its deterministic ID. A failed
+	// one is rerun in place rather than queued a second time; otherwise a
+	// new task is queued under an ID chosen now so the audit entry has it.
+	var taskID string
+	var newTask *asynq.Task
+	existing, err := h.inspector.GetTaskInfo(h.cfg.CallbackQueue, worker.CallbackTaskID(*checkoutRequestID))
+	switch {
+	case err == nil && (existing.State == asynq.TaskStatePending || existing.State == asynq.TaskStateActive || existing.State == asynq.TaskStateScheduled):
+		respondError(w, http.StatusConflict, "Callback task "+existing.ID+" is already "+existing.State.String())
+		return
+	case err == nil && (existing.State == asynq.TaskStateRetry || existing.State == asynq.TaskStateArchived):
+		taskID = existing.ID
+	case err != nil && !errors.Is(err, asynq.ErrTaskNotFound) && !errors.Is(err, asynq.ErrQueueNotFound):
+		logging.Printf("Failed to fetch callback task for %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+		return
+	default:
+		// No task, or a completed one still held for MPESA_CALLBACK_UNIQUE_TTL
+		newTask, err = worker.NewReprocessCallbackTask(ctx, rawPayload)
+		if err != nil {
+			logging.Printf("Failed to create task: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+			return
+		}
+		taskID = "reprocess:" + uuid.New().String()
+	}
+
+	// Operator override of the state machine: the worker only applies
+	// callbacks to PENDING transactions
+	if terminal {
+		_, err = tx.Exec(ctx, `
+			UPDATE transactions
+			SET status = 'PENDING', error_message = NULL, completed_at = NULL
+			WHERE internal_transaction_id = $1
+		`, transactionID)
+		if err != nil {
+			logging.Printf("Failed to reset transaction %s: %v", transactionID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+			return
+		}
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"force":           req.Force,
+		"previous_status": status,
+		"task_id":         taskID,
+		"reason":          req.Reason,
+	})
+	_, err = tx.Exec(ctx, `
+		INSERT INTO admin_audit_log (action, actor, transaction_id, details)
+		VALUES ($1, $2, $3, $4)
+	`, auditActionReprocess, actor, transactionID, details)
+	if err != nil {
+		logging.Printf("Failed to write audit log for %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+		return
+	}
+
+	// Commit before the task can run, so the worker sees the reset status
+	// and every task run has its audit entry
+	if err := tx.Commit(ctx); err != nil {
+		logging.Printf("Failed to commit reprocess of %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reprocess transaction")
+		return
+	}
+
+	// The transaction is now PENDING, so if queueing fails the reconciler
+	// still settles it, and the request can be retried without force
+	if newTask != nil {
+		_, err = h.queueClient.Enqueue(newTask, asynq.Queue(h.cfg.CallbackQueue), asynq.TaskID(taskID), asynq.MaxRetry(3))
+	} else {
+		err = h.inspector.RunTask(h.cfg.CallbackQueue, taskID)
+	}
+	if err != nil {
+		logging.Printf("Failed to queue callback reprocess: transaction=%s task_id=%s actor=%q: %v", transactionID, taskID, actor, err)
+		respondError(w, http.StatusInternalServerError, "Reprocess recorded but the callback task could not be queued; retry the request")
+		return
+	}
+
+	logging.Printf("Callback reprocess queued: transaction=%s task_id=%s actor=%q force=%t", transactionID, taskID, actor, req.Force)
+
+	respondJSON(w, http.StatusAccepted, map[string]string{
+		"transaction_id": transactionID.String(),
+		"task_id":        taskID,
+		"status":         "queued",
+	})
+}
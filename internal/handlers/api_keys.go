@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/mpesa-gateway/internal/apikey"
+	"github.com/mpesa-gateway/internal/logging"
+)
+
+// admin_audit_log actions for API key management
+const (
+	auditActionAPIKeyCreate  = "api_key_create"
+	auditActionAPIKeyDisable = "api_key_disable"
+)
+
+// APIKey describes an API key without its secret
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Label      string     `json:"label"`
+	TenantID   *string    `json:"tenant_id"`
+	Enabled    bool       `json:"enabled"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+}
+
+// ListAPIKeysResponse is the payload for GET /admin/api-keys
+type ListAPIKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// CreateAPIKeyRequest is the body of POST /admin/api-keys
+type CreateAPIKeyRequest struct {
+	Label    string `json:"label" validate:"required,max=100"`
+	TenantID string `json:"tenant_id" validate:"omitempty,max=64"`
+}
+
+// CreateAPIKeyResponse is the payload for POST /admin/api-keys. Key is only
+// ever returned here.
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// ListAPIKeys handles GET /admin/api-keys
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(r.Context(), `
+		SELECT id, label, tenant_id, enabled, created_at, disabled_at
+		FROM api_keys
+		ORDER BY id
+	`)
+	if err != nil {
+		logging.Printf("Failed to list API keys: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list API keys")
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Label, &k.TenantID, &k.Enabled, &k.CreatedAt, &k.DisabledAt); err != nil {
+			logging.Printf("Failed to scan API key: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to list API keys")
+			return
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		logging.Printf("Failed to list API keys: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list API keys")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, ListAPIKeysResponse{Keys: keys})
+}
+
+// CreateAPIKey handles POST /admin/api-keys, issuing a new key. The key is
+// returned once and only its hash is stored.
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	actor := r.Header.Get("X-Operator")
+	if actor == "" || len(actor) > 100 {
+		respondError(w, http.StatusBadRequest, "X-Operator header is required")
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON")
+		return
+	}
+	if err := h.validator.Struct(req); err != nil {
+		respondValidationError(w, err)
+		return
+	}
+
+	key, hash, err := apikey.Generate()
+	if err != nil {
+		logging.Printf("Failed to generate API key: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	var tenantID *string
+	if req.TenantID != "" {
+		tenantID = &req.TenantID
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		logging.Printf("Failed to begin transaction: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	resp := CreateAPIKeyResponse{
+		APIKey: APIKey{Label: req.Label, TenantID: tenantID, Enabled: true},
+		Key:    key,
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO api_keys (label, key_hash, tenant_id)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, req.Label, hash, tenantID).Scan(&resp.ID, &resp.CreatedAt)
+	if err != nil {
+		logging.Printf("Failed to insert API key: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{
+		"key_id":    resp.ID,
+		"label":     req.Label,
+		"tenant_id": req.TenantID,
+	})
+	_, err = tx.Exec(ctx, `
+		INSERT INTO admin_audit_log (action, actor, details)
+		VALUES ($1, $2, $3)
+	`, auditActionAPIKeyCreate, actor, details)
+	if err != nil {
+		logging.Printf("Failed to write audit log for API key %d: %v", resp.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logging.Printf("Failed to commit API key %d: %v", resp.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	logging.Printf("API key %d (%s) created by %q", resp.ID, req.Label, actor)
+
+	respondJSON(w, http.StatusCreated, resp)
+}
+
+// DisableAPIKey handles DELETE /admin/api-keys/{id}. The key stays in the
+// table for the audit trail but is no longer accepted.
+func (h *Handler) DisableAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid API key ID")
+		return
+	}
+
+	actor := r.Header.Get("X-Operator")
+	if actor == "" || len(actor) > 100 {
+		respondError(w, http.StatusBadRequest, "X-Operator header is required")
+		return
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		logging.Printf("Failed to begin transaction: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to disable API key")
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE api_keys
+		SET enabled = FALSE, disabled_at = COALESCE(disabled_at, NOW())
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		logging.Printf("Failed to disable API key %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to disable API key")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		respondError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{"key_id": id})
+	_, err = tx.Exec(ctx, `
+		INSERT INTO admin_audit_log (action, actor, details)
+		VALUES ($1, $2, $3)
+	`, auditActionAPIKeyDisable, actor, details)
+	if err != nil {
+		logging.Printf("Failed to write audit log for API key %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to disable API key")
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logging.Printf("Failed to commit disabling API key %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to disable API key")
+		return
+	}
+
+	logging.Printf("API key %d disabled by %q", id, actor)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/mpesa-gateway/internal/middleware"
+	"github.com/mpesa-gateway/internal/payment"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// maxBatchSize caps the payments accepted by one POST /initiate/batch
+	maxBatchSize = 100
+	// batchConcurrency bounds the STK Push calls one batch runs at a time.
+	// MPESA_STK_MAX_IN_FLIGHT still applies across all requests.
+	batchConcurrency = 10
+)
+
+// InitiateBatchRequest is the body of POST /initiate/batch
+type InitiateBatchRequest struct {
+	Payments []InitiatePaymentRequest `json:"payments"`
+}
+
+// BatchItemResult is the outcome of one payment in a batch. StatusCode is
+// what POST /initiate would have returned for the same payment.
+type BatchItemResult struct {
+	Index      int `json:"index"`
+	StatusCode int `json:"status_code"`
+	*payment.InitiatePaymentResponse
+	Code   string       `json:"code,omitempty"` // Set with Error
+	Error  string       `json:"error,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// InitiateBatchResponse is the payload for POST /initiate/batch
+type InitiateBatchResponse struct {
+	Results   []BatchItemResult `json:"results"` // In request order
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+}
+
+// InitiateBatch handles POST /initiate/batch. Every payment is validated
+// before any is initiated; invalid ones are reported and skipped, and a
+// failure on one payment never fails the others.
+func (h *Handler) InitiateBatch(w http.ResponseWriter, r *http.Request) {
+	var req InitiateBatchRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if len(req.Payments) == 0 {
+		respondError(w, http.StatusBadRequest, "payments must not be empty")
+		return
+	}
+	if len(req.Payments) > maxBatchSize {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("payments must contain at most %d items", maxBatchSize))
+		return
+	}
+
+	results := make([]BatchItemResult, len(req.Payments))
+	paymentReqs := make([]*payment.InitiatePaymentRequest, len(req.Payments))
+	tenantHeader := r.Header.Get("X-Tenant-ID")
+	seenKeys := make(map[uuid.UUID]int, len(req.Payments))
+
+	for i := range req.Payments {
+		results[i].Index = i
+
+		paymentReq, initErr := h.buildPaymentRequest(&req.Payments[i], tenantHeader)
+		if initErr != nil {
+			results[i].setError(initErr)
+			continue
+		}
+
+		// Two items sharing a key would race to replay each other
+		if first, ok := seenKeys[paymentReq.IdempotencyKey]; ok {
+			results[i].setError(&initiateError{
+				status:  http.StatusBadRequest,
+				code:    CodeDuplicateRequest,
+				message: fmt.Sprintf("Duplicate idempotency key: already used by payment %d", first),
+			})
+			continue
+		}
+		seenKeys[paymentReq.IdempotencyKey] = i
+		paymentReqs[i] = &paymentReq
+	}
+
+	var g errgroup.Group
+	g.SetLimit(batchConcurrency)
+	for i, paymentReq := range paymentReqs {
+		if paymentReq == nil {
+			continue
+		}
+		g.Go(func() error {
+			// Each payment draws on the caller's rate limit, so a batch
+			// cannot send more STK Pushes than single requests could
+			if allowed, wait := h.cfg.InitiateLimiter.Allow(r.Context()); !allowed {
+				results[i].setError(&initiateError{
+					status:     http.StatusTooManyRequests,
+					message:    "Rate limit exceeded, retry later",
+					retryAfter: middleware.RetryAfter(wait),
+				})
+				return nil
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), h.cfg.InitiateTimeout)
+			defer cancel()
+			resp, status, initErr := h.initiate(ctx, *paymentReq, req.Payments[i].NotifyPending)
+			if initErr != nil {
+				results[i].setError(initErr)
+				return nil
+			}
+			results[i].StatusCode = status
+			results[i].InitiatePaymentResponse = resp
+			return nil
+		})
+	}
+	g.Wait()
+
+	resp := InitiateBatchResponse{Results: results}
+	for _, result := range results {
+		if result.InitiatePaymentResponse != nil {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+func (b *BatchItemResult) setError(e *initiateError) {
+	b.StatusCode = e.status
+	b.Code = e.errorCode()
+	b.Error = e.message
+	b.Errors = e.fields
+	if e.fields != nil {
+		b.Error = "Validation failed"
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/hibiken/asynq"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/payment"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/mpesa-gateway/internal/worker"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// auditActionC2BRegister is the admin_audit_log action for C2B URL registration
+const auditActionC2BRegister = "c2b_register_urls"
+
+// C2B validation result codes Safaricom understands
+const (
+	c2bAccepted     = "0"
+	c2bOtherErrored = "C2B00016"
+)
+
+// c2bResponse is the body Safaricom expects from the C2B validation and
+// confirmation URLs
+type c2bResponse struct {
+	ResultCode string `json:"ResultCode"`
+	ResultDesc string `json:"ResultDesc"`
+}
+
+// C2BValidation handles POST /callback/c2b/validation. Safaricom only calls it
+// when external validation is enabled for the short code; well-formed
+// payments are accepted and recorded once confirmed.
+func (h *Handler) C2BValidation(w http.ResponseWriter, r *http.Request) {
+	var payload worker.C2BPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.TransID == "" {
+		logging.Printf("Rejecting malformed C2B validation request from %s", r.RemoteAddr)
+		respondJSON(w, http.StatusOK, c2bResponse{ResultCode: c2bOtherErrored, ResultDesc: "Rejected"})
+		return
+	}
+
+	logging.Printf("C2B validation accepted: trans_id=%s amount=%s bill_ref=%q", payload.TransID, payload.TransAmount, payload.BillRefNumber)
+
+	respondJSON(w, http.StatusOK, c2bResponse{ResultCode: c2bAccepted, ResultDesc: "Accepted"})
+}
+
+// C2BConfirmation handles POST /callback/c2b/confirmation, queueing the
+// confirmed payment to be recorded as a COMPLETED C2B transaction
+func (h *Handler) C2BConfirmation(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Tracer().Start(r.Context(), "c2b.confirmation.receive", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logging.Printf("Failed to read C2B confirmation body: %v", err)
+		respondError(w, http.StatusBadRequest, "Failed to read request")
+		return
+	}
+
+	var payload worker.C2BPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		logging.Printf("Invalid JSON in C2B confirmation: %v", err)
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON")
+		return
+	}
+	if payload.TransID == "" {
+		logging.Printf("Dropping C2B confirmation without TransID from %s: %s", r.RemoteAddr, truncate(body, maxLoggedCallback))
+		respondJSON(w, http.StatusOK, c2bResponse{ResultCode: c2bAccepted, ResultDesc: "Success"})
+		return
+	}
+
+	task, err := worker.NewProcessC2BConfirmationTask(ctx, body)
+	if err != nil {
+		logging.Printf("Failed to create task: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to queue callback")
+		return
+	}
+
+	opts := []asynq.Option{
+		asynq.Queue(h.cfg.CallbackQueue),
+		asynq.MaxRetry(3),
+		asynq.TaskID(worker.C2BConfirmationTaskID(payload.TransID)),
+	}
+	if h.cfg.CallbackUniqueTTL > 0 {
+		opts = append(opts, asynq.Retention(h.cfg.CallbackUniqueTTL))
+	}
+
+	info, err := h.queueClient.Enqueue(task, opts...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		logging.Printf("Duplicate C2B confirmation for TransID %s already queued", payload.TransID)
+		respondJSON(w, http.StatusOK, c2bResponse{ResultCode: c2bAccepted, ResultDesc: "Success"})
+		return
+	}
+	if err != nil {
+		logging.Printf("Failed to enqueue task: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to queue callback")
+		return
+	}
+
+	logging.Printf("C2B confirmation queued: task_id=%s trans_id=%s", info.ID, payload.TransID)
+
+	respondJSON(w, http.StatusOK, c2bResponse{ResultCode: c2bAccepted, ResultDesc: "Success"})
+}
+
+// RegisterC2BURLs handles POST /admin/c2b/register-urls, registering the
+// configured C2B validation and confirmation URLs with Safaricom. Every call
+// is recorded in admin_audit_log.
+func (h *Handler) RegisterC2BURLs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	actor := r.Header.Get("X-Operator")
+	if actor == "" || len(actor) > 100 {
+		respondError(w, http.StatusBadRequest, "X-Operator header is required")
+		return
+	}
+
+	registration, err := h.paymentService.RegisterC2BURLs(ctx)
+	if err != nil {
+		logging.Printf("C2B URL registration by %q failed: %v", actor, err)
+
+		var rateLimited *mpesa.RateLimitError
+		switch {
+		case errors.Is(err, payment.ErrC2BDisabled):
+			respondError(w, http.StatusServiceUnavailable, "C2B URLs are not configured")
+		case errors.Is(err, payment.ErrC2BRegistrationRejected):
+			respondError(w, http.StatusBadGateway, err.Error())
+		case errors.Is(err, payment.ErrTokenUnavailable):
+			respondError(w, http.StatusServiceUnavailable, "Payment provider authentication unavailable, retry later")
+		case errors.As(err, &rateLimited):
+			if rateLimited.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(rateLimited.RetryAfter.Seconds())))
+			}
+			respondError(w, http.StatusTooManyRequests, "Payment provider rate limit reached, retry later")
+		default:
+			respondError(w, http.StatusBadGateway, "Failed to register C2B URLs")
+		}
+		return
+	}
+
+	// Registration already happened; a failed audit write is only logged
+	details, _ := json.Marshal(registration)
+	_, err = h.db.Exec(ctx, `
+		INSERT INTO admin_audit_log (action, actor, details)
+		VALUES ($1, $2, $3)
+	`, auditActionC2BRegister, actor, details)
+	if err != nil {
+		logging.Printf("Failed to write audit log for C2B URL registration: %v", err)
+	}
+
+	logging.Printf("C2B URLs registered for short code %s by %q", registration.ShortCode, actor)
+
+	respondJSON(w, http.StatusOK, registration)
+}
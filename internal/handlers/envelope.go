@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/mpesa-gateway/internal/middleware"
+)
+
+// envelope is the body of every JSON response under /v1: exactly one of
+// Data and Error is non-null
+type envelope struct {
+	Data  interface{}    `json:"data"`
+	Error *envelopeError `json:"error"`
+}
+
+// envelopeError describes a failed /v1 request. Fields is set for
+// validation failures.
+type envelopeError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// enveloped reports whether w was wrapped by middleware.Envelope
+func enveloped(w http.ResponseWriter) bool {
+	return middleware.Enveloped(w)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/mpesa-gateway/internal/middleware"
+)
+
+// Error codes are the stable, machine-readable "code" of every JSON error
+// response. Messages may change; codes only ever get added.
+const (
+	// Generic codes, used when no specific code applies
+	CodeBadRequest         = "BAD_REQUEST"
+	CodeNotFound           = "NOT_FOUND"
+	CodeConflict           = "CONFLICT"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeInternal           = "INTERNAL_ERROR"
+	CodeServiceUnavailable = "SERVICE_UNAVAILABLE"
+	CodeUpstreamError      = "UPSTREAM_ERROR"
+
+	// Request problems
+	CodeInvalidJSON           = "INVALID_JSON"
+	CodeValidationFailed      = "VALIDATION_FAILED"
+	CodeInvalidAmount         = "INVALID_AMOUNT"
+	CodeInvalidPhone          = "INVALID_PHONE"
+	CodeInvalidIdempotencyKey = "INVALID_IDEMPOTENCY_KEY"
+	CodeInvalidWebhookURL     = "INVALID_WEBHOOK_URL"
+	CodeUnknownTenant         = "UNKNOWN_TENANT"
+	CodeDuplicateRequest      = "DUPLICATE_REQUEST"
+
+	// Rejections by middleware, before the handler runs
+	CodeUnauthorized         = middleware.CodeUnauthorized
+	CodeForbidden            = middleware.CodeForbidden
+	CodeUnsupportedMediaType = middleware.CodeUnsupportedMediaType
+
+	// Payment provider outcomes
+	CodeSTKPushFailed       = "STK_PUSH_FAILED"
+	CodeUpstreamTimeout     = "UPSTREAM_TIMEOUT"
+	CodeProviderUnavailable = "PROVIDER_UNAVAILABLE"
+	CodeProviderAuth        = "PROVIDER_AUTH_UNAVAILABLE"
+	CodeTooManyInFlight     = "TOO_MANY_IN_FLIGHT"
+	CodeNotRecorded         = "PAYMENT_NOT_RECORDED"
+	CodePayoutsDisabled     = "PAYOUTS_DISABLED"
+	CodePayoutRejected      = "PAYOUT_REJECTED"
+	CodePayoutUnconfirmed   = "PAYOUT_UNCONFIRMED"
+)
+
+// statusErrorCode is the generic code for an error status
+func statusErrorCode(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return CodeNotFound
+	case status == http.StatusConflict:
+		return CodeConflict
+	case status == http.StatusTooManyRequests:
+		return CodeRateLimited
+	case status == http.StatusServiceUnavailable:
+		return CodeServiceUnavailable
+	case status == http.StatusBadGateway:
+		return CodeUpstreamError
+	case status == http.StatusGatewayTimeout:
+		return CodeUpstreamTimeout
+	case status >= 500:
+		return CodeInternal
+	default:
+		return CodeBadRequest
+	}
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/shopspring/decimal"
+)
+
+// exportFlushEvery is how many rows are written between flushes to the client
+const exportFlushEvery = 500
+
+// exportColumns is the CSV header row, in ExportRow field order
+var exportColumns = []string{
+	"transaction_id", "direction", "status", "amount", "phone",
+	"mpesa_receipt_number", "tenant_id", "error_message", "created_at", "completed_at",
+}
+
+// ExportRow is one transaction in a GET /transactions/export response
+type ExportRow struct {
+	TransactionID      uuid.UUID       `json:"transaction_id"`
+	Direction          string          `json:"direction"`
+	Status             string          `json:"status"`
+	Amount             decimal.Decimal `json:"amount"`
+	Phone              string          `json:"phone"`
+	MpesaReceiptNumber *string         `json:"mpesa_receipt_number"`
+	TenantID           *string         `json:"tenant_id"`
+	ErrorMessage       *string         `json:"error_message"`
+	CreatedAt          time.Time       `json:"created_at"`
+	CompletedAt        *time.Time      `json:"completed_at"`
+}
+
+// csvRecord formats the row in exportColumns order
+func (e *ExportRow) csvRecord() []string {
+	completedAt := ""
+	if e.CompletedAt != nil {
+		completedAt = e.CompletedAt.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		e.TransactionID.String(),
+		e.Direction,
+		e.Status,
+		e.Amount.StringFixed(2),
+		e.Phone,
+		deref(e.MpesaReceiptNumber),
+		deref(e.TenantID),
+		deref(e.ErrorMessage),
+		e.CreatedAt.UTC().Format(time.RFC3339),
+		completedAt,
+	}
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// exportWriter writes rows in one export format
+type exportWriter interface {
+	Write(row *ExportRow) error
+	Flush() error
+}
+
+type csvExportWriter struct{ w *csv.Writer }
+
+func (c csvExportWriter) Write(row *ExportRow) error { return c.w.Write(row.csvRecord()) }
+
+func (c csvExportWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonExportWriter struct{ enc *json.Encoder }
+
+func (j jsonExportWriter) Write(row *ExportRow) error { return j.enc.Encode(row) }
+
+func (j jsonExportWriter) Flush() error { return nil }
+
+// ExportTransactions handles GET /transactions/export. Transactions created
+// in [from, to) are streamed oldest first as CSV or JSON lines, so large
+// ranges are never held in memory. include_archive=true also exports
+// transactions moved to transactions_archive.
+func (h *Handler) ExportTransactions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var bounds [2]time.Time
+	for i, param := range []string{"from", "to"} {
+		value := q.Get(param)
+		if value == "" {
+			respondError(w, http.StatusBadRequest, "Missing "+param+": expected RFC3339 timestamp")
+			return
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid "+param+": expected RFC3339 timestamp")
+			return
+		}
+		bounds[i] = t
+	}
+	from, to := bounds[0], bounds[1]
+	if !from.Before(to) {
+		respondError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		respondError(w, http.StatusBadRequest, "Invalid format: expected csv or json")
+		return
+	}
+
+	includeArchive := false
+	if value := q.Get("include_archive"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid include_archive: expected true or false")
+			return
+		}
+		includeArchive = b
+	}
+
+	query := `
+		SELECT id, internal_transaction_id, direction, status, amount, phone, mpesa_receipt_number,
+		       tenant_id, error_message, created_at, completed_at
+		FROM transactions
+		WHERE created_at >= $1 AND created_at < $2
+	`
+	if includeArchive {
+		query += `
+		UNION ALL
+		SELECT id, internal_transaction_id, direction, status, amount, phone, mpesa_receipt_number,
+		       tenant_id, error_message, created_at, completed_at
+		FROM transactions_archive
+		WHERE created_at >= $1 AND created_at < $2
+		`
+	}
+	query += ` ORDER BY created_at, id`
+
+	// Streaming a large range to a slow client can outlast the pool's
+	// statement_timeout, which would truncate the export
+	tx, err := h.db.Begin(r.Context())
+	if err != nil {
+		logging.Printf("Failed to export transactions: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to export transactions")
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	if _, err := tx.Exec(r.Context(), `SET LOCAL statement_timeout = 0`); err != nil {
+		logging.Printf("Failed to export transactions: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to export transactions")
+		return
+	}
+
+	rows, err := tx.Query(r.Context(), query, from, to)
+	if err != nil {
+		logging.Printf("Failed to export transactions: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to export transactions")
+		return
+	}
+	defer rows.Close()
+
+	filename := "transactions-" + from.UTC().Format("20060102T150405Z") + "-" + to.UTC().Format("20060102T150405Z")
+	var out exportWriter
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		out = csvExportWriter{cw}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.jsonl"`)
+		out = jsonExportWriter{json.NewEncoder(w)}
+	}
+
+	// The status is sent with the first bytes; later failures can only be
+	// signalled by truncating the stream
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	for rows.Next() {
+		var row ExportRow
+		var id uuid.UUID
+		if err := rows.Scan(
+			&id,
+			&row.TransactionID,
+			&row.Direction,
+			&row.Status,
+			&row.Amount,
+			&row.Phone,
+			&row.MpesaReceiptNumber,
+			&row.TenantID,
+			&row.ErrorMessage,
+			&row.CreatedAt,
+			&row.CompletedAt,
+		); err != nil {
+			logging.Printf("Failed to scan exported transaction: %v", err)
+			return
+		}
+		if err := out.Write(&row); err != nil {
+			logging.Printf("Transaction export aborted: %v", err)
+			return
+		}
+
+		count++
+		if count%exportFlushEvery == 0 {
+			if err := out.Flush(); err != nil {
+				logging.Printf("Transaction export aborted: %v", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logging.Printf("Transaction export failed after %d rows: %v", count, err)
+		return
+	}
+	if err := out.Flush(); err != nil {
+		logging.Printf("Transaction export aborted: %v", err)
+	}
+}
@@ -1,45 +1,125 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/middleware"
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/mpesa"
 	"github.com/mpesa-gateway/internal/payment"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/mpesa-gateway/internal/txcache"
 	"github.com/mpesa-gateway/internal/worker"
 	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// PaymentInitiator is the payment service the handlers call. *payment.Service
+// implements it; internal/payment/mock provides a stub for handler tests.
+type PaymentInitiator interface {
+	InitiatePayment(ctx context.Context, req payment.InitiatePaymentRequest) (*payment.InitiatePaymentResponse, error)
+	InitiateB2C(ctx context.Context, req payment.InitiatePayoutRequest) (*payment.InitiatePaymentResponse, error)
+	GetByIdempotencyKey(ctx context.Context, key uuid.UUID) (*payment.InitiatePaymentResponse, error)
+	CheckToken(ctx context.Context) error
+	TokenStats() mpesa.TokenStats
+	RegisterC2BURLs(ctx context.Context) (*payment.C2BRegistration, error)
+}
+
+var _ PaymentInitiator = (*payment.Service)(nil)
+
 // Handler holds dependencies for HTTP handlers
 type Handler struct {
 	db             *pgxpool.Pool
-	paymentService *payment.Service
+	paymentService PaymentInitiator
 	queueClient    *asynq.Client
+	inspector      *asynq.Inspector
 	validator      *validator.Validate
+	cfg            HandlerConfig
+}
+
+// HandlerConfig holds HTTP handler behaviour settings
+type HandlerConfig struct {
+	// VerifyCallbackCheckoutID drops callbacks for unknown CheckoutRequestIDs
+	VerifyCallbackCheckoutID bool
+
+	// CallbackReplayWindow drops callbacks for settled transactions or for
+	// checkout requests created longer ago than the window; 0 disables
+	CallbackReplayWindow time.Duration
+
+	// CallbackQueue is the asynq queue callback tasks are enqueued on. Tasks
+	// that exhaust their retries are archived there for inspection.
+	CallbackQueue string
+
+	// CallbackUniqueTTL keeps a processed callback's task ID reserved so
+	// Safaricom redeliveries are rejected at enqueue time; 0 releases it as soon as the task completes
+	CallbackUniqueTTL time.Duration
+
+	// MinAmount and MaxAmount bound accepted payment amounts (inclusive)
+	MinAmount decimal.Decimal
+	MaxAmount decimal.Decimal
+
+	// AmountPolicy must match the payment service's so amounts it would
+	// reject are refused before anything is recorded
+	AmountPolicy payment.AmountPolicy
+
+	// SanitizeReferences must match the payment service's. When off,
+	// account_reference and transaction_desc are held to Safaricom's limits.
+	SanitizeReferences bool
+
+	// TxCache serves the callback CheckoutRequestID checks; nil disables
+	// caching. It only ever holds PENDING transactions, so a settled one is
+	// always read from the database and replays are still dropped.
+	TxCache *txcache.Cache
+
+	// InitiateLimiter is taken once per /initiate/batch payment, as
+	// /initiate takes it once per request; nil disables limiting
+	InitiateLimiter *middleware.RateLimiter
+
+	// InitiateTimeout bounds each /initiate/batch payment, as
+	// MPESA_INITIATE_TIMEOUT bounds a single /initiate request
+	InitiateTimeout time.Duration
 }
 
 // NewHandler creates a new handler instance
-func NewHandler(db *pgxpool.Pool, paymentService *payment.Service, queueClient *asynq.Client) *Handler {
+func NewHandler(db *pgxpool.Pool, paymentService PaymentInitiator, queueClient *asynq.Client, inspector *asynq.Inspector, cfg HandlerConfig) *Handler {
 	return &Handler{
 		db:             db,
 		paymentService: paymentService,
 		queueClient:    queueClient,
-		validator:      validator.New(),
+		inspector:      inspector,
+		validator:      newValidator(),
+		cfg:            cfg,
 	}
 }
 
 // InitiatePaymentRequest represents the /initiate request
 type InitiatePaymentRequest struct {
-	Amount         string `json:"amount" validate:"required,numeric"`
-	Phone          string `json:"phone" validate:"required,len=12,numeric"`
-	WebhookURL     string `json:"webhook_url" validate:"required,url"`
-	IdempotencyKey string `json:"idempotency_key" validate:"required,uuid4"`
+	Amount           string `json:"amount" validate:"required,numeric"`
+	Phone            string `json:"phone" validate:"required,len=12,numeric"`
+	WebhookURL       string `json:"webhook_url" validate:"required,url"`
+	WebhookSecret    string `json:"webhook_secret" validate:"omitempty,min=16"`
+	IdempotencyKey   string `json:"idempotency_key" validate:"required,uuid4"`
+	TenantID         string `json:"tenant_id" validate:"omitempty,max=64"`
+	TransactionType  string `json:"transaction_type" validate:"omitempty,oneof=CustomerPayBillOnline CustomerBuyGoodsOnline"`
+	AccountReference string `json:"account_reference" validate:"omitempty,max=100"`
+	TransactionDesc  string `json:"transaction_desc" validate:"omitempty,max=100"`
+	NotifyPending    bool   `json:"notify_pending"` // Send a PENDING webhook once the STK prompt is sent
 }
 
 // InitiatePayment handles POST /initiate
@@ -47,139 +127,789 @@ func (h *Handler) InitiatePayment(w http.ResponseWriter, r *http.Request) {
 	var req InitiatePaymentRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON: "+err.Error())
 		return
 	}
 
-	// Validate request
-	if err := h.validator.Struct(req); err != nil {
-		respondError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+	paymentReq, initErr := h.buildPaymentRequest(&req, r.Header.Get("X-Tenant-ID"))
+	if initErr != nil {
+		respondInitiateError(w, initErr)
 		return
 	}
 
-	// Parse amount
-	amount, err := decimal.NewFromString(req.Amount)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid amount format")
+	resp, status, initErr := h.initiate(r.Context(), paymentReq, req.NotifyPending)
+	if initErr != nil {
+		respondInitiateError(w, initErr)
 		return
 	}
 
-	if amount.LessThanOrEqual(decimal.Zero) {
-		respondError(w, http.StatusBadRequest, "Amount must be greater than zero")
+	respondJSON(w, status, resp)
+}
+
+// initiateError is a failed initiation and the HTTP response it maps to
+type initiateError struct {
+	status     int
+	code       string // Generic code for status when empty
+	message    string
+	fields     []FieldError // Set instead of message for validation failures
+	retryAfter string
+}
+
+// respondInitiateError writes an initiateError in the same shape as
+// respondError and respondValidationError
+func respondInitiateError(w http.ResponseWriter, e *initiateError) {
+	if e.retryAfter != "" {
+		w.Header().Set("Retry-After", e.retryAfter)
+	}
+	if e.fields != nil {
+		respondFieldErrors(w, e.status, e.fields)
 		return
 	}
+	respondErrorCode(w, e.status, e.errorCode(), e.message)
+}
+
+// errorCode is the code reported for e
+func (e *initiateError) errorCode() string {
+	switch {
+	case e.fields != nil:
+		return CodeValidationFailed
+	case e.code != "":
+		return e.code
+	default:
+		return statusErrorCode(e.status)
+	}
+}
+
+// buildPaymentRequest normalizes and validates req. tenantHeader is the
+// X-Tenant-ID header, which takes precedence over the body field.
+func (h *Handler) buildPaymentRequest(req *InitiatePaymentRequest, tenantHeader string) (payment.InitiatePaymentRequest, *initiateError) {
+	if tenantHeader != "" {
+		req.TenantID = tenantHeader
+	}
+
+	// Normalize phone to canonical 2547XXXXXXXX form
+	phone, err := mpesa.NormalizePhone(req.Phone)
+	if err != nil {
+		return payment.InitiatePaymentRequest{}, &initiateError{
+			status:  http.StatusBadRequest,
+			code:    CodeInvalidPhone,
+			message: "Invalid phone number: expected 07XXXXXXXX, +2547XXXXXXXX or 2547XXXXXXXX",
+		}
+	}
+	req.Phone = phone
+
+	// Validate request
+	if err := h.validator.Struct(req); err != nil {
+		fields, msg := validationErrors(err)
+		return payment.InitiatePaymentRequest{}, &initiateError{status: http.StatusBadRequest, code: CodeValidationFailed, message: msg, fields: fields}
+	}
+	if fields := h.referenceLengthErrors(req); fields != nil {
+		return payment.InitiatePaymentRequest{}, &initiateError{status: http.StatusBadRequest, code: CodeValidationFailed, fields: fields}
+	}
+
+	// Parse amount
+	amount, err := h.parseAmount(req.Amount)
+	if err != nil {
+		return payment.InitiatePaymentRequest{}, &initiateError{status: http.StatusBadRequest, code: CodeInvalidAmount, message: err.Error()}
+	}
 
 	// Parse idempotency key
 	idempotencyKey, err := uuid.Parse(req.IdempotencyKey)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid idempotency key")
+		return payment.InitiatePaymentRequest{}, &initiateError{status: http.StatusBadRequest, code: CodeInvalidIdempotencyKey, message: "Invalid idempotency key"}
+	}
+
+	return payment.InitiatePaymentRequest{
+		Amount:           amount,
+		Phone:            req.Phone,
+		WebhookURL:       req.WebhookURL,
+		WebhookSecret:    req.WebhookSecret,
+		IdempotencyKey:   idempotencyKey,
+		TenantID:         req.TenantID,
+		TransactionType:  req.TransactionType,
+		AccountReference: req.AccountReference,
+		TransactionDesc:  req.TransactionDesc,
+	}, nil
+}
+
+// referenceLengthErrors reports references too long for Safaricom. Only
+// unsanitized references are checked; sanitized ones are truncated to fit.
+func (h *Handler) referenceLengthErrors(req *InitiatePaymentRequest) []FieldError {
+	if h.cfg.SanitizeReferences {
+		return nil
+	}
+
+	var fields []FieldError
+	if len(req.AccountReference) > mpesa.AccountReferenceMaxLen {
+		fields = append(fields, FieldError{Field: "account_reference", Message: fmt.Sprintf("must be at most %d characters", mpesa.AccountReferenceMaxLen)})
+	}
+	if len(req.TransactionDesc) > mpesa.TransactionDescMaxLen {
+		fields = append(fields, FieldError{Field: "transaction_desc", Message: fmt.Sprintf("must be at most %d characters", mpesa.TransactionDescMaxLen)})
+	}
+	return fields
+}
+
+// initiate calls the payment service, returning 201 for a new transaction or
+// 200 when an idempotent replay returns the original one
+func (h *Handler) initiate(ctx context.Context, paymentReq payment.InitiatePaymentRequest, notifyPending bool) (*payment.InitiatePaymentResponse, int, *initiateError) {
+	paymentReq.RequestID = middleware.GetRequestID(ctx)
+	resp, err := h.paymentService.InitiatePayment(ctx, paymentReq)
+	if err != nil {
+		return h.initiateFailed(ctx, paymentReq.IdempotencyKey, err)
+	}
+
+	if notifyPending && resp.CheckoutRequestID != "" {
+		h.enqueueNotifyPending(ctx, resp)
+	}
+
+	return resp, http.StatusCreated, nil
+}
+
+// initiateFailed maps an InitiatePayment or InitiateB2C error to its
+// response, so /initiate and /payouts answer the same way. A duplicate
+// idempotency key replays the original transaction with 200.
+func (h *Handler) initiateFailed(ctx context.Context, idempotencyKey uuid.UUID, err error) (*payment.InitiatePaymentResponse, int, *initiateError) {
+	// Idempotent replay: return the original transaction
+	if errors.Is(err, payment.ErrDuplicateIdempotencyKey) {
+		existing, err := h.paymentService.GetByIdempotencyKey(ctx, idempotencyKey)
+		if err != nil {
+			logging.Printf("Failed to fetch original transaction: %v", err)
+			return nil, 0, &initiateError{status: http.StatusInternalServerError, message: "Failed to initiate payment"}
+		}
+		logging.Printf("Replaying transaction %s for duplicate idempotency key", existing.TransactionID)
+		return existing, http.StatusOK, nil
+	}
+
+	if errors.Is(err, payment.ErrInvalidWebhookURL) {
+		return nil, 0, &initiateError{status: http.StatusBadRequest, code: CodeInvalidWebhookURL, message: err.Error()}
+	}
+	if errors.Is(err, payment.ErrUnknownTenant) {
+		return nil, 0, &initiateError{status: http.StatusBadRequest, code: CodeUnknownTenant, message: err.Error()}
+	}
+	if errors.Is(err, payment.ErrReferenceTooLong) {
+		return nil, 0, &initiateError{status: http.StatusBadRequest, code: CodeValidationFailed, message: err.Error()}
+	}
+	if errors.Is(err, payment.ErrFractionalAmount) {
+		return nil, 0, &initiateError{status: http.StatusBadRequest, code: CodeInvalidAmount, message: h.amountPolicyError(err).Error()}
+	}
+	if errors.Is(err, payment.ErrPayoutsDisabled) {
+		return nil, 0, &initiateError{status: http.StatusServiceUnavailable, code: CodePayoutsDisabled, message: "Payouts are not enabled"}
+	}
+
+	// MPESA_INITIATE_TIMEOUT expired and the Safaricom call was abandoned
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logging.Printf("Payment initiation timed out: %v", err)
+		return nil, 0, &initiateError{status: http.StatusGatewayTimeout, code: CodeUpstreamTimeout, message: "Payment provider did not respond in time; check the transaction status before retrying"}
+	}
+
+	var rateLimited *mpesa.RateLimitError
+	if errors.As(err, &rateLimited) {
+		e := &initiateError{status: http.StatusTooManyRequests, message: "Payment provider rate limit reached, retry later"}
+		if rateLimited.RetryAfter > 0 {
+			e.retryAfter = strconv.Itoa(int(rateLimited.RetryAfter.Seconds()))
+		}
+		return nil, 0, e
+	}
+
+	if errors.Is(err, payment.ErrCircuitOpen) {
+		return nil, 0, &initiateError{status: http.StatusServiceUnavailable, code: CodeProviderUnavailable, message: "Payment provider unavailable, retry later"}
+	}
+
+	if errors.Is(err, payment.ErrTooManyInFlight) {
+		return nil, 0, &initiateError{status: http.StatusServiceUnavailable, code: CodeTooManyInFlight, message: "Too many payments in progress, retry later", retryAfter: "1"}
+	}
+
+	if errors.Is(err, payment.ErrTokenUnavailable) {
+		logging.Printf("Payment initiation failed: %v", err)
+		return nil, 0, &initiateError{status: http.StatusServiceUnavailable, code: CodeProviderAuth, message: "Payment provider authentication unavailable, retry later"}
+	}
+
+	if errors.Is(err, payment.ErrSTKPushRejected) {
+		logging.Printf("Payment initiation rejected: %v", err)
+		return nil, 0, &initiateError{status: http.StatusBadGateway, code: CodeSTKPushFailed, message: "Payment provider rejected the payment request"}
+	}
+
+	if errors.Is(err, payment.ErrCheckoutNotRecorded) {
+		logging.Printf("Payment initiation not recorded: %v", err)
+		return nil, 0, &initiateError{status: http.StatusInternalServerError, code: CodeNotRecorded, message: "Payment may have been initiated but could not be recorded; do not resend it with a new idempotency key"}
+	}
+
+	if errors.Is(err, payment.ErrPayoutRejected) {
+		logging.Printf("Payout initiation rejected: %v", err)
+		return nil, 0, &initiateError{status: http.StatusBadGateway, code: CodePayoutRejected, message: "Payment provider rejected the payout request"}
+	}
+
+	if errors.Is(err, payment.ErrPayoutUnconfirmed) {
+		logging.Printf("Payout initiation unconfirmed: %v", err)
+		return nil, 0, &initiateError{status: http.StatusBadGateway, code: CodePayoutUnconfirmed, message: "Payout may have been sent; it stays PENDING until reconciled, so do not resend it with a new idempotency key"}
+	}
+
+	if errors.Is(err, payment.ErrPayoutNotRecorded) {
+		logging.Printf("Payout initiation not recorded: %v", err)
+		return nil, 0, &initiateError{status: http.StatusInternalServerError, code: CodeNotRecorded, message: "Payout may have been sent but could not be recorded; do not resend it with a new idempotency key"}
+	}
+
+	logging.Printf("Payment initiation failed: %v", err)
+	return nil, 0, &initiateError{status: http.StatusInternalServerError, message: "Failed to initiate payment"}
+}
+
+// parseAmount parses a request amount and checks it against the amount
+// policy and bounds. The bounds apply to the amount that will be charged;
+// the requested amount is returned and the payment service rounds it.
+func (h *Handler) parseAmount(raw string) (decimal.Decimal, error) {
+	amount, err := decimal.NewFromString(raw)
+	if err != nil {
+		return decimal.Decimal{}, errors.New("Invalid amount format")
+	}
+
+	charged, err := h.cfg.AmountPolicy.Apply(amount)
+	if err != nil {
+		return decimal.Decimal{}, h.amountPolicyError(err)
+	}
+
+	if charged.LessThan(h.cfg.MinAmount) || charged.GreaterThan(h.cfg.MaxAmount) {
+		return decimal.Decimal{}, fmt.Errorf("Amount must be between %s and %s", h.cfg.MinAmount, h.cfg.MaxAmount)
+	}
+
+	return amount, nil
+}
+
+// amountPolicyError turns an AmountPolicy rejection into a client message
+func (h *Handler) amountPolicyError(err error) error {
+	if !errors.Is(err, payment.ErrFractionalAmount) {
+		return err
+	}
+	if h.cfg.AmountPolicy.MinorUnits {
+		return errors.New("Amount must have at most two decimal places")
+	}
+	return errors.New("Amount must be a whole number of shillings")
+}
+
+// enqueueNotifyPending queues the opt-in PENDING acknowledgement webhook.
+// The payment is already initiated, so failures are only logged.
+func (h *Handler) enqueueNotifyPending(ctx context.Context, resp *payment.InitiatePaymentResponse) {
+	task, err := worker.NewNotifyPendingTask(ctx, resp.CheckoutRequestID)
+	if err != nil {
+		logging.Printf("Failed to create PENDING webhook task for %s: %v", resp.TransactionID, err)
 		return
 	}
 
-	// Call payment service
-	paymentReq := payment.InitiatePaymentRequest{
-		Amount:         amount,
-		Phone:          req.Phone,
-		WebhookURL:     req.WebhookURL,
-		IdempotencyKey: idempotencyKey,
+	if _, err := h.queueClient.Enqueue(task, asynq.Queue("default"), asynq.MaxRetry(3)); err != nil {
+		logging.Printf("Failed to queue PENDING webhook for %s: %v", resp.TransactionID, err)
+	}
+}
+
+// TransactionResponse represents the GET /transactions/{id} response
+type TransactionResponse struct {
+	TransactionID   uuid.UUID        `json:"transaction_id"`
+	Status          string           `json:"status"`
+	Amount          decimal.Decimal  `json:"amount"`                     // Charged amount
+	RequestedAmount *decimal.Decimal `json:"requested_amount,omitempty"` // Set when the amount policy rounded the request
+	Phone           string           `json:"phone"`
+	ReceiptNumber   *string          `json:"mpesa_receipt_number,omitempty"`
+	CheckoutID      *string          `json:"checkout_request_id,omitempty"` // Set once the STK prompt was sent
+	MpesaMetadata   json.RawMessage  `json:"mpesa_metadata,omitempty"`
+	ErrorMessage    *string          `json:"error_message,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+	CompletedAt     *time.Time       `json:"completed_at,omitempty"`
+}
+
+// GetTransaction handles GET /transactions/{id}
+func (h *Handler) GetTransaction(w http.ResponseWriter, r *http.Request) {
+	transactionID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+
+	h.respondTransaction(w, r, "internal_transaction_id = $1", transactionID)
+}
+
+// GetTransactionByReceipt handles GET /transactions/receipt/{receipt} for
+// support queries where the customer only has their M-Pesa SMS
+func (h *Handler) GetTransactionByReceipt(w http.ResponseWriter, r *http.Request) {
+	receipt := strings.ToUpper(strings.TrimSpace(chi.URLParam(r, "receipt")))
+	if receipt == "" || len(receipt) > 20 {
+		respondError(w, http.StatusBadRequest, "Invalid receipt number")
+		return
+	}
+
+	h.respondTransaction(w, r, "mpesa_receipt_number = $1", receipt)
+}
+
+// tenantCondition restricts a query to the caller's tenant when their API
+// key is pinned to one, appending the tenant to args
+func tenantCondition(r *http.Request, column string, args []interface{}) (string, []interface{}, bool) {
+	tenantID, ok := middleware.AuthenticatedTenant(r.Context())
+	if !ok {
+		return "", args, false
+	}
+	args = append(args, tenantID)
+	return fmt.Sprintf("%s = $%d", column, len(args)), args, true
+}
+
+// respondTransaction writes the single transaction matching condition
+func (h *Handler) respondTransaction(w http.ResponseWriter, r *http.Request, condition string, arg interface{}) {
+	args := []interface{}{arg}
+	if scope, scopedArgs, ok := tenantCondition(r, "tenant_id", args); ok {
+		condition += " AND " + scope
+		args = scopedArgs
 	}
 
-	resp, err := h.paymentService.InitiatePayment(r.Context(), paymentReq)
+	query := `
+		SELECT internal_transaction_id, status, amount, requested_amount, phone, mpesa_receipt_number, checkout_request_id,
+		       mpesa_metadata, error_message, created_at, updated_at, completed_at
+		FROM transactions
+		WHERE ` + condition
+
+	var resp TransactionResponse
+	var metadata []byte
+	err := h.db.QueryRow(r.Context(), query, args...).Scan(
+		&resp.TransactionID,
+		&resp.Status,
+		&resp.Amount,
+		&resp.RequestedAmount,
+		&resp.Phone,
+		&resp.ReceiptNumber,
+		&resp.CheckoutID,
+		&metadata,
+		&resp.ErrorMessage,
+		&resp.CreatedAt,
+		&resp.UpdatedAt,
+		&resp.CompletedAt,
+	)
 	if err != nil {
-		log.Printf("Payment initiation failed: %v", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			respondError(w, http.StatusNotFound, "Transaction not found")
+			return
+		}
+		logging.Printf("Failed to fetch transaction (%v): %v", arg, err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch transaction")
+		return
+	}
+	resp.MpesaMetadata = metadata
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// Pagination limits for GET /transactions
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// ListTransactionsResponse represents the GET /transactions response
+type ListTransactionsResponse struct {
+	Transactions []TransactionResponse `json:"transactions"`
+	NextCursor   string                `json:"next_cursor,omitempty"`
+}
+
+// ListTransactions handles GET /transactions
+func (h *Handler) ListTransactions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
 
-		// Check for idempotency conflict
-		if contains(err.Error(), "duplicate idempotency key") {
-			respondError(w, http.StatusConflict, "Duplicate request")
+	var conditions []string
+	var args []interface{}
+	addCondition := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(clause, len(args)))
+	}
+
+	if tenantID, ok := middleware.AuthenticatedTenant(r.Context()); ok {
+		addCondition("tenant_id = $%d", tenantID)
+	}
+
+	if status := q.Get("status"); status != "" {
+		switch models.TransactionStatus(status) {
+		case models.StatusPending, models.StatusCompleted, models.StatusFailed, models.StatusExpired:
+			addCondition("status = $%d", status)
+		default:
+			respondError(w, http.StatusBadRequest, "Invalid status")
 			return
 		}
+	}
 
-		respondError(w, http.StatusInternalServerError, "Failed to initiate payment")
+	if phone := q.Get("phone"); phone != "" {
+		normalized, err := mpesa.NormalizePhone(phone)
+		if err != nil {
+			respondErrorCode(w, http.StatusBadRequest, CodeInvalidPhone, "Invalid phone number")
+			return
+		}
+		addCondition("phone = $%d", normalized)
+	}
+
+	for _, bound := range []struct{ param, clause string }{
+		{"from", "created_at >= $%d"},
+		{"to", "created_at < $%d"},
+	} {
+		if value := q.Get(bound.param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid "+bound.param+": expected RFC3339 timestamp")
+				return
+			}
+			addCondition(bound.clause, t)
+		}
+	}
+
+	limit := defaultListLimit
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	if cursor := q.Get("cursor"); cursor != "" {
+		createdAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		args = append(args, createdAt, id)
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	query := `
+		SELECT id, internal_transaction_id, status, amount, phone, mpesa_receipt_number, checkout_request_id,
+		       mpesa_metadata, error_message, created_at, updated_at, completed_at
+		FROM transactions
+	`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// Fetch one extra row to know whether another page exists
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := h.db.Query(r.Context(), query, args...)
+	if err != nil {
+		logging.Printf("Failed to list transactions: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list transactions")
+		return
+	}
+	defer rows.Close()
+
+	resp := ListTransactionsResponse{Transactions: []TransactionResponse{}}
+	var lastID uuid.UUID
+	for rows.Next() {
+		if len(resp.Transactions) == limit {
+			last := resp.Transactions[limit-1]
+			resp.NextCursor = encodeCursor(last.CreatedAt, lastID)
+			break
+		}
+
+		var tx TransactionResponse
+		var metadata []byte
+		if err := rows.Scan(
+			&lastID,
+			&tx.TransactionID,
+			&tx.Status,
+			&tx.Amount,
+			&tx.Phone,
+			&tx.ReceiptNumber,
+			&tx.CheckoutID,
+			&metadata,
+			&tx.ErrorMessage,
+			&tx.CreatedAt,
+			&tx.UpdatedAt,
+			&tx.CompletedAt,
+		); err != nil {
+			logging.Printf("Failed to scan transaction: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to list transactions")
+			return
+		}
+		tx.MpesaMetadata = metadata
+		resp.Transactions = append(resp.Transactions, tx)
+	}
+	if err := rows.Err(); err != nil {
+		logging.Printf("Failed to list transactions: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list transactions")
 		return
 	}
 
-	respondJSON(w, http.StatusCreated, resp)
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// encodeCursor builds an opaque keyset cursor from the last row of a page
+func encodeCursor(createdAt time.Time, id uuid.UUID) string {
+	raw := createdAt.UTC().Format(time.RFC3339Nano) + "," + id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses a cursor produced by encodeCursor
+func decodeCursor(cursor string) (time.Time, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+
+	parts := strings.SplitN(string(raw), ",", 2)
+	if len(parts) != 2 {
+		return time.Time{}, uuid.Nil, fmt.Errorf("malformed cursor")
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+
+	return createdAt, id, nil
 }
 
 // MPesaCallback handles POST /callback (non-blocking)
 func (h *Handler) MPesaCallback(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Tracer().Start(r.Context(), "callback.receive", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	// Read raw body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Failed to read callback body: %v", err)
+		logging.Printf("Failed to read callback body: %v", err)
 		respondError(w, http.StatusBadRequest, "Failed to read request")
 		return
 	}
 
 	// Minimal validation: ensure it's valid JSON
-	var rawPayload map[string]interface{}
-	if err := json.Unmarshal(body, &rawPayload); err != nil {
-		log.Printf("Invalid JSON in callback: %v", err)
-		respondError(w, http.StatusBadRequest, "Invalid JSON")
+	if !json.Valid(body) {
+		logging.Printf("Invalid JSON in callback from %s", r.RemoteAddr)
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON")
+		return
+	}
+
+	// A B2C result sent to the STK callback URL (e.g. a ResultURL pointing
+	// here) is processed as one rather than dropped as malformed
+	if worker.DetectCallbackKind(body) == worker.CallbackKindB2CResult {
+		logging.Printf("B2C result received on %s, routing to B2C processing", r.URL.Path)
+		h.queueB2CResult(ctx, w, r, body)
 		return
 	}
 
+	// Malformed callbacks would only fail and retry in the worker. Respond
+	// 200 so Safaricom does not redeliver them, but queue nothing.
+	if err := worker.ValidateCallbackShape(body); err != nil {
+		logging.Printf("Dropping malformed callback from %s: %v: %s", r.RemoteAddr, err, truncate(body, maxLoggedCallback))
+		respondCallbackReceived(w)
+		return
+	}
+
+	var payload worker.CallbackPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		logging.Printf("Dropping undecodable callback from %s: %v: %s", r.RemoteAddr, err, truncate(body, maxLoggedCallback))
+		respondCallbackReceived(w)
+		return
+	}
+
+	// Drop callbacks for transactions we never initiated, and replays of
+	// ones already settled or too old. Respond 200 so Safaricom does not
+	// retry, but create no queue work.
+	if h.cfg.VerifyCallbackCheckoutID || h.cfg.CallbackReplayWindow > 0 {
+		checkoutRequestID := payload.Body.StkCallback.CheckoutRequestID
+		checkout, err := h.lookupCheckoutRequest(ctx, checkoutRequestID)
+		if err != nil {
+			logging.Printf("Failed to verify callback CheckoutRequestID %q: %v", checkoutRequestID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to verify callback")
+			return
+		}
+		if checkout == nil && h.cfg.VerifyCallbackCheckoutID {
+			logging.Printf("Dropping callback for unknown CheckoutRequestID %q from %s", checkoutRequestID, r.RemoteAddr)
+			respondCallbackReceived(w)
+			return
+		}
+		if checkout != nil && h.cfg.CallbackReplayWindow > 0 {
+			if checkout.Status != models.StatusPending {
+				logging.Printf("Dropping callback for CheckoutRequestID %q from %s: transaction already %s", checkoutRequestID, r.RemoteAddr, checkout.Status)
+				respondCallbackReceived(w)
+				return
+			}
+			if age := time.Since(checkout.CreatedAt); age > h.cfg.CallbackReplayWindow {
+				logging.Printf("Dropping callback for CheckoutRequestID %q from %s: checkout request is %s old", checkoutRequestID, r.RemoteAddr, age.Round(time.Second))
+				respondCallbackReceived(w)
+				return
+			}
+		}
+	}
+
 	// Enqueue task for background processing
-	task, err := worker.NewProcessCallbackTask(body)
+	task, err := worker.NewProcessCallbackTask(ctx, body)
 	if err != nil {
-		log.Printf("Failed to create task: %v", err)
+		logging.Printf("Failed to create task: %v", err)
 		respondError(w, http.StatusInternalServerError, "Failed to queue callback")
 		return
 	}
 
-	info, err := h.queueClient.Enqueue(task, asynq.Queue("default"), asynq.MaxRetry(3))
+	opts := []asynq.Option{asynq.Queue(h.cfg.CallbackQueue), asynq.MaxRetry(3)}
+	checkoutRequestID := payload.Body.StkCallback.CheckoutRequestID
+	if checkoutRequestID != "" {
+		// asynq.Unique hashes the payload, which carries per-request trace
+		// context, so duplicates are keyed by task ID instead. The ID also
+		// lets operators find the task from the CheckoutRequestID.
+		opts = append(opts, asynq.TaskID(worker.CallbackTaskID(checkoutRequestID)))
+		if h.cfg.CallbackUniqueTTL > 0 {
+			opts = append(opts, asynq.Retention(h.cfg.CallbackUniqueTTL))
+		}
+	}
+
+	info, err := h.queueClient.Enqueue(task, opts...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) || errors.Is(err, asynq.ErrDuplicateTask) {
+		logging.Printf("Duplicate callback for CheckoutRequestID %s already queued", checkoutRequestID)
+		respondCallbackReceived(w)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to enqueue task: %v", err)
+		logging.Printf("Failed to enqueue task: %v", err)
 		respondError(w, http.StatusInternalServerError, "Failed to queue callback")
 		return
 	}
 
-	log.Printf("Callback queued: task_id=%s", info.ID)
+	logging.Printf("Callback queued: task_id=%s", info.ID)
 
 	// Immediately return 200 OK to Safaricom
+	respondCallbackReceived(w)
+}
+
+// maxLoggedCallback bounds how much of a rejected callback body is logged
+const maxLoggedCallback = 2048
+
+// truncate returns at most n bytes of b as a string
+func truncate(b []byte, n int) string {
+	if len(b) <= n {
+		return string(b)
+	}
+	return string(b[:n]) + "...(truncated)"
+}
+
+// checkoutRequest is the state of the transaction a callback refers to
+type checkoutRequest struct {
+	Status    models.TransactionStatus
+	CreatedAt time.Time
+}
+
+// lookupCheckoutRequest returns the transaction with the given
+// CheckoutRequestID, or nil if there is none (served by
+// idx_transactions_checkout_request, or TxCache while it is PENDING)
+func (h *Handler) lookupCheckoutRequest(ctx context.Context, checkoutRequestID string) (*checkoutRequest, error) {
+	if checkoutRequestID == "" {
+		return nil, nil
+	}
+
+	tx, err := h.cfg.TxCache.Lookup(ctx, h.db, checkoutRequestID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &checkoutRequest{Status: models.TransactionStatus(tx.Status), CreatedAt: tx.CreatedAt}, nil
+}
+
+// respondCallbackReceived acknowledges a callback to Safaricom
+func respondCallbackReceived(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"received"}`))
 }
 
-// HealthCheck handles GET /health
+// HealthCheck handles GET /health. It is a liveness probe: it answers 200
+// whenever the process can serve HTTP and never touches dependencies, so a
+// database or Safaricom outage does not get healthy pods restarted.
 func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadinessCheck handles GET /ready. It is a readiness probe: it answers 200
+// only when the database and Redis respond and a Safaricom access token can
+// be obtained, so traffic is routed only to instances able to take payments.
+// Otherwise it answers 503 listing the failing dependencies.
+func (h *Handler) ReadinessCheck(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	health := map[string]string{
-		"status": "ok",
+	ready := map[string]string{
+		"status": "ready",
 	}
 
 	// Check database
 	if err := h.db.Ping(ctx); err != nil {
-		health["database"] = "down"
-		health["status"] = "degraded"
+		ready["database"] = "down"
+		ready["status"] = "not_ready"
+	} else {
+		ready["database"] = "up"
+	}
+
+	// Check queue (Redis)
+	if _, err := h.inspector.Queues(); err != nil {
+		ready["queue"] = "down"
+		ready["status"] = "not_ready"
+	} else {
+		ready["queue"] = "up"
+	}
+
+	// Check Safaricom OAuth (served from cache while the token is valid)
+	if err := h.paymentService.CheckToken(ctx); err != nil {
+		logging.Printf("Readiness: Safaricom token unavailable: %v", err)
+		ready["safaricom"] = "down"
+		ready["status"] = "not_ready"
 	} else {
-		health["database"] = "up"
+		ready["safaricom"] = "up"
 	}
 
-	// Note: Queue health check would require Redis ping, omitted for simplicity
+	// Repeated refresh failures mean payments will fail once the cached
+	// token expires; report it without taking the instance out of rotation
+	stats := h.paymentService.TokenStats()
+	if stats.Degraded() && ready["safaricom"] == "up" {
+		ready["safaricom"] = "degraded"
+	}
+	if !stats.LastRefreshAt.IsZero() {
+		ready["safaricom_last_token_refresh"] = stats.LastRefreshAt.UTC().Format(time.RFC3339)
+	}
 
 	status := http.StatusOK
-	if health["status"] != "ok" {
+	if ready["status"] != "ready" {
 		status = http.StatusServiceUnavailable
 	}
 
-	respondJSON(w, status, health)
+	respondJSON(w, status, ready)
 }
 
-// respondJSON writes a JSON response
+// respondJSON writes a JSON response, enveloped under /v1
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
+	if enveloped(w) {
+		data = envelope{Data: data}
+	}
+	writeJSON(w, status, data)
 }
 
-// respondError writes an error response
+// respondError writes an error response with the generic code for status
 func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
+	respondErrorCode(w, status, statusErrorCode(status), message)
 }
 
-// contains checks if a string contains a substring
-func contains(s, substr string) bool {
-	return bytes.Contains([]byte(s), []byte(substr))
+// respondErrorCode writes an error response with a specific code
+func respondErrorCode(w http.ResponseWriter, status int, code, message string) {
+	if enveloped(w) {
+		writeJSON(w, status, envelope{Error: &envelopeError{Code: code, Message: message}})
+		return
+	}
+	writeJSON(w, status, map[string]string{"error": message, "code": code})
+}
+
+// respondFieldErrors writes a 4xx response listing per-field errors
+func respondFieldErrors(w http.ResponseWriter, status int, fields []FieldError) {
+	if enveloped(w) {
+		writeJSON(w, status, envelope{Error: &envelopeError{Code: CodeValidationFailed, Message: "Validation failed", Fields: fields}})
+		return
+	}
+	writeJSON(w, status, map[string]interface{}{"errors": fields, "code": CodeValidationFailed})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
 }
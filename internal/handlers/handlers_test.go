@@ -0,0 +1,507 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
+
+	"github.com/mpesa-gateway/internal/middleware"
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/payment"
+	"github.com/mpesa-gateway/internal/payment/mock"
+	"github.com/mpesa-gateway/internal/worker"
+)
+
+const testIdempotencyKey = "0b7c3f9e-4c1e-4e8a-9d0a-1f2e3d4c5b6a"
+
+// newTestHandler builds a Handler around svc with no database or queue
+func newTestHandler(svc *mock.Service) *Handler {
+	return NewHandler(nil, svc, nil, nil, HandlerConfig{
+		MinAmount:          decimal.NewFromInt(1),
+		MaxAmount:          decimal.NewFromInt(150000),
+		SanitizeReferences: true,
+	})
+}
+
+// initiateBody is a valid /initiate request body
+func initiateBody(amount string) string {
+	return fmt.Sprintf(`{"amount": %q, "phone": "0712345678", "webhook_url": "https://merchant.example.com/hooks/mpesa", "idempotency_key": %q}`, amount, testIdempotencyKey)
+}
+
+func postInitiate(h *Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/initiate", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.InitiatePayment(rec, req)
+	return rec
+}
+
+// errorCode decodes the code of a bare error response
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode error response: %v", err)
+	}
+	return body.Code
+}
+
+func TestInitiatePaymentReplaysDuplicateIdempotencyKey(t *testing.T) {
+	original := &payment.InitiatePaymentResponse{
+		TransactionID:     uuid.MustParse("7f8c9d1e-2a3b-4c5d-8e7f-9a0b1c2d3e4f"),
+		Status:            string(models.StatusCompleted),
+		CheckoutRequestID: "ws_CO_191220191020363925",
+	}
+
+	// What the payment service returns when the insert hits the unique index
+	violation := &pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           "23505",
+		Message:        `duplicate key value violates unique constraint "transactions_idempotency_key_key"`,
+		TableName:      "transactions",
+		ConstraintName: "transactions_idempotency_key_key",
+	}
+
+	var lookedUp uuid.UUID
+	svc := &mock.Service{
+		InitiatePaymentFunc: func(ctx context.Context, req payment.InitiatePaymentRequest) (*payment.InitiatePaymentResponse, error) {
+			return nil, fmt.Errorf("%w: %w", payment.ErrDuplicateIdempotencyKey, violation)
+		},
+		GetByIdempotencyKeyFunc: func(ctx context.Context, key uuid.UUID) (*payment.InitiatePaymentResponse, error) {
+			lookedUp = key
+			return original, nil
+		},
+	}
+
+	rec := postInitiate(newTestHandler(svc), initiateBody("100"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d for a replay; body %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if lookedUp.String() != testIdempotencyKey {
+		t.Errorf("GetByIdempotencyKey(%s), want %s", lookedUp, testIdempotencyKey)
+	}
+
+	var got payment.InitiatePaymentResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got.TransactionID != original.TransactionID || got.Status != original.Status || got.CheckoutRequestID != original.CheckoutRequestID {
+		t.Errorf("response = %+v, want the original transaction %+v", got, original)
+	}
+}
+
+func TestInitiatePaymentCreated(t *testing.T) {
+	txID := uuid.New()
+	svc := &mock.Service{
+		InitiatePaymentFunc: func(ctx context.Context, req payment.InitiatePaymentRequest) (*payment.InitiatePaymentResponse, error) {
+			return &payment.InitiatePaymentResponse{
+				TransactionID:     txID,
+				Status:            string(models.StatusPending),
+				CheckoutRequestID: "ws_CO_191220191020363925",
+				CustomerMessage:   "Success. Request accepted for processing",
+			}, nil
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/initiate", strings.NewReader(initiateBody("250")))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-ID", "acme")
+	rec := httptest.NewRecorder()
+	newTestHandler(svc).InitiatePayment(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var got payment.InitiatePaymentResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got.TransactionID != txID || got.Status != string(models.StatusPending) {
+		t.Errorf("response = %+v, want transaction %s PENDING", got, txID)
+	}
+
+	requests := svc.PaymentRequests()
+	if len(requests) != 1 {
+		t.Fatalf("InitiatePayment called %d times, want 1", len(requests))
+	}
+	sent := requests[0]
+	if sent.Phone != "254712345678" {
+		t.Errorf("Phone = %q, want the normalized 254712345678", sent.Phone)
+	}
+	if !sent.Amount.Equal(decimal.NewFromInt(250)) {
+		t.Errorf("Amount = %s, want 250", sent.Amount)
+	}
+	if sent.IdempotencyKey.String() != testIdempotencyKey {
+		t.Errorf("IdempotencyKey = %s, want %s", sent.IdempotencyKey, testIdempotencyKey)
+	}
+	if sent.TenantID != "acme" {
+		t.Errorf("TenantID = %q, want the X-Tenant-ID %q", sent.TenantID, "acme")
+	}
+}
+
+func TestInitiatePaymentRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode string
+	}{
+		{"malformed JSON", `{"amount": `, CodeInvalidJSON},
+		{"bad phone", strings.Replace(initiateBody("100"), "0712345678", "12345", 1), CodeInvalidPhone},
+		{"amount above maximum", initiateBody("150001"), CodeInvalidAmount},
+		{"fractional amount", initiateBody("10.50"), CodeInvalidAmount},
+		{"missing webhook URL", strings.Replace(initiateBody("100"), "https://merchant.example.com/hooks/mpesa", "", 1), CodeValidationFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mock.Service{}
+			rec := postInitiate(newTestHandler(svc), tt.body)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			if code := errorCode(t, rec); code != tt.wantCode {
+				t.Errorf("code = %q, want %q", code, tt.wantCode)
+			}
+			if n := len(svc.PaymentRequests()); n != 0 {
+				t.Errorf("InitiatePayment called %d times for an invalid request", n)
+			}
+		})
+	}
+}
+
+func TestInitiatePaymentMapsServiceErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantRetryAfter string
+	}{
+		{"circuit open", payment.ErrCircuitOpen, http.StatusServiceUnavailable, CodeProviderUnavailable, ""},
+		{"rate limited", &mpesa.RateLimitError{RetryAfter: 30 * time.Second}, http.StatusTooManyRequests, CodeRateLimited, "30"},
+		{"too many in flight", payment.ErrTooManyInFlight, http.StatusServiceUnavailable, CodeTooManyInFlight, "1"},
+		{"no access token", fmt.Errorf("%w: oauth failed", payment.ErrTokenUnavailable), http.StatusServiceUnavailable, CodeProviderAuth, ""},
+		{"rejected by Safaricom", fmt.Errorf("%w: invalid shortcode", payment.ErrSTKPushRejected), http.StatusBadGateway, CodeSTKPushFailed, ""},
+		{"unknown tenant", payment.ErrUnknownTenant, http.StatusBadRequest, CodeUnknownTenant, ""},
+		{"checkout not recorded", payment.ErrCheckoutNotRecorded, http.StatusInternalServerError, CodeNotRecorded, ""},
+		{"unexpected", errors.New("connection reset"), http.StatusInternalServerError, CodeInternal, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mock.Service{
+				InitiatePaymentFunc: func(ctx context.Context, req payment.InitiatePaymentRequest) (*payment.InitiatePaymentResponse, error) {
+					return nil, tt.err
+				},
+			}
+			rec := postInitiate(newTestHandler(svc), initiateBody("100"))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if code := errorCode(t, rec); code != tt.wantCode {
+				t.Errorf("code = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestInitiatePaymentEnveloped(t *testing.T) {
+	svc := &mock.Service{
+		InitiatePaymentFunc: func(ctx context.Context, req payment.InitiatePaymentRequest) (*payment.InitiatePaymentResponse, error) {
+			return nil, payment.ErrCircuitOpen
+		},
+	}
+	h := middleware.Envelope(http.HandlerFunc(newTestHandler(svc).InitiatePayment))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/initiate", strings.NewReader(initiateBody("100")))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var body struct {
+		Data  json.RawMessage `json:"data"`
+		Error *envelopeError  `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if string(body.Data) != "null" || body.Error == nil || body.Error.Code != CodeProviderUnavailable {
+		t.Errorf("body = {data: %s, error: %+v}, want an enveloped %s error", body.Data, body.Error, CodeProviderUnavailable)
+	}
+}
+
+func TestInitiatePayoutUsesTenantHeader(t *testing.T) {
+	svc := &mock.Service{
+		InitiateB2CFunc: func(ctx context.Context, req payment.InitiatePayoutRequest) (*payment.InitiatePaymentResponse, error) {
+			return &payment.InitiatePaymentResponse{TransactionID: uuid.New(), Status: string(models.StatusPending)}, nil
+		},
+	}
+
+	body := `{"amount": "500", "phone": "+254712345678", "webhook_url": "https://merchant.example.com/hooks/mpesa", "idempotency_key": "` + testIdempotencyKey + `", "tenant_id": "body-tenant"}`
+	req := httptest.NewRequest(http.MethodPost, "/payouts", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-ID", "header-tenant")
+	rec := httptest.NewRecorder()
+	newTestHandler(svc).InitiatePayout(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	requests := svc.PayoutRequests()
+	if len(requests) != 1 {
+		t.Fatalf("InitiateB2C called %d times, want 1", len(requests))
+	}
+	if requests[0].TenantID != "header-tenant" || requests[0].Phone != "254712345678" {
+		t.Errorf("payout request = %+v, want tenant header-tenant and phone 254712345678", requests[0])
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  payment.AmountPolicy
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{"not a number", payment.AmountPolicy{}, "ten", "", "Invalid amount format"},
+		{"reject refuses cents", payment.AmountPolicy{Rounding: payment.AmountRoundingReject}, "100.50", "", "Amount must be a whole number of shillings"},
+		{"reject with minor units refuses a third place", payment.AmountPolicy{Rounding: payment.AmountRoundingReject, MinorUnits: true}, "100.505", "", "Amount must have at most two decimal places"},
+		{"reject accepts whole shillings", payment.AmountPolicy{Rounding: payment.AmountRoundingReject}, "100", "100", ""},
+
+		// The requested amount is returned unrounded; the bounds apply to the charge
+		{"floor keeps the requested amount", payment.AmountPolicy{Rounding: payment.AmountRoundingFloor}, "100.99", "100.99", ""},
+		{"floor below the minimum", payment.AmountPolicy{Rounding: payment.AmountRoundingFloor}, "0.99", "", "Amount must be a whole number of shillings"},
+		{"floor within the maximum", payment.AmountPolicy{Rounding: payment.AmountRoundingFloor}, "150000.99", "150000.99", ""},
+
+		{"half_up keeps the requested amount", payment.AmountPolicy{Rounding: payment.AmountRoundingHalfUp}, "100.5", "100.5", ""},
+		{"half_up above the maximum", payment.AmountPolicy{Rounding: payment.AmountRoundingHalfUp}, "150000.5", "", "Amount must be between 1 and 150000"},
+		{"half_up within the maximum", payment.AmountPolicy{Rounding: payment.AmountRoundingHalfUp}, "150000.49", "150000.49", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(&mock.Service{})
+			h.cfg.AmountPolicy = tt.policy
+
+			got, err := h.parseAmount(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseAmount(%q) error = %v, want %q", tt.raw, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAmount(%q) error = %v", tt.raw, err)
+			}
+			if !got.Equal(decimal.RequireFromString(tt.want)) {
+				t.Errorf("parseAmount(%q) = %s, want %s", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeTaskList serves tasks the way the asynq inspector pages them
+func fakeTaskList(tasks []*asynq.TaskInfo, calls *int) func(...asynq.ListOption) ([]*asynq.TaskInfo, error) {
+	return func(opts ...asynq.ListOption) ([]*asynq.TaskInfo, error) {
+		*calls++
+		start := min((*calls-1)*taskScanPageSize, len(tasks))
+		end := min(start+taskScanPageSize, len(tasks))
+		return tasks[start:end], nil
+	}
+}
+
+func TestCollectCallbacksSkipsWebhooksAcrossPages(t *testing.T) {
+	// A full page of webhook deliveries ahead of the callbacks
+	var tasks []*asynq.TaskInfo
+	for i := 0; i < taskScanPageSize; i++ {
+		tasks = append(tasks, &asynq.TaskInfo{ID: fmt.Sprintf("webhook-%d", i), Type: worker.TypeDeliverWebhook})
+	}
+	tasks = append(tasks,
+		&asynq.TaskInfo{ID: "stk", Type: worker.TypeProcessCallback},
+		&asynq.TaskInfo{ID: "b2c", Type: worker.TypeProcessB2CResult},
+		&asynq.TaskInfo{ID: "c2b", Type: worker.TypeProcessC2BConfirmation},
+	)
+
+	var calls int
+	got, err := collectCallbacks(fakeTaskList(tasks, &calls), 10)
+	if err != nil {
+		t.Fatalf("collectCallbacks() error = %v", err)
+	}
+	if len(got) != 3 || got[0].ID != "stk" || got[1].ID != "b2c" || got[2].ID != "c2b" {
+		t.Errorf("collectCallbacks() = %d tasks, want the STK, B2C and C2B callbacks", len(got))
+	}
+	if calls != 2 {
+		t.Errorf("pages read = %d, want 2", calls)
+	}
+
+	// Enough collected stops the scan
+	calls = 0
+	if got, _ := collectCallbacks(fakeTaskList(tasks[taskScanPageSize:], &calls), 1); len(got) != 3 || calls != 1 {
+		t.Errorf("collectCallbacks(want 1) = %d tasks in %d pages, want the first page only", len(got), calls)
+	}
+}
+
+func TestFailedCallbacksPage(t *testing.T) {
+	var tasks []*asynq.TaskInfo
+	for i := 0; i < 5; i++ {
+		tasks = append(tasks, &asynq.TaskInfo{ID: strconv.Itoa(i), Type: worker.TypeProcessCallback, State: asynq.TaskStateRetry})
+	}
+
+	tests := []struct {
+		page, limit  int
+		wantIDs      []string
+		wantNextPage int
+	}{
+		{1, 2, []string{"0", "1"}, 2},
+		{2, 2, []string{"2", "3"}, 3},
+		{3, 2, []string{"4"}, 0},
+		{4, 2, nil, 0},
+		{1, 5, []string{"0", "1", "2", "3", "4"}, 0},
+	}
+
+	for _, tt := range tests {
+		resp := failedCallbacksPage(tasks, tt.page, tt.limit)
+		var ids []string
+		for _, c := range resp.Callbacks {
+			ids = append(ids, c.TaskID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) || resp.NextPage != tt.wantNextPage {
+			t.Errorf("page %d limit %d = %v next %d, want %v next %d", tt.page, tt.limit, ids, resp.NextPage, tt.wantIDs, tt.wantNextPage)
+		}
+		if resp.Callbacks == nil {
+			t.Errorf("page %d limit %d: Callbacks is nil, want an empty list", tt.page, tt.limit)
+		}
+	}
+}
+
+func TestToFailedCallbackIdentifiers(t *testing.T) {
+	ctx := context.Background()
+	stk, _ := worker.NewProcessCallbackTask(ctx, []byte(`{"Body":{"stkCallback":{"CheckoutRequestID":"ws_CO_1","ResultCode":0}}}`))
+	b2c, _ := worker.NewProcessB2CResultTask(ctx, []byte(`{"Result":{"ConversationID":"AG_1","ResultCode":0}}`))
+	c2b, _ := worker.NewProcessC2BConfirmationTask(ctx, []byte(`{"TransID":"RKTQDM7W6S"}`))
+
+	got := toFailedCallback(&asynq.TaskInfo{Type: stk.Type(), State: asynq.TaskStateArchived, Payload: stk.Payload()})
+	if got.CheckoutRequestID != "ws_CO_1" || got.Type != worker.TypeProcessCallback {
+		t.Errorf("STK callback = %+v, want checkout_request_id ws_CO_1", got)
+	}
+	got = toFailedCallback(&asynq.TaskInfo{Type: b2c.Type(), State: asynq.TaskStateArchived, Payload: b2c.Payload()})
+	if got.ConversationID != "AG_1" || got.CheckoutRequestID != "" {
+		t.Errorf("B2C result = %+v, want conversation_id AG_1 only", got)
+	}
+	got = toFailedCallback(&asynq.TaskInfo{Type: c2b.Type(), State: asynq.TaskStateArchived, Payload: c2b.Payload()})
+	if got.TransID != "RKTQDM7W6S" || got.CheckoutRequestID != "" {
+		t.Errorf("C2B confirmation = %+v, want trans_id RKTQDM7W6S only", got)
+	}
+}
+
+// payoutBody is a valid /payouts request body
+const payoutBody = `{"amount": "500", "phone": "0712345678", "webhook_url": "https://merchant.example.com/hooks/mpesa", "idempotency_key": "` + testIdempotencyKey + `"}`
+
+func postPayout(ctx context.Context, h *Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/payouts", strings.NewReader(payoutBody)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.InitiatePayout(rec, req)
+	return rec
+}
+
+func TestInitiatePayoutMapsServiceErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantRetryAfter string
+	}{
+		{"payouts disabled", payment.ErrPayoutsDisabled, http.StatusServiceUnavailable, CodePayoutsDisabled, ""},
+		{"rate limited", &mpesa.RateLimitError{RetryAfter: 30 * time.Second}, http.StatusTooManyRequests, CodeRateLimited, "30"},
+		{"no access token", fmt.Errorf("%w: oauth failed", payment.ErrTokenUnavailable), http.StatusServiceUnavailable, CodeProviderAuth, ""},
+		{"rejected by Safaricom", fmt.Errorf("%w: invalid initiator", payment.ErrPayoutRejected), http.StatusBadGateway, CodePayoutRejected, ""},
+		{"outcome unknown", fmt.Errorf("%w: 503", payment.ErrPayoutUnconfirmed), http.StatusBadGateway, CodePayoutUnconfirmed, ""},
+		{"conversation not recorded", payment.ErrPayoutNotRecorded, http.StatusInternalServerError, CodeNotRecorded, ""},
+		{"unknown tenant", payment.ErrUnknownTenant, http.StatusBadRequest, CodeUnknownTenant, ""},
+		{"unexpected", errors.New("connection reset"), http.StatusInternalServerError, CodeInternal, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mock.Service{
+				InitiateB2CFunc: func(ctx context.Context, req payment.InitiatePayoutRequest) (*payment.InitiatePaymentResponse, error) {
+					return nil, tt.err
+				},
+			}
+			rec := postPayout(context.Background(), newTestHandler(svc))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if code := errorCode(t, rec); code != tt.wantCode {
+				t.Errorf("code = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestInitiatePayoutTimeout(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	svc := &mock.Service{
+		InitiateB2CFunc: func(ctx context.Context, req payment.InitiatePayoutRequest) (*payment.InitiatePaymentResponse, error) {
+			return nil, fmt.Errorf("%w: %w", payment.ErrPayoutUnconfirmed, ctx.Err())
+		},
+	}
+	rec := postPayout(ctx, newTestHandler(svc))
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+	if code := errorCode(t, rec); code != CodeUpstreamTimeout {
+		t.Errorf("code = %q, want %q", code, CodeUpstreamTimeout)
+	}
+}
+
+func TestInitiatePayoutReplaysDuplicateIdempotencyKey(t *testing.T) {
+	original := &payment.InitiatePaymentResponse{TransactionID: uuid.New(), Status: string(models.StatusPending)}
+	svc := &mock.Service{
+		InitiateB2CFunc: func(ctx context.Context, req payment.InitiatePayoutRequest) (*payment.InitiatePaymentResponse, error) {
+			return nil, payment.ErrDuplicateIdempotencyKey
+		},
+		GetByIdempotencyKeyFunc: func(ctx context.Context, key uuid.UUID) (*payment.InitiatePaymentResponse, error) {
+			return original, nil
+		},
+	}
+	rec := postPayout(context.Background(), newTestHandler(svc))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got payment.InitiatePaymentResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got.TransactionID != original.TransactionID {
+		t.Errorf("response = %+v (%v), want the original transaction %s", got, err, original.TransactionID)
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/middleware"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/payment"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/mpesa-gateway/internal/worker"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InitiatePayoutRequest represents the /payouts request
+type InitiatePayoutRequest struct {
+	Amount         string `json:"amount" validate:"required,numeric"`
+	Phone          string `json:"phone" validate:"required,len=12,numeric"`
+	WebhookURL     string `json:"webhook_url" validate:"required,url"`
+	WebhookSecret  string `json:"webhook_secret" validate:"omitempty,min=16"`
+	IdempotencyKey string `json:"idempotency_key" validate:"required,uuid4"`
+	Remarks        string `json:"remarks" validate:"omitempty,max=100"`
+	Occasion       string `json:"occasion" validate:"omitempty,max=100"`
+	TenantID       string `json:"tenant_id" validate:"omitempty,max=64"`
+}
+
+// InitiatePayout handles POST /payouts
+func (h *Handler) InitiatePayout(w http.ResponseWriter, r *http.Request) {
+	var req InitiatePayoutRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	// Normalize phone to canonical 2547XXXXXXXX form
+	phone, err := mpesa.NormalizePhone(req.Phone)
+	if err != nil {
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidPhone, "Invalid phone number: expected 07XXXXXXXX, +2547XXXXXXXX or 2547XXXXXXXX")
+		return
+	}
+	req.Phone = phone
+
+	if err := h.validator.Struct(req); err != nil {
+		respondValidationError(w, err)
+		return
+	}
+
+	amount, err := h.parseAmount(req.Amount)
+	if err != nil {
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidAmount, err.Error())
+		return
+	}
+
+	idempotencyKey, err := uuid.Parse(req.IdempotencyKey)
+	if err != nil {
+		respondErrorCode(w, http.StatusBadRequest, CodeInvalidIdempotencyKey, "Invalid idempotency key")
+		return
+	}
+
+	// The X-Tenant-ID header takes precedence, as on /initiate
+	tenantID := req.TenantID
+	if header := r.Header.Get("X-Tenant-ID"); header != "" {
+		tenantID = header
+	}
+
+	resp, err := h.paymentService.InitiateB2C(r.Context(), payment.InitiatePayoutRequest{
+		Amount:         amount,
+		Phone:          req.Phone,
+		WebhookURL:     req.WebhookURL,
+		WebhookSecret:  req.WebhookSecret,
+		IdempotencyKey: idempotencyKey,
+		Remarks:        req.Remarks,
+		Occasion:       req.Occasion,
+		TenantID:       tenantID,
+		RequestID:      middleware.GetRequestID(r.Context()),
+	})
+	if err != nil {
+		existing, status, initErr := h.initiateFailed(r.Context(), idempotencyKey, err)
+		if initErr != nil {
+			respondInitiateError(w, initErr)
+			return
+		}
+		respondJSON(w, status, existing)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, resp)
+}
+
+// B2CCallback handles POST /callback/b2c/result and /callback/b2c/timeout.
+// Queue timeouts carry the same Result body with a non-zero ResultCode.
+func (h *Handler) B2CCallback(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Tracer().Start(r.Context(), "b2c.result.receive", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logging.Printf("Failed to read B2C callback body: %v", err)
+		respondError(w, http.StatusBadRequest, "Failed to read request")
+		return
+	}
+
+	if !json.Valid(body) {
+		logging.Printf("Invalid JSON in B2C callback from %s", r.RemoteAddr)
+		respondError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	h.queueB2CResult(ctx, w, r, body)
+}
+
+// queueB2CResult queues a B2C result or queue timeout for processing.
+// Malformed ones are acknowledged and dropped, as they could only fail.
+func (h *Handler) queueB2CResult(ctx context.Context, w http.ResponseWriter, r *http.Request, body []byte) {
+	if err := worker.ValidateB2CResultShape(body); err != nil {
+		logging.Printf("Dropping malformed B2C callback from %s: %v: %s", r.RemoteAddr, err, truncate(body, maxLoggedCallback))
+		respondCallbackReceived(w)
+		return
+	}
+
+	var payload worker.B2CResultPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		logging.Printf("Dropping undecodable B2C callback from %s: %v: %s", r.RemoteAddr, err, truncate(body, maxLoggedCallback))
+		respondCallbackReceived(w)
+		return
+	}
+
+	task, err := worker.NewProcessB2CResultTask(ctx, body)
+	if err != nil {
+		logging.Printf("Failed to create task: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to queue callback")
+		return
+	}
+
+	info, err := h.queueClient.Enqueue(task, asynq.Queue(h.cfg.CallbackQueue), asynq.MaxRetry(3))
+	if err != nil {
+		logging.Printf("Failed to enqueue task: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to queue callback")
+		return
+	}
+
+	logging.Printf("B2C callback queued: task_id=%s conversation_id=%s", info.ID, payload.Result.ConversationID)
+
+	respondCallbackReceived(w)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError describes one invalid request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// newValidator returns a validator that reports fields by their JSON names
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return f.Name
+		}
+		return name
+	})
+	return v
+}
+
+// respondValidationError writes a 400 with one entry per failed field.
+// Errors that are not validator.ValidationErrors fall back to respondError.
+func respondValidationError(w http.ResponseWriter, err error) {
+	fields, msg := validationErrors(err)
+	if fields == nil {
+		respondErrorCode(w, http.StatusBadRequest, CodeValidationFailed, msg)
+		return
+	}
+
+	respondFieldErrors(w, http.StatusBadRequest, fields)
+}
+
+// validationErrors converts a validator error into per-field errors, or a
+// single message when err is not a validator.ValidationErrors
+func validationErrors(err error) ([]FieldError, string) {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil, "Validation failed: " + err.Error()
+	}
+
+	fieldErrs := make([]FieldError, 0, len(validationErrs))
+	for _, fe := range validationErrs {
+		fieldErrs = append(fieldErrs, FieldError{
+			Field:   fe.Field(),
+			Message: validationMessage(fe),
+		})
+	}
+
+	return fieldErrs, ""
+}
+
+// validationMessage turns a failed validation tag into a human-readable message
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "len":
+		if fe.Field() == "phone" {
+			return fmt.Sprintf("must be %s digits", fe.Param())
+		}
+		return fmt.Sprintf("must be exactly %s characters", fe.Param())
+	case "min":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at least %s characters", fe.Param())
+		}
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at most %s characters", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "numeric":
+		return "must be numeric"
+	case "url":
+		return "must be a valid URL"
+	case "uuid4":
+		return "must be a valid UUIDv4"
+	case "oneof":
+		return "must be one of: " + strings.Join(strings.Fields(fe.Param()), ", ")
+	default:
+		return fmt.Sprintf("failed %q validation", fe.Tag())
+	}
+}
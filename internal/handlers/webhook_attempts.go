@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/mpesa-gateway/internal/logging"
+)
+
+// maxAttemptResponseBody bounds each response body returned by
+// GET /transactions/{id}/webhook-attempts
+const maxAttemptResponseBody = 1024
+
+// WebhookAttempt is one recorded webhook delivery attempt
+type WebhookAttempt struct {
+	AttemptNumber  int       `json:"attempt_number"`
+	WebhookURL     string    `json:"webhook_url"`
+	StatusCode     int       `json:"status_code"` // 0 when no response was received
+	ResponseTimeMs int       `json:"response_time_ms"`
+	Success        bool      `json:"success"`
+	ResponseBody   string    `json:"response_body,omitempty"`
+	AttemptedAt    time.Time `json:"attempted_at"`
+}
+
+// ListWebhookAttemptsResponse is the payload for
+// GET /transactions/{id}/webhook-attempts
+type ListWebhookAttemptsResponse struct {
+	TransactionID uuid.UUID        `json:"transaction_id"`
+	Attempts      []WebhookAttempt `json:"attempts"`
+}
+
+// ListWebhookAttempts handles GET /transactions/{id}/webhook-attempts,
+// returning delivery history oldest first so support can see why a tenant
+// missed a notification
+func (h *Handler) ListWebhookAttempts(w http.ResponseWriter, r *http.Request) {
+	transactionID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+
+	condition := "t.internal_transaction_id = $1"
+	args := []interface{}{transactionID}
+	if scope, scopedArgs, ok := tenantCondition(r, "t.tenant_id", args); ok {
+		condition += " AND " + scope
+		args = scopedArgs
+	}
+
+	var exists bool
+	err = h.db.QueryRow(r.Context(),
+		`SELECT EXISTS (SELECT 1 FROM transactions t WHERE `+condition+`)`,
+		args...,
+	).Scan(&exists)
+	if err != nil {
+		logging.Printf("Failed to fetch transaction %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list webhook attempts")
+		return
+	}
+	if !exists {
+		respondError(w, http.StatusNotFound, "Transaction not found")
+		return
+	}
+
+	query := `
+		SELECT a.attempt_number, a.webhook_url, COALESCE(a.response_status_code, 0),
+		       COALESCE(a.response_time_ms, 0), a.success, a.response_body, a.attempted_at
+		FROM webhook_attempts a
+		JOIN transactions t ON t.id = a.transaction_id
+		WHERE ` + condition + `
+		ORDER BY a.attempted_at, a.id
+	`
+
+	rows, err := h.db.Query(r.Context(), query, args...)
+	if err != nil {
+		logging.Printf("Failed to list webhook attempts for %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list webhook attempts")
+		return
+	}
+	defer rows.Close()
+
+	resp := ListWebhookAttemptsResponse{TransactionID: transactionID, Attempts: []WebhookAttempt{}}
+	for rows.Next() {
+		var attempt WebhookAttempt
+		var body *string
+		if err := rows.Scan(
+			&attempt.AttemptNumber,
+			&attempt.WebhookURL,
+			&attempt.StatusCode,
+			&attempt.ResponseTimeMs,
+			&attempt.Success,
+			&body,
+			&attempt.AttemptedAt,
+		); err != nil {
+			logging.Printf("Failed to scan webhook attempt: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to list webhook attempts")
+			return
+		}
+		if body != nil {
+			attempt.ResponseBody = truncate([]byte(*body), maxAttemptResponseBody)
+		}
+		resp.Attempts = append(resp.Attempts, attempt)
+	}
+	if err := rows.Err(); err != nil {
+		logging.Printf("Failed to list webhook attempts for %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list webhook attempts")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// FleetWebhookAttempt is a webhook delivery attempt with the transaction it
+// belongs to, as listed by GET /admin/webhook-attempts
+type FleetWebhookAttempt struct {
+	TransactionID     uuid.UUID `json:"transaction_id"`
+	TransactionStatus string    `json:"transaction_status"`
+	TenantID          *string   `json:"tenant_id,omitempty"`
+	TenantWebhookURL  string    `json:"tenant_webhook_url"`
+	ErrorMessage      *string   `json:"error_message,omitempty"`
+	WebhookAttempt
+}
+
+// ListFleetWebhookAttemptsResponse is the payload for
+// GET /admin/webhook-attempts
+type ListFleetWebhookAttemptsResponse struct {
+	Attempts   []FleetWebhookAttempt `json:"attempts"`
+	NextCursor string                `json:"next_cursor,omitempty"`
+}
+
+// ListFleetWebhookAttempts handles GET /admin/webhook-attempts, listing
+// delivery attempts across all transactions newest first with keyset
+// pagination. success=false narrows it to failed deliveries.
+func (h *Handler) ListFleetWebhookAttempts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(clause, len(args)))
+	}
+
+	if value := q.Get("success"); value != "" {
+		success, err := strconv.ParseBool(value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid success: expected true or false")
+			return
+		}
+		addCondition("a.success = $%d", success)
+	}
+
+	if tenantID := q.Get("tenant_id"); tenantID != "" {
+		addCondition("t.tenant_id = $%d", tenantID)
+	}
+
+	for _, bound := range []struct{ param, clause string }{
+		{"from", "a.attempted_at >= $%d"},
+		{"to", "a.attempted_at < $%d"},
+	} {
+		if value := q.Get(bound.param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid "+bound.param+": expected RFC3339 timestamp")
+				return
+			}
+			addCondition(bound.clause, t)
+		}
+	}
+
+	limit := defaultListLimit
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	if cursor := q.Get("cursor"); cursor != "" {
+		attemptedAt, id, err := decodeAttemptCursor(cursor)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		args = append(args, attemptedAt, id)
+		conditions = append(conditions, fmt.Sprintf("(a.attempted_at, a.id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	query := `
+		SELECT a.id, t.internal_transaction_id, t.status, t.tenant_id, t.tenant_webhook_url,
+		       a.attempt_number, a.webhook_url, COALESCE(a.response_status_code, 0),
+		       COALESCE(a.response_time_ms, 0), a.success, a.response_body, a.error_message, a.attempted_at
+		FROM webhook_attempts a
+		JOIN transactions t ON t.id = a.transaction_id
+	`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// Fetch one extra row to know whether another page exists
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY a.attempted_at DESC, a.id DESC LIMIT $%d", len(args))
+
+	rows, err := h.db.Query(r.Context(), query, args...)
+	if err != nil {
+		logging.Printf("Failed to list webhook attempts: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list webhook attempts")
+		return
+	}
+	defer rows.Close()
+
+	resp := ListFleetWebhookAttemptsResponse{Attempts: []FleetWebhookAttempt{}}
+	var lastID int64
+	for rows.Next() {
+		if len(resp.Attempts) == limit {
+			last := resp.Attempts[limit-1]
+			resp.NextCursor = encodeAttemptCursor(last.AttemptedAt, lastID)
+			break
+		}
+
+		var attempt FleetWebhookAttempt
+		var body *string
+		if err := rows.Scan(
+			&lastID,
+			&attempt.TransactionID,
+			&attempt.TransactionStatus,
+			&attempt.TenantID,
+			&attempt.TenantWebhookURL,
+			&attempt.AttemptNumber,
+			&attempt.WebhookURL,
+			&attempt.StatusCode,
+			&attempt.ResponseTimeMs,
+			&attempt.Success,
+			&body,
+			&attempt.ErrorMessage,
+			&attempt.AttemptedAt,
+		); err != nil {
+			logging.Printf("Failed to scan webhook attempt: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to list webhook attempts")
+			return
+		}
+		if body != nil {
+			attempt.ResponseBody = truncate([]byte(*body), maxAttemptResponseBody)
+		}
+		resp.Attempts = append(resp.Attempts, attempt)
+	}
+	if err := rows.Err(); err != nil {
+		logging.Printf("Failed to list webhook attempts: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list webhook attempts")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// encodeAttemptCursor builds an opaque keyset cursor from the last attempt
+// of a page
+func encodeAttemptCursor(attemptedAt time.Time, id int64) string {
+	raw := attemptedAt.UTC().Format(time.RFC3339Nano) + "," + strconv.FormatInt(id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeAttemptCursor parses a cursor produced by encodeAttemptCursor
+func decodeAttemptCursor(cursor string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	parts := strings.SplitN(string(raw), ",", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("malformed cursor")
+	}
+
+	attemptedAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	return attemptedAt, id, nil
+}
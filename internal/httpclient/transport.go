@@ -0,0 +1,55 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// TLSVersions maps accepted MPESA_TLS_MIN_VERSION values to TLS versions
+var TLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TransportConfig tunes the connection pool of outbound transports
+type TransportConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	MinTLSVersion      uint16            // 0 means TLS 1.2
+	ClientCertificates []tls.Certificate // Presented when the server requests mTLS
+}
+
+// NewTransport returns a pooled transport with TLS 1.2+ (or MinTLSVersion)
+// and certificate verification enforced. Build one per destination class and share it
+// between clients so connections are reused. control, if non-nil, vets
+// every dialled address (see urlguard.Policy.DialControl).
+func NewTransport(cfg TransportConfig, control func(network, address string, c syscall.RawConn) error) *http.Transport {
+	minVersion := cfg.MinTLSVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   control,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig: &tls.Config{
+			MinVersion:   minVersion,
+			Certificates: cfg.ClientCertificates,
+			// InsecureSkipVerify: false (default, enforced SSL verification)
+		},
+	}
+}
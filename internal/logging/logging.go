@@ -0,0 +1,63 @@
+// Package logging wraps the standard logger with optional redaction of
+// customer data. Phone numbers (MSISDNs) are masked in every message while
+// redaction is enabled, which is the default.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync/atomic"
+)
+
+var redactionDisabled atomic.Bool
+
+// SetRedaction turns PII redaction on or off (e.g. off for local development)
+func SetRedaction(enabled bool) {
+	redactionDisabled.Store(!enabled)
+}
+
+// RedactionEnabled reports whether phone numbers are being masked
+func RedactionEnabled() bool {
+	return !redactionDisabled.Load()
+}
+
+// msisdnPattern matches Kenyan mobile numbers as 2547XXXXXXXX, +2547XXXXXXXX
+// or 07XXXXXXXX (and the 1XX ranges)
+var msisdnPattern = regexp.MustCompile(`\+?\b(?:254|0)[17][0-9]{8}\b`)
+
+// MaskPhone hides the four digits before the last four of a phone number
+// (2547****5678, 07****5678)
+func MaskPhone(phone string) string {
+	if len(phone) <= 8 {
+		return "****"
+	}
+	return phone[:len(phone)-8] + "****" + phone[len(phone)-4:]
+}
+
+// Redact masks every phone number in s unless redaction is disabled
+func Redact(s string) string {
+	if redactionDisabled.Load() {
+		return s
+	}
+	return msisdnPattern.ReplaceAllStringFunc(s, MaskPhone)
+}
+
+// Printf formats like log.Printf and redacts the result
+func Printf(format string, v ...interface{}) {
+	log.Output(2, Redact(fmt.Sprintf(format, v...)))
+}
+
+// Println formats like log.Println and redacts the result
+func Println(v ...interface{}) {
+	log.Output(2, Redact(fmt.Sprintln(v...)))
+}
+
+// Logger adapts the redacting logger to interfaces expecting Print, such as
+// chi's request logger
+type Logger struct{}
+
+// Print formats like log.Print and redacts the result
+func (Logger) Print(v ...interface{}) {
+	log.Output(2, Redact(fmt.Sprint(v...)))
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dbConnsTotal = prometheus.NewDesc(
+		"mpesa_db_conns_total",
+		"PostgreSQL connections currently open in the pool.",
+		nil, nil,
+	)
+	dbConnsIdle = prometheus.NewDesc(
+		"mpesa_db_conns_idle",
+		"PostgreSQL connections open and idle in the pool.",
+		nil, nil,
+	)
+	dbConnsAcquired = prometheus.NewDesc(
+		"mpesa_db_conns_acquired",
+		"PostgreSQL connections currently checked out of the pool.",
+		nil, nil,
+	)
+	dbConnsMax = prometheus.NewDesc(
+		"mpesa_db_conns_max",
+		"Maximum size of the PostgreSQL connection pool.",
+		nil, nil,
+	)
+	dbAcquireWait = prometheus.NewDesc(
+		"mpesa_db_acquire_wait_seconds_total",
+		"Total time spent acquiring PostgreSQL connections from the pool.",
+		nil, nil,
+	)
+	dbEmptyAcquires = prometheus.NewDesc(
+		"mpesa_db_empty_acquires_total",
+		"Acquires that had to wait because the pool had no idle connection.",
+		nil, nil,
+	)
+)
+
+// dbPoolCollector reads pool statistics on every scrape
+type dbPoolCollector struct {
+	pool *pgxpool.Pool
+}
+
+// RegisterDBPool exports the pool's connection statistics. Acquired
+// connections near mpesa_db_conns_max, with mpesa_db_empty_acquires_total
+// rising, mean requests are queueing for connections.
+func RegisterDBPool(pool *pgxpool.Pool) {
+	prometheus.MustRegister(dbPoolCollector{pool: pool})
+}
+
+func (c dbPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbConnsTotal
+	ch <- dbConnsIdle
+	ch <- dbConnsAcquired
+	ch <- dbConnsMax
+	ch <- dbAcquireWait
+	ch <- dbEmptyAcquires
+}
+
+func (c dbPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(dbConnsTotal, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(dbConnsIdle, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(dbConnsAcquired, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(dbConnsMax, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(dbAcquireWait, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(dbEmptyAcquires, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Callback processing results for CallbacksProcessed
+const (
+	CallbackCompleted = "completed"
+	CallbackFailed    = "failed"
+	CallbackSkipped   = "skipped"  // Already terminal or processed elsewhere
+	CallbackError     = "error"    // Task returned an error (will be retried)
+	CallbackRejected  = "rejected" // Failed a consistency check and was dropped
+	CallbackDeferred  = "deferred" // Waiting for another callback; retried later
+)
+
+// OAuth token refresh results for TokenRefreshes
+const (
+	TokenRefreshSuccess = "success"
+	TokenRefreshFailure = "failure"
+)
+
+var (
+	// PaymentsInitiated counts STK Push payments successfully initiated
+	PaymentsInitiated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mpesa_payments_initiated_total",
+		Help: "Total number of STK Push payments successfully initiated.",
+	})
+
+	// OrphanedCheckouts counts accepted STK Pushes whose checkout ID could
+	// not be saved; each needs manual reconciliation
+	OrphanedCheckouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mpesa_orphaned_checkouts_total",
+		Help: "Total number of accepted STK Pushes whose checkout ID could not be recorded.",
+	})
+
+	// OrphanedPayouts counts B2C payouts that may have been sent but cannot
+	// be settled by a result; each needs manual reconciliation
+	OrphanedPayouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mpesa_orphaned_payouts_total",
+		Help: "Total number of B2C payouts with an unknown outcome or unrecorded conversation ID.",
+	})
+
+	// CallbackMerchantIDMismatches counts STK callbacks whose
+	// MerchantRequestID differs from the one stored for their checkout
+	CallbackMerchantIDMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mpesa_callback_merchant_id_mismatches_total",
+		Help: "Total number of STK callbacks whose MerchantRequestID did not match the stored one.",
+	})
+
+	// PayoutsInitiated counts B2C payouts accepted by Safaricom
+	PayoutsInitiated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mpesa_payouts_initiated_total",
+		Help: "Total number of B2C payouts successfully initiated.",
+	})
+
+	// STKPushDuration observes Safaricom STK Push API latency
+	STKPushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mpesa_stkpush_duration_seconds",
+		Help:    "Latency of Safaricom STK Push API calls.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// STKPushInFlight tracks STK Push calls holding a MPESA_STK_MAX_IN_FLIGHT slot
+	STKPushInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mpesa_stkpush_in_flight",
+		Help: "STK Push requests currently in flight to Safaricom.",
+	})
+
+	// TokenRefreshes counts Safaricom OAuth token refreshes by result
+	TokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpesa_token_refreshes_total",
+		Help: "Total number of Safaricom OAuth token refreshes, by result.",
+	}, []string{"result"})
+
+	// TokenCacheHits counts token requests served from the cache
+	TokenCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mpesa_token_cache_hits_total",
+		Help: "Total number of Safaricom OAuth token requests served from the cache.",
+	})
+
+	// TokenLastRefresh records when a token was last refreshed successfully
+	TokenLastRefresh = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mpesa_token_last_refresh_timestamp_seconds",
+		Help: "Unix time of the last successful Safaricom OAuth token refresh.",
+	})
+
+	// CallbacksProcessed counts processed callbacks by result
+	CallbacksProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpesa_callbacks_processed_total",
+		Help: "Total number of M-Pesa callbacks processed, by result.",
+	}, []string{"result"})
+
+	// TxCacheLookups counts callback transaction lookups against the
+	// MPESA_TX_CACHE_SIZE cache, by result (hit or miss)
+	TxCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpesa_tx_cache_lookups_total",
+		Help: "Total number of cached transaction lookups by CheckoutRequestID, by result.",
+	}, []string{"result"})
+
+	// WebhookAttempts counts tenant webhook delivery attempts by outcome
+	WebhookAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpesa_webhook_attempts_total",
+		Help: "Total number of tenant webhook delivery attempts, by success.",
+	}, []string{"success"})
+
+	// WebhookInFlight tracks webhook deliveries in progress per host, as
+	// limited by MPESA_WEBHOOK_MAX_PER_HOST
+	WebhookInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mpesa_webhook_in_flight",
+		Help: "Tenant webhook deliveries currently in flight, by host.",
+	}, []string{"host"})
+
+	// WebhookDeliveryDuration observes tenant webhook response latency
+	WebhookDeliveryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mpesa_webhook_delivery_duration_seconds",
+		Help:    "Latency of tenant webhook delivery attempts.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// Handler returns the HTTP handler serving the Prometheus registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
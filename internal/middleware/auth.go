@@ -1,19 +1,65 @@
 package middleware
 
 import (
+	"context"
 	"crypto/subtle"
 	"net/http"
+
+	"github.com/mpesa-gateway/internal/apikey"
 )
 
-// EnsureInternalAuth validates the X-Internal-Secret header
-func EnsureInternalAuth(secret string) func(http.Handler) http.Handler {
+// tenantKey is the context key for the tenant an API key is pinned to
+type tenantKey struct{}
+
+// apiKeyIDKey is the context key for the ID of the API key that
+// authenticated the request
+type apiKeyIDKey struct{}
+
+// AuthenticatedTenant returns the tenant the request's API key is pinned to.
+// ok is false for the internal secret and unpinned keys, which may act for
+// any tenant.
+func AuthenticatedTenant(ctx context.Context) (tenantID string, ok bool) {
+	tenantID, ok = ctx.Value(tenantKey{}).(string)
+	return tenantID, ok
+}
+
+// EnsureAuth accepts either the shared X-Internal-Secret (when secret is
+// set) or an X-API-Key from keys (when keys is non-nil). A key pinned to a
+// tenant sets X-Tenant-ID and the AuthenticatedTenant, is refused if the
+// caller sent a different one, and is only accepted when allowTenantKeys is
+// true.
+func EnsureAuth(secret string, keys *apikey.Store, allowTenantKeys bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			providedSecret := r.Header.Get("X-Internal-Secret")
+			if keys != nil {
+				if providedKey := r.Header.Get("X-API-Key"); providedKey != "" {
+					key, ok := keys.Authenticate(providedKey)
+					if !ok {
+						writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Invalid API key")
+						return
+					}
+					if key.TenantID != "" {
+						if !allowTenantKeys {
+							writeError(w, http.StatusForbidden, CodeForbidden, "API keys pinned to a tenant cannot use this endpoint")
+							return
+						}
+						if tenant := r.Header.Get("X-Tenant-ID"); tenant != "" && tenant != key.TenantID {
+							writeError(w, http.StatusForbidden, CodeForbidden, "X-Tenant-ID does not match the API key's tenant")
+							return
+						}
+						r.Header.Set("X-Tenant-ID", key.TenantID)
+						r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, key.TenantID))
+					}
+					r = r.WithContext(context.WithValue(r.Context(), apiKeyIDKey{}, key.ID))
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
 
 			// Constant-time comparison to prevent timing attacks
-			if subtle.ConstantTimeCompare([]byte(providedSecret), []byte(secret)) != 1 {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			providedSecret := r.Header.Get("X-Internal-Secret")
+			if secret == "" || subtle.ConstantTimeCompare([]byte(providedSecret), []byte(secret)) != 1 {
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid credentials")
 				return
 			}
 
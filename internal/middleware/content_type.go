@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+)
+
+// RequireJSON rejects requests whose Content-Type is not application/json
+// with 415 Unsupported Media Type. With allowMissing set, requests without a
+// Content-Type pass through for senders that omit it (Safaricom); handlers
+// still reject bodies that are not valid JSON.
+func RequireJSON(allowMissing bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType := r.Header.Get("Content-Type")
+			if contentType == "" && allowMissing {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Parameters such as charset=utf-8 are allowed
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Content-Type must be application/json")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
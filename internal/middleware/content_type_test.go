@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowMissing bool
+		contentType  string
+		wantStatus   int
+	}{
+		{"JSON", false, "application/json", http.StatusOK},
+		{"JSON with charset", false, "application/json; charset=utf-8", http.StatusOK},
+		{"JSON in upper case", false, "Application/JSON", http.StatusOK},
+		{"missing", false, "", http.StatusUnsupportedMediaType},
+		{"form", false, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"text", false, "text/plain", http.StatusUnsupportedMediaType},
+		{"malformed", false, "application/json;;", http.StatusUnsupportedMediaType},
+
+		{"missing allowed", true, "", http.StatusOK},
+		{"JSON with missing allowed", true, "application/json", http.StatusOK},
+		{"wrong type with missing allowed", true, "text/plain", http.StatusUnsupportedMediaType},
+		{"malformed with missing allowed", true, "application/json;;", http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := RequireJSON(tt.allowMissing)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/initiate", strings.NewReader("{}"))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code != http.StatusUnsupportedMediaType {
+				return
+			}
+
+			var body struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("decode error response: %v", err)
+			}
+			if body.Code != CodeUnsupportedMediaType {
+				t.Errorf("code = %q, want %q", body.Code, CodeUnsupportedMediaType)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import "net/http"
+
+// envelopeWriter marks a response to be written in the {"data","error"}
+// envelope. It passes Flush through so streamed exports keep working.
+type envelopeWriter struct {
+	http.ResponseWriter
+}
+
+func (e envelopeWriter) Flush() {
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (e envelopeWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// Envelope is middleware that makes JSON responses, including the errors of
+// middleware registered after it, wrap their body in
+// {"data": ..., "error": ...}. Routes without it keep the bare objects
+// existing integrations expect.
+func Envelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(envelopeWriter{w}, r)
+	})
+}
+
+// Enveloped reports whether w was wrapped by Envelope
+func Enveloped(w http.ResponseWriter) bool {
+	_, ok := w.(envelopeWriter)
+	return ok
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Codes of the errors returned before a request reaches its handler. They
+// join the handlers' codes in the same {"error": ..., "code": ...} body.
+const (
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeForbidden            = "FORBIDDEN"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+)
+
+// envelopedError is the body of a rejection under Envelope, matching the
+// handlers' {"data": null, "error": {...}}
+type envelopedError struct {
+	Data  interface{} `json:"data"`
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeError rejects a request with a JSON error body and a stable code,
+// enveloped when the route is
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	var body interface{} = map[string]string{"error": message, "code": code}
+	if Enveloped(w) {
+		var e envelopedError
+		e.Error.Code, e.Error.Message = code, message
+		body = e
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
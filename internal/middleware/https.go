@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RequireHTTPS rejects requests that did not arrive over HTTPS with 403 and
+// sets Strict-Transport-Security on the rest (hstsMaxAge seconds; 0 omits
+// it). Behind a proxy that terminates TLS, X-Forwarded-Proto is only
+// honoured when the direct peer is one of trustedProxies.
+func RequireHTTPS(trustedProxies []string, hstsMaxAge int) func(http.Handler) http.Handler {
+	trusted := parseIPNets(trustedProxies)
+	hsts := "max-age=" + strconv.Itoa(hstsMaxAge)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isHTTPS(r, trusted) {
+				writeError(w, http.StatusForbidden, CodeForbidden, "HTTPS required")
+				return
+			}
+
+			if hstsMaxAge > 0 {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isHTTPS reports whether the request reached us, or the trusted proxy in
+// front of us, over TLS
+func isHTTPS(r *http.Request, trusted []*net.IPNet) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	remote := parseIP(r.RemoteAddr)
+	if remote == nil || !containsIP(trusted, remote) {
+		return false
+	}
+
+	// Proxies that append rather than overwrite produce a list; the last
+	// entry was set by the proxy we trust
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if i := strings.LastIndexByte(proto, ','); i >= 0 {
+		proto = proto[i+1:]
+	}
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
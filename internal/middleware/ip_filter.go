@@ -6,16 +6,27 @@ import (
 	"strings"
 )
 
-// IPFilter creates a middleware that validates source IP against an allowlist
-func IPFilter(allowedIPs []string) func(http.Handler) http.Handler {
+// IPFilter creates a middleware that validates source IP against an allowlist.
+// Forwarding headers are only honoured when the direct peer is one of
+// trustedProxies; otherwise the connection's own address is checked.
+func IPFilter(allowedIPs, trustedProxies []string) func(http.Handler) http.Handler {
+	allowed := parseIPNets(allowedIPs)
+	trusted := parseIPNets(trustedProxies)
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Extract real IP from headers or remote address
-			clientIP := getRealIP(r)
+			// Empty allowlist = allow all (for development)
+			if len(allowedIPs) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Extract real IP from trusted headers or remote address
+			clientIP := getRealIP(r, trusted)
 
 			// Check if IP is in allowlist
-			if !isIPAllowed(clientIP, allowedIPs) {
-				http.Error(w, "Forbidden: Source IP not allowed", http.StatusForbidden)
+			if !isIPAllowed(clientIP, allowed) {
+				writeError(w, http.StatusForbidden, CodeForbidden, "Source IP not allowed")
 				return
 			}
 
@@ -24,54 +35,93 @@ func IPFilter(allowedIPs []string) func(http.Handler) http.Handler {
 	}
 }
 
-// getRealIP extracts the real client IP from request
-func getRealIP(r *http.Request) string {
-	// Check X-Real-IP first (set by nginx, etc.)
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+// getRealIP extracts the client IP from request. X-Forwarded-For and
+// X-Real-IP are only consulted when RemoteAddr is a trusted proxy, since any
+// client can set them.
+func getRealIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	remote := parseIP(r.RemoteAddr)
+	if remote == nil || !containsIP(trusted, remote) {
+		return remote
 	}
 
-	// Check X-Forwarded-For (may contain chain of IPs)
+	// Walk X-Forwarded-For from the right: the last entry was appended by
+	// our proxy, so the first untrusted hop is the real client
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP in the chain
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseIP(hops[i])
+			if ip == nil {
+				return nil
+			}
+			if !containsIP(trusted, ip) {
+				return ip
+			}
 		}
 	}
 
-	// Fall back to RemoteAddr
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
+	// Check X-Real-IP (set by nginx, etc.)
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip
+	}
+
+	// Request came straight from the proxy
+	return remote
 }
 
 // isIPAllowed checks if client IP is in the allowlist
-func isIPAllowed(clientIP string, allowedIPs []string) bool {
-	// Empty allowlist = allow all (for development)
-	if len(allowedIPs) == 0 {
-		return true
-	}
-
-	ip := net.ParseIP(clientIP)
-	if ip == nil {
+func isIPAllowed(clientIP net.IP, allowed []*net.IPNet) bool {
+	if clientIP == nil {
 		return false
 	}
+	return containsIP(allowed, clientIP)
+}
 
-	for _, allowed := range allowedIPs {
-		// Check if allowed is a CIDR range
-		if strings.Contains(allowed, "/") {
-			_, ipNet, err := net.ParseCIDR(allowed)
-			if err == nil && ipNet.Contains(ip) {
-				return true
-			}
-		} else {
-			// Direct IP comparison
-			allowedIP := net.ParseIP(allowed)
-			if allowedIP != nil && ip.Equal(allowedIP) {
-				return true
+// parseIPNets parses IPs and CIDR ranges (IPv4 or IPv6). Single IPs become
+// host-sized networks; invalid entries are skipped (config validates them).
+func parseIPNets(entries []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+				nets = append(nets, ipNet)
 			}
+			continue
+		}
+
+		ip := parseIP(entry)
+		if ip == nil {
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 8*net.IPv4len
 		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
 	}
+	return nets
+}
 
+// containsIP reports whether ip falls within any of nets. IPv4-mapped IPv6
+// addresses match their IPv4 form.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
 	return false
 }
+
+// parseIP parses an address with optional port, brackets or IPv6 zone
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	return net.ParseIP(addr)
+}
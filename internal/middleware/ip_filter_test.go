@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	allowed := []string{"196.201.214.200", "196.201.213.0/24", "2001:db8::/32"}
+	trusted := []string{"10.0.0.0/8"}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		xRealIP    string
+		wantStatus int
+	}{
+		{"allowed peer", "196.201.214.200:443", "", "", http.StatusOK},
+		{"allowed peer in CIDR", "196.201.213.17:443", "", "", http.StatusOK},
+		{"allowed IPv6 peer", "[2001:db8::1]:443", "", "", http.StatusOK},
+		{"unlisted peer", "203.0.113.5:443", "", "", http.StatusForbidden},
+
+		// Untrusted peers cannot claim an allowed address
+		{"spoofed X-Forwarded-For from untrusted peer", "203.0.113.5:443", "196.201.214.200", "", http.StatusForbidden},
+		{"spoofed X-Real-IP from untrusted peer", "203.0.113.5:443", "", "196.201.214.200", http.StatusForbidden},
+		{"allowed peer with unlisted X-Forwarded-For", "196.201.214.200:443", "203.0.113.5", "", http.StatusOK},
+
+		// Behind a trusted proxy the first untrusted hop from the right counts
+		{"trusted proxy forwarding allowed client", "10.1.2.3:443", "196.201.214.200", "", http.StatusOK},
+		{"trusted proxy forwarding unlisted client", "10.1.2.3:443", "203.0.113.5", "", http.StatusForbidden},
+		{"client-prepended hop ignored", "10.1.2.3:443", "196.201.214.200, 203.0.113.5", "", http.StatusForbidden},
+		{"chain of trusted proxies", "10.1.2.3:443", "196.201.214.200, 10.9.9.9", "", http.StatusOK},
+		{"malformed hop", "10.1.2.3:443", "not-an-ip", "", http.StatusForbidden},
+		{"trusted proxy with X-Real-IP", "10.1.2.3:443", "", "196.201.214.200", http.StatusOK},
+		{"trusted proxy without forwarding headers", "10.1.2.3:443", "", "", http.StatusForbidden},
+	}
+
+	filter := IPFilter(allowed, trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/callback", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xRealIP != "" {
+				req.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+
+			rec := httptest.NewRecorder()
+			filter.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestIPFilterEmptyAllowlist(t *testing.T) {
+	filter := IPFilter(nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/callback", nil)
+	req.RemoteAddr = "203.0.113.5:443"
+	rec := httptest.NewRecorder()
+	filter.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d with no allowlist", rec.Code, http.StatusOK)
+	}
+}
+
+func TestGetRealIP(t *testing.T) {
+	trusted := parseIPNets([]string{"10.0.0.0/8", "::1"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		xRealIP    string
+		want       string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.5:1234", "196.201.214.200", "196.201.214.206", "203.0.113.5"},
+		{"trusted peer uses rightmost untrusted hop", "10.0.0.1:1234", "1.1.1.1, 196.201.214.200, 10.0.0.2", "", "196.201.214.200"},
+		{"trusted peer falls back to X-Real-IP", "10.0.0.1:1234", "", "196.201.214.206", "196.201.214.206"},
+		{"trusted IPv6 loopback peer", "[::1]:1234", "196.201.214.200", "", "196.201.214.200"},
+		{"zoned IPv6 peer", "[fe80::1%eth0]:1234", "", "", "fe80::1"},
+		{"peer without port", "203.0.113.5", "", "", "203.0.113.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/callback", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xRealIP != "" {
+				req.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+
+			if got := getRealIP(req, trusted); got.String() != tt.want {
+				t.Errorf("getRealIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/mpesa-gateway/internal/logging"
+)
+
+// tokenBucketScript refills the bucket by elapsed time, then takes one token.
+// Returns {allowed, wait_ms}. Running it in Redis keeps the limit shared
+// across API replicas.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+
+return {allowed, wait}
+`)
+
+// RateLimiter is a per-caller token bucket of requests, shared across API
+// replicas through Redis. A nil *RateLimiter allows everything.
+type RateLimiter struct {
+	client redis.UniversalClient
+	rate   float64 // Tokens per millisecond
+	burst  int
+}
+
+// NewRateLimiter creates a limiter of perMinute requests with the given
+// burst. It returns nil, disabling limiting, when perMinute is not positive.
+func NewRateLimiter(client redis.UniversalClient, perMinute, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &RateLimiter{client: client, rate: float64(perMinute) / 60000, burst: burst}
+}
+
+// Allow takes one token from the caller's bucket, returning how long to
+// wait when none is left. It must run after EnsureAuth: see
+// rateLimitBucket. Redis errors fail open so a Redis outage does not block
+// payments.
+func (l *RateLimiter) Allow(ctx context.Context) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	allowed, wait, err := takeToken(ctx, l.client, "ratelimit:initiate:"+rateLimitBucket(ctx), l.rate, l.burst)
+	if err != nil {
+		logging.Printf("Rate limiter unavailable, allowing request: %v", err)
+		return true, 0
+	}
+	return allowed, wait
+}
+
+// RetryAfter formats a wait returned by Allow for the Retry-After header
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// RateLimit creates a middleware taking one token from l per request
+func RateLimit(l *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowed, wait := l.Allow(r.Context()); !allowed {
+				w.Header().Set("Retry-After", RetryAfter(wait))
+				writeError(w, http.StatusTooManyRequests, CodeRateLimited, "Rate limit exceeded, retry later")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitBucket names the bucket a request draws from. Only authenticated
+// identities are used, never caller-supplied headers, so a caller cannot
+// get a fresh bucket by changing X-Tenant-ID and the keys stay bounded.
+// Tenant-pinned keys share their tenant's bucket, other API keys get one
+// each, and internal-secret callers share the default bucket.
+func rateLimitBucket(ctx context.Context) string {
+	if tenantID, ok := AuthenticatedTenant(ctx); ok {
+		return "tenant:" + tenantID
+	}
+	if keyID, ok := ctx.Value(apiKeyIDKey{}).(int64); ok {
+		return "key:" + strconv.FormatInt(keyID, 10)
+	}
+	return "default"
+}
+
+// takeToken runs the token bucket script for key
+func takeToken(ctx context.Context, client redis.UniversalClient, key string, rate float64, burst int) (bool, time.Duration, error) {
+	res, err := tokenBucketScript.Run(ctx, client, []string{key},
+		rate*1000, burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
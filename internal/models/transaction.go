@@ -9,22 +9,36 @@ import (
 
 // Transaction represents a payment transaction record
 type Transaction struct {
-	ID                    uuid.UUID       `db:"id"`
-	InternalTransactionID uuid.UUID       `db:"internal_transaction_id"`
-	IdempotencyKey        uuid.UUID       `db:"idempotency_key"`
-	CheckoutRequestID     *string         `db:"checkout_request_id"`
-	MerchantRequestID     *string         `db:"merchant_request_id"`
-	Amount                decimal.Decimal `db:"amount"`
-	Phone                 string          `db:"phone"`
-	Status                string          `db:"status"`
-	MpesaMetadata         []byte          `db:"mpesa_metadata"` // JSONB
-	TenantWebhookURL      string          `db:"tenant_webhook_url"`
-	ErrorMessage          *string         `db:"error_message"`
-	CreatedAt             time.Time       `db:"created_at"`
-	UpdatedAt             time.Time       `db:"updated_at"`
-	CompletedAt           *time.Time      `db:"completed_at"`
+	ID                    uuid.UUID        `db:"id"`
+	InternalTransactionID uuid.UUID        `db:"internal_transaction_id"`
+	IdempotencyKey        *uuid.UUID       `db:"idempotency_key"` // NULL once past retention
+	CheckoutRequestID     *string          `db:"checkout_request_id"`
+	MerchantRequestID     *string          `db:"merchant_request_id"`
+	ConversationID        *string          `db:"conversation_id"` // B2C only
+	Direction             string           `db:"direction"`
+	Amount                decimal.Decimal  `db:"amount"`           // Charged amount, after the amount policy
+	RequestedAmount       *decimal.Decimal `db:"requested_amount"` // Set only when the policy rounded the request
+	Phone                 string           `db:"phone"`
+	Status                string           `db:"status"`
+	MpesaMetadata         []byte           `db:"mpesa_metadata"` // JSONB
+	MpesaReceiptNumber    *string          `db:"mpesa_receipt_number"`
+	TenantWebhookURL      string           `db:"tenant_webhook_url"`
+	WebhookSecret         *string          `db:"webhook_secret"`
+	TenantID              *string          `db:"tenant_id"`
+	CallbackURL           *string          `db:"callback_url"` // STK Push CallBackURL; NULL before migration 011
+	RequestID             *string          `db:"request_id"`   // X-Request-ID of the originating API request
+	ErrorMessage          *string          `db:"error_message"`
+	CreatedAt             time.Time        `db:"created_at"`
+	UpdatedAt             time.Time        `db:"updated_at"`
+	CompletedAt           *time.Time       `db:"completed_at"`
 }
 
+// Transaction directions
+const (
+	DirectionC2B = "C2B" // Collection from a customer (STK Push or C2B confirmation)
+	DirectionB2C = "B2C" // Payout to a customer
+)
+
 // TransactionStatus represents valid transaction states
 type TransactionStatus string
 
@@ -32,15 +46,17 @@ const (
 	StatusPending   TransactionStatus = "PENDING"
 	StatusCompleted TransactionStatus = "COMPLETED"
 	StatusFailed    TransactionStatus = "FAILED"
+	StatusExpired   TransactionStatus = "EXPIRED" // Customer never answered the STK prompt
 )
 
 // IsValidTransition checks if a status transition is allowed
 func IsValidTransition(from, to TransactionStatus) bool {
 	validTransitions := map[TransactionStatus][]TransactionStatus{
-		StatusPending: {StatusCompleted, StatusFailed},
+		StatusPending: {StatusCompleted, StatusFailed, StatusExpired},
 		// No transitions allowed from terminal states
 		StatusCompleted: {},
 		StatusFailed:    {},
+		StatusExpired:   {},
 	}
 
 	allowed, exists := validTransitions[from]
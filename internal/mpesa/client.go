@@ -0,0 +1,302 @@
+package mpesa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrorCodeStillProcessing is returned by the STK query API while the
+// customer has not yet responded to the prompt
+const ErrorCodeStillProcessing = "500.001.1001"
+
+// Endpoints holds the Safaricom API URLs a Client calls
+type Endpoints struct {
+	Auth        string
+	STKPush     string
+	STKQuery    string
+	B2C         string
+	C2BRegister string
+}
+
+// ClientConfig configures a Client
+type ClientConfig struct {
+	Endpoints Endpoints
+
+	// HTTPClient sends every request; its Transport is shared with the
+	// token services built by NewTokenService
+	HTTPClient *http.Client
+
+	RequestTimeout time.Duration // Deadline for each STK Push / STK Query / B2C call
+	TokenTimeout   time.Duration // Deadline for each OAuth token attempt
+
+	// TokenRefreshBuffer is how long before Safaricom's expiry a token is
+	// refreshed, clamped to half the token's lifetime
+	TokenRefreshBuffer time.Duration
+}
+
+// Client performs Safaricom API calls. It holds no credentials: callers pass
+// the access token of the credential set the call is made for, so one Client
+// serves every tenant.
+type Client struct {
+	endpoints      Endpoints
+	httpClient     *http.Client
+	requestTimeout time.Duration
+	tokenTimeout   time.Duration
+	tokenBuffer    time.Duration
+}
+
+// NewClient creates a new Safaricom API client
+func NewClient(cfg ClientConfig) *Client {
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	return &Client{
+		endpoints:      cfg.Endpoints,
+		httpClient:     httpClient,
+		requestTimeout: cfg.RequestTimeout,
+		tokenTimeout:   cfg.TokenTimeout,
+		tokenBuffer:    cfg.TokenRefreshBuffer,
+	}
+}
+
+// NewTokenService creates a token service for a credential set using the
+// client's auth endpoint and transport
+func (c *Client) NewTokenService(consumerKey, consumerSecret string) *TokenService {
+	return NewTokenService(consumerKey, consumerSecret, c.endpoints.Auth, c.httpClient.Transport, c.tokenTimeout, c.tokenBuffer)
+}
+
+// APIError is a non-200 Safaricom response
+type APIError struct {
+	Operation  string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s failed with status %d: %s", e.Operation, e.StatusCode, e.Body)
+}
+
+// IsServerError reports whether err means Safaricom is unhealthy: a transport
+// failure or a 5xx response. Business rejections and rate limits are not.
+func IsServerError(err error) bool {
+	if err == nil || errors.Is(err, ErrRateLimited) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// STKPushRequest represents Safaricom STK Push API request
+type STKPushRequest struct {
+	BusinessShortCode string `json:"BusinessShortCode"`
+	Password          string `json:"Password"`
+	Timestamp         string `json:"Timestamp"`
+	TransactionType   string `json:"TransactionType"`
+	Amount            string `json:"Amount"`
+	PartyA            string `json:"PartyA"`
+	PartyB            string `json:"PartyB"`
+	PhoneNumber       string `json:"PhoneNumber"`
+	CallBackURL       string `json:"CallBackURL"`
+	AccountReference  string `json:"AccountReference"`
+	TransactionDesc   string `json:"TransactionDesc"`
+}
+
+// STKPushResponse represents Safaricom STK Push API response
+type STKPushResponse struct {
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	CustomerMessage     string `json:"CustomerMessage"`
+
+	Raw []byte `json:"-"` // Body as received, for debug logging
+}
+
+// STKQueryRequest represents Safaricom STK Push Query API request
+type STKQueryRequest struct {
+	BusinessShortCode string `json:"BusinessShortCode"`
+	Password          string `json:"Password"`
+	Timestamp         string `json:"Timestamp"`
+	CheckoutRequestID string `json:"CheckoutRequestID"`
+}
+
+// STKQueryResponse represents Safaricom STK Push Query API response
+type STKQueryResponse struct {
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResultCode          string `json:"ResultCode"`
+	ResultDesc          string `json:"ResultDesc"`
+	ErrorCode           string `json:"errorCode"`
+	ErrorMessage        string `json:"errorMessage"`
+}
+
+// B2CRequest represents Safaricom B2C payment request
+type B2CRequest struct {
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	InitiatorName            string `json:"InitiatorName"`
+	SecurityCredential       string `json:"SecurityCredential"`
+	CommandID                string `json:"CommandID"`
+	Amount                   string `json:"Amount"`
+	PartyA                   string `json:"PartyA"`
+	PartyB                   string `json:"PartyB"`
+	Remarks                  string `json:"Remarks"`
+	QueueTimeOutURL          string `json:"QueueTimeOutURL"`
+	ResultURL                string `json:"ResultURL"`
+	Occasion                 string `json:"Occasion"`
+}
+
+// B2CResponse represents Safaricom B2C synchronous acknowledgement
+type B2CResponse struct {
+	ConversationID           string `json:"ConversationID"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ResponseCode             string `json:"ResponseCode"`
+	ResponseDescription      string `json:"ResponseDescription"`
+	ErrorCode                string `json:"errorCode"`
+	ErrorMessage             string `json:"errorMessage"`
+}
+
+// C2BRegisterURLRequest represents Safaricom C2B URL registration request
+type C2BRegisterURLRequest struct {
+	ShortCode       string `json:"ShortCode"`
+	ResponseType    string `json:"ResponseType"` // Applied when ValidationURL is unreachable
+	ConfirmationURL string `json:"ConfirmationURL"`
+	ValidationURL   string `json:"ValidationURL"`
+}
+
+// C2BRegisterURLResponse represents Safaricom C2B URL registration response
+type C2BRegisterURLResponse struct {
+	OriginatorConversationID string `json:"OriginatorCoversationID"` // Misspelt by Safaricom
+	ResponseCode             string `json:"ResponseCode"`
+	ResponseDescription      string `json:"ResponseDescription"`
+}
+
+// STKPush sends an STK Push request. A decoded response is returned for any
+// 200, including business rejections (non-zero ResponseCode).
+func (c *Client) STKPush(ctx context.Context, token string, req STKPushRequest) (*STKPushResponse, error) {
+	status, body, err := c.post(ctx, "STK Push", c.endpoints.STKPush, token, req)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, &APIError{Operation: "STK Push", StatusCode: status, Body: string(body)}
+	}
+
+	var resp STKPushResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	resp.Raw = body
+	return &resp, nil
+}
+
+// STKQuery asks for the result of an STK Push. Safaricom reports "still
+// processing" as a non-200 carrying ErrorCodeStillProcessing; that response
+// is returned without an error.
+func (c *Client) STKQuery(ctx context.Context, token string, req STKQueryRequest) (*STKQueryResponse, error) {
+	status, body, err := c.post(ctx, "STK query", c.endpoints.STKQuery, token, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp STKQueryResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, &APIError{Operation: "STK query", StatusCode: status, Body: string(body)}
+	}
+	if status != http.StatusOK && resp.ErrorCode != ErrorCodeStillProcessing {
+		return nil, &APIError{Operation: "STK query", StatusCode: status, Body: string(body)}
+	}
+	return &resp, nil
+}
+
+// B2C sends a B2C payment request. The result arrives asynchronously on the
+// request's ResultURL.
+func (c *Client) B2C(ctx context.Context, token string, req B2CRequest) (*B2CResponse, error) {
+	status, body, err := c.post(ctx, "B2C request", c.endpoints.B2C, token, req)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, &APIError{Operation: "B2C request", StatusCode: status, Body: string(body)}
+	}
+
+	var resp B2CResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &resp, nil
+}
+
+// RegisterC2BURLs registers the validation and confirmation URLs Safaricom
+// calls for payments made directly to a short code
+func (c *Client) RegisterC2BURLs(ctx context.Context, token string, req C2BRegisterURLRequest) (*C2BRegisterURLResponse, error) {
+	status, body, err := c.post(ctx, "C2B URL registration", c.endpoints.C2BRegister, token, req)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, &APIError{Operation: "C2B URL registration", StatusCode: status, Body: string(body)}
+	}
+
+	var resp C2BRegisterURLResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &resp, nil
+}
+
+// post sends payload as JSON with a bearer token and returns the status and
+// body. 429 responses are returned as a RateLimitError.
+func (c *Client) post(ctx context.Context, operation, url, token string, payload interface{}) (int, []byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to marshal %s request: %w", operation, err)
+	}
+
+	if c.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to send %s: %w", operation, err)
+	}
+	defer resp.Body.Close()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return resp.StatusCode, nil, NewRateLimitError(resp.Header)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return resp.StatusCode, respBody, nil
+}
@@ -0,0 +1,78 @@
+package mpesa
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a Client whose STK Push endpoint is handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return NewClient(ClientConfig{
+		Endpoints:      Endpoints{STKPush: srv.URL},
+		RequestTimeout: 5 * time.Second,
+	})
+}
+
+func TestSTKPushRateLimited(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{"delay-seconds", "30", 30 * time.Second},
+		{"HTTP date", time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat), 2 * time.Minute},
+		{"absent", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte(`{"errorCode":"429.001.01","errorMessage":"Too Many Requests"}`))
+			})
+
+			resp, err := client.STKPush(context.Background(), "token", STKPushRequest{})
+			if resp != nil {
+				t.Errorf("STKPush() response = %+v, want nil", resp)
+			}
+			if !errors.Is(err, ErrRateLimited) {
+				t.Fatalf("STKPush() error = %v, want ErrRateLimited", err)
+			}
+			var rateLimited *RateLimitError
+			if !errors.As(err, &rateLimited) {
+				t.Fatalf("STKPush() error = %T, want *RateLimitError", err)
+			}
+			// HTTP dates have one-second resolution
+			if diff := rateLimited.RetryAfter - tt.want; diff < -time.Second || diff > time.Second {
+				t.Errorf("RetryAfter = %s, want %s", rateLimited.RetryAfter, tt.want)
+			}
+			if IsServerError(err) {
+				t.Error("IsServerError() = true, want a rate limit not to count towards the breaker")
+			}
+		})
+	}
+}
+
+func TestSTKPushServerErrorCountsTowardsBreaker(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	_, err := client.STKPush(context.Background(), "token", STKPushRequest{})
+	if errors.Is(err, ErrRateLimited) {
+		t.Fatalf("STKPush() error = %v, want a non rate limit error", err)
+	}
+	if !IsServerError(err) {
+		t.Errorf("IsServerError(%v) = false, want true for a 503", err)
+	}
+}
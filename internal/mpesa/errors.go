@@ -0,0 +1,59 @@
+package mpesa
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRateLimited matches any RateLimitError via errors.Is
+var ErrRateLimited = errors.New("safaricom rate limited")
+
+// RateLimitError is returned when Safaricom responds with HTTP 429
+type RateLimitError struct {
+	RetryAfter time.Duration // Suggested delay from Retry-After; zero if absent
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (retry after %s)", ErrRateLimited, e.RetryAfter)
+	}
+	return ErrRateLimited.Error()
+}
+
+// Is reports whether target is ErrRateLimited
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// NewRateLimitError builds a RateLimitError from a 429 response's headers
+func NewRateLimitError(header http.Header) *RateLimitError {
+	return &RateLimitError{RetryAfter: ParseRetryAfter(header.Get("Retry-After"))}
+}
+
+// ParseRetryAfter parses a Retry-After value given as delay-seconds or an
+// HTTP date. It returns zero when the value is absent or invalid.
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d.Round(time.Second)
+		}
+	}
+
+	return 0
+}
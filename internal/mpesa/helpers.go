@@ -1,5 +1,22 @@
 package mpesa
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Safaricom STK Push transaction types
+const (
+	TransactionTypePayBill  = "CustomerPayBillOnline"  // Paybill number
+	TransactionTypeBuyGoods = "CustomerBuyGoodsOnline" // Till number
+)
+
+// IsValidTransactionType reports whether t is a supported STK Push transaction type
+func IsValidTransactionType(t string) bool {
+	return t == TransactionTypePayBill || t == TransactionTypeBuyGoods
+}
+
 // Item represents a key-value pair from M-Pesa callback metadata
 type Item struct {
 	Name  string      `json:"Name"`
@@ -18,3 +35,123 @@ func ParseMpesaMetadata(items []Item) map[string]interface{} {
 	}
 	return result
 }
+
+// ResultParameter represents a key-value pair from a B2C result
+type ResultParameter struct {
+	Key   string      `json:"Key"`
+	Value interface{} `json:"Value"`
+}
+
+// ParseResultParameters converts a B2C ResultParameter array to a map
+func ParseResultParameters(params []ResultParameter) map[string]interface{} {
+	result := make(map[string]interface{}, len(params))
+	for _, p := range params {
+		if p.Key != "" {
+			result[p.Key] = p.Value
+		}
+	}
+	return result
+}
+
+// ReceiptNumber returns the M-Pesa receipt from parsed callback or B2C result
+// metadata, or nil when there is none (e.g. failed payments)
+func ReceiptNumber(metadata map[string]interface{}) *string {
+	for _, key := range []string{"MpesaReceiptNumber", "TransactionReceipt"} {
+		if receipt, ok := metadata[key].(string); ok && receipt != "" {
+			return &receipt
+		}
+	}
+	return nil
+}
+
+// Maximum lengths Safaricom accepts on STK Push requests
+const (
+	AccountReferenceMaxLen = 12
+	TransactionDescMaxLen  = 13
+)
+
+// disallowedReferenceChars matches characters Safaricom rejects in
+// AccountReference and TransactionDesc
+var disallowedReferenceChars = regexp.MustCompile(`[^A-Za-z0-9 _.-]`)
+
+// SanitizeReference strips characters Safaricom rejects and truncates s to
+// maxLen. truncated reports whether characters were cut off the end.
+func SanitizeReference(s string, maxLen int) (sanitized string, truncated bool) {
+	sanitized = strings.TrimSpace(disallowedReferenceChars.ReplaceAllString(s, ""))
+	if len(sanitized) > maxLen {
+		return strings.TrimSpace(sanitized[:maxLen]), true
+	}
+	return sanitized, false
+}
+
+// Placeholders a TransactionDesc template may contain
+const (
+	DescPlaceholderRef    = "{ref}"    // The AccountReference sent with the STK Push
+	DescPlaceholderAmount = "{amount}" // The amount charged
+)
+
+// ValidateDescTemplate reports whether tmpl uses only the {ref} and {amount}
+// placeholders, has no stray braces, and leaves room for every placeholder
+// within TransactionDescMaxLen. A placeholder whose fixed text before it
+// already fills the limit would always be cut off.
+func ValidateDescTemplate(tmpl string) error {
+	rest := tmpl
+	// Shortest possible rendered length so far: the fixed text that
+	// survives sanitizing plus one character per placeholder
+	minLen := 0
+	for {
+		i := strings.IndexAny(rest, "{}")
+		if i < 0 {
+			return nil
+		}
+		if rest[i] == '}' {
+			return fmt.Errorf("unmatched '}' in %q", tmpl)
+		}
+		end := strings.IndexByte(rest[i:], '}')
+		if end < 0 {
+			return fmt.Errorf("unmatched '{' in %q", tmpl)
+		}
+		placeholder := rest[i : i+end+1]
+		if placeholder != DescPlaceholderRef && placeholder != DescPlaceholderAmount {
+			return fmt.Errorf("unknown placeholder %s in %q (use %s or %s)", placeholder, tmpl, DescPlaceholderRef, DescPlaceholderAmount)
+		}
+		minLen += len(disallowedReferenceChars.ReplaceAllString(rest[:i], ""))
+		if minLen >= TransactionDescMaxLen {
+			return fmt.Errorf("placeholder %s in %q starts after Safaricom's %d-character TransactionDesc limit and would always be cut off", placeholder, tmpl, TransactionDescMaxLen)
+		}
+		minLen++
+		rest = rest[i+end+1:]
+	}
+}
+
+// RenderDescTemplate substitutes ref and amount into a template that passed
+// ValidateDescTemplate, then sanitizes and truncates the result to
+// TransactionDescMaxLen
+func RenderDescTemplate(tmpl, ref, amount string) string {
+	desc := strings.NewReplacer(DescPlaceholderRef, ref, DescPlaceholderAmount, amount).Replace(tmpl)
+	desc, _ = SanitizeReference(desc, TransactionDescMaxLen)
+	return desc
+}
+
+// msisdnPattern matches a canonical Safaricom MSISDN (2547XXXXXXXX or 2541XXXXXXXX)
+var msisdnPattern = regexp.MustCompile(`^254[17][0-9]{8}$`)
+
+// NormalizePhone converts 07XXXXXXXX, +2547XXXXXXXX and 2547XXXXXXXX into the
+// canonical 2547XXXXXXXX form Safaricom expects
+func NormalizePhone(phone string) (string, error) {
+	p := strings.TrimSpace(phone)
+	p = strings.NewReplacer(" ", "", "-", "").Replace(p)
+
+	switch {
+	case strings.HasPrefix(p, "+254"):
+		p = p[1:]
+	case strings.HasPrefix(p, "0") && len(p) == 10:
+		p = "254" + p[1:]
+	}
+
+	if !msisdnPattern.MatchString(p) {
+		return "", fmt.Errorf("invalid phone number %q", phone)
+	}
+
+	return p, nil
+}
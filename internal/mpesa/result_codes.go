@@ -0,0 +1,86 @@
+package mpesa
+
+import "encoding/json"
+
+// FailureReason is a stable, machine-readable category for a failed STK
+// payment. Tenants should branch on it rather than on ResultDesc, whose
+// wording Safaricom changes.
+type FailureReason string
+
+const (
+	FailureInsufficientFunds FailureReason = "insufficient_funds"
+	FailureAmountOutOfRange  FailureReason = "amount_out_of_range"
+	FailureLimitExceeded     FailureReason = "limit_exceeded"
+	FailureSubscriberBusy    FailureReason = "subscriber_busy"
+	FailureExpired           FailureReason = "expired"
+	FailureUserCancelled     FailureReason = "user_cancelled"
+	FailureTimeout           FailureReason = "timeout"
+	FailureInvalidPIN        FailureReason = "invalid_pin"
+	FailureProviderError     FailureReason = "provider_error"
+	FailureUnknown           FailureReason = "unknown"
+)
+
+// resultCodeReasons maps documented STK callback ResultCodes to reasons
+var resultCodeReasons = map[int]FailureReason{
+	1:    FailureInsufficientFunds, // Balance insufficient
+	2:    FailureAmountOutOfRange,  // Less than minimum transaction value
+	3:    FailureAmountOutOfRange,  // More than maximum transaction value
+	4:    FailureLimitExceeded,     // Would exceed daily transfer limit
+	8:    FailureLimitExceeded,     // Would exceed maximum balance
+	1001: FailureSubscriberBusy,    // Another transaction in progress for the subscriber
+	1019: FailureExpired,           // Transaction expired
+	1025: FailureProviderError,     // Error sending push request
+	1032: FailureUserCancelled,     // Request cancelled by user
+	1037: FailureTimeout,           // DS timeout, user cannot be reached
+	2001: FailureInvalidPIN,        // Wrong PIN / invalid initiator information
+	9999: FailureProviderError,     // Error sending push request
+}
+
+// Failure describes why a payment failed, in mapped and raw form
+type Failure struct {
+	Reason     FailureReason `json:"failure_reason"`
+	ResultCode int           `json:"result_code"`
+	ResultDesc string        `json:"result_desc"`
+}
+
+// ClassifyResultCode maps a non-zero STK ResultCode to a FailureReason
+func ClassifyResultCode(code int) FailureReason {
+	if reason, ok := resultCodeReasons[code]; ok {
+		return reason
+	}
+	return FailureUnknown
+}
+
+// IsExpiry reports whether the failure means the prompt went unanswered
+// rather than being declined
+func (f *Failure) IsExpiry() bool {
+	return f.Reason == FailureTimeout || f.Reason == FailureExpired
+}
+
+// NewFailure builds a Failure from a callback's ResultCode and ResultDesc
+func NewFailure(code int, desc string) *Failure {
+	return &Failure{
+		Reason:     ClassifyResultCode(code),
+		ResultCode: code,
+		ResultDesc: desc,
+	}
+}
+
+// MetadataFailureKey is the mpesa_metadata key holding a failed result's
+// classified Failure
+const MetadataFailureKey = "failure"
+
+// MetadataJSON encodes the mpesa_metadata stored for a result. A failure is
+// always stored under MetadataFailureKey next to the parsed items, since
+// failed B2C results still carry a TransactionID and other metadata.
+func MetadataJSON(metadata map[string]interface{}, failure *Failure) ([]byte, error) {
+	if failure == nil {
+		return json.Marshal(metadata)
+	}
+	merged := make(map[string]interface{}, len(metadata)+1)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	merged[MetadataFailureKey] = failure
+	return json.Marshal(merged)
+}
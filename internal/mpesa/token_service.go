@@ -2,14 +2,19 @@ package mpesa
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/mpesa-gateway/internal/metrics"
 )
 
 // TokenService manages Safaricom OAuth tokens with thread-safe access
@@ -17,35 +22,84 @@ type TokenService struct {
 	consumerKey    string
 	consumerSecret string
 	authURL        string
+	requestTimeout time.Duration
+	refreshBuffer  time.Duration
 	client         *http.Client
 
-	mu          sync.RWMutex
-	token       string
-	expiresAt   time.Time
-	refreshOnce sync.Once
+	mu        sync.RWMutex
+	token     string
+	expiresAt time.Time
+	lifetime  time.Duration // Usable lifetime of the cached token, expiresAt minus fetch time
+
+	// refreshSlot admits one refresh at a time. It is separate from mu so
+	// the OAuth request and its backoff never hold the token lock.
+	refreshSlot chan struct{}
+
+	// Refresh counters are written under mu; cache hits happen under the
+	// read lock and so are atomic
+	refreshes           uint64
+	failures            uint64
+	consecutiveFailures int
+	lastRefreshAt       time.Time
+	cacheHits           atomic.Uint64
+}
+
+// TokenStats is a snapshot of a TokenService's refresh history
+type TokenStats struct {
+	Refreshes           uint64    // Successful refreshes
+	Failures            uint64    // Failed refreshes, after retries
+	CacheHits           uint64    // GetToken calls served from the cache
+	ConsecutiveFailures int       // Failed refreshes since the last success
+	LastRefreshAt       time.Time // Zero until the first successful refresh
+}
+
+// Degraded reports whether refreshes have failed often enough in a row that
+// payments will start failing once the cached token expires
+func (s TokenStats) Degraded() bool {
+	return s.ConsecutiveFailures >= tokenDegradedAfter
 }
 
+const (
+	// autoRefreshAhead is how long before expiresAt the background refresh runs
+	autoRefreshAhead = time.Minute
+	// autoRefreshRetry is the delay before retrying a failed background refresh
+	autoRefreshRetry = 10 * time.Second
+
+	// tokenMaxAttempts bounds OAuth requests per refresh
+	tokenMaxAttempts = 3
+	// tokenRetryBase is the initial backoff between OAuth attempts
+	tokenRetryBase = 500 * time.Millisecond
+	// tokenMaxRetryWait caps a Retry-After wait between OAuth attempts; a
+	// longer Retry-After fails the refresh
+	tokenMaxRetryWait = 10 * time.Second
+
+	// tokenDegradedAfter is the number of consecutive failed refreshes after
+	// which TokenStats.Degraded reports true
+	tokenDegradedAfter = 3
+)
+
 // TokenResponse represents Safaricom OAuth response
 type TokenResponse struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   string `json:"expires_in"` // Duration in seconds as string
 }
 
-// NewTokenService creates a new token service with SSL verification enforced
-func NewTokenService(consumerKey, consumerSecret, authURL string) *TokenService {
+// NewTokenService creates a new token service. transport is shared with the
+// other Safaricom clients and enforces SSL verification. Each OAuth request is
+// bounded by requestTimeout. Tokens are treated as expired refreshBuffer
+// before Safaricom's expiry, or halfway through their lifetime if that is
+// sooner.
+func NewTokenService(consumerKey, consumerSecret, authURL string, transport http.RoundTripper, requestTimeout, refreshBuffer time.Duration) *TokenService {
 	return &TokenService{
 		consumerKey:    consumerKey,
 		consumerSecret: consumerSecret,
 		authURL:        authURL,
+		requestTimeout: requestTimeout,
+		refreshBuffer:  refreshBuffer,
 		client: &http.Client{
-			Timeout: 15 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					MinVersion: tls.VersionTLS12,
-					// InsecureSkipVerify: false (default, enforced SSL verification)
-				},
-			},
+			Transport: transport,
 		},
+		refreshSlot: make(chan struct{}, 1),
 	}
 }
 
@@ -56,6 +110,7 @@ func (ts *TokenService) GetToken(ctx context.Context) (string, error) {
 	if time.Now().Before(ts.expiresAt) && ts.token != "" {
 		token := ts.token
 		ts.mu.RUnlock()
+		ts.recordCacheHit()
 		return token, nil
 	}
 	ts.mu.RUnlock()
@@ -64,14 +119,80 @@ func (ts *TokenService) GetToken(ctx context.Context) (string, error) {
 	return ts.refreshTokenSafe(ctx)
 }
 
-// refreshTokenSafe ensures only one goroutine refreshes the token at a time
+// StartAutoRefresh refreshes the token in the background shortly before it
+// expires, keeping GetToken on its fast path. It returns immediately; the
+// goroutine stops when ctx is cancelled.
+func (ts *TokenService) StartAutoRefresh(ctx context.Context) {
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			wait := autoRefreshRetry
+			if err := ts.refreshAhead(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Background token refresh failed: %v", err)
+			} else {
+				ts.mu.RLock()
+				wait = time.Until(ts.expiresAt) - ts.refreshAheadWindow()
+				ts.mu.RUnlock()
+			}
+
+			timer.Reset(max(wait, 0))
+		}
+	}()
+}
+
+// refreshAhead refreshes the token if it expires within refreshAheadWindow.
+// Holding the refresh slot serialises it with on-demand refreshes.
+func (ts *TokenService) refreshAhead(ctx context.Context) error {
+	if err := ts.acquireRefresh(ctx); err != nil {
+		return err
+	}
+	defer ts.releaseRefresh()
+
+	// Another goroutine may have refreshed already
+	ts.mu.RLock()
+	fresh := ts.token != "" && time.Until(ts.expiresAt) > ts.refreshAheadWindow()
+	ts.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	return ts.refreshToken(ctx)
+}
+
+// refreshAheadWindow is how long before expiresAt the background refresh
+// runs: autoRefreshAhead, or half the token's lifetime for short-lived
+// tokens so a fresh token is never immediately due for refresh again
+// (caller must hold the lock)
+func (ts *TokenService) refreshAheadWindow() time.Duration {
+	return min(autoRefreshAhead, ts.lifetime/2)
+}
+
+// refreshTokenSafe ensures only one goroutine refreshes the token at a time.
+// Callers waiting for another refresh give up when their context ends.
 func (ts *TokenService) refreshTokenSafe(ctx context.Context) (string, error) {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
+	if err := ts.acquireRefresh(ctx); err != nil {
+		return "", err
+	}
+	defer ts.releaseRefresh()
 
-	// Double-check after acquiring write lock (another goroutine may have refreshed)
-	if time.Now().Before(ts.expiresAt) && ts.token != "" {
-		return ts.token, nil
+	// Double-check after acquiring the slot (another goroutine may have refreshed)
+	ts.mu.RLock()
+	token, valid := ts.token, time.Now().Before(ts.expiresAt) && ts.token != ""
+	ts.mu.RUnlock()
+	if valid {
+		ts.recordCacheHit()
+		return token, nil
 	}
 
 	// Perform actual refresh
@@ -79,14 +200,145 @@ func (ts *TokenService) refreshTokenSafe(ctx context.Context) (string, error) {
 		return "", err
 	}
 
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
 	return ts.token, nil
 }
 
-// refreshToken fetches a new token from Safaricom (caller must hold write lock)
+// acquireRefresh waits for the refresh slot or the end of ctx
+func (ts *TokenService) acquireRefresh(ctx context.Context) error {
+	select {
+	case ts.refreshSlot <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ts *TokenService) releaseRefresh() {
+	<-ts.refreshSlot
+}
+
+// Stats returns a snapshot of the refresh counters
+func (ts *TokenService) Stats() TokenStats {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return TokenStats{
+		Refreshes:           ts.refreshes,
+		Failures:            ts.failures,
+		CacheHits:           ts.cacheHits.Load(),
+		ConsecutiveFailures: ts.consecutiveFailures,
+		LastRefreshAt:       ts.lastRefreshAt,
+	}
+}
+
+func (ts *TokenService) recordCacheHit() {
+	ts.cacheHits.Add(1)
+	metrics.TokenCacheHits.Inc()
+}
+
+// refreshToken fetches a new token and stores it with the outcome (caller
+// must hold the refresh slot). The write lock is only taken once the fetch
+// is done. Cancellation by the caller is not counted as a failure.
 func (ts *TokenService) refreshToken(ctx context.Context) error {
+	tokenResp, err := ts.fetchToken(ctx)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		ts.failures++
+		ts.consecutiveFailures++
+		metrics.TokenRefreshes.WithLabelValues(metrics.TokenRefreshFailure).Inc()
+		return err
+	}
+
+	// Parse expiry (Safaricom returns seconds as string, typically "3599")
+	expiresIn := 3599 * time.Second // Default to ~1 hour
+	if tokenResp.ExpiresIn != "" {
+		var seconds int
+		if _, err := fmt.Sscanf(tokenResp.ExpiresIn, "%d", &seconds); err == nil && seconds > 0 {
+			expiresIn = time.Duration(seconds) * time.Second
+		}
+	}
+
+	ts.token = tokenResp.AccessToken
+	ts.lifetime = tokenLifetime(expiresIn, ts.refreshBuffer)
+	ts.expiresAt = time.Now().Add(ts.lifetime)
+
+	ts.refreshes++
+	ts.consecutiveFailures = 0
+	ts.lastRefreshAt = time.Now()
+	metrics.TokenRefreshes.WithLabelValues(metrics.TokenRefreshSuccess).Inc()
+	metrics.TokenLastRefresh.SetToCurrentTime()
+	return nil
+}
+
+// fetchToken fetches a new token from Safaricom. Network errors and 5xx/429
+// responses are retried with jittered backoff. A Retry-After longer than
+// tokenMaxRetryWait or the time left before ctx's deadline ends the retries
+// with the rate limit error.
+func (ts *TokenService) fetchToken(ctx context.Context) (*TokenResponse, error) {
+	var tokenResp *TokenResponse
+	var err error
+
+	for attempt := 1; attempt <= tokenMaxAttempts; attempt++ {
+		var retryable bool
+		attemptCtx, cancel := context.WithTimeout(ctx, ts.requestTimeout)
+		tokenResp, retryable, err = ts.requestToken(attemptCtx)
+		cancel()
+		// A per-attempt timeout is retryable; cancellation of ctx is not
+		if err == nil || !retryable || attempt == tokenMaxAttempts || ctx.Err() != nil {
+			break
+		}
+
+		// Exponential backoff with jitter, or Safaricom's Retry-After when
+		// rate limited, bounded by the context deadline
+		backoff := tokenRetryBase << (attempt - 1)
+		wait := time.Duration(rand.Int63n(int64(backoff))) + backoff/2
+		var rateLimited *RateLimitError
+		if errors.As(err, &rateLimited) && rateLimited.RetryAfter > wait {
+			wait = rateLimited.RetryAfter
+		}
+		limit := tokenMaxRetryWait
+		if deadline, ok := ctx.Deadline(); ok {
+			limit = min(limit, time.Until(deadline))
+		}
+		if wait > limit {
+			break
+		}
+
+		log.Printf("Token request attempt %d/%d failed, retrying in %s: %v", attempt, tokenMaxAttempts, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return tokenResp, err
+}
+
+// tokenLifetime is how long a token valid for expiresIn is used before being
+// refreshed. The buffer is clamped to half of expiresIn, so a token shorter
+// than the buffer still gets a lifetime in the future instead of triggering a
+// refresh on every call.
+func tokenLifetime(expiresIn, buffer time.Duration) time.Duration {
+	return expiresIn - min(buffer, expiresIn/2)
+}
+
+// requestToken performs a single OAuth request. The bool reports whether a
+// failure is transient and worth retrying.
+func (ts *TokenService) requestToken(ctx context.Context) (*TokenResponse, bool, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.authURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create auth request: %w", err)
+		return nil, false, fmt.Errorf("failed to create auth request: %w", err)
 	}
 
 	// Set Basic Auth header
@@ -97,36 +349,38 @@ func (ts *TokenService) refreshToken(ctx context.Context) error {
 
 	resp, err := ts.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to request token: %w", err)
+		return nil, true, fmt.Errorf("failed to request token: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, true, NewRateLimitError(resp.Header)
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
+		retryable := resp.StatusCode >= http.StatusInternalServerError
+		return nil, retryable, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
 	var tokenResp TokenResponse
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return fmt.Errorf("failed to decode token response: %w", err)
+		return nil, false, fmt.Errorf("failed to decode token response: %w", err)
 	}
 
 	if tokenResp.AccessToken == "" {
-		return fmt.Errorf("received empty access token")
-	}
-
-	// Parse expiry (Safaricom returns seconds as string, typically "3599")
-	expiresIn := 3599 * time.Second // Default to ~1 hour
-	if tokenResp.ExpiresIn != "" {
-		var seconds int
-		if _, err := fmt.Sscanf(tokenResp.ExpiresIn, "%d", &seconds); err == nil {
-			expiresIn = time.Duration(seconds) * time.Second
-		}
+		return nil, false, fmt.Errorf("received empty access token")
 	}
 
-	// Store token with buffer time (refresh 5 minutes before actual expiry)
-	ts.token = tokenResp.AccessToken
-	ts.expiresAt = time.Now().Add(expiresIn - 5*time.Minute)
+	return &tokenResp, false, nil
+}
 
-	return nil
+// NewStaticTokenService returns a TokenService that always serves token and
+// never contacts Safaricom, for simulation mode
+func NewStaticTokenService(token string) *TokenService {
+	return &TokenService{
+		token:       token,
+		expiresAt:   time.Now().AddDate(100, 0, 0),
+		refreshSlot: make(chan struct{}, 1),
+	}
 }
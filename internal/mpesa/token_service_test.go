@@ -0,0 +1,203 @@
+package mpesa
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rateLimitedAuthServer answers the first OAuth request with 429 and
+// retryAfter, and later ones with a token
+func rateLimitedAuthServer(t *testing.T, retryAfter string, firstRequest chan<- struct{}) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			if firstRequest != nil {
+				close(firstRequest)
+			}
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"fresh-token","expires_in":"3599"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestGetTokenHonoursRetryAfter(t *testing.T) {
+	srv, calls := rateLimitedAuthServer(t, "1", nil)
+	ts := NewTokenService("key", "secret", srv.URL, http.DefaultTransport, 5*time.Second, 0)
+
+	start := time.Now()
+	token, err := ts.GetToken(context.Background())
+	if err != nil {
+		t.Fatalf("GetToken() error = %v", err)
+	}
+	if token != "fresh-token" {
+		t.Errorf("GetToken() = %q, want %q", token, "fresh-token")
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("OAuth requests = %d, want 2", got)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("GetToken() retried after %s, want at least the 1s Retry-After", elapsed)
+	}
+}
+
+func TestGetTokenRetryAfterBeyondDeadline(t *testing.T) {
+	srv, calls := rateLimitedAuthServer(t, "120", nil)
+	ts := NewTokenService("key", "secret", srv.URL, http.DefaultTransport, 5*time.Second, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := ts.GetToken(ctx)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("GetToken() error = %v, want ErrRateLimited", err)
+	}
+	var rateLimited *RateLimitError
+	if !errors.As(err, &rateLimited) || rateLimited.RetryAfter != 120*time.Second {
+		t.Errorf("GetToken() error = %v, want RetryAfter 2m0s", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("OAuth requests = %d, want 1", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetToken() took %s, want it to give up instead of waiting", elapsed)
+	}
+}
+
+func TestGetTokenRetryAfterCappedWithoutDeadline(t *testing.T) {
+	srv, calls := rateLimitedAuthServer(t, "3600", nil)
+	ts := NewTokenService("key", "secret", srv.URL, http.DefaultTransport, 5*time.Second, 0)
+
+	_, err := ts.GetToken(context.Background())
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("GetToken() error = %v, want ErrRateLimited", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("OAuth requests = %d, want 1", got)
+	}
+	if stats := ts.Stats(); stats.Failures != 1 {
+		t.Errorf("Stats().Failures = %d, want 1", stats.Failures)
+	}
+}
+
+func TestRetryAfterWaitDoesNotHoldTokenLock(t *testing.T) {
+	firstRequest := make(chan struct{})
+	srv, _ := rateLimitedAuthServer(t, "1", firstRequest)
+	ts := NewTokenService("key", "secret", srv.URL, http.DefaultTransport, 5*time.Second, 0)
+
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := ts.GetToken(context.Background())
+		refreshed <- err
+	}()
+	<-firstRequest
+
+	// Stats takes the read lock; it must not wait out the Retry-After
+	statsDone := make(chan struct{})
+	go func() {
+		ts.Stats()
+		close(statsDone)
+	}()
+	select {
+	case <-statsDone:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Stats() blocked while a refresh waited out Retry-After")
+	}
+
+	// A second caller waiting on the refresh gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := ts.GetToken(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("concurrent GetToken() error = %v, want context.DeadlineExceeded", err)
+	}
+
+	if err := <-refreshed; err != nil {
+		t.Fatalf("GetToken() error = %v", err)
+	}
+}
+
+func TestTokenLifetime(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		buffer    time.Duration
+		want      time.Duration
+	}{
+		{"typical token", 3599 * time.Second, 60 * time.Second, 3539 * time.Second},
+		{"no buffer", 3599 * time.Second, 0, 3599 * time.Second},
+		{"buffer longer than the token", 30 * time.Second, 60 * time.Second, 15 * time.Second},
+		{"buffer equal to the token", 60 * time.Second, 60 * time.Second, 30 * time.Second},
+		{"one second token", time.Second, 60 * time.Second, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tokenLifetime(tt.expiresIn, tt.buffer)
+			if got != tt.want {
+				t.Errorf("tokenLifetime(%s, %s) = %s, want %s", tt.expiresIn, tt.buffer, got, tt.want)
+			}
+			if got <= 0 {
+				t.Errorf("tokenLifetime(%s, %s) = %s, want a lifetime in the future", tt.expiresIn, tt.buffer, got)
+			}
+		})
+	}
+}
+
+func TestRefreshAheadWindow(t *testing.T) {
+	tests := []struct {
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{3539 * time.Second, autoRefreshAhead},
+		{2 * autoRefreshAhead, autoRefreshAhead},
+		{15 * time.Second, 7500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		ts := &TokenService{lifetime: tt.lifetime}
+		if got := ts.refreshAheadWindow(); got != tt.want {
+			t.Errorf("refreshAheadWindow() with lifetime %s = %s, want %s", tt.lifetime, got, tt.want)
+		}
+	}
+}
+
+func TestShortLivedTokenIsCached(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"short-token","expires_in":"30"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	// expires_in is below the 60s refresh buffer
+	ts := NewTokenService("key", "secret", srv.URL, http.DefaultTransport, 5*time.Second, 60*time.Second)
+
+	for i := 0; i < 5; i++ {
+		if _, err := ts.GetToken(context.Background()); err != nil {
+			t.Fatalf("GetToken() error = %v", err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("OAuth requests after 5 GetToken calls = %d, want 1", got)
+	}
+
+	// Nor is a freshly fetched token already due for a background refresh
+	if err := ts.refreshAhead(context.Background()); err != nil {
+		t.Fatalf("refreshAhead() error = %v", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("OAuth requests after refreshAhead = %d, want 1", got)
+	}
+}
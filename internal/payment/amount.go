@@ -0,0 +1,83 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// ErrFractionalAmount is returned when an amount has more decimal places
+// than the AmountPolicy allows and the policy is to reject it
+var ErrFractionalAmount = errors.New("amount has a fractional part the provider cannot charge")
+
+// AmountRounding selects how amounts with unsupported decimal places are handled
+type AmountRounding string
+
+const (
+	AmountRoundingReject AmountRounding = "reject"  // Refuse the request
+	AmountRoundingFloor  AmountRounding = "floor"   // Round down, never overcharging the customer
+	AmountRoundingHalfUp AmountRounding = "half_up" // Round to nearest, halves away from zero
+)
+
+// AmountPolicy describes how request amounts map to the amount actually
+// charged. The zero value rejects anything but whole shillings, which is
+// what Safaricom accepts.
+type AmountPolicy struct {
+	Rounding   AmountRounding
+	MinorUnits bool // Allow cents (two decimal places) through to the provider
+}
+
+// places is the number of decimal places the provider is sent
+func (p AmountPolicy) places() int32 {
+	if p.MinorUnits {
+		return 2
+	}
+	return 0
+}
+
+// Apply returns the amount that will be charged for a requested amount.
+// An amount that would round down to nothing is rejected whatever the mode.
+func (p AmountPolicy) Apply(amount decimal.Decimal) (decimal.Decimal, error) {
+	places := p.places()
+	var charged decimal.Decimal
+	switch p.Rounding {
+	case AmountRoundingFloor:
+		charged = amount.RoundFloor(places)
+	case AmountRoundingHalfUp:
+		charged = amount.Round(places)
+	case AmountRoundingReject, "":
+		charged = amount.Truncate(places)
+		if !charged.Equal(amount) {
+			return decimal.Decimal{}, ErrFractionalAmount
+		}
+	default:
+		return decimal.Decimal{}, fmt.Errorf("unknown amount rounding %q", p.Rounding)
+	}
+
+	if amount.IsPositive() && !charged.IsPositive() {
+		return decimal.Decimal{}, ErrFractionalAmount
+	}
+	return charged, nil
+}
+
+// Format renders a charged amount the way it is sent to Safaricom
+func (p AmountPolicy) Format(amount decimal.Decimal) string {
+	return amount.StringFixed(p.places())
+}
+
+// applyAmountPolicy replaces amount with the amount to charge. It returns
+// the original when the policy changed it, for the requested_amount column.
+func (s *Service) applyAmountPolicy(amount *decimal.Decimal) (*decimal.Decimal, error) {
+	charged, err := s.cfg.AmountPolicy.Apply(*amount)
+	if err != nil {
+		return nil, err
+	}
+	if charged.Equal(*amount) {
+		return nil, nil
+	}
+
+	requested := *amount
+	*amount = charged
+	return &requested, nil
+}
@@ -0,0 +1,70 @@
+package payment
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestAmountPolicyApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  AmountPolicy
+		amount  string
+		want    string
+		wantErr error
+	}{
+		{"zero value rejects cents", AmountPolicy{}, "10.50", "", ErrFractionalAmount},
+		{"zero value accepts whole shillings", AmountPolicy{}, "10", "10", nil},
+		{"reject accepts trailing zeros", AmountPolicy{Rounding: AmountRoundingReject}, "10.00", "10", nil},
+		{"reject refuses cents", AmountPolicy{Rounding: AmountRoundingReject}, "10.01", "", ErrFractionalAmount},
+		{"reject with minor units allows cents", AmountPolicy{Rounding: AmountRoundingReject, MinorUnits: true}, "10.25", "10.25", nil},
+		{"reject with minor units refuses a third place", AmountPolicy{Rounding: AmountRoundingReject, MinorUnits: true}, "10.255", "", ErrFractionalAmount},
+
+		{"floor rounds down", AmountPolicy{Rounding: AmountRoundingFloor}, "10.99", "10", nil},
+		{"floor leaves whole amounts", AmountPolicy{Rounding: AmountRoundingFloor}, "10", "10", nil},
+		{"floor with minor units", AmountPolicy{Rounding: AmountRoundingFloor, MinorUnits: true}, "10.259", "10.25", nil},
+		{"floor to nothing is rejected", AmountPolicy{Rounding: AmountRoundingFloor}, "0.99", "", ErrFractionalAmount},
+
+		{"half_up rounds a half up", AmountPolicy{Rounding: AmountRoundingHalfUp}, "10.5", "11", nil},
+		{"half_up rounds below a half down", AmountPolicy{Rounding: AmountRoundingHalfUp}, "10.49", "10", nil},
+		{"half_up with minor units", AmountPolicy{Rounding: AmountRoundingHalfUp, MinorUnits: true}, "10.255", "10.26", nil},
+		{"half_up to nothing is rejected", AmountPolicy{Rounding: AmountRoundingHalfUp}, "0.4", "", ErrFractionalAmount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.Apply(decimal.RequireFromString(tt.amount))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Apply(%s) error = %v, want %v", tt.amount, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply(%s) error = %v", tt.amount, err)
+			}
+			if !got.Equal(decimal.RequireFromString(tt.want)) {
+				t.Errorf("Apply(%s) = %s, want %s", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmountPolicyApplyUnknownRounding(t *testing.T) {
+	_, err := AmountPolicy{Rounding: "ceil"}.Apply(decimal.NewFromInt(10))
+	if err == nil || errors.Is(err, ErrFractionalAmount) {
+		t.Errorf("Apply() with an unknown rounding error = %v, want a configuration error", err)
+	}
+}
+
+func TestAmountPolicyFormat(t *testing.T) {
+	amount := decimal.RequireFromString("10.5")
+	if got := (AmountPolicy{}).Format(amount.Round(0)); got != "11" {
+		t.Errorf("Format() = %q, want %q", got, "11")
+	}
+	if got := (AmountPolicy{MinorUnits: true}).Format(amount); got != "10.50" {
+		t.Errorf("Format() with minor units = %q, want %q", got, "10.50")
+	}
+}
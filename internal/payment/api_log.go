@@ -0,0 +1,76 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/mpesa"
+)
+
+// apiOperationSTKPush is the mpesa_api_logs operation for STK Push calls
+const apiOperationSTKPush = "stk_push"
+
+// redactedPassword replaces the STK Push Password in mpesa_api_logs
+const redactedPassword = "[REDACTED]"
+
+// logSTKPush records an STK Push call in mpesa_api_logs for debugging
+// rejections. The Password is redacted, and the phone numbers are masked
+// while MPESA_LOG_REDACT_PII is on; the response is stored as Safaricom sent
+// it. Failures are only logged, since the call has already happened.
+func (s *Service) logSTKPush(ctx context.Context, transactionID, tenantID string, req mpesa.STKPushRequest, resp *mpesa.STKPushResponse, callErr error, elapsed time.Duration) {
+	req.Password = redactedPassword
+	if logging.RedactionEnabled() {
+		req.PartyA = logging.MaskPhone(req.PartyA)
+		req.PhoneNumber = logging.MaskPhone(req.PhoneNumber)
+	}
+	request, err := json.Marshal(req)
+	if err != nil {
+		logging.Printf("Failed to marshal STK Push request for API log of %s: %v", transactionID, err)
+		return
+	}
+
+	var statusCode *int
+	var body, errorMsg *string
+	var apiErr *mpesa.APIError
+	var rateLimited *mpesa.RateLimitError
+	switch {
+	case resp != nil:
+		status := http.StatusOK
+		raw := string(resp.Raw)
+		if raw == "" {
+			encoded, _ := json.Marshal(resp)
+			raw = string(encoded)
+		}
+		statusCode, body = &status, &raw
+	case errors.As(callErr, &apiErr):
+		statusCode, body = &apiErr.StatusCode, &apiErr.Body
+	case errors.As(callErr, &rateLimited):
+		status := http.StatusTooManyRequests
+		statusCode = &status
+	}
+	if callErr != nil {
+		msg := callErr.Error()
+		errorMsg = &msg
+	}
+
+	var tenant *string
+	if tenantID != "" {
+		tenant = &tenantID
+	}
+
+	// The client may have gone away; the log is still wanted
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), resultWriteTimeout)
+	defer cancel()
+
+	_, err = s.db.Exec(writeCtx, `
+		INSERT INTO mpesa_api_logs (transaction_id, tenant_id, operation, request, status_code, response, error_message, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, transactionID, tenant, apiOperationSTKPush, request, statusCode, body, errorMsg, elapsed.Milliseconds())
+	if err != nil {
+		logging.Printf("Failed to write API log for %s: %v", transactionID, err)
+	}
+}
@@ -0,0 +1,102 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrC2BDisabled is returned when no C2B confirmation URL is configured
+var ErrC2BDisabled = errors.New("C2B URL registration is not configured")
+
+// ErrC2BRegistrationRejected is returned when Safaricom refuses to register
+// the C2B URLs, e.g. because they are already registered for the short code
+var ErrC2BRegistrationRejected = errors.New("C2B URL registration rejected by Safaricom")
+
+// C2BConfig holds the URLs registered for payments made directly to a
+// paybill or till, outside STK Push
+type C2BConfig struct {
+	ShortCode       string
+	ValidationURL   string // Optional; Safaricom only calls it when external validation is enabled
+	ConfirmationURL string
+	ResponseType    string // Completed or Cancelled when ValidationURL is unreachable
+}
+
+// Enabled reports whether enough is configured to register C2B URLs
+func (c C2BConfig) Enabled() bool {
+	return c.ConfirmationURL != ""
+}
+
+// C2BRegistration is the outcome of RegisterC2BURLs
+type C2BRegistration struct {
+	ShortCode                string `json:"short_code"`
+	ValidationURL            string `json:"validation_url"`
+	ConfirmationURL          string `json:"confirmation_url"`
+	ResponseType             string `json:"response_type"`
+	OriginatorConversationID string `json:"originator_conversation_id"`
+	ResponseDescription      string `json:"response_description"`
+}
+
+// RegisterC2BURLs registers the configured validation and confirmation URLs
+// with Safaricom using the default credential set
+func (s *Service) RegisterC2BURLs(ctx context.Context) (_ *C2BRegistration, err error) {
+	cfg := s.cfg.C2B
+	ctx, span := tracing.Tracer().Start(ctx, "safaricom.c2b_register", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("mpesa.short_code", cfg.ShortCode)))
+	defer func() { tracing.End(span, err) }()
+
+	if !cfg.Enabled() {
+		return nil, ErrC2BDisabled
+	}
+
+	creds, err := s.credentials.Get("")
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := creds.Tokens.GetToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenUnavailable, err)
+	}
+
+	// Safaricom rejects an empty ValidationURL; the confirmation URL is a
+	// harmless stand-in since validation is off unless Safaricom enables it
+	validationURL := cfg.ValidationURL
+	if validationURL == "" {
+		validationURL = cfg.ConfirmationURL
+	}
+
+	req := mpesa.C2BRegisterURLRequest{
+		ShortCode:       cfg.ShortCode,
+		ResponseType:    cfg.ResponseType,
+		ConfirmationURL: cfg.ConfirmationURL,
+		ValidationURL:   validationURL,
+	}
+	resp, err := s.api.RegisterC2BURLs(ctx, token, req)
+	if err != nil {
+		var apiErr *mpesa.APIError
+		if errors.As(err, &apiErr) && !mpesa.IsServerError(err) {
+			return nil, fmt.Errorf("%w: %w", ErrC2BRegistrationRejected, err)
+		}
+		return nil, err
+	}
+	// Success is "0", or "00000000" on some Safaricom deployments
+	if resp.ResponseCode == "" || strings.Trim(resp.ResponseCode, "0") != "" {
+		return nil, fmt.Errorf("%w: %s", ErrC2BRegistrationRejected, resp.ResponseDescription)
+	}
+
+	return &C2BRegistration{
+		ShortCode:                req.ShortCode,
+		ValidationURL:            req.ValidationURL,
+		ConfirmationURL:          req.ConfirmationURL,
+		ResponseType:             req.ResponseType,
+		OriginatorConversationID: resp.OriginatorConversationID,
+		ResponseDescription:      resp.ResponseDescription,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mpesa-gateway/internal/mpesa"
+)
+
+// ErrUnknownTenant is returned when no credential set exists for a tenant
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// Credentials is one merchant's Safaricom credential set
+type Credentials struct {
+	ShortCode       string
+	TillNumber      string // PartyB for Buy Goods; defaults to ShortCode
+	TransactionType string // Default STK transaction type (PayBill if empty)
+	Passkey         string
+	CallbackURL     string // STK Push CallBackURL; defaults to PaymentConfig.CallbackURL
+	DescTemplate    string // STK TransactionDesc template using {ref} and {amount}; "Payment" if empty
+	Tokens          *mpesa.TokenService
+}
+
+// CredentialStore resolves Safaricom credentials per tenant. Requests without
+// a tenant ID use the default credential set.
+type CredentialStore struct {
+	defaultCreds *Credentials
+	tenants      map[string]*Credentials
+}
+
+// NewCredentialStore creates a store with the given default credential set
+func NewCredentialStore(defaultCreds *Credentials) *CredentialStore {
+	return &CredentialStore{
+		defaultCreds: defaultCreds,
+		tenants:      make(map[string]*Credentials),
+	}
+}
+
+// Add registers a tenant's credential set. It is not safe to call
+// concurrently with Get and is intended for startup wiring.
+func (cs *CredentialStore) Add(tenantID string, creds *Credentials) {
+	cs.tenants[tenantID] = creds
+}
+
+// Get returns the credential set for tenantID, or the default set when
+// tenantID is empty
+func (cs *CredentialStore) Get(tenantID string) (*Credentials, error) {
+	if tenantID == "" {
+		return cs.defaultCreds, nil
+	}
+
+	creds, ok := cs.tenants[tenantID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, tenantID)
+	}
+	return creds, nil
+}
+
+// TenantsForShortCode returns the tenants whose STK Pushes are paid to
+// shortCode, as business short code or till number, and whether the
+// default credential set is paid to it too
+func (cs *CredentialStore) TenantsForShortCode(shortCode string) (tenantIDs []string, isDefault bool) {
+	paidTo := func(creds *Credentials) bool {
+		return shortCode != "" && (creds.ShortCode == shortCode || creds.TillNumber == shortCode)
+	}
+
+	for tenantID, creds := range cs.tenants {
+		if paidTo(creds) {
+			tenantIDs = append(tenantIDs, tenantID)
+		}
+	}
+	return tenantIDs, paidTo(cs.defaultCreds)
+}
+
+// StartAutoRefresh starts background token refresh for every credential set
+func (cs *CredentialStore) StartAutoRefresh(ctx context.Context) {
+	cs.defaultCreds.Tokens.StartAutoRefresh(ctx)
+	for _, creds := range cs.tenants {
+		creds.Tokens.StartAutoRefresh(ctx)
+	}
+}
@@ -0,0 +1,101 @@
+// Package mock provides a stub payment service for testing HTTP handlers
+// without a database or Safaricom.
+package mock
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/payment"
+)
+
+// ErrNotConfigured is returned by methods whose Func field is nil
+var ErrNotConfigured = errors.New("mock: method not configured")
+
+// Service implements handlers.PaymentInitiator. Each method delegates to the
+// matching Func field and records the request it received.
+type Service struct {
+	InitiatePaymentFunc     func(ctx context.Context, req payment.InitiatePaymentRequest) (*payment.InitiatePaymentResponse, error)
+	InitiateB2CFunc         func(ctx context.Context, req payment.InitiatePayoutRequest) (*payment.InitiatePaymentResponse, error)
+	GetByIdempotencyKeyFunc func(ctx context.Context, key uuid.UUID) (*payment.InitiatePaymentResponse, error)
+	CheckTokenFunc          func(ctx context.Context) error
+	TokenStatsFunc          func() mpesa.TokenStats
+	RegisterC2BURLsFunc     func(ctx context.Context) (*payment.C2BRegistration, error)
+
+	mu              sync.Mutex
+	paymentRequests []payment.InitiatePaymentRequest
+	payoutRequests  []payment.InitiatePayoutRequest
+}
+
+// InitiatePayment calls InitiatePaymentFunc
+func (s *Service) InitiatePayment(ctx context.Context, req payment.InitiatePaymentRequest) (*payment.InitiatePaymentResponse, error) {
+	s.mu.Lock()
+	s.paymentRequests = append(s.paymentRequests, req)
+	s.mu.Unlock()
+
+	if s.InitiatePaymentFunc == nil {
+		return nil, ErrNotConfigured
+	}
+	return s.InitiatePaymentFunc(ctx, req)
+}
+
+// InitiateB2C calls InitiateB2CFunc
+func (s *Service) InitiateB2C(ctx context.Context, req payment.InitiatePayoutRequest) (*payment.InitiatePaymentResponse, error) {
+	s.mu.Lock()
+	s.payoutRequests = append(s.payoutRequests, req)
+	s.mu.Unlock()
+
+	if s.InitiateB2CFunc == nil {
+		return nil, ErrNotConfigured
+	}
+	return s.InitiateB2CFunc(ctx, req)
+}
+
+// GetByIdempotencyKey calls GetByIdempotencyKeyFunc
+func (s *Service) GetByIdempotencyKey(ctx context.Context, key uuid.UUID) (*payment.InitiatePaymentResponse, error) {
+	if s.GetByIdempotencyKeyFunc == nil {
+		return nil, ErrNotConfigured
+	}
+	return s.GetByIdempotencyKeyFunc(ctx, key)
+}
+
+// CheckToken calls CheckTokenFunc, reporting healthy when it is nil
+func (s *Service) CheckToken(ctx context.Context) error {
+	if s.CheckTokenFunc == nil {
+		return nil
+	}
+	return s.CheckTokenFunc(ctx)
+}
+
+// TokenStats calls TokenStatsFunc, returning zero stats when it is nil
+func (s *Service) TokenStats() mpesa.TokenStats {
+	if s.TokenStatsFunc == nil {
+		return mpesa.TokenStats{}
+	}
+	return s.TokenStatsFunc()
+}
+
+// RegisterC2BURLs calls RegisterC2BURLsFunc
+func (s *Service) RegisterC2BURLs(ctx context.Context) (*payment.C2BRegistration, error) {
+	if s.RegisterC2BURLsFunc == nil {
+		return nil, ErrNotConfigured
+	}
+	return s.RegisterC2BURLsFunc(ctx)
+}
+
+// PaymentRequests returns the requests passed to InitiatePayment so far
+func (s *Service) PaymentRequests() []payment.InitiatePaymentRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]payment.InitiatePaymentRequest(nil), s.paymentRequests...)
+}
+
+// PayoutRequests returns the requests passed to InitiateB2C so far
+func (s *Service) PayoutRequests() []payment.InitiatePayoutRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]payment.InitiatePayoutRequest(nil), s.payoutRequests...)
+}
@@ -0,0 +1,270 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrPayoutsDisabled is returned when B2C credentials are not configured
+var ErrPayoutsDisabled = errors.New("B2C payouts are not configured")
+
+// ErrPayoutRejected is returned when Safaricom refuses a B2C request (a 4xx
+// response or a non-zero ResponseCode); nothing was queued for payment
+var ErrPayoutRejected = errors.New("B2C payout rejected by Safaricom")
+
+// ErrPayoutUnconfirmed is returned when a B2C request failed in a way that
+// may still have reached Safaricom's queue, e.g. a timeout or 5xx. The
+// payout stays PENDING and is flagged for reconciliation.
+var ErrPayoutUnconfirmed = errors.New("B2C payout outcome unknown; it may still be paid out")
+
+// ErrPayoutNotRecorded is returned when Safaricom accepted the payout but
+// its conversation ID could not be saved on the transaction
+var ErrPayoutNotRecorded = errors.New("B2C payout accepted but conversation ID not recorded; payout may have been sent")
+
+// B2CConfig holds Safaricom B2C (payout) settings
+type B2CConfig struct {
+	ShortCode          string // PartyA paying out
+	InitiatorName      string
+	SecurityCredential string // Initiator password encrypted with Safaricom's certificate
+	CommandID          string // BusinessPayment, SalaryPayment or PromotionPayment
+	ResultURL          string
+	QueueTimeoutURL    string
+}
+
+// Enabled reports whether enough is configured to send payouts
+func (c B2CConfig) Enabled() bool {
+	return c.InitiatorName != "" && c.SecurityCredential != ""
+}
+
+// InitiatePayoutRequest is the input for InitiateB2C
+type InitiatePayoutRequest struct {
+	Amount         decimal.Decimal `validate:"required"`
+	Phone          string          `validate:"required,len=12,numeric"`
+	WebhookURL     string          `validate:"required,url"`
+	WebhookSecret  string          `validate:"omitempty,min=16"`
+	IdempotencyKey uuid.UUID       `validate:"required"`
+	Remarks        string          `validate:"omitempty,max=100"` // Defaults to "Payout"
+	Occasion       string          `validate:"omitempty,max=100"`
+	TenantID       string          // Tenant the payout is recorded for; B2C always uses the default credentials
+	RequestID      string          // X-Request-ID of the API request, echoed in webhooks
+}
+
+// InitiateB2C records a payout and submits it to Safaricom. The result
+// arrives asynchronously on the B2C result URL.
+func (s *Service) InitiateB2C(ctx context.Context, req InitiatePayoutRequest) (resp *InitiatePaymentResponse, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "payout.initiate", trace.WithAttributes(
+		attribute.String("payment.idempotency_key", req.IdempotencyKey.String()),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	if !s.cfg.B2C.Enabled() {
+		return nil, ErrPayoutsDisabled
+	}
+
+	// Reject webhook URLs pointing at internal infrastructure
+	if err := s.cfg.WebhookPolicy.ValidateURL(ctx, req.WebhookURL); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhookURL, err)
+	}
+
+	// B2C always uses the default credential set's OAuth token, but the
+	// tenant must still exist for the payout to be recorded against it
+	if _, err := s.credentials.Get(req.TenantID); err != nil {
+		return nil, err
+	}
+	creds, err := s.credentials.Get("")
+	if err != nil {
+		return nil, err
+	}
+
+	requestedAmount, err := s.applyAmountPolicy(&req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	internalTxID := uuid.New()
+
+	var webhookSecret *string
+	if req.WebhookSecret != "" {
+		webhookSecret = &req.WebhookSecret
+	}
+
+	var requestID *string
+	if req.RequestID != "" {
+		requestID = &req.RequestID
+	}
+
+	var tenantID *string
+	if req.TenantID != "" {
+		tenantID = &req.TenantID
+	}
+
+	// Insert and commit the PENDING record before calling Safaricom, as for
+	// STK Pushes: once the payout may have been sent the row must survive
+	// whatever happens to this request
+	insertSQL := `
+		INSERT INTO transactions (
+			internal_transaction_id,
+			idempotency_key,
+			amount,
+			phone,
+			status,
+			tenant_webhook_url,
+			webhook_secret,
+			direction,
+			request_id,
+			requested_amount,
+			tenant_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`
+
+	var txID uuid.UUID
+	err = s.db.QueryRow(ctx, insertSQL,
+		internalTxID,
+		req.IdempotencyKey,
+		req.Amount,
+		req.Phone,
+		models.StatusPending,
+		req.WebhookURL,
+		webhookSecret,
+		models.DirectionB2C,
+		requestID,
+		requestedAmount,
+		tenantID,
+	).Scan(&txID)
+	if err != nil {
+		return nil, insertError(err)
+	}
+
+	conversationID, err := s.callB2C(ctx, creds, req, internalTxID.String())
+
+	// Record the outcome even if the client has gone away: Safaricom may
+	// already have queued the payout
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), resultWriteTimeout)
+	defer cancel()
+
+	if err != nil {
+		// Nothing reached Safaricom's queue: delete the record so the
+		// client can retry with the same idempotency key
+		if errors.Is(err, mpesa.ErrRateLimited) || errors.Is(err, ErrTokenUnavailable) {
+			if _, delErr := s.db.Exec(writeCtx, `DELETE FROM transactions WHERE id = $1`, txID); delErr != nil {
+				logging.Printf("Failed to discard payout %s: %v", internalTxID, delErr)
+			}
+			return nil, err
+		}
+
+		// Refused outright: nothing will be paid and no result will
+		// arrive, so settle it as failed
+		if errors.Is(err, ErrPayoutRejected) {
+			failSQL := `UPDATE transactions SET status = $1, error_message = $2, completed_at = NOW() WHERE id = $3`
+			if _, updErr := s.db.Exec(writeCtx, failSQL, models.StatusFailed, err.Error(), txID); updErr != nil {
+				logging.Printf("Failed to record B2C rejection for %s: %v", internalTxID, updErr)
+			}
+			return nil, err
+		}
+
+		// Timeouts and 5xx may still be paid out. Without a conversation
+		// ID no result can settle the payout, so keep it PENDING and flag
+		// it for reconciliation.
+		if _, updErr := s.db.Exec(writeCtx, `UPDATE transactions SET error_message = $1 WHERE id = $2`, err.Error(), txID); updErr != nil {
+			logging.Printf("Failed to record B2C error for %s: %v", internalTxID, updErr)
+		}
+		s.recordOrphanedPayout(writeCtx, internalTxID, tenantID, "", err)
+		return nil, fmt.Errorf("%w: transaction %s: %w", ErrPayoutUnconfirmed, internalTxID, err)
+	}
+
+	_, err = s.db.Exec(writeCtx, `UPDATE transactions SET conversation_id = $1 WHERE id = $2`, conversationID, txID)
+	if err != nil {
+		// The failed update has usually used up writeCtx
+		orphanCtx, cancelOrphan := context.WithTimeout(context.WithoutCancel(ctx), resultWriteTimeout)
+		defer cancelOrphan()
+		s.recordOrphanedPayout(orphanCtx, internalTxID, tenantID, conversationID, err)
+		return nil, fmt.Errorf("%w: transaction %s, conversation %s: %w", ErrPayoutNotRecorded, internalTxID, conversationID, err)
+	}
+
+	metrics.PayoutsInitiated.Inc()
+	span.SetAttributes(attribute.String("payment.transaction_id", internalTxID.String()))
+
+	return &InitiatePaymentResponse{
+		TransactionID: internalTxID,
+		Status:        string(models.StatusPending),
+	}, nil
+}
+
+// callB2C calls Safaricom's B2C payment request API
+func (s *Service) callB2C(ctx context.Context, creds *Credentials, payReq InitiatePayoutRequest, reference string) (_ string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "safaricom.b2c", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	token, err := creds.Tokens.GetToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTokenUnavailable, err)
+	}
+
+	cfg := s.cfg.B2C
+	remarks := "Payout"
+	if payReq.Remarks != "" {
+		remarks = payReq.Remarks
+	}
+
+	b2cResp, err := s.api.B2C(ctx, token, mpesa.B2CRequest{
+		OriginatorConversationID: reference,
+		InitiatorName:            cfg.InitiatorName,
+		SecurityCredential:       cfg.SecurityCredential,
+		CommandID:                cfg.CommandID,
+		Amount:                   s.cfg.AmountPolicy.Format(payReq.Amount),
+		PartyA:                   cfg.ShortCode,
+		PartyB:                   payReq.Phone,
+		Remarks:                  remarks,
+		QueueTimeOutURL:          cfg.QueueTimeoutURL,
+		ResultURL:                cfg.ResultURL,
+		Occasion:                 payReq.Occasion,
+	})
+	if err != nil {
+		// A 4xx is a definitive refusal; transport errors and 5xx are not
+		var apiErr *mpesa.APIError
+		if errors.As(err, &apiErr) && !mpesa.IsServerError(err) {
+			return "", fmt.Errorf("%w: %w", ErrPayoutRejected, err)
+		}
+		return "", err
+	}
+
+	if b2cResp.ResponseCode != "0" {
+		return "", fmt.Errorf("%w: %s", ErrPayoutRejected, b2cResp.ResponseDescription)
+	}
+
+	return b2cResp.ConversationID, nil
+}
+
+// recordOrphanedPayout saves a payout that may have been sent but cannot be
+// settled by a B2C result, for manual reconciliation: conversationID is the
+// accepted payout's ID that could not be written to its transaction, or
+// empty when Safaricom's answer never arrived. The log line is the record of
+// last resort if the database is unusable.
+func (s *Service) recordOrphanedPayout(ctx context.Context, internalTxID uuid.UUID, tenantID *string, conversationID string, cause error) {
+	metrics.OrphanedPayouts.Inc()
+	logging.Printf("ORPHANED PAYOUT: transaction %s conversation_id=%s: %v", internalTxID, conversationID, cause)
+
+	var convID *string
+	if conversationID != "" {
+		convID = &conversationID
+	}
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO orphaned_checkouts (transaction_id, tenant_id, conversation_id, error_message)
+		VALUES ($1, $2, $3, $4)
+	`, internalTxID, tenantID, convID, cause.Error())
+	if err != nil {
+		logging.Printf("Failed to record orphaned payout %s: %v", internalTxID, err)
+	}
+}
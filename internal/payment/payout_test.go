@@ -0,0 +1,151 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/urlguard"
+)
+
+// b2cAPI answers B2C requests with resp and err
+type b2cAPI struct {
+	SafaricomAPI
+	resp *mpesa.B2CResponse
+	err  error
+}
+
+func (a b2cAPI) B2C(ctx context.Context, token string, req mpesa.B2CRequest) (*mpesa.B2CResponse, error) {
+	return a.resp, a.err
+}
+
+var (
+	b2cAccepted = &mpesa.B2CResponse{ConversationID: "AG_20191219_00005797af5d7d75f652", ResponseCode: "0"}
+	b2cRefused  = &mpesa.B2CResponse{ResponseCode: "2001", ResponseDescription: "The initiator information is invalid."}
+)
+
+func newPayoutService(db *pgxpool.Pool, api SafaricomAPI) (*Service, *Credentials) {
+	creds := &Credentials{ShortCode: "600000", Tokens: mpesa.NewStaticTokenService("token")}
+	s := NewService(db, NewCredentialStore(creds), api, PaymentConfig{
+		WebhookPolicy: urlguard.Policy{AllowPrivate: true},
+		B2C: B2CConfig{
+			ShortCode:          "600000",
+			InitiatorName:      "testapi",
+			SecurityCredential: "credential",
+			CommandID:          "BusinessPayment",
+		},
+	})
+	return s, creds
+}
+
+func TestCallB2CClassifiesErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		api          b2cAPI
+		wantRejected bool
+	}{
+		{"non-zero ResponseCode", b2cAPI{resp: b2cRefused}, true},
+		{"400", b2cAPI{err: &mpesa.APIError{Operation: "B2C request", StatusCode: http.StatusBadRequest}}, true},
+		{"500", b2cAPI{err: &mpesa.APIError{Operation: "B2C request", StatusCode: http.StatusInternalServerError}}, false},
+		{"transport timeout", b2cAPI{err: context.DeadlineExceeded}, false},
+		{"rate limited", b2cAPI{err: &mpesa.RateLimitError{}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, creds := newPayoutService(nil, tt.api)
+			_, err := s.callB2C(context.Background(), creds, InitiatePayoutRequest{Amount: decimal.NewFromInt(500), Phone: "254712345678"}, "ref")
+			if err == nil {
+				t.Fatal("callB2C() error = nil")
+			}
+			if got := errors.Is(err, ErrPayoutRejected); got != tt.wantRejected {
+				t.Errorf("errors.Is(%v, ErrPayoutRejected) = %t, want %t", err, got, tt.wantRejected)
+			}
+		})
+	}
+
+	s, creds := newPayoutService(nil, b2cAPI{resp: b2cAccepted})
+	conversationID, err := s.callB2C(context.Background(), creds, InitiatePayoutRequest{Amount: decimal.NewFromInt(500), Phone: "254712345678"}, "ref")
+	if err != nil || conversationID != b2cAccepted.ConversationID {
+		t.Errorf("callB2C() = %q, %v, want %q", conversationID, err, b2cAccepted.ConversationID)
+	}
+}
+
+func TestInitiateB2COutcomes(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		api         b2cAPI
+		wantErr     error
+		wantStatus  models.TransactionStatus // Empty when no row is kept
+		wantOrphans int
+	}{
+		{"accepted", b2cAPI{resp: b2cAccepted}, nil, models.StatusPending, 0},
+		{"refused", b2cAPI{resp: b2cRefused}, ErrPayoutRejected, models.StatusFailed, 0},
+		{"timed out", b2cAPI{err: context.DeadlineExceeded}, ErrPayoutUnconfirmed, models.StatusPending, 1},
+		{"server error", b2cAPI{err: &mpesa.APIError{Operation: "B2C request", StatusCode: http.StatusServiceUnavailable}}, ErrPayoutUnconfirmed, models.StatusPending, 1},
+		{"rate limited", b2cAPI{err: &mpesa.RateLimitError{}}, mpesa.ErrRateLimited, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newPayoutService(db, tt.api)
+			req := InitiatePayoutRequest{
+				Amount:         decimal.NewFromInt(500),
+				Phone:          "254712345678",
+				WebhookURL:     "https://merchant.example.com/hooks/mpesa",
+				IdempotencyKey: uuid.New(),
+			}
+
+			resp, err := s.InitiateB2C(ctx, req)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("InitiateB2C() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("InitiateB2C() error = %v, want %v", err, tt.wantErr)
+			}
+			if resp != nil {
+				t.Cleanup(func() {
+					db.Exec(context.Background(), `DELETE FROM transactions WHERE internal_transaction_id = $1`, resp.TransactionID)
+				})
+			}
+
+			var internalTxID uuid.UUID
+			var status string
+			err = db.QueryRow(ctx, `SELECT internal_transaction_id, status FROM transactions WHERE idempotency_key = $1`, req.IdempotencyKey).Scan(&internalTxID, &status)
+			if tt.wantStatus == "" {
+				if err == nil {
+					t.Errorf("payout recorded as %s, want no row", status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load payout: %v", err)
+			}
+			t.Cleanup(func() {
+				db.Exec(context.Background(), `DELETE FROM orphaned_checkouts WHERE transaction_id = $1`, internalTxID)
+				db.Exec(context.Background(), `DELETE FROM transactions WHERE internal_transaction_id = $1`, internalTxID)
+			})
+			if models.TransactionStatus(status) != tt.wantStatus {
+				t.Errorf("status = %s, want %s", status, tt.wantStatus)
+			}
+
+			var orphans int
+			if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM orphaned_checkouts WHERE transaction_id = $1`, internalTxID).Scan(&orphans); err != nil {
+				t.Fatalf("count orphaned payouts: %v", err)
+			}
+			if orphans != tt.wantOrphans {
+				t.Errorf("orphaned payouts = %d, want %d", orphans, tt.wantOrphans)
+			}
+		})
+	}
+}
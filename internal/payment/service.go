@@ -1,108 +1,289 @@
 package payment
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
 	"github.com/mpesa-gateway/internal/models"
 	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/mpesa-gateway/internal/urlguard"
 	"github.com/shopspring/decimal"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
 )
 
+// ErrCircuitOpen is returned when the STK Push circuit breaker is open and
+// Safaricom calls are being fast-failed
+var ErrCircuitOpen = errors.New("safaricom STK Push circuit breaker open")
+
+// ErrTooManyInFlight is returned when MaxInFlight STK Push calls are already
+// running and no slot freed up within InFlightWait
+var ErrTooManyInFlight = errors.New("too many STK Push requests in flight")
+
+// ErrInvalidWebhookURL is returned when a webhook URL fails the SSRF policy
+var ErrInvalidWebhookURL = errors.New("invalid webhook URL")
+
+// ErrDuplicateIdempotencyKey is returned when a transaction already exists
+// for the request's idempotency key
+var ErrDuplicateIdempotencyKey = errors.New("duplicate idempotency key")
+
+// ErrSTKPushRejected is returned when Safaricom refuses an STK Push request
+// it considers invalid, as opposed to failing or rate limiting it
+var ErrSTKPushRejected = errors.New("STK Push rejected by Safaricom")
+
+// ErrReferenceTooLong is returned when SanitizeReferences is off and an
+// AccountReference or TransactionDesc exceeds what Safaricom accepts
+var ErrReferenceTooLong = errors.New("reference exceeds Safaricom's length limit")
+
+// ErrTokenUnavailable is returned when no Safaricom access token could be
+// obtained for the credential set
+var ErrTokenUnavailable = errors.New("safaricom access token unavailable")
+
+// ErrCheckoutNotRecorded is returned when Safaricom accepted the STK Push
+// but its checkout ID could not be saved, so the customer may have been
+// prompted and the callback cannot be matched automatically
+var ErrCheckoutNotRecorded = errors.New("STK Push accepted but checkout ID not recorded; payment may have been initiated")
+
+const (
+	// pgUniqueViolation is the SQLSTATE for unique constraint violations
+	pgUniqueViolation = "23505"
+	// idempotencyKeyConstraint is the unique constraint on transactions.idempotency_key
+	idempotencyKeyConstraint = "transactions_idempotency_key_key"
+)
+
+// insertError wraps a failed transaction insert. A unique violation of the
+// idempotency key becomes ErrDuplicateIdempotencyKey so the caller can
+// replay the original transaction.
+func insertError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation && pgErr.ConstraintName == idempotencyKeyConstraint {
+		return fmt.Errorf("%w: %w", ErrDuplicateIdempotencyKey, err)
+	}
+	return fmt.Errorf("failed to insert transaction: %w", err)
+}
+
+// resultWriteTimeout bounds the writes recording an STK Push outcome, which
+// run detached from the request context
+const resultWriteTimeout = 5 * time.Second
+
+// SafaricomAPI is the Safaricom client the service calls; *mpesa.Client
+// implements it
+type SafaricomAPI interface {
+	STKPush(ctx context.Context, token string, req mpesa.STKPushRequest) (*mpesa.STKPushResponse, error)
+	STKQuery(ctx context.Context, token string, req mpesa.STKQueryRequest) (*mpesa.STKQueryResponse, error)
+	B2C(ctx context.Context, token string, req mpesa.B2CRequest) (*mpesa.B2CResponse, error)
+	RegisterC2BURLs(ctx context.Context, token string, req mpesa.C2BRegisterURLRequest) (*mpesa.C2BRegisterURLResponse, error)
+}
+
 // Service handles payment operations
 type Service struct {
-	db           *pgxpool.Pool
-	tokenService *mpesa.TokenService
-	cfg          PaymentConfig
-	client       *http.Client
+	db          *pgxpool.Pool
+	credentials *CredentialStore
+	api         SafaricomAPI
+	cfg         PaymentConfig
+	breaker     *gobreaker.CircuitBreaker
+	inFlight    *semaphore.Weighted // nil when MaxInFlight is 0
 }
 
-// PaymentConfig holds Safaricom API configuration
+// PaymentConfig holds Safaricom API configuration shared by all tenants
 type PaymentConfig struct {
-	ShortCode   string
-	Passkey     string
-	STKPushURL  string
 	CallbackURL string
+
+	// Circuit breaker around STK Push
+	BreakerMaxFailures uint32        // Consecutive failures before opening
+	BreakerCooldown    time.Duration // Time open before allowing a trial call
+
+	// Concurrent STK Push calls allowed (0 = unlimited), and how long a
+	// request waits for a free slot before failing with ErrTooManyInFlight
+	MaxInFlight  int64
+	InFlightWait time.Duration
+
+	// Allowed webhook destinations
+	WebhookPolicy urlguard.Policy
+
+	// Strip disallowed characters from and truncate tenant-supplied
+	// AccountReference/TransactionDesc before sending the STK Push
+	SanitizeReferences bool
+
+	// Record every STK Push request and response in mpesa_api_logs
+	LogAPICalls bool
+
+	// Log each STK password's timestamp and fingerprint (never the password)
+	DebugSTKPassword bool
+
+	// How fractional amounts are charged; applied before the transaction
+	// is recorded so the stored amount is what Safaricom is asked for
+	AmountPolicy AmountPolicy
+
+	// B2C payouts; disabled unless initiator credentials are set
+	B2C B2CConfig
+
+	// C2B URL registration; disabled unless the confirmation URL is set
+	C2B C2BConfig
 }
 
 // NewService creates a new payment service
-func NewService(db *pgxpool.Pool, tokenService *mpesa.TokenService, cfg PaymentConfig) *Service {
-	return &Service{
-		db:           db,
-		tokenService: tokenService,
-		cfg:          cfg,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					MinVersion: tls.VersionTLS12,
-				},
-			},
+func NewService(db *pgxpool.Pool, credentials *CredentialStore, api SafaricomAPI, cfg PaymentConfig) *Service {
+	maxFailures := cfg.BreakerMaxFailures
+	if maxFailures == 0 {
+		maxFailures = 5
+	}
+
+	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    "safaricom-stkpush",
+		Timeout: cfg.BreakerCooldown,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= maxFailures
 		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			logging.Printf("Circuit breaker %s: %s -> %s", name, from, to)
+		},
+	})
+
+	var inFlight *semaphore.Weighted
+	if cfg.MaxInFlight > 0 {
+		inFlight = semaphore.NewWeighted(cfg.MaxInFlight)
+	}
+
+	return &Service{
+		db:          db,
+		credentials: credentials,
+		api:         api,
+		cfg:         cfg,
+		breaker:     breaker,
+		inFlight:    inFlight,
 	}
 }
 
+// acquireInFlight reserves an STK Push slot, waiting up to InFlightWait. The
+// returned func releases it.
+func (s *Service) acquireInFlight(ctx context.Context) (func(), error) {
+	if s.inFlight == nil {
+		return func() {}, nil
+	}
+
+	if s.cfg.InFlightWait <= 0 {
+		if !s.inFlight.TryAcquire(1) {
+			return nil, ErrTooManyInFlight
+		}
+	} else {
+		waitCtx, cancel := context.WithTimeout(ctx, s.cfg.InFlightWait)
+		defer cancel()
+		if err := s.inFlight.Acquire(waitCtx, 1); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, ErrTooManyInFlight
+		}
+	}
+
+	metrics.STKPushInFlight.Inc()
+	return func() {
+		metrics.STKPushInFlight.Dec()
+		s.inFlight.Release(1)
+	}, nil
+}
+
 // InitiatePaymentRequest represents the payment initiation request
 type InitiatePaymentRequest struct {
-	Amount         decimal.Decimal `validate:"required"`
-	Phone          string          `validate:"required,len=12,numeric"`
-	WebhookURL     string          `validate:"required,url"`
-	IdempotencyKey uuid.UUID       `validate:"required"`
+	Amount           decimal.Decimal `validate:"required"`
+	Phone            string          `validate:"required,len=12,numeric"`
+	WebhookURL       string          `validate:"required,url"`
+	WebhookSecret    string          `validate:"omitempty,min=16"` // HMAC key for this tenant's webhooks; gateway default if empty
+	IdempotencyKey   uuid.UUID       `validate:"required"`
+	TenantID         string          // Selects the credential set; default credentials if empty
+	TransactionType  string          // Optional override of Credentials.TransactionType
+	AccountReference string          `validate:"omitempty,max=100"` // Shown on the customer's prompt; defaults to the internal tx ID. At most mpesa.AccountReferenceMaxLen unless SanitizeReferences
+	TransactionDesc  string          `validate:"omitempty,max=100"` // Defaults to "Payment". At most mpesa.TransactionDescMaxLen unless SanitizeReferences
+	RequestID        string          // X-Request-ID of the API request, echoed in webhooks
 }
 
 // InitiatePaymentResponse represents the payment initiation response
 type InitiatePaymentResponse struct {
-	TransactionID uuid.UUID `json:"transaction_id"`
-	Status        string    `json:"status"`
-}
-
-// STKPushRequest represents Safaricom STK Push API request
-type STKPushRequest struct {
-	BusinessShortCode string `json:"BusinessShortCode"`
-	Password          string `json:"Password"`
-	Timestamp         string `json:"Timestamp"`
-	TransactionType   string `json:"TransactionType"`
-	Amount            string `json:"Amount"`
-	PartyA            string `json:"PartyA"`
-	PartyB            string `json:"PartyB"`
-	PhoneNumber       string `json:"PhoneNumber"`
-	CallBackURL       string `json:"CallBackURL"`
-	AccountReference  string `json:"AccountReference"`
-	TransactionDesc   string `json:"TransactionDesc"`
-}
-
-// STKPushResponse represents Safaricom STK Push API response
-type STKPushResponse struct {
-	MerchantRequestID   string `json:"MerchantRequestID"`
-	CheckoutRequestID   string `json:"CheckoutRequestID"`
-	ResponseCode        string `json:"ResponseCode"`
-	ResponseDescription string `json:"ResponseDescription"`
-	CustomerMessage     string `json:"CustomerMessage"`
+	TransactionID     uuid.UUID `json:"transaction_id"`
+	Status            string    `json:"status"`
+	CheckoutRequestID string    `json:"checkout_request_id,omitempty"` // Set when the STK prompt was sent
+	MerchantRequestID string    `json:"merchant_request_id,omitempty"`
+	CustomerMessage   string    `json:"customer_message,omitempty"` // Safaricom's text for the payer; only on the initial response
 }
 
 // InitiatePayment initiates an STK Push payment
-func (s *Service) InitiatePayment(ctx context.Context, req InitiatePaymentRequest) (*InitiatePaymentResponse, error) {
-	// Generate internal transaction ID
-	internalTxID := uuid.New()
+func (s *Service) InitiatePayment(ctx context.Context, req InitiatePaymentRequest) (resp *InitiatePaymentResponse, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "payment.initiate", trace.WithAttributes(
+		attribute.String("tenant.id", req.TenantID),
+		attribute.String("payment.idempotency_key", req.IdempotencyKey.String()),
+	))
+	defer func() { tracing.End(span, err) }()
 
-	// Start database transaction
-	tx, err := s.db.Begin(ctx)
+	resp, err = s.initiatePayment(ctx, req)
+	if err == nil {
+		span.SetAttributes(attribute.String("payment.transaction_id", resp.TransactionID.String()))
+	}
+	return resp, err
+}
+
+// initiatePayment records the transaction and sends the STK Push
+func (s *Service) initiatePayment(ctx context.Context, req InitiatePaymentRequest) (*InitiatePaymentResponse, error) {
+	// Reject webhook URLs pointing at internal infrastructure
+	if err := s.cfg.WebhookPolicy.ValidateURL(ctx, req.WebhookURL); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhookURL, err)
+	}
+
+	// Resolve the tenant's Safaricom credentials
+	creds, err := s.credentials.Get(req.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	requestedAmount, err := s.applyAmountPolicy(&req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unsanitized references are sent as they are, so must already fit
+	if !s.cfg.SanitizeReferences {
+		if len(req.AccountReference) > mpesa.AccountReferenceMaxLen {
+			return nil, fmt.Errorf("%w: account_reference must be at most %d characters", ErrReferenceTooLong, mpesa.AccountReferenceMaxLen)
+		}
+		if len(req.TransactionDesc) > mpesa.TransactionDescMaxLen {
+			return nil, fmt.Errorf("%w: transaction_desc must be at most %d characters", ErrReferenceTooLong, mpesa.TransactionDescMaxLen)
+		}
+	}
+
+	// Fail fast without touching the database while Safaricom is unavailable
+	if s.breaker.State() == gobreaker.StateOpen {
+		return nil, ErrCircuitOpen
+	}
+
+	// Bound concurrent Safaricom calls before recording anything, so a
+	// saturated request leaves no row behind
+	release, err := s.acquireInFlight(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, err
 	}
-	defer tx.Rollback(ctx)
+	defer release()
 
-	// Insert initial transaction record
+	// Generate internal transaction ID
+	internalTxID := uuid.New()
+
+	// Insert and commit the PENDING record before calling Safaricom so no
+	// pooled connection is held open across the HTTP call. The unique
+	// idempotency key still rejects concurrent duplicates.
 	insertSQL := `
 		INSERT INTO transactions (
 			internal_transaction_id, 
@@ -110,128 +291,451 @@ func (s *Service) InitiatePayment(ctx context.Context, req InitiatePaymentReques
 			amount, 
 			phone, 
 			status, 
-			tenant_webhook_url
-		) VALUES ($1, $2, $3, $4, $5, $6)
+			tenant_webhook_url,
+			webhook_secret,
+			tenant_id,
+			callback_url,
+			request_id,
+			requested_amount
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		RETURNING id
 	`
 
+	var tenantID *string
+	if req.TenantID != "" {
+		tenantID = &req.TenantID
+	}
+
+	var webhookSecret *string
+	if req.WebhookSecret != "" {
+		webhookSecret = &req.WebhookSecret
+	}
+
+	var requestID *string
+	if req.RequestID != "" {
+		requestID = &req.RequestID
+	}
+
 	var txID uuid.UUID
-	err = tx.QueryRow(ctx, insertSQL,
+	err = s.db.QueryRow(ctx, insertSQL,
 		internalTxID,
 		req.IdempotencyKey,
 		req.Amount,
 		req.Phone,
 		models.StatusPending,
 		req.WebhookURL,
+		webhookSecret,
+		tenantID,
+		s.callbackURL(creds),
+		requestID,
+		requestedAmount,
 	).Scan(&txID)
 
 	if err != nil {
-		// Check for unique constraint violation (idempotency)
-		// In pgx v5, errors are in pgconn package
-		if err.Error() == "ERROR: duplicate key value violates unique constraint \"transactions_idempotency_key_key\" (SQLSTATE 23505)" ||
-			strings.Contains(err.Error(), "23505") {
-			return nil, fmt.Errorf("duplicate idempotency key: %w", err)
-		}
-		return nil, fmt.Errorf("failed to insert transaction: %w", err)
+		return nil, insertError(err)
 	}
 
 	// Call Safaricom STK Push API
-	checkoutRequestID, merchantRequestID, err := s.callSTKPush(ctx, req.Phone, req.Amount, internalTxID.String())
+	stkResp, err := s.callSTKPush(ctx, creds, req, internalTxID.String())
+
+	// Record the outcome even if the client has gone away: the STK prompt
+	// may already be on the customer's phone
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), resultWriteTimeout)
+	defer cancel()
+
 	if err != nil {
-		// Update transaction with error
+		// Breaker tripped mid-flight, Safaricom rate limited us or no token
+		// could be obtained: nothing was sent, so delete the record so no
+		// orphaned PENDING row is left and the client can retry with the
+		// same idempotency key
+		if errors.Is(err, ErrCircuitOpen) || errors.Is(err, mpesa.ErrRateLimited) || errors.Is(err, ErrTokenUnavailable) {
+			if _, delErr := s.db.Exec(writeCtx, `DELETE FROM transactions WHERE id = $1`, txID); delErr != nil {
+				logging.Printf("Failed to discard transaction %s: %v", internalTxID, delErr)
+			}
+			return nil, err
+		}
+
+		// Safaricom refused the request outright: no prompt was sent, so
+		// the transaction is settled as FAILED
+		if errors.Is(err, ErrSTKPushRejected) {
+			failSQL := `UPDATE transactions SET status = $1, error_message = $2, completed_at = NOW() WHERE id = $3`
+			if _, updErr := s.db.Exec(writeCtx, failSQL, models.StatusFailed, err.Error(), txID); updErr != nil {
+				logging.Printf("Failed to mark transaction %s as failed: %v", internalTxID, updErr)
+			}
+			return nil, fmt.Errorf("STK Push failed: %w", err)
+		}
+
+		// Timed out or failed in transit: the prompt may still have been
+		// sent, so leave it PENDING with the error. Having no checkout ID,
+		// reconciliation cannot query it and expires it once stale
 		updateErrSQL := `UPDATE transactions SET error_message = $1 WHERE id = $2`
-		tx.Exec(ctx, updateErrSQL, err.Error(), txID)
-		tx.Commit(ctx)
+		if _, updErr := s.db.Exec(writeCtx, updateErrSQL, err.Error(), txID); updErr != nil {
+			logging.Printf("Failed to record STK Push error for %s: %v", internalTxID, updErr)
+		}
 		return nil, fmt.Errorf("STK Push failed: %w", err)
 	}
 
 	// Update transaction with Safaricom IDs
+	checkoutRequestID, merchantRequestID := stkResp.CheckoutRequestID, stkResp.MerchantRequestID
 	updateSQL := `
 		UPDATE transactions 
 		SET checkout_request_id = $1, merchant_request_id = $2 
 		WHERE id = $3
 	`
-	_, err = tx.Exec(ctx, updateSQL, checkoutRequestID, merchantRequestID, txID)
+	_, err = s.db.Exec(writeCtx, updateSQL, checkoutRequestID, merchantRequestID, txID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to update transaction with checkout ID: %w", err)
+		// The failed update has usually used up writeCtx
+		orphanCtx, cancelOrphan := context.WithTimeout(context.WithoutCancel(ctx), resultWriteTimeout)
+		defer cancelOrphan()
+		s.recordOrphanedCheckout(orphanCtx, internalTxID, tenantID, checkoutRequestID, merchantRequestID, err)
+		return nil, fmt.Errorf("%w: transaction %s, checkout %s: %w", ErrCheckoutNotRecorded, internalTxID, checkoutRequestID, err)
 	}
 
-	// Commit transaction
-	if err := tx.Commit(ctx); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %w", err)
-	}
+	metrics.PaymentsInitiated.Inc()
 
 	return &InitiatePaymentResponse{
-		TransactionID: internalTxID,
-		Status:        string(models.StatusPending),
+		TransactionID:     internalTxID,
+		Status:            string(models.StatusPending),
+		CheckoutRequestID: checkoutRequestID,
+		MerchantRequestID: merchantRequestID,
+		CustomerMessage:   stkResp.CustomerMessage,
 	}, nil
 }
 
-// callSTKPush calls Safaricom's STK Push API
-func (s *Service) callSTKPush(ctx context.Context, phone string, amount decimal.Decimal, reference string) (string, string, error) {
+// recordOrphanedCheckout saves an accepted STK Push whose checkout ID could
+// not be written to its transaction, for manual reconciliation. The log line
+// is the record of last resort if the database is unusable.
+func (s *Service) recordOrphanedCheckout(ctx context.Context, internalTxID uuid.UUID, tenantID *string, checkoutRequestID, merchantRequestID string, cause error) {
+	metrics.OrphanedCheckouts.Inc()
+	logging.Printf("ORPHANED CHECKOUT: transaction %s checkout_request_id=%s merchant_request_id=%s: %v",
+		internalTxID, checkoutRequestID, merchantRequestID, cause)
+
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO orphaned_checkouts (transaction_id, tenant_id, checkout_request_id, merchant_request_id, error_message)
+		VALUES ($1, $2, $3, $4, $5)
+	`, internalTxID, tenantID, checkoutRequestID, merchantRequestID, cause.Error())
+	if err != nil {
+		logging.Printf("Failed to record orphaned checkout %s: %v", checkoutRequestID, err)
+	}
+}
+
+// CheckToken reports whether an access token can be obtained for the default
+// credential set
+func (s *Service) CheckToken(ctx context.Context) error {
+	creds, err := s.credentials.Get("")
+	if err != nil {
+		return err
+	}
+	if _, err := creds.Tokens.GetToken(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrTokenUnavailable, err)
+	}
+	return nil
+}
+
+// TenantsForShortCode returns the tenants whose STK Pushes are paid to
+// shortCode, and whether the default credential set is paid to it too
+func (s *Service) TenantsForShortCode(shortCode string) ([]string, bool) {
+	return s.credentials.TenantsForShortCode(shortCode)
+}
+
+// TokenStats returns the refresh counters for the default credential set
+func (s *Service) TokenStats() mpesa.TokenStats {
+	creds, err := s.credentials.Get("")
+	if err != nil {
+		return mpesa.TokenStats{}
+	}
+	return creds.Tokens.Stats()
+}
+
+// GetByIdempotencyKey returns the transaction previously created with the
+// given idempotency key, so duplicate requests can replay the original result
+func (s *Service) GetByIdempotencyKey(ctx context.Context, key uuid.UUID) (*InitiatePaymentResponse, error) {
+	query := `
+		SELECT internal_transaction_id, status, checkout_request_id, merchant_request_id
+		FROM transactions WHERE idempotency_key = $1
+	`
+
+	var resp InitiatePaymentResponse
+	var checkoutRequestID, merchantRequestID *string
+	if err := s.db.QueryRow(ctx, query, key).Scan(&resp.TransactionID, &resp.Status, &checkoutRequestID, &merchantRequestID); err != nil {
+		return nil, fmt.Errorf("failed to fetch transaction by idempotency key: %w", err)
+	}
+	resp.CheckoutRequestID = derefString(checkoutRequestID)
+	resp.MerchantRequestID = derefString(merchantRequestID)
+
+	return &resp, nil
+}
+
+// callSTKPush calls Safaricom's STK Push API and returns its accepted
+// response
+func (s *Service) callSTKPush(ctx context.Context, creds *Credentials, payReq InitiatePaymentRequest, reference string) (_ *mpesa.STKPushResponse, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "safaricom.stk_push", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
 	// Get access token
-	token, err := s.tokenService.GetToken(ctx)
+	token, err := creds.Tokens.GetToken(ctx)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to get access token: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrTokenUnavailable, err)
 	}
 
 	// Generate timestamp and password
-	timestamp := time.Now().Format("20060102150405")
-	password := base64.StdEncoding.EncodeToString(
-		[]byte(s.cfg.ShortCode + s.cfg.Passkey + timestamp),
-	)
+	timestamp, password := generatePassword(creds)
+	s.debugPassword("STK Push "+reference, creds, timestamp, password)
+
+	// Resolve transaction type and receiving party
+	transactionType := creds.TransactionType
+	if payReq.TransactionType != "" {
+		transactionType = payReq.TransactionType
+	}
+	if transactionType == "" {
+		transactionType = mpesa.TransactionTypePayBill
+	}
+	if !mpesa.IsValidTransactionType(transactionType) {
+		return nil, fmt.Errorf("unsupported transaction type: %s", transactionType)
+	}
+
+	partyB := creds.ShortCode
+	if transactionType == mpesa.TransactionTypeBuyGoods && creds.TillNumber != "" {
+		partyB = creds.TillNumber
+	}
+
+	// Tenant-supplied reference and description, falling back to our own
+	// (the credential set's description template, if any, or "Payment").
+	// A template using {ref} needs a supplied reference: the internal ID
+	// is too long to leave anything useful within the 13 characters.
+	accountReference := reference
+	if ref := s.sanitizeReference("AccountReference", payReq.AccountReference, mpesa.AccountReferenceMaxLen, reference); ref != "" {
+		accountReference = ref
+	}
+	transactionDesc := "Payment"
+	if creds.DescTemplate != "" && (payReq.AccountReference != "" || !strings.Contains(creds.DescTemplate, mpesa.DescPlaceholderRef)) {
+		if desc := mpesa.RenderDescTemplate(creds.DescTemplate, accountReference, s.cfg.AmountPolicy.Format(payReq.Amount)); desc != "" {
+			transactionDesc = desc
+		}
+	}
+	if desc := s.sanitizeReference("TransactionDesc", payReq.TransactionDesc, mpesa.TransactionDescMaxLen, reference); desc != "" {
+		transactionDesc = desc
+	}
 
 	// Build request
-	stkReq := STKPushRequest{
-		BusinessShortCode: s.cfg.ShortCode,
+	stkReq := mpesa.STKPushRequest{
+		BusinessShortCode: creds.ShortCode,
 		Password:          password,
 		Timestamp:         timestamp,
-		TransactionType:   "CustomerPayBillOnline",
-		Amount:            amount.StringFixed(0), // No decimals for Safaricom
-		PartyA:            phone,
-		PartyB:            s.cfg.ShortCode,
-		PhoneNumber:       phone,
-		CallBackURL:       s.cfg.CallbackURL,
-		AccountReference:  reference,
-		TransactionDesc:   "Payment",
+		TransactionType:   transactionType,
+		Amount:            s.cfg.AmountPolicy.Format(payReq.Amount),
+		PartyA:            payReq.Phone,
+		PartyB:            partyB,
+		PhoneNumber:       payReq.Phone,
+		CallBackURL:       s.callbackURL(creds),
+		AccountReference:  accountReference,
+		TransactionDesc:   transactionDesc,
 	}
 
-	body, err := json.Marshal(stkReq)
+	// Only transport errors and 5xx responses count towards the breaker;
+	// business rejections (4xx) and rate limits mean Safaricom is up
+	var stkResp *mpesa.STKPushResponse
+	var callErr error
+	var called bool
+	var elapsed time.Duration
+	_, err = s.breaker.Execute(func() (interface{}, error) {
+		start := time.Now()
+		stkResp, callErr = s.api.STKPush(ctx, token, stkReq)
+		called, elapsed = true, time.Since(start)
+		metrics.STKPushDuration.Observe(elapsed.Seconds())
+		if mpesa.IsServerError(callErr) {
+			return nil, callErr
+		}
+		return nil, nil
+	})
+	if called && s.cfg.LogAPICalls {
+		s.logSTKPush(ctx, reference, payReq.TenantID, stkReq, stkResp, callErr, elapsed)
+	}
 	if err != nil {
-		return "", "", fmt.Errorf("failed to marshal STK request: %w", err)
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+			return nil, ErrCircuitOpen
+		}
+		return nil, err
+	}
+	if callErr != nil {
+		var apiErr *mpesa.APIError
+		if errors.As(callErr, &apiErr) && !mpesa.IsServerError(callErr) {
+			return nil, fmt.Errorf("%w: %w", ErrSTKPushRejected, callErr)
+		}
+		return nil, callErr
+	}
+
+	if stkResp.ResponseCode != "0" {
+		return nil, fmt.Errorf("%w: %s", ErrSTKPushRejected, stkResp.ResponseDescription)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.STKPushURL, bytes.NewReader(body))
+	return stkResp, nil
+}
+
+// STKStatus is the outcome of QuerySTKStatus
+type STKStatus struct {
+	Status  models.TransactionStatus
+	Updated bool           // This call moved the transaction out of PENDING
+	Failure *mpesa.Failure // Set when Status is FAILED or EXPIRED
+}
+
+// QuerySTKStatus asks Safaricom for the result of an STK Push and resolves the
+// matching PENDING transaction. The status stays PENDING while Safaricom is
+// still processing the request; timeouts resolve to EXPIRED.
+func (s *Service) QuerySTKStatus(ctx context.Context, checkoutRequestID string) (*STKStatus, error) {
+	// The query must be signed with the credentials that initiated the push
+	var tenantID *string
+	err := s.db.QueryRow(ctx, `SELECT tenant_id FROM transactions WHERE checkout_request_id = $1`, checkoutRequestID).Scan(&tenantID)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to look up transaction tenant: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	creds, err := s.credentials.Get(derefString(tenantID))
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := s.client.Do(req)
+	stkResp, err := s.callSTKQuery(ctx, creds, checkoutRequestID)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to send STK Push: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	if stkResp.ErrorCode == mpesa.ErrorCodeStillProcessing {
+		return &STKStatus{Status: models.StatusPending}, nil
+	}
+
+	if stkResp.ResultCode == "" {
+		return nil, fmt.Errorf("STK query returned no result: %s %s", stkResp.ErrorCode, stkResp.ErrorMessage)
+	}
+
+	result := &STKStatus{}
+	var errorMsg *string
+
+	if stkResp.ResultCode == "0" {
+		result.Status = models.StatusCompleted
+	} else {
+		code, err := strconv.Atoi(stkResp.ResultCode)
+		if err != nil {
+			return nil, fmt.Errorf("STK query returned invalid result code %q", stkResp.ResultCode)
+		}
+		msg := stkResp.ResultDesc
+		errorMsg = &msg
+		result.Failure = mpesa.NewFailure(code, msg)
+		result.Status = models.StatusFailed
+		if result.Failure.IsExpiry() {
+			result.Status = models.StatusExpired
+		}
+	}
+
+	if !models.IsValidTransition(models.StatusPending, result.Status) {
+		return nil, fmt.Errorf("invalid state transition from %s to %s", models.StatusPending, result.Status)
+	}
+
+	// STK Query carries no receipt metadata; failures record the failure
+	// as a callback would
+	var metadataJSON []byte
+	if result.Failure != nil {
+		if metadataJSON, err = mpesa.MetadataJSON(nil, result.Failure); err != nil {
+			return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+	}
+
+	updateSQL := `
+		UPDATE transactions 
+		SET status = $1, 
+		    error_message = $2,
+		    mpesa_metadata = COALESCE($4, mpesa_metadata),
+		    completed_at = NOW()
+		WHERE checkout_request_id = $3 AND status = 'PENDING'
+	`
+
+	tag, err := s.db.Exec(ctx, updateSQL, string(result.Status), errorMsg, checkoutRequestID, metadataJSON)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to update transaction: %w", err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("STK Push failed with status %d: %s", resp.StatusCode, string(respBody))
+	if tag.RowsAffected() == 0 {
+		// Already resolved elsewhere (e.g. a late callback); report the stored state
+		var current string
+		if err := s.db.QueryRow(ctx, `SELECT status FROM transactions WHERE checkout_request_id = $1`, checkoutRequestID).Scan(&current); err != nil {
+			return nil, fmt.Errorf("failed to read transaction status: %w", err)
+		}
+		return &STKStatus{Status: models.TransactionStatus(current)}, nil
 	}
 
-	var stkResp STKPushResponse
-	if err := json.Unmarshal(respBody, &stkResp); err != nil {
-		return "", "", fmt.Errorf("failed to unmarshal response: %w", err)
+	result.Updated = true
+	return result, nil
+}
+
+// callSTKQuery calls Safaricom's STK Push Query API
+func (s *Service) callSTKQuery(ctx context.Context, creds *Credentials, checkoutRequestID string) (*mpesa.STKQueryResponse, error) {
+	token, err := creds.Tokens.GetToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenUnavailable, err)
 	}
 
-	if stkResp.ResponseCode != "0" {
-		return "", "", fmt.Errorf("STK Push error: %s", stkResp.ResponseDescription)
+	timestamp, password := generatePassword(creds)
+	s.debugPassword("STK Query "+checkoutRequestID, creds, timestamp, password)
+
+	return s.api.STKQuery(ctx, token, mpesa.STKQueryRequest{
+		BusinessShortCode: creds.ShortCode,
+		Password:          password,
+		Timestamp:         timestamp,
+		CheckoutRequestID: checkoutRequestID,
+	})
+}
+
+// sanitizeReference cleans a tenant-supplied STK Push field when
+// SanitizeReferences is enabled, logging truncation. An empty result means
+// the default should be used.
+func (s *Service) sanitizeReference(field, value string, maxLen int, reference string) string {
+	if !s.cfg.SanitizeReferences || value == "" {
+		return value
 	}
 
-	return stkResp.CheckoutRequestID, stkResp.MerchantRequestID, nil
+	sanitized, truncated := mpesa.SanitizeReference(value, maxLen)
+	if truncated {
+		logging.Printf("Truncated %s for %s to %d characters: %q -> %q", field, reference, maxLen, value, sanitized)
+	}
+	return sanitized
+}
+
+// callbackURL returns the STK Push CallBackURL for a credential set
+func (s *Service) callbackURL(creds *Credentials) string {
+	if creds.CallbackURL != "" {
+		return creds.CallbackURL
+	}
+	return s.cfg.CallbackURL
+}
+
+// generatePassword builds the timestamp and base64 password Safaricom expects
+// on STK Push and STK Query requests
+func generatePassword(creds *Credentials) (string, string) {
+	timestamp := time.Now().Format("20060102150405")
+	password := base64.StdEncoding.EncodeToString(
+		[]byte(creds.ShortCode + creds.Passkey + timestamp),
+	)
+	return timestamp, password
+}
+
+// debugPassword logs what an STK password was built from when
+// DebugSTKPassword is set. Only a truncated SHA-256 of the password is
+// logged; operators compare it with one computed from the passkey they
+// expect, and check the timestamp against Safaricom's clock (EAT, UTC+3).
+func (s *Service) debugPassword(label string, creds *Credentials, timestamp, password string) {
+	if !s.cfg.DebugSTKPassword {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	logging.Printf("STK password debug for %s: shortcode=%s timestamp=%s (%s) password_sha256=%s",
+		label, creds.ShortCode, timestamp, time.Now().Format("MST -07:00"), hex.EncodeToString(sum[:8]))
+}
+
+// derefString returns the pointed-to string, or "" for nil
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
 }
@@ -0,0 +1,211 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+	"github.com/sony/gobreaker"
+
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/urlguard"
+	"github.com/mpesa-gateway/migrations"
+)
+
+// idempotencyViolation is the error Postgres returns when a second insert
+// reuses an idempotency key
+func idempotencyViolation() *pgconn.PgError {
+	return &pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           "23505",
+		Message:        `duplicate key value violates unique constraint "transactions_idempotency_key_key"`,
+		Detail:         "Key (idempotency_key)=(0b7c3f9e-4c1e-4e8a-9d0a-1f2e3d4c5b6a) already exists.",
+		SchemaName:     "public",
+		TableName:      "transactions",
+		ConstraintName: "transactions_idempotency_key_key",
+	}
+}
+
+func TestInsertError(t *testing.T) {
+	otherUnique := idempotencyViolation()
+	otherUnique.ConstraintName = "transactions_internal_transaction_id_key"
+	otherCode := idempotencyViolation()
+	otherCode.Code = "23502" // not_null_violation
+
+	tests := []struct {
+		name          string
+		err           error
+		wantDuplicate bool
+	}{
+		{"idempotency key violation", idempotencyViolation(), true},
+		{"wrapped idempotency key violation", fmt.Errorf("query: %w", idempotencyViolation()), true},
+		{"other unique constraint", otherUnique, false},
+		{"other SQLSTATE on the constraint", otherCode, false},
+		{"message mentioning a duplicate key", errors.New(`duplicate key value violates unique constraint "transactions_idempotency_key_key"`), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := insertError(tt.err)
+			if got := errors.Is(err, ErrDuplicateIdempotencyKey); got != tt.wantDuplicate {
+				t.Errorf("errors.Is(insertError(), ErrDuplicateIdempotencyKey) = %t, want %t", got, tt.wantDuplicate)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("insertError() = %v, want it to wrap the database error", err)
+			}
+		})
+	}
+}
+
+func TestSTKPushRateLimitSkipsBreaker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	client := mpesa.NewClient(mpesa.ClientConfig{Endpoints: mpesa.Endpoints{STKPush: srv.URL}, RequestTimeout: 5 * time.Second})
+	creds := &Credentials{ShortCode: "174379", Passkey: "passkey", Tokens: mpesa.NewStaticTokenService("token")}
+	s := NewService(nil, NewCredentialStore(creds), client, PaymentConfig{
+		CallbackURL:        "https://gateway.example.com/callback",
+		BreakerMaxFailures: 1,
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := s.callSTKPush(context.Background(), creds, InitiatePaymentRequest{Amount: decimal.NewFromInt(10), Phone: "254712345678"}, "ref")
+		var rateLimited *mpesa.RateLimitError
+		if !errors.As(err, &rateLimited) || rateLimited.RetryAfter != 30*time.Second {
+			t.Fatalf("callSTKPush() error = %v, want a RateLimitError with RetryAfter 30s", err)
+		}
+	}
+	if counts := s.breaker.Counts(); counts.TotalFailures != 0 {
+		t.Errorf("breaker failures = %d, want rate limits not counted", counts.TotalFailures)
+	}
+	if state := s.breaker.State(); state != gobreaker.StateClosed {
+		t.Errorf("breaker state = %s, want closed", state)
+	}
+}
+
+// testDB connects to MPESA_TEST_DATABASE_URL and applies the migrations,
+// skipping the test when no test database is configured
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("MPESA_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("MPESA_TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatalf("connect to test database: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	if err := migrations.Run(ctx, pool); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+	return pool
+}
+
+// acceptingAPI accepts every STK Push
+type acceptingAPI struct{ SafaricomAPI }
+
+func (acceptingAPI) STKPush(ctx context.Context, token string, req mpesa.STKPushRequest) (*mpesa.STKPushResponse, error) {
+	return &mpesa.STKPushResponse{
+		MerchantRequestID: "29115-" + uuid.NewString(),
+		CheckoutRequestID: "ws_CO_" + uuid.NewString(),
+		ResponseCode:      "0",
+	}, nil
+}
+
+func TestInitiatePaymentDuplicateKeyAgainstSchema(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	creds := &Credentials{ShortCode: "174379", Passkey: "passkey", Tokens: mpesa.NewStaticTokenService("token")}
+	s := NewService(db, NewCredentialStore(creds), acceptingAPI{}, PaymentConfig{
+		CallbackURL:   "https://gateway.example.com/callback",
+		WebhookPolicy: urlguard.Policy{AllowPrivate: true},
+	})
+
+	req := InitiatePaymentRequest{
+		Amount:         decimal.NewFromInt(10),
+		Phone:          "254712345678",
+		WebhookURL:     "https://merchant.example.com/hooks/mpesa",
+		IdempotencyKey: uuid.New(),
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM transactions WHERE idempotency_key = $1`, req.IdempotencyKey)
+	})
+
+	first, err := s.InitiatePayment(ctx, req)
+	if err != nil {
+		t.Fatalf("first InitiatePayment() error = %v", err)
+	}
+
+	// The second insert hits the idempotency key's unique index as migrated
+	_, err = s.InitiatePayment(ctx, req)
+	if !errors.Is(err, ErrDuplicateIdempotencyKey) {
+		t.Fatalf("second InitiatePayment() error = %v, want ErrDuplicateIdempotencyKey", err)
+	}
+
+	replay, err := s.GetByIdempotencyKey(ctx, req.IdempotencyKey)
+	if err != nil {
+		t.Fatalf("GetByIdempotencyKey() error = %v", err)
+	}
+	if replay.TransactionID != first.TransactionID {
+		t.Errorf("replayed transaction = %s, want %s", replay.TransactionID, first.TransactionID)
+	}
+}
+
+// rejectingAPI refuses every STK Push
+type rejectingAPI struct{ SafaricomAPI }
+
+func (rejectingAPI) STKPush(ctx context.Context, token string, req mpesa.STKPushRequest) (*mpesa.STKPushResponse, error) {
+	return &mpesa.STKPushResponse{ResponseCode: "1", ResponseDescription: "Invalid shortcode"}, nil
+}
+
+func TestInitiatePaymentRejectedIsFailed(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	creds := &Credentials{ShortCode: "174379", Passkey: "passkey", Tokens: mpesa.NewStaticTokenService("token")}
+	s := NewService(db, NewCredentialStore(creds), rejectingAPI{}, PaymentConfig{
+		CallbackURL:   "https://gateway.example.com/callback",
+		WebhookPolicy: urlguard.Policy{AllowPrivate: true},
+	})
+
+	req := InitiatePaymentRequest{
+		Amount:         decimal.NewFromInt(10),
+		Phone:          "254712345678",
+		WebhookURL:     "https://merchant.example.com/hooks/mpesa",
+		IdempotencyKey: uuid.New(),
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM transactions WHERE idempotency_key = $1`, req.IdempotencyKey)
+	})
+
+	if _, err := s.InitiatePayment(ctx, req); !errors.Is(err, ErrSTKPushRejected) {
+		t.Fatalf("InitiatePayment() error = %v, want ErrSTKPushRejected", err)
+	}
+
+	var status string
+	var completed bool
+	err := db.QueryRow(ctx, `SELECT status, completed_at IS NOT NULL FROM transactions WHERE idempotency_key = $1`, req.IdempotencyKey).Scan(&status, &completed)
+	if err != nil {
+		t.Fatalf("reading transaction: %v", err)
+	}
+	if status != string(models.StatusFailed) || !completed {
+		t.Errorf("status = %s, completed = %v, want FAILED and completed", status, completed)
+	}
+}
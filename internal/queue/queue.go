@@ -4,12 +4,26 @@ import (
 	"log"
 
 	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
 )
 
+// DefaultWeights are the asynq queues the worker serves and their relative
+// priorities when MPESA_QUEUE_WEIGHTS is unset
+var DefaultWeights = map[string]int{
+	"critical": 6,
+	"default":  3,
+	"low":      1,
+}
+
 // Queue wraps Asynq client and server
 type Queue struct {
-	Client *asynq.Client
-	Server *asynq.ServeMux
+	Client    *asynq.Client
+	Server    *asynq.ServeMux
+	Inspector *asynq.Inspector
+	Redis     redis.UniversalClient // Shared connection for non-queue state (rate limits)
+	RedisOpt  asynq.RedisConnOpt    // Parsed connection options for asynq servers and schedulers
+
+	concurrency int
 }
 
 // NewQueue creates a new queue client and server
@@ -25,35 +39,47 @@ func NewQueue(redisURL string, concurrency int) (*Queue, error) {
 	// Create server mux for registering handlers
 	serverMux := asynq.NewServeMux()
 
+	// Create inspector for queue health and introspection
+	inspector := asynq.NewInspector(redisOpt)
+
+	// Create plain Redis client on the same instance
+	redisClient := redisOpt.MakeRedisClient().(redis.UniversalClient)
+
 	log.Printf("Queue client and server initialized (concurrency: %d)", concurrency)
 
 	return &Queue{
-		Client: client,
-		Server: serverMux,
+		Client:    client,
+		Server:    serverMux,
+		Inspector: inspector,
+		Redis:     redisClient,
+		RedisOpt:  redisOpt,
+
+		concurrency: concurrency,
 	}, nil
 }
 
-// GetServerConfig returns server configuration and Redis options for worker
-func (q *Queue) GetServerConfig(redisURL string, concurrency int) (asynq.RedisConnOpt, *asynq.Config, error) {
-	redisOpt, err := asynq.ParseRedisURI(redisURL)
-	if err != nil {
-		return nil, nil, err
+// GetServerConfig returns the worker server configuration for use with
+// asynq.NewServer(q.RedisOpt, cfg). weights maps each served queue to its
+// priority; nil uses DefaultWeights.
+func (q *Queue) GetServerConfig(weights map[string]int) asynq.Config {
+	if len(weights) == 0 {
+		weights = DefaultWeights
 	}
 
-	cfg := &asynq.Config{
-		Concurrency: concurrency,
-		Queues: map[string]int{
-			"critical": 6,
-			"default":  3,
-			"low":      1,
-		},
+	return asynq.Config{
+		Concurrency: q.concurrency,
+		Queues:      weights,
 	}
-
-	return redisOpt, cfg, nil
 }
 
-// Close gracefully closes the queue client
+// Close gracefully closes the queue client, inspector and Redis client
 func (q *Queue) Close() error {
+	if q.Inspector != nil {
+		q.Inspector.Close()
+	}
+	if q.Redis != nil {
+		q.Redis.Close()
+	}
 	if q.Client != nil {
 		log.Println("Closing queue client...")
 		return q.Client.Close()
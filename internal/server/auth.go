@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/mpesa-gateway/internal/apikey"
+	"github.com/mpesa-gateway/internal/config"
+	customMiddleware "github.com/mpesa-gateway/internal/middleware"
+)
+
+// LoadAPIKeys loads the api_keys table and keeps it refreshed until ctx is
+// cancelled. It returns nil when MPESA_AUTH_MODE only accepts the shared
+// secret.
+func LoadAPIKeys(ctx context.Context, cfg *config.Config, db *pgxpool.Pool) (*apikey.Store, error) {
+	if cfg.AuthMode == config.AuthModeSecret {
+		return nil, nil
+	}
+
+	keys := apikey.NewStore(db)
+	if err := keys.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	keys.StartRefresh(ctx, time.Duration(cfg.APIKeyRefresh)*time.Second)
+	return keys, nil
+}
+
+// Auth returns the authentication middleware for MPESA_AUTH_MODE, accepting
+// the internal secret unless the mode is API keys only. Keys pinned to a
+// tenant are only accepted where allowTenantKeys is true.
+func Auth(cfg *config.Config, keys *apikey.Store, allowTenantKeys bool) func(http.Handler) http.Handler {
+	secret := cfg.InternalSecret
+	if cfg.AuthMode == config.AuthModeAPIKey {
+		secret = ""
+	}
+	return customMiddleware.EnsureAuth(secret, keys, allowTenantKeys)
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"time"
@@ -8,27 +10,50 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/mpesa-gateway/internal/apikey"
 	"github.com/mpesa-gateway/internal/config"
-	customMiddleware "github.com/mpesa-gateway/internal/middleware"
 	"github.com/mpesa-gateway/internal/handlers"
+	"github.com/mpesa-gateway/internal/httpclient"
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
+	customMiddleware "github.com/mpesa-gateway/internal/middleware"
 )
 
 // Server wraps the HTTP server
 type Server struct {
-	router  *chi.Mux
-	handler *handlers.Handler
-	config  *config.Config
+	router          *chi.Mux
+	handler         *handlers.Handler
+	config          *config.Config
+	initiateLimiter *customMiddleware.RateLimiter
+	apiKeys         *apikey.Store
+	srv             *http.Server
 }
 
-// NewServer creates a new HTTP server
-func NewServer(cfg *config.Config, h *handlers.Handler) *Server {
+// NewServer creates a new HTTP server. initiateLimiter is the
+// MPESA_INITIATE_RATE_LIMIT limiter shared with the batch handler (nil when
+// disabled); apiKeys is nil unless MPESA_AUTH_MODE accepts API keys.
+func NewServer(cfg *config.Config, h *handlers.Handler, initiateLimiter *customMiddleware.RateLimiter, apiKeys *apikey.Store) *Server {
 	s := &Server{
-		router:  chi.NewRouter(),
-		handler: h,
-		config:  cfg,
+		router:          chi.NewRouter(),
+		handler:         h,
+		config:          cfg,
+		initiateLimiter: initiateLimiter,
+		apiKeys:         apiKeys,
 	}
 
 	s.setupRoutes()
+
+	s.srv = &http.Server{
+		Addr:    ":" + cfg.ServerPort,
+		Handler: s.router,
+	}
+	if cfg.ServerCert != nil {
+		s.srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{*cfg.ServerCert},
+			MinVersion:   httpclient.TLSVersions[cfg.TLSMinVersion],
+		}
+	}
+
 	return s
 }
 
@@ -37,35 +62,175 @@ func (s *Server) setupRoutes() {
 	r := s.router
 
 	// Global middleware
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(customMiddleware.RequestID)
+	r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: logging.Logger{}})) // Masks phone numbers in query strings
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(30 * time.Second))
 
-	// Public health check
-	r.Get("/health", s.handler.HealthCheck)
+	// Every route lives under MPESA_ROUTE_PREFIX, if set
+	if s.config.RoutePrefix != "" {
+		r.Route(s.config.RoutePrefix, s.routes)
+	} else {
+		s.routes(r)
+	}
 
-	// Protected initiate endpoint (requires internal authentication)
+	log.Println("Routes configured successfully")
+}
+
+// routes registers the probes, metrics, API and Safaricom callback endpoints
+// on r
+func (s *Server) routes(r chi.Router) {
+	// Public liveness and readiness probes. These and /metrics are
+	// registered outside the callback group so MPESA_SAFARICOM_IPS never
+	// applies to them; keep the IP filter scoped to that group. Probes and
+	// scrapes usually come straight over plain HTTP, so MPESA_REQUIRE_HTTPS
+	// does not apply to them either.
 	r.Group(func(r chi.Router) {
-		r.Use(customMiddleware.EnsureInternalAuth(s.config.InternalSecret))
-		r.Post("/initiate", s.handler.InitiatePayment)
+		r.Use(timeout(s.config.CallbackTimeout))
+		r.Get("/health", s.handler.HealthCheck)
+		r.Get("/ready", s.handler.ReadinessCheck)
 	})
 
-	// Callback endpoint (IP filtered + size limited)
+	// Prometheus metrics (optionally behind internal auth)
 	r.Group(func(r chi.Router) {
-		r.Use(customMiddleware.IPFilter(s.config.SafaricomIPs))
+		r.Use(timeout(s.config.RequestTimeout))
+		if s.config.MetricsRequireAuth {
+			r.Use(s.auth(false))
+		}
+		r.Handle("/metrics", metrics.Handler())
+	})
+
+	// Versioned API with the {"data","error"} response envelope. Envelope
+	// comes first so middleware rejections are enveloped too.
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(customMiddleware.Envelope)
+		r.Use(s.requireHTTPS())
+		s.apiRoutes(r)
+	})
+
+	// Unversioned API with bare responses for existing integrations
+	if s.config.LegacyRoutes {
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireHTTPS())
+			s.apiRoutes(r)
+		})
+	}
+
+	// Callback endpoint (IP filtered + size limited). Callbacks are only
+	// queued, so a short timeout stops a stuck dependency from holding
+	// Safaricom's connection open.
+	r.Group(func(r chi.Router) {
+		r.Use(timeout(s.config.CallbackTimeout))
+		r.Use(s.requireHTTPS())
+		r.Use(customMiddleware.IPFilter(s.config.SafaricomIPs, s.config.TrustedProxies))
 		r.Use(customMiddleware.RequestSizeLimit(s.config.MaxRequestSize))
-		r.Post("/callback", s.handler.MPesaCallback)
+		// Safaricom does not always send a Content-Type
+		r.Use(customMiddleware.RequireJSON(true))
+		cb := s.config.CallbackPath
+		r.Post(cb, s.handler.MPesaCallback)
+		r.Post(cb+"/tenants/{tenantID}", s.handler.MPesaCallback)
+		r.Post(cb+"/b2c/result", s.handler.B2CCallback)
+		r.Post(cb+"/b2c/timeout", s.handler.B2CCallback)
+		r.Post(cb+"/c2b/validation", s.handler.C2BValidation)
+		r.Post(cb+"/c2b/confirmation", s.handler.C2BConfirmation)
 	})
+}
 
-	log.Println("Routes configured successfully")
+// apiRoutes registers the tenant and operator endpoints on r
+func (s *Server) apiRoutes(r chi.Router) {
+	// Protected tenant endpoints (requires internal authentication)
+	r.Group(func(r chi.Router) {
+		r.Use(s.auth(true))
+
+		// Safaricom is called inline, so these get MPESA_INITIATE_TIMEOUT.
+		// Deadlines only shorten when nested, so the groups are disjoint.
+		r.Group(func(r chi.Router) {
+			r.Use(timeout(s.config.InitiateTimeout))
+			r.With(s.initiateRateLimit(), customMiddleware.RequireJSON(false)).Post("/initiate", s.handler.InitiatePayment)
+		})
+
+		// Batches take a rate limit token and get MPESA_INITIATE_TIMEOUT per
+		// item in the handler, so the request as a whole has no deadline
+		r.With(customMiddleware.RequireJSON(false)).Post("/initiate/batch", s.handler.InitiateBatch)
+
+		// Reads are limited to the key's tenant by the handlers
+		r.Group(func(r chi.Router) {
+			r.Use(timeout(s.config.RequestTimeout))
+			r.Get("/transactions", s.handler.ListTransactions)
+			r.Get("/transactions/{id}", s.handler.GetTransaction)
+			r.Get("/transactions/{id}/webhook-attempts", s.handler.ListWebhookAttempts)
+			r.Get("/transactions/receipt/{receipt}", s.handler.GetTransactionByReceipt)
+		})
+	})
+
+	// Endpoints not yet scoped to a tenant, so closed to tenant-pinned keys
+	r.Group(func(r chi.Router) {
+		r.Use(s.auth(false))
+		r.With(timeout(s.config.InitiateTimeout), s.initiateRateLimit(), customMiddleware.RequireJSON(false)).Post("/payouts", s.handler.InitiatePayout)
+		r.With(timeout(s.config.RequestTimeout)).Get("/transactions/export", s.handler.ExportTransactions)
+	})
+
+	// Operator endpoints (requires internal authentication)
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(timeout(s.config.RequestTimeout))
+		r.Use(s.auth(false))
+		r.Get("/failed-callbacks", s.handler.ListFailedCallbacks)
+		r.Post("/failed-callbacks/{taskID}/requeue", s.handler.RequeueFailedCallback)
+		r.Get("/callbacks/{checkoutRequestID}", s.handler.GetCallbackTask)
+		r.Get("/webhook-attempts", s.handler.ListFleetWebhookAttempts)
+		r.Post("/transactions/{id}/reprocess", s.handler.ReprocessTransaction)
+		r.Post("/c2b/register-urls", s.handler.RegisterC2BURLs)
+		r.Get("/api-keys", s.handler.ListAPIKeys)
+		r.Post("/api-keys", s.handler.CreateAPIKey)
+		r.Delete("/api-keys/{id}", s.handler.DisableAPIKey)
+	})
 }
 
-// Start starts the HTTP server
+// auth returns the authentication middleware for MPESA_AUTH_MODE. Keys
+// pinned to a tenant are only accepted where allowTenantKeys is true.
+func (s *Server) auth(allowTenantKeys bool) func(http.Handler) http.Handler {
+	return Auth(s.config, s.apiKeys, allowTenantKeys)
+}
+
+// timeout cancels the request context after seconds and answers 504 if the
+// handler has not written a response by then. Handlers pass the context on,
+// so a Safaricom call in flight is abandoned with it.
+func timeout(seconds int) func(http.Handler) http.Handler {
+	return middleware.Timeout(time.Duration(seconds) * time.Second)
+}
+
+// initiateRateLimit returns the per-caller limiter for /initiate, or a
+// pass-through when disabled
+func (s *Server) initiateRateLimit() func(http.Handler) http.Handler {
+	if s.initiateLimiter == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return customMiddleware.RateLimit(s.initiateLimiter)
+}
+
+// requireHTTPS returns the MPESA_REQUIRE_HTTPS middleware, or a
+// pass-through when disabled
+func (s *Server) requireHTTPS() func(http.Handler) http.Handler {
+	if !s.config.RequireHTTPS {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return customMiddleware.RequireHTTPS(s.config.TrustedProxies, s.config.HSTSMaxAge)
+}
+
+// Start starts the HTTP server, terminating TLS itself when a certificate
+// is configured. It returns http.ErrServerClosed after Shutdown.
 func (s *Server) Start() error {
-	addr := ":" + s.config.ServerPort
-	log.Printf("Starting HTTP server on %s", addr)
+	if s.srv.TLSConfig != nil {
+		log.Printf("Starting HTTPS server on %s", s.srv.Addr)
+		return s.srv.ListenAndServeTLS("", "")
+	}
+
+	log.Printf("Starting HTTP server on %s", s.srv.Addr)
+	return s.srv.ListenAndServe()
+}
 
-	return http.ListenAndServe(addr, s.router)
+// Shutdown stops accepting new connections and waits for in-flight requests
+// to complete until ctx expires
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down HTTP server...")
+	return s.srv.Shutdown(ctx)
 }
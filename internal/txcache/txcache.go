@@ -0,0 +1,168 @@
+// Package txcache looks up transactions by CheckoutRequestID, optionally
+// through a small in-memory LRU cache so retried callbacks do not each hit
+// the database.
+//
+// Only PENDING transactions are cached. A PENDING entry may be stale for up
+// to the TTL once another process settles the transaction, which callers
+// tolerate because the status-guarded UPDATE decides the outcome. A terminal
+// status is never served from the cache: an operator's forced reprocess can
+// reset it to PENDING, and a stale terminal status would drop that callback.
+package txcache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/mpesa-gateway/internal/metrics"
+	"github.com/mpesa-gateway/internal/models"
+)
+
+// Cache is a bounded, TTL-limited LRU of PENDING transactions keyed by
+// CheckoutRequestID. A nil *Cache is valid and caches nothing.
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Front is most recently used
+}
+
+type entry struct {
+	checkoutRequestID string
+	tx                models.Transaction
+	expires           time.Time
+}
+
+// New creates a cache of at most size transactions, each kept for ttl. It
+// returns nil, disabling caching, when size or ttl is not positive.
+func New(size int, ttl time.Duration) *Cache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Lookup returns the transaction with the given CheckoutRequestID from the
+// cache, or loads it from the database and caches it while PENDING.
+// pgx.ErrNoRows is returned when there is none.
+func (c *Cache) Lookup(ctx context.Context, db *pgxpool.Pool, checkoutRequestID string) (*models.Transaction, error) {
+	if tx, ok := c.get(checkoutRequestID); ok {
+		metrics.TxCacheLookups.WithLabelValues("hit").Inc()
+		return tx, nil
+	}
+	if c != nil {
+		metrics.TxCacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	tx, err := Load(ctx, db, checkoutRequestID)
+	if err != nil {
+		return nil, err
+	}
+	c.put(checkoutRequestID, tx)
+	return tx, nil
+}
+
+// Invalidate drops a transaction whose status changed
+func (c *Cache) Invalidate(checkoutRequestID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[checkoutRequestID]; ok {
+		c.order.Remove(el)
+		delete(c.entries, checkoutRequestID)
+	}
+}
+
+// get returns a copy of a live cached transaction
+func (c *Cache) get(checkoutRequestID string) (*models.Transaction, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[checkoutRequestID]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, checkoutRequestID)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	tx := e.tx
+	return &tx, true
+}
+
+// put caches a copy of tx if it is PENDING, evicting the least recently
+// used entry when full
+func (c *Cache) put(checkoutRequestID string, tx *models.Transaction) {
+	if c == nil || models.TransactionStatus(tx.Status) != models.StatusPending {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &entry{checkoutRequestID: checkoutRequestID, tx: *tx, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[checkoutRequestID]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[checkoutRequestID] = c.order.PushFront(e)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).checkoutRequestID)
+	}
+}
+
+// Load fetches the transaction with the given CheckoutRequestID from the
+// database, bypassing any cache
+func Load(ctx context.Context, db *pgxpool.Pool, checkoutRequestID string) (*models.Transaction, error) {
+	query := `
+		SELECT id, internal_transaction_id, idempotency_key, checkout_request_id, merchant_request_id,
+		       direction, amount, requested_amount, phone, status, tenant_webhook_url, request_id, created_at, updated_at
+		FROM transactions
+		WHERE checkout_request_id = $1
+	`
+
+	var tx models.Transaction
+	err := db.QueryRow(ctx, query, checkoutRequestID).Scan(
+		&tx.ID,
+		&tx.InternalTransactionID,
+		&tx.IdempotencyKey,
+		&tx.CheckoutRequestID,
+		&tx.MerchantRequestID,
+		&tx.Direction,
+		&tx.Amount,
+		&tx.RequestedAmount,
+		&tx.Phone,
+		&tx.Status,
+		&tx.TenantWebhookURL,
+		&tx.RequestID,
+		&tx.CreatedAt,
+		&tx.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
@@ -0,0 +1,119 @@
+package urlguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+)
+
+// ErrBlockedAddress is returned when a URL resolves to a disallowed address
+var ErrBlockedAddress = errors.New("address not allowed")
+
+// Policy controls which webhook destinations are permitted
+type Policy struct {
+	RequireHTTPS bool // Reject plain http:// URLs
+	AllowPrivate bool // Permit private/loopback addresses (development only)
+}
+
+// blockedNets lists ranges not covered by the net.IP classification helpers
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "This" network
+	"100.64.0.0/10", // Carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // Benchmarking
+)
+
+// ValidateURL checks the scheme and resolves the host, rejecting URLs that
+// point at private, loopback, link-local or cloud metadata addresses
+func (p Policy) ValidateURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if p.RequireHTTPS {
+			return fmt.Errorf("URL must use https")
+		}
+	default:
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("URL has no host")
+	}
+
+	if p.AllowPrivate {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	for _, addr := range addrs {
+		if IsBlocked(addr.IP) {
+			return fmt.Errorf("%s resolves to %s: %w", host, addr.IP, ErrBlockedAddress)
+		}
+	}
+
+	return nil
+}
+
+// DialControl is a net.Dialer Control hook that rejects connections to
+// blocked addresses. It checks the address actually dialled, so it also
+// defeats DNS rebinding between validation and delivery.
+func (p Policy) DialControl(network, address string, _ syscall.RawConn) error {
+	if p.AllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || IsBlocked(ip) {
+		return fmt.Errorf("dial %s: %w", address, ErrBlockedAddress)
+	}
+
+	return nil
+}
+
+// IsBlocked reports whether ip is a private, loopback, link-local (including
+// 169.254.169.254 metadata), multicast or otherwise non-public address
+func IsBlocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/mpesa-gateway/internal/logging"
+)
+
+// NewArchiveTransactionsTask creates a new transaction archival task
+func NewArchiveTransactionsTask() *asynq.Task {
+	return asynq.NewTask(TypeArchiveTransactions, nil)
+}
+
+// ArchiveTransactions moves settled transactions older than ArchiveAfter,
+// and their webhook attempts, into the archive tables. Each batch is moved
+// in its own database transaction so a failure never leaves a transaction
+// in both tables or in neither.
+func (p *Processor) ArchiveTransactions(ctx context.Context, t *asynq.Task) error {
+	if p.retentionCfg.ArchiveAfter <= 0 {
+		return nil
+	}
+
+	var archived int
+	for {
+		n, err := p.archiveBatch(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to archive transactions: %w", err)
+		}
+		archived += n
+		if n < p.retentionCfg.ArchiveBatchSize {
+			break
+		}
+	}
+
+	if archived > 0 {
+		logging.Printf("Archived %d settled transactions", archived)
+	}
+	return nil
+}
+
+// archiveBatch moves up to ArchiveBatchSize transactions and returns how
+// many were moved
+func (p *Processor) archiveBatch(ctx context.Context) (int, error) {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// SKIP LOCKED leaves rows being updated (e.g. a late reprocess) for the
+	// next run instead of waiting on them
+	rows, err := tx.Query(ctx, `
+		SELECT id FROM transactions
+		WHERE status <> 'PENDING'
+		  AND created_at < NOW() - make_interval(secs => $1)
+		ORDER BY created_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, p.retentionCfg.ArchiveAfter.Seconds(), p.retentionCfg.ArchiveBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Attempts first: deleting a transaction would cascade to them
+	_, err = tx.Exec(ctx, `
+		WITH moved AS (
+			DELETE FROM webhook_attempts WHERE transaction_id = ANY($1) RETURNING *
+		)
+		INSERT INTO webhook_attempts_archive SELECT * FROM moved
+	`, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive webhook attempts: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		WITH moved AS (
+			DELETE FROM transactions WHERE id = ANY($1) RETURNING *
+		)
+		INSERT INTO transactions_archive SELECT * FROM moved
+	`, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,243 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errC2BAwaitingSTK is returned by ProcessC2BConfirmation while a PENDING
+// STK Push could be the same payment. Safaricom also sends C2B confirmations
+// for STK Pushes to the short code, and until the STK callback records the
+// receipt the confirmation would otherwise be inserted as a second payment.
+var errC2BAwaitingSTK = errors.New("C2B confirmation may belong to a pending STK Push")
+
+const (
+	// c2bAwaitSTKDelay is how long a deferred confirmation waits before
+	// checking again
+	c2bAwaitSTKDelay = 30 * time.Second
+	// c2bSTKMatchWindow bounds the deferral: STK Pushes created longer ago
+	// are left to the reconciler and no longer hold confirmations back
+	c2bSTKMatchWindow = 15 * time.Minute
+)
+
+// C2BPayload is the body Safaricom posts to the C2B validation and
+// confirmation URLs for a payment made directly to the short code
+type C2BPayload struct {
+	TransactionType   string `json:"TransactionType"`
+	TransID           string `json:"TransID"`
+	TransTime         string `json:"TransTime"`
+	TransAmount       string `json:"TransAmount"`
+	BusinessShortCode string `json:"BusinessShortCode"`
+	BillRefNumber     string `json:"BillRefNumber"`
+	InvoiceNumber     string `json:"InvoiceNumber"`
+	OrgAccountBalance string `json:"OrgAccountBalance"`
+	ThirdPartyTransID string `json:"ThirdPartyTransID"`
+	MSISDN            string `json:"MSISDN"` // Masked or hashed by Safaricom on most accounts
+	FirstName         string `json:"FirstName"`
+	MiddleName        string `json:"MiddleName"`
+	LastName          string `json:"LastName"`
+}
+
+// metadata returns the payload fields stored in mpesa_metadata and sent to
+// the tenant webhook
+func (c *C2BPayload) metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"TransactionType":   c.TransactionType,
+		"TransID":           c.TransID,
+		"TransTime":         c.TransTime,
+		"BusinessShortCode": c.BusinessShortCode,
+		"BillRefNumber":     c.BillRefNumber,
+		"InvoiceNumber":     c.InvoiceNumber,
+		"ThirdPartyTransID": c.ThirdPartyTransID,
+		"MSISDN":            c.MSISDN,
+		"FirstName":         c.FirstName,
+		"MiddleName":        c.MiddleName,
+		"LastName":          c.LastName,
+	}
+}
+
+// NewProcessC2BConfirmationTask creates a C2B confirmation processing task
+// carrying the trace context from ctx. It shares the callback task envelope.
+func NewProcessC2BConfirmationTask(ctx context.Context, confirmation []byte) (*asynq.Task, error) {
+	data, err := json.Marshal(ProcessCallbackPayload{
+		Callback:     confirmation,
+		TraceContext: tracing.Inject(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal C2B confirmation task payload: %w", err)
+	}
+	return asynq.NewTask(TypeProcessC2BConfirmation, data), nil
+}
+
+// C2BConfirmationTaskID is the asynq task ID for a C2B confirmation, so
+// redeliveries of the same TransID are rejected at enqueue time
+func C2BConfirmationTaskID(transID string) string {
+	return "c2b:" + transID
+}
+
+// ProcessC2BConfirmation records a payment confirmed on the C2B
+// confirmation URL
+func (p *Processor) ProcessC2BConfirmation(ctx context.Context, t *asynq.Task) (err error) {
+	payload, err := ParseProcessCallbackPayload(t.Payload())
+	if err != nil {
+		metrics.CallbacksProcessed.WithLabelValues(metrics.CallbackError).Inc()
+		return fmt.Errorf("failed to unmarshal C2B confirmation task: %w", err)
+	}
+
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, payload.TraceContext), "c2b.confirmation.process",
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	defer func() { tracing.End(span, err) }()
+
+	result, err := p.processC2BConfirmation(ctx, payload.Callback)
+	switch {
+	case errors.Is(err, errC2BAwaitingSTK):
+		result = metrics.CallbackDeferred
+	case err != nil:
+		result = metrics.CallbackError
+	}
+	metrics.CallbacksProcessed.WithLabelValues(result).Inc()
+	span.SetAttributes(attribute.String("callback.result", result))
+
+	return err
+}
+
+// processC2BConfirmation inserts a COMPLETED C2B transaction for the
+// confirmation and returns its metrics result label. Confirmations for a
+// receipt already recorded, by an earlier confirmation or a completed STK
+// Push, are skipped, and those that may match a PENDING STK Push are
+// deferred with errC2BAwaitingSTK.
+func (p *Processor) processC2BConfirmation(ctx context.Context, raw []byte) (string, error) {
+	var payload C2BPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return "", fmt.Errorf("failed to unmarshal C2B confirmation: %w", err)
+	}
+	if payload.TransID == "" {
+		return "", fmt.Errorf("missing TransID in C2B confirmation")
+	}
+
+	logging.Printf("Processing C2B confirmation for TransID: %s", payload.TransID)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("mpesa.trans_id", payload.TransID))
+
+	amount, err := decimal.NewFromString(payload.TransAmount)
+	if err != nil || !amount.IsPositive() {
+		return "", fmt.Errorf("invalid TransAmount %q in C2B confirmation", payload.TransAmount)
+	}
+
+	// Masked MSISDNs are kept in the metadata only
+	phone, err := mpesa.NormalizePhone(payload.MSISDN)
+	if err != nil {
+		phone = ""
+	}
+
+	pending, err := p.pendingSTKMatch(ctx, payload.BusinessShortCode, amount, phone)
+	if err != nil {
+		return "", err
+	}
+	if pending {
+		logging.Printf("Deferring C2B confirmation %s: a pending STK Push may be the same payment", payload.TransID)
+		return "", fmt.Errorf("%w: TransID %s", errC2BAwaitingSTK, payload.TransID)
+	}
+
+	metadata := payload.metadata()
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	tx := models.Transaction{
+		InternalTransactionID: uuid.New(),
+		Direction:             models.DirectionC2B,
+		Amount:                amount,
+		Phone:                 phone,
+		Status:                string(models.StatusCompleted),
+		TenantWebhookURL:      p.webhookCfg.C2BWebhookURL,
+	}
+
+	// INSERT ... SELECT does not infer parameter types from the target
+	// columns, hence the casts
+	insertSQL := `
+		INSERT INTO transactions (
+			internal_transaction_id, direction, amount, phone, status,
+			mpesa_metadata, mpesa_receipt_number, tenant_webhook_url, completed_at
+		)
+		SELECT $1::uuid, $2::text, $3::numeric, $4::text, $5::text, $6::jsonb, $7::text, $8::text, NOW()
+		WHERE NOT EXISTS (SELECT 1 FROM transactions WHERE mpesa_receipt_number = $7::text)
+		ON CONFLICT (mpesa_receipt_number)
+			WHERE checkout_request_id IS NULL AND conversation_id IS NULL AND mpesa_receipt_number IS NOT NULL
+			DO NOTHING
+		RETURNING id, created_at, updated_at
+	`
+
+	err = p.db.QueryRow(ctx, insertSQL,
+		tx.InternalTransactionID,
+		tx.Direction,
+		tx.Amount,
+		tx.Phone,
+		tx.Status,
+		metadataJSON,
+		payload.TransID,
+		tx.TenantWebhookURL,
+	).Scan(&tx.ID, &tx.CreatedAt, &tx.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		logging.Printf("C2B confirmation %s already recorded", payload.TransID)
+		return metrics.CallbackSkipped, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to insert C2B transaction: %w", err)
+	}
+
+	logging.Printf("C2B payment %s recorded as transaction %s", payload.TransID, tx.InternalTransactionID)
+
+	if tx.TenantWebhookURL != "" {
+		if err := p.enqueueWebhook(ctx, &tx, models.StatusCompleted, metadata, nil); err != nil {
+			logging.Printf("Failed to queue webhook for %s: %v", tx.InternalTransactionID, err)
+		}
+	}
+
+	return metrics.CallbackCompleted, nil
+}
+
+// pendingSTKMatch reports whether a recent PENDING STK Push to shortCode
+// for amount could be the payment a confirmation describes. The phone is
+// only compared when known, as Safaricom masks MSISDNs on most accounts.
+func (p *Processor) pendingSTKMatch(ctx context.Context, shortCode string, amount decimal.Decimal, phone string) (bool, error) {
+	tenantIDs, isDefault := p.paymentService.TenantsForShortCode(shortCode)
+	if len(tenantIDs) == 0 && !isDefault {
+		return false, nil
+	}
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM transactions
+			WHERE status = 'PENDING'
+			  AND checkout_request_id IS NOT NULL
+			  AND amount = $1
+			  AND created_at > $2
+			  AND ($3 = '' OR phone = $3)
+			  AND (tenant_id = ANY($4) OR (tenant_id IS NULL AND $5))
+		)
+	`
+
+	var exists bool
+	err := p.db.QueryRow(ctx, query, amount, time.Now().Add(-c2bSTKMatchWindow), phone, tenantIDs, isDefault).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for pending STK Push: %w", err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// SQLSTATEs for errors that succeed when the statement is simply re-run
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+// isContentionError reports whether err is a Postgres serialization failure
+// or deadlock
+func isContentionError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == pgSerializationFailure || pgErr.Code == pgDeadlockDetected
+}
+
+// retryOnContention runs fn, re-running it up to retries more times while it
+// fails with a contention error. Waits start at delay and double per retry,
+// jittered so colliding callbacks do not collide again.
+func retryOnContention(ctx context.Context, retries int, delay time.Duration, fn func() error) error {
+	err := fn()
+	for attempt := 0; attempt < retries && isContentionError(err); attempt++ {
+		wait := delay << attempt
+		if wait > 0 {
+			wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/txcache"
+)
+
+// CallbackConfig controls duplicate callback suppression, contention
+// handling and transaction lookup caching
+type CallbackConfig struct {
+	Redis    redis.UniversalClient
+	DedupTTL time.Duration // How long a CheckoutRequestID stays claimed; 0 disables
+
+	// Serialization failures and deadlocks on the status update are retried
+	// in the task this many times, waiting DBRetryDelay doubled per retry,
+	// before the task fails back to asynq
+	DBRetries    int
+	DBRetryDelay time.Duration
+
+	// CheckMerchantID compares a callback's MerchantRequestID with the one
+	// stored for its CheckoutRequestID and logs mismatches;
+	// RejectMerchantIDMismatch also drops the callback
+	CheckMerchantID          bool
+	RejectMerchantIDMismatch bool
+
+	// TxCache serves callback transaction lookups; nil disables caching.
+	// Entries are dropped here when a callback or reconciliation settles
+	// the transaction.
+	TxCache *txcache.Cache
+}
+
+// releaseClaimScript deletes the claim only if this task still holds it
+var releaseClaimScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// callbackDedupKey is the Redis key claimed while a callback is processed
+func callbackDedupKey(checkoutRequestID string) string {
+	return "callback:dedup:" + checkoutRequestID
+}
+
+// claimCallback reports whether the current task may process the callback
+// for checkoutRequestID. The first task to arrive claims it for DedupTTL;
+// asynq retries of that task keep their claim. Redis errors fail open since
+// the PENDING guard on the update still prevents double application.
+func (p *Processor) claimCallback(ctx context.Context, checkoutRequestID string) bool {
+	if p.callbackCfg.DedupTTL <= 0 || p.callbackCfg.Redis == nil {
+		return true
+	}
+
+	taskID, _ := asynq.GetTaskID(ctx)
+	key := callbackDedupKey(checkoutRequestID)
+
+	claimed, err := p.callbackCfg.Redis.SetNX(ctx, key, taskID, p.callbackCfg.DedupTTL).Result()
+	if err != nil {
+		logging.Printf("Callback dedup unavailable, processing %s: %v", checkoutRequestID, err)
+		return true
+	}
+	if claimed {
+		return true
+	}
+
+	holder, err := p.callbackCfg.Redis.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			// Claim expired or was released in between; treat as ours
+			return true
+		}
+		logging.Printf("Callback dedup unavailable, processing %s: %v", checkoutRequestID, err)
+		return true
+	}
+
+	return holder == taskID
+}
+
+// releaseCallback drops this task's claim so a retry or a later duplicate
+// can process the callback after a failure
+func (p *Processor) releaseCallback(ctx context.Context, checkoutRequestID string) {
+	if p.callbackCfg.DedupTTL <= 0 || p.callbackCfg.Redis == nil {
+		return
+	}
+
+	taskID, _ := asynq.GetTaskID(ctx)
+	if err := releaseClaimScript.Run(ctx, p.callbackCfg.Redis, []string{callbackDedupKey(checkoutRequestID)}, taskID).Err(); err != nil {
+		logging.Printf("Failed to release callback claim for %s: %v", checkoutRequestID, err)
+	}
+}
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpesa-gateway/internal/metrics"
+)
+
+// errWebhookHostBusy is returned by DeliverWebhook when the webhook host
+// already has MaxPerHost deliveries in flight. The task is retried shortly
+// without using up one of its retries.
+var errWebhookHostBusy = errors.New("webhook host at concurrency limit")
+
+// webhookHostBusyDelay is how long a delivery deferred by the per-host
+// limit waits before trying again
+const webhookHostBusyDelay = 2 * time.Second
+
+// hostLimiter caps concurrent webhook deliveries per host within this
+// process
+type hostLimiter struct {
+	max int // 0 = unlimited
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newHostLimiter(max int) *hostLimiter {
+	return &hostLimiter{max: max, inFlight: make(map[string]int)}
+}
+
+// tryAcquire takes a delivery slot for the host of webhookURL without
+// waiting. The returned func releases it.
+func (l *hostLimiter) tryAcquire(webhookURL string) (string, func(), bool) {
+	host := webhookHost(webhookURL)
+	if l.max <= 0 {
+		return host, func() {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[host] >= l.max {
+		return host, nil, false
+	}
+	l.inFlight[host]++
+	metrics.WebhookInFlight.WithLabelValues(host).Inc()
+
+	return host, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// Drop idle hosts so the map only holds hosts being delivered to
+		if l.inFlight[host]--; l.inFlight[host] <= 0 {
+			delete(l.inFlight, host)
+		}
+		metrics.WebhookInFlight.WithLabelValues(host).Dec()
+	}, true
+}
+
+// webhookHost returns the lower-cased host[:port] deliveries are limited by
+func webhookHost(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Host == "" {
+		return webhookURL
+	}
+	return strings.ToLower(u.Host)
+}
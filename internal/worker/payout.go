@@ -0,0 +1,232 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hibiken/asynq"
+
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
+	"github.com/mpesa-gateway/internal/models"
+	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// B2CResultPayload is the body Safaricom posts to the B2C result and queue
+// timeout URLs
+type B2CResultPayload struct {
+	Result struct {
+		ResultType               int        `json:"ResultType"`
+		ResultCode               ResultCode `json:"ResultCode"`
+		ResultDesc               string     `json:"ResultDesc"`
+		OriginatorConversationID string     `json:"OriginatorConversationID"`
+		ConversationID           string     `json:"ConversationID"`
+		TransactionID            string     `json:"TransactionID"`
+		ResultParameters         struct {
+			ResultParameter []mpesa.ResultParameter `json:"ResultParameter"`
+		} `json:"ResultParameters"`
+	} `json:"Result"`
+}
+
+// ResultCode is a Result.ResultCode. Safaricom sends it as a number on B2C
+// results but as a numeric string on some queue timeouts, so both decode.
+type ResultCode int
+
+// UnmarshalJSON accepts 2001 and "2001"
+func (c *ResultCode) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(b, &n); err == nil {
+		*c = ResultCode(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("ResultCode must be a number or numeric string: %s", b)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("ResultCode must be a number or numeric string: %q", s)
+	}
+	*c = ResultCode(n)
+	return nil
+}
+
+// ValidateB2CResultShape checks that a B2C result or queue timeout carries
+// the fields processing depends on. A missing ResultCode would otherwise
+// read as success.
+func ValidateB2CResultShape(raw []byte) error {
+	var shape struct {
+		Result *struct {
+			ConversationID *string     `json:"ConversationID"`
+			ResultCode     *ResultCode `json:"ResultCode"`
+		} `json:"Result"`
+	}
+	if err := json.Unmarshal(raw, &shape); err != nil {
+		return err
+	}
+
+	switch {
+	case shape.Result == nil:
+		return errors.New("missing Result")
+	case shape.Result.ConversationID == nil || *shape.Result.ConversationID == "":
+		return errors.New("missing Result.ConversationID")
+	case shape.Result.ResultCode == nil:
+		return errors.New("missing Result.ResultCode")
+	}
+	return nil
+}
+
+// NewProcessB2CResultTask creates a new B2C result processing task carrying
+// the trace context from ctx. It shares the callback task envelope.
+func NewProcessB2CResultTask(ctx context.Context, result []byte) (*asynq.Task, error) {
+	data, err := json.Marshal(ProcessCallbackPayload{
+		Callback:     result,
+		TraceContext: tracing.Inject(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal B2C result task payload: %w", err)
+	}
+	return asynq.NewTask(TypeProcessB2CResult, data), nil
+}
+
+// ProcessB2CResult processes an asynchronous B2C payout result
+func (p *Processor) ProcessB2CResult(ctx context.Context, t *asynq.Task) (err error) {
+	payload, err := ParseProcessCallbackPayload(t.Payload())
+	if err != nil {
+		metrics.CallbacksProcessed.WithLabelValues(metrics.CallbackError).Inc()
+		return fmt.Errorf("failed to unmarshal B2C result task: %w", err)
+	}
+
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, payload.TraceContext), "b2c.result.process",
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	defer func() { tracing.End(span, err) }()
+
+	result, err := p.processB2CResult(ctx, payload.Callback)
+	if err != nil {
+		result = metrics.CallbackError
+	}
+	metrics.CallbacksProcessed.WithLabelValues(result).Inc()
+	span.SetAttributes(attribute.String("callback.result", result))
+
+	return err
+}
+
+// processB2CResult applies a B2C result and returns its metrics result label
+func (p *Processor) processB2CResult(ctx context.Context, raw []byte) (string, error) {
+	var payload B2CResultPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return "", fmt.Errorf("failed to unmarshal B2C result: %w", err)
+	}
+
+	res := payload.Result
+	if res.ConversationID == "" {
+		return "", fmt.Errorf("missing ConversationID in B2C result")
+	}
+
+	logging.Printf("Processing B2C result for ConversationID: %s", res.ConversationID)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("mpesa.conversation_id", res.ConversationID))
+
+	tx, err := p.getTransactionByConversationID(ctx, res.ConversationID)
+	if err != nil {
+		return "", fmt.Errorf("failed to find transaction: %w", err)
+	}
+
+	currentStatus := models.TransactionStatus(tx.Status)
+	if currentStatus != models.StatusPending {
+		logging.Printf("Transaction %s is already in terminal state: %s", tx.InternalTransactionID, currentStatus)
+		return metrics.CallbackSkipped, nil
+	}
+
+	var newStatus models.TransactionStatus
+	var errorMsg *string
+	var failure *mpesa.Failure
+
+	if res.ResultCode == 0 {
+		newStatus = models.StatusCompleted
+	} else {
+		msg := res.ResultDesc
+		errorMsg = &msg
+		failure = mpesa.NewFailure(int(res.ResultCode), msg)
+		newStatus = models.StatusFailed
+	}
+
+	metadata := mpesa.ParseResultParameters(res.ResultParameters.ResultParameter)
+	if res.TransactionID != "" {
+		metadata["TransactionID"] = res.TransactionID
+	}
+	metadataJSON, err := mpesa.MetadataJSON(metadata, failure)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	updateSQL := `
+		UPDATE transactions 
+		SET status = $1, 
+		    mpesa_metadata = $2, 
+		    error_message = $3,
+		    mpesa_receipt_number = $4,
+		    completed_at = NOW()
+		WHERE conversation_id = $5 AND status = 'PENDING'
+	`
+
+	result, err := p.db.Exec(ctx, updateSQL, string(newStatus), metadataJSON, errorMsg, mpesa.ReceiptNumber(metadata), res.ConversationID)
+	if err != nil {
+		return "", fmt.Errorf("failed to update transaction: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		logging.Printf("No rows updated for ConversationID: %s (may have been processed already)", res.ConversationID)
+		return metrics.CallbackSkipped, nil
+	}
+
+	logging.Printf("Payout %s updated to status: %s", tx.InternalTransactionID, newStatus)
+
+	if err := p.enqueueWebhook(ctx, tx, newStatus, metadata, failure); err != nil {
+		logging.Printf("Failed to queue webhook for %s: %v", tx.InternalTransactionID, err)
+	}
+
+	if newStatus == models.StatusCompleted {
+		return metrics.CallbackCompleted, nil
+	}
+	return metrics.CallbackFailed, nil
+}
+
+// getTransactionByConversationID fetches a B2C transaction from database
+func (p *Processor) getTransactionByConversationID(ctx context.Context, conversationID string) (*models.Transaction, error) {
+	query := `
+		SELECT id, internal_transaction_id, idempotency_key, conversation_id,
+		       direction, amount, requested_amount, phone, status, tenant_webhook_url, request_id, created_at, updated_at
+		FROM transactions 
+		WHERE conversation_id = $1
+	`
+
+	var tx models.Transaction
+	err := p.db.QueryRow(ctx, query, conversationID).Scan(
+		&tx.ID,
+		&tx.InternalTransactionID,
+		&tx.IdempotencyKey,
+		&tx.ConversationID,
+		&tx.Direction,
+		&tx.Amount,
+		&tx.RequestedAmount,
+		&tx.Phone,
+		&tx.Status,
+		&tx.TenantWebhookURL,
+		&tx.RequestID,
+		&tx.CreatedAt,
+		&tx.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/mpesa-gateway/internal/mpesa"
+)
+
+// Callback bodies as Safaricom posts them, from the Daraja B2C documentation
+const (
+	b2cResultSuccess = `{
+  "Result": {
+    "ResultType": 0,
+    "ResultCode": 0,
+    "ResultDesc": "The service request is processed successfully.",
+    "OriginatorConversationID": "10571-7910404-1",
+    "ConversationID": "AG_20191219_00004e48cf7e3533f581",
+    "TransactionID": "NLJ41HAY6Q",
+    "ResultParameters": {
+      "ResultParameter": [
+        {"Key": "TransactionAmount", "Value": 10},
+        {"Key": "TransactionReceipt", "Value": "NLJ41HAY6Q"},
+        {"Key": "B2CRecipientIsRegisteredCustomer", "Value": "Y"},
+        {"Key": "B2CChargesPaidAccountAvailableFunds", "Value": -4510.00},
+        {"Key": "ReceiverPartyPublicName", "Value": "254708374149 - John Doe"},
+        {"Key": "TransactionCompletedDateTime", "Value": "19.12.2019 11:45:50"},
+        {"Key": "B2CUtilityAccountAvailableFunds", "Value": 10116.00},
+        {"Key": "B2CWorkingAccountAvailableFunds", "Value": 900000.00}
+      ]
+    },
+    "ReferenceData": {
+      "ReferenceItem": {
+        "Key": "QueueTimeoutURL",
+        "Value": "https://internalsandbox.safaricom.co.ke/mpesa/b2cresults/v1/submit"
+      }
+    }
+  }
+}`
+
+	b2cResultFailure = `{
+  "Result": {
+    "ResultType": 0,
+    "ResultCode": 2001,
+    "ResultDesc": "The initiator information is invalid.",
+    "OriginatorConversationID": "29112-34801843-1",
+    "ConversationID": "AG_20191219_00006c6fddb15123addf",
+    "TransactionID": "NLJ0000000",
+    "ReferenceData": {
+      "ReferenceItem": {
+        "Key": "QueueTimeoutURL",
+        "Value": "https://internalsandbox.safaricom.co.ke/mpesa/b2cresults/v1/submit"
+      }
+    }
+  }
+}`
+
+	// Queue timeouts carry ResultCode as a string
+	b2cQueueTimeout = `{
+  "Result": {
+    "ResultType": 1,
+    "ResultCode": "1037",
+    "ResultDesc": "DS timeout user cannot be reached",
+    "OriginatorConversationID": "8574-61118424-1",
+    "ConversationID": "AG_20231010_2010366f4e15b0d4c6c4",
+    "TransactionID": "RJA0000000"
+  }
+}`
+
+	stkCallbackSuccess = `{
+  "Body": {
+    "stkCallback": {
+      "MerchantRequestID": "29115-34620561-1",
+      "CheckoutRequestID": "ws_CO_191220191020363925",
+      "ResultCode": 0,
+      "ResultDesc": "The service request is processed successfully.",
+      "CallbackMetadata": {
+        "Item": [
+          {"Name": "Amount", "Value": 1.00},
+          {"Name": "MpesaReceiptNumber", "Value": "NLJ7RT61SV"},
+          {"Name": "TransactionDate", "Value": 20191219102115},
+          {"Name": "PhoneNumber", "Value": 254708374149}
+        ]
+      }
+    }
+  }
+}`
+)
+
+func TestDetectCallbackKind(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"B2C success result", b2cResultSuccess, CallbackKindB2CResult},
+		{"B2C failure result", b2cResultFailure, CallbackKindB2CResult},
+		{"B2C queue timeout", b2cQueueTimeout, CallbackKindB2CResult},
+		{"STK callback", stkCallbackSuccess, CallbackKindSTK},
+		{"null Result", `{"Result": null}`, CallbackKindUnknown},
+		{"empty Body", `{"Body": {}}`, CallbackKindUnknown},
+		{"not JSON", `<xml/>`, CallbackKindUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectCallbackKind([]byte(tt.raw)); got != tt.want {
+				t.Errorf("DetectCallbackKind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateB2CResultShape(t *testing.T) {
+	for name, raw := range map[string]string{
+		"success":       b2cResultSuccess,
+		"failure":       b2cResultFailure,
+		"queue timeout": b2cQueueTimeout,
+	} {
+		if err := ValidateB2CResultShape([]byte(raw)); err != nil {
+			t.Errorf("ValidateB2CResultShape(%s) = %v", name, err)
+		}
+	}
+
+	for name, raw := range map[string]string{
+		"STK callback":           stkCallbackSuccess,
+		"missing ResultCode":     `{"Result": {"ConversationID": "AG_20191219_00004e48cf7e3533f581"}}`,
+		"missing ConversationID": `{"Result": {"ResultCode": 0}}`,
+		"non-numeric ResultCode": `{"Result": {"ConversationID": "AG_1", "ResultCode": "timeout"}}`,
+	} {
+		if err := ValidateB2CResultShape([]byte(raw)); err == nil {
+			t.Errorf("ValidateB2CResultShape(%s) = nil, want an error", name)
+		}
+	}
+}
+
+func TestB2CResultPayloadDecodesSamples(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		wantCode    ResultCode
+		wantConvID  string
+		wantReceipt string
+	}{
+		{"success", b2cResultSuccess, 0, "AG_20191219_00004e48cf7e3533f581", "NLJ41HAY6Q"},
+		{"failure", b2cResultFailure, 2001, "AG_20191219_00006c6fddb15123addf", ""},
+		{"queue timeout", b2cQueueTimeout, 1037, "AG_20231010_2010366f4e15b0d4c6c4", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload B2CResultPayload
+			if err := json.Unmarshal([]byte(tt.raw), &payload); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if payload.Result.ResultCode != tt.wantCode {
+				t.Errorf("ResultCode = %d, want %d", payload.Result.ResultCode, tt.wantCode)
+			}
+			if payload.Result.ConversationID != tt.wantConvID {
+				t.Errorf("ConversationID = %q, want %q", payload.Result.ConversationID, tt.wantConvID)
+			}
+
+			metadata := mpesa.ParseResultParameters(payload.Result.ResultParameters.ResultParameter)
+			receipt := mpesa.ReceiptNumber(metadata)
+			switch {
+			case tt.wantReceipt == "" && receipt != nil:
+				t.Errorf("ReceiptNumber() = %q, want none", *receipt)
+			case tt.wantReceipt != "" && (receipt == nil || *receipt != tt.wantReceipt):
+				t.Errorf("ReceiptNumber() = %v, want %q", receipt, tt.wantReceipt)
+			}
+		})
+	}
+}
+
+func TestB2CResultTaskRoundTrip(t *testing.T) {
+	task, err := NewProcessB2CResultTask(context.Background(), []byte(b2cResultSuccess))
+	if err != nil {
+		t.Fatalf("NewProcessB2CResultTask() error = %v", err)
+	}
+
+	payload, err := ParseProcessCallbackPayload(task.Payload())
+	if err != nil {
+		t.Fatalf("ParseProcessCallbackPayload() error = %v", err)
+	}
+	if got := DetectCallbackKind(payload.Callback); got != CallbackKindB2CResult {
+		t.Errorf("DetectCallbackKind(task callback) = %q, want %q", got, CallbackKindB2CResult)
+	}
+}
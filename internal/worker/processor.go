@@ -5,103 +5,403 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/tls"
+	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/metrics"
 	"github.com/mpesa-gateway/internal/models"
 	"github.com/mpesa-gateway/internal/mpesa"
+	"github.com/mpesa-gateway/internal/payment"
+	"github.com/mpesa-gateway/internal/tracing"
+	"github.com/mpesa-gateway/internal/txcache"
+	"github.com/mpesa-gateway/internal/urlguard"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	TypeProcessCallback = "callback:process"
+	TypeProcessCallback  = "callback:process"
+	TypeReconcilePending = "transactions:reconcile_pending"
+	TypeDeliverWebhook   = "webhook:deliver"
+	TypeProcessB2CResult = "b2c:process_result"
+	TypeNotifyPending    = "webhook:notify_pending"
+
+	TypeProcessC2BConfirmation = "c2b:process_confirmation"
+
+	TypePurgeIdempotencyKeys = "transactions:purge_idempotency_keys"
+	TypeArchiveTransactions  = "transactions:archive"
+	TypePurgeAPILogs         = "api_logs:purge"
 )
 
 // Processor handles background job processing
 type Processor struct {
-	db     *pgxpool.Pool
-	client *http.Client
+	db             *pgxpool.Pool
+	queueClient    *asynq.Client
+	paymentService *payment.Service
+	reconcileCfg   ReconcileConfig
+	retentionCfg   RetentionConfig
+	webhookCfg     WebhookConfig
+	callbackCfg    CallbackConfig
+	client         *http.Client
+	hostLimiter    *hostLimiter
+
+	onWebhookResult func(WebhookEvent)
+}
+
+// WebhookEvent describes the outcome of one webhook delivery attempt
+type WebhookEvent struct {
+	TransactionID uuid.UUID // Internal transaction ID returned to the tenant
+	Attempt       int       // 1 for the first delivery, incremented per retry
+	StatusCode    int       // 0 when no response was received
+	Success       bool
+	Final         bool // No further retries will be made
+}
+
+// ReconcileConfig controls the sweep over stuck PENDING transactions
+type ReconcileConfig struct {
+	PendingAge time.Duration // Minimum age before a PENDING transaction is queried
+	BatchSize  int           // Maximum transactions queried per run
+}
+
+// RetentionConfig controls how long settled transactions keep their
+// idempotency keys and stay in the live tables
+type RetentionConfig struct {
+	IdempotencyKeyTTL time.Duration // 0 keeps keys forever
+	ArchiveAfter      time.Duration // Age at which settled transactions are archived; 0 never archives
+	ArchiveBatchSize  int           // Transactions moved per database transaction
+	APILogTTL         time.Duration // Age at which mpesa_api_logs rows are deleted; 0 keeps them forever
+}
+
+// WebhookConfig controls tenant webhook retries
+type WebhookConfig struct {
+	MaxRetries    int             // Retries after the first delivery attempt
+	BackoffBase   time.Duration   // Upper bound of the first retry's delay, doubled per retry
+	BackoffMax    time.Duration   // Cap on the upper bound
+	Timeout       time.Duration   // Deadline for each delivery attempt
+	MaxBody       int64           // Bytes of each response body read and recorded
+	DefaultSecret string          // HMAC key when the transaction has no webhook_secret
+	Policy        urlguard.Policy // Allowed webhook destinations
+	MaxPerHost    int             // Concurrent deliveries per webhook host in this process (0 = unlimited)
+
+	// Extra headers per tenant ID, then per exact webhook URL. Values
+	// often hold credentials and are never logged or recorded.
+	TenantHeaders map[string]map[string]map[string]string
+
+	// Signature algorithm per tenant ID ("hmac-sha256" or "hmac-sha512");
+	// tenants not listed, and transactions without a tenant, use hmac-sha256
+	TenantSignatureAlgorithms map[string]string
+
+	// C2BWebhookURL is notified of payments confirmed on the C2B
+	// confirmation URL; empty records them without a webhook
+	C2BWebhookURL string
+
+	// Transport must vet dialled addresses with Policy.DialControl to
+	// defeat DNS rebinding
+	Transport http.RoundTripper
 }
 
 // NewProcessor creates a new worker processor
-func NewProcessor(db *pgxpool.Pool) *Processor {
+func NewProcessor(db *pgxpool.Pool, queueClient *asynq.Client, paymentService *payment.Service, reconcileCfg ReconcileConfig, retentionCfg RetentionConfig, webhookCfg WebhookConfig, callbackCfg CallbackConfig) *Processor {
 	return &Processor{
-		db: db,
+		db:             db,
+		queueClient:    queueClient,
+		paymentService: paymentService,
+		reconcileCfg:   reconcileCfg,
+		retentionCfg:   retentionCfg,
+		webhookCfg:     webhookCfg,
+		callbackCfg:    callbackCfg,
+		hostLimiter:    newHostLimiter(webhookCfg.MaxPerHost),
+		// Attempts are bounded by webhookCfg.Timeout in deliverWebhook
 		client: &http.Client{
-			Timeout: 10 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					MinVersion: tls.VersionTLS12,
-				},
+			Transport: webhookCfg.Transport,
+			// Redirects could point at internal hosts; the dialer still guards them
+			// but tenants should register their final URL
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
 			},
 		},
 	}
 }
 
-// NewProcessCallbackTask creates a new callback processing task
-func NewProcessCallbackTask(payload []byte) (*asynq.Task, error) {
-	return asynq.NewTask(TypeProcessCallback, payload), nil
+// OnWebhookResult registers fn to be called after every webhook delivery
+// attempt. fn runs on the worker goroutine, so it must not block. Register it
+// before the asynq server starts; a nil fn disables the hook.
+func (p *Processor) OnWebhookResult(fn func(WebhookEvent)) {
+	p.onWebhookResult = fn
+}
+
+// ProcessCallbackPayload is the payload of a TypeProcessCallback task
+type ProcessCallbackPayload struct {
+	Callback     json.RawMessage   `json:"callback"`                // Body exactly as Safaricom sent it
+	TraceContext map[string]string `json:"trace_context,omitempty"` // W3C trace context of the enqueuer
+	Reprocess    bool              `json:"reprocess,omitempty"`     // Operator replay; bypasses duplicate suppression
+}
+
+// NewProcessCallbackTask creates a new callback processing task carrying the
+// trace context from ctx
+func NewProcessCallbackTask(ctx context.Context, callback []byte) (*asynq.Task, error) {
+	data, err := json.Marshal(ProcessCallbackPayload{
+		Callback:     callback,
+		TraceContext: tracing.Inject(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal callback task payload: %w", err)
+	}
+	return asynq.NewTask(TypeProcessCallback, data), nil
+}
+
+// CallbackTaskID is the asynq task ID for a Safaricom callback. Deriving it
+// from the CheckoutRequestID makes asynq reject redeliveries at enqueue time.
+func CallbackTaskID(checkoutRequestID string) string {
+	return "callback:" + checkoutRequestID
+}
+
+// NewReprocessCallbackTask creates a callback task for an operator replay of
+// a stored callback. Unlike Safaricom redeliveries it is not deduplicated.
+func NewReprocessCallbackTask(ctx context.Context, callback []byte) (*asynq.Task, error) {
+	data, err := json.Marshal(ProcessCallbackPayload{
+		Callback:     callback,
+		TraceContext: tracing.Inject(ctx),
+		Reprocess:    true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal callback task payload: %w", err)
+	}
+	return asynq.NewTask(TypeProcessCallback, data), nil
+}
+
+// ParseProcessCallbackPayload decodes a TypeProcessCallback task payload.
+// Tasks enqueued before the envelope was introduced hold the raw callback.
+func ParseProcessCallbackPayload(data []byte) (*ProcessCallbackPayload, error) {
+	var payload ProcessCallbackPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	if len(payload.Callback) == 0 {
+		payload.Callback = data
+	}
+	return &payload, nil
+}
+
+// DeliverWebhookPayload is the payload of a TypeDeliverWebhook task
+type DeliverWebhookPayload struct {
+	TransactionID         uuid.UUID         `json:"transaction_id"`
+	InternalTransactionID uuid.UUID         `json:"internal_transaction_id"`
+	WebhookURL            string            `json:"webhook_url"`
+	Body                  json.RawMessage   `json:"body"`
+	RequestID             string            `json:"request_id,omitempty"` // Sent as X-Request-ID
+	Pending               bool              `json:"pending,omitempty"`    // PENDING acknowledgement; dropped once the transaction is terminal
+	TraceContext          map[string]string `json:"trace_context,omitempty"`
+}
+
+// NotifyPendingPayload is the payload of a TypeNotifyPending task
+type NotifyPendingPayload struct {
+	CheckoutRequestID string            `json:"checkout_request_id"`
+	TraceContext      map[string]string `json:"trace_context,omitempty"`
+}
+
+// NewNotifyPendingTask creates a task that sends the PENDING acknowledgement
+// webhook for a transaction whose STK prompt was sent
+func NewNotifyPendingTask(ctx context.Context, checkoutRequestID string) (*asynq.Task, error) {
+	data, err := json.Marshal(NotifyPendingPayload{
+		CheckoutRequestID: checkoutRequestID,
+		TraceContext:      tracing.Inject(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notify pending task payload: %w", err)
+	}
+	return asynq.NewTask(TypeNotifyPending, data), nil
+}
+
+// NewDeliverWebhookTask creates a new webhook delivery task
+func NewDeliverWebhookTask(payload DeliverWebhookPayload) (*asynq.Task, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook task payload: %w", err)
+	}
+	return asynq.NewTask(TypeDeliverWebhook, data), nil
+}
+
+// IsFailure is the asynq IsFailure func for the worker server. A delivery
+// deferred by the per-host limit never reached the tenant, so it is retried
+// without counting against MPESA_WEBHOOK_MAX_RETRIES. Likewise a C2B
+// confirmation waiting on a pending STK Push has not failed.
+func (p *Processor) IsFailure(err error) bool {
+	return err != nil && !errors.Is(err, errWebhookHostBusy) && !errors.Is(err, errC2BAwaitingSTK)
+}
+
+// RetryDelay is the asynq RetryDelayFunc for the worker server. Webhook
+// deliveries back off exponentially with full jitter (n is the number of
+// retries so far), or wait webhookHostBusyDelay when their host was at its
+// concurrency limit. Deferred C2B confirmations wait c2bAwaitSTKDelay; other
+// tasks use asynq's default.
+func (p *Processor) RetryDelay(n int, err error, t *asynq.Task) time.Duration {
+	if errors.Is(err, errWebhookHostBusy) {
+		return webhookHostBusyDelay
+	}
+	if errors.Is(err, errC2BAwaitingSTK) {
+		return c2bAwaitSTKDelay
+	}
+	if t.Type() == TypeDeliverWebhook && p.webhookCfg.BackoffBase > 0 {
+		return webhookBackoff(n, p.webhookCfg.BackoffBase, p.webhookCfg.BackoffMax)
+	}
+	return asynq.DefaultRetryDelayFunc(n, err, t)
+}
+
+// webhookBackoff returns a random delay in [0, min(base*2^n, ceiling)).
+// Full jitter spreads out retries of deliveries that failed together, e.g.
+// because their endpoint went down, instead of retrying them in lockstep.
+func webhookBackoff(n int, base, ceiling time.Duration) time.Duration {
+	bound := base
+	for i := 0; i < n && bound < ceiling; i++ {
+		bound *= 2
+	}
+	if ceiling > 0 && bound > ceiling {
+		bound = ceiling
+	}
+	return time.Duration(rand.Int63n(int64(bound)))
+}
+
+// NewReconcilePendingTask creates a new pending-transaction reconciliation task
+func NewReconcilePendingTask() *asynq.Task {
+	return asynq.NewTask(TypeReconcilePending, nil)
 }
 
 // ProcessCallback processes M-Pesa callback
-func (p *Processor) ProcessCallback(ctx context.Context, t *asynq.Task) error {
+func (p *Processor) ProcessCallback(ctx context.Context, t *asynq.Task) (err error) {
+	payload, err := ParseProcessCallbackPayload(t.Payload())
+	if err != nil {
+		metrics.CallbacksProcessed.WithLabelValues(metrics.CallbackError).Inc()
+		return fmt.Errorf("failed to unmarshal callback task: %w", err)
+	}
+
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, payload.TraceContext), "callback.process",
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	defer func() { tracing.End(span, err) }()
+
+	var result string
+	if DetectCallbackKind(payload.Callback) == CallbackKindB2CResult {
+		// A B2C result posted to the STK callback URL
+		result, err = p.processB2CResult(ctx, payload.Callback)
+	} else {
+		result, err = p.processCallback(ctx, payload.Callback, !payload.Reprocess)
+	}
+	if err != nil {
+		result = metrics.CallbackError
+	}
+	metrics.CallbacksProcessed.WithLabelValues(result).Inc()
+	span.SetAttributes(attribute.String("callback.result", result))
+
+	return err
+}
+
+// processCallback applies a callback and returns its metrics result label.
+// With dedup set, concurrent duplicates of a callback are skipped.
+func (p *Processor) processCallback(ctx context.Context, raw []byte, dedup bool) (_ string, err error) {
 	var callback CallbackPayload
-	if err := json.Unmarshal(t.Payload(), &callback); err != nil {
-		return fmt.Errorf("failed to unmarshal callback: %w", err)
+	if err := json.Unmarshal(raw, &callback); err != nil {
+		return "", fmt.Errorf("failed to unmarshal callback: %w", err)
 	}
 
-	log.Printf("Processing callback for CheckoutRequestID: %s", callback.Body.StkCallback.CheckoutRequestID)
+	logging.Printf("Processing callback for CheckoutRequestID: %s", callback.Body.StkCallback.CheckoutRequestID)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("mpesa.checkout_request_id", callback.Body.StkCallback.CheckoutRequestID))
+
+	// Persist the raw callback before any validation so disputes can be
+	// investigated even when processing fails
+	p.recordCallback(ctx, raw, &callback)
 
 	// Extract checkout request ID
 	checkoutRequestID := callback.Body.StkCallback.CheckoutRequestID
 	if checkoutRequestID == "" {
-		return fmt.Errorf("missing CheckoutRequestID in callback")
+		return "", fmt.Errorf("missing CheckoutRequestID in callback")
 	}
 
-	// Find transaction in database
-	tx, err := p.getTransactionByCheckoutID(ctx, checkoutRequestID)
+	// Safaricom sometimes delivers the same callback twice; let only the
+	// first task through and acknowledge the rest
+	if dedup {
+		if !p.claimCallback(ctx, checkoutRequestID) {
+			logging.Printf("Skipping duplicate callback for CheckoutRequestID: %s", checkoutRequestID)
+			return metrics.CallbackSkipped, nil
+		}
+		defer func() {
+			if err != nil {
+				p.releaseCallback(ctx, checkoutRequestID)
+			}
+		}()
+	}
+
+	// Find transaction; a cached entry is always PENDING and at worst
+	// stale, which the status-guarded update below absorbs
+	tx, err := p.callbackCfg.TxCache.Lookup(ctx, p.db, checkoutRequestID)
 	if err != nil {
-		return fmt.Errorf("failed to find transaction: %w", err)
+		return "", fmt.Errorf("failed to find transaction: %w", err)
+	}
+
+	// A different MerchantRequestID means the checkout ID collided or the
+	// callback was forged
+	if p.callbackCfg.CheckMerchantID && tx.MerchantRequestID != nil &&
+		*tx.MerchantRequestID != callback.Body.StkCallback.MerchantRequestID {
+		metrics.CallbackMerchantIDMismatches.Inc()
+		logging.Printf("MerchantRequestID mismatch for CheckoutRequestID %s: callback has %q, transaction %s has %q",
+			checkoutRequestID, callback.Body.StkCallback.MerchantRequestID, tx.InternalTransactionID, *tx.MerchantRequestID)
+		if p.callbackCfg.RejectMerchantIDMismatch {
+			return metrics.CallbackRejected, nil
+		}
 	}
 
 	// Validate state transition
 	currentStatus := models.TransactionStatus(tx.Status)
 	if currentStatus != models.StatusPending {
-		log.Printf("Transaction %s is already in terminal state: %s", tx.InternalTransactionID, currentStatus)
-		return nil // Skip processing
+		logging.Printf("Transaction %s is already in terminal state: %s", tx.InternalTransactionID, currentStatus)
+		return metrics.CallbackSkipped, nil // Skip processing
 	}
 
 	// Parse result
 	resultCode := callback.Body.StkCallback.ResultCode
 	var newStatus models.TransactionStatus
 	var errorMsg *string
+	var failure *mpesa.Failure
 
 	if resultCode == 0 {
 		newStatus = models.StatusCompleted
 	} else {
-		newStatus = models.StatusFailed
 		msg := callback.Body.StkCallback.ResultDesc
 		errorMsg = &msg
+		failure = mpesa.NewFailure(resultCode, msg)
+		newStatus = models.StatusFailed
+		if failure.IsExpiry() {
+			newStatus = models.StatusExpired
+		}
 	}
 
 	// Validate transition
 	if !models.IsValidTransition(currentStatus, newStatus) {
-		return fmt.Errorf("invalid state transition from %s to %s", currentStatus, newStatus)
+		return "", fmt.Errorf("invalid state transition from %s to %s", currentStatus, newStatus)
 	}
 
-	// Parse metadata
+	// Parse metadata; failures carry none and store the failure instead
 	metadata := mpesa.ParseMpesaMetadata(callback.Body.StkCallback.CallbackMetadata.Item)
-	metadataJSON, err := json.Marshal(metadata)
+	metadataJSON, err := mpesa.MetadataJSON(metadata, failure)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %w", err)
+		return "", fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
 	// Update transaction
@@ -110,136 +410,539 @@ func (p *Processor) ProcessCallback(ctx context.Context, t *asynq.Task) error {
 		SET status = $1, 
 		    mpesa_metadata = $2, 
 		    error_message = $3,
-		    completed_at = CASE WHEN $1 IN ('COMPLETED', 'FAILED') THEN NOW() ELSE completed_at END
-		WHERE checkout_request_id = $4 AND status = 'PENDING'
+		    mpesa_receipt_number = $4,
+		    completed_at = CASE WHEN $1 IN ('COMPLETED', 'FAILED', 'EXPIRED') THEN NOW() ELSE completed_at END
+		WHERE checkout_request_id = $5 AND status = 'PENDING'
 	`
 
-	result, err := p.db.Exec(ctx, updateSQL, string(newStatus), metadataJSON, errorMsg, checkoutRequestID)
+	// Concurrent callbacks for the same checkout can contend on the row;
+	// re-running is safe because the status guard lets only one update win
+	var result pgconn.CommandTag
+	err = retryOnContention(ctx, p.callbackCfg.DBRetries, p.callbackCfg.DBRetryDelay, func() error {
+		var err error
+		result, err = p.db.Exec(ctx, updateSQL, string(newStatus), metadataJSON, errorMsg, mpesa.ReceiptNumber(metadata), checkoutRequestID)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to update transaction: %w", err)
+		return "", fmt.Errorf("failed to update transaction: %w", err)
 	}
 
+	// Settled either way: by this update, or already by someone else
+	p.callbackCfg.TxCache.Invalidate(checkoutRequestID)
+
 	rowsAffected := result.RowsAffected()
 	if rowsAffected == 0 {
-		log.Printf("No rows updated for CheckoutRequestID: %s (may have been processed already)", checkoutRequestID)
+		logging.Printf("No rows updated for CheckoutRequestID: %s (may have been processed already)", checkoutRequestID)
+		return metrics.CallbackSkipped, nil
+	}
+
+	logging.Printf("Transaction %s updated to status: %s", tx.InternalTransactionID, newStatus)
+
+	// Queue webhook to tenant
+	if err := p.enqueueWebhook(ctx, tx, newStatus, metadata, failure); err != nil {
+		logging.Printf("Failed to queue webhook for %s: %v", tx.InternalTransactionID, err)
+		// Don't fail the task, the transaction update is already committed
+	}
+
+	if newStatus == models.StatusCompleted {
+		return metrics.CallbackCompleted, nil
+	}
+	return metrics.CallbackFailed, nil
+}
+
+// ReconcilePending queries Safaricom for PENDING transactions whose callback
+// never arrived and resolves them. STK Pushes that failed before Safaricom
+// returned a checkout ID cannot be queried, so stale ones are expired
+func (p *Processor) ReconcilePending(ctx context.Context, t *asynq.Task) error {
+	if err := p.expireUnacknowledged(ctx); err != nil {
+		return err
+	}
+
+	query := `
+		SELECT checkout_request_id
+		FROM transactions
+		WHERE status = 'PENDING'
+		  AND checkout_request_id IS NOT NULL
+		  AND created_at < NOW() - make_interval(secs => $1)
+		ORDER BY created_at
+		LIMIT $2
+	`
+
+	rows, err := p.db.Query(ctx, query, p.reconcileCfg.PendingAge.Seconds(), p.reconcileCfg.BatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to select pending transactions: %w", err)
+	}
+
+	var checkoutIDs []string
+	for rows.Next() {
+		var checkoutRequestID string
+		if err := rows.Scan(&checkoutRequestID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan pending transaction: %w", err)
+		}
+		checkoutIDs = append(checkoutIDs, checkoutRequestID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read pending transactions: %w", err)
+	}
+
+	if len(checkoutIDs) == 0 {
 		return nil
 	}
 
-	log.Printf("Transaction %s updated to status: %s", tx.InternalTransactionID, newStatus)
+	resolved := 0
+	for _, checkoutRequestID := range checkoutIDs {
+		result, err := p.paymentService.QuerySTKStatus(ctx, checkoutRequestID)
+		if err != nil {
+			logging.Printf("Reconciliation query failed for CheckoutRequestID %s: %v", checkoutRequestID, err)
+			continue
+		}
+		if result.Status == models.StatusPending {
+			continue
+		}
+		resolved++
+		p.callbackCfg.TxCache.Invalidate(checkoutRequestID)
 
-	// Send webhook to tenant
-	if err := p.sendWebhook(ctx, tx, newStatus, metadata); err != nil {
-		log.Printf("Webhook delivery failed for %s: %v", tx.InternalTransactionID, err)
-		// Don't fail the task, webhook failures are logged separately
+		// Notify the tenant only if this run resolved it; a late callback
+		// that got there first has already queued the webhook
+		if result.Updated {
+			p.notifyReconciled(ctx, checkoutRequestID, result)
+		}
 	}
 
+	logging.Printf("Reconciliation resolved %d of %d pending transactions", resolved, len(checkoutIDs))
+
 	return nil
 }
 
-// getTransactionByCheckoutID fetches transaction from database
-func (p *Processor) getTransactionByCheckoutID(ctx context.Context, checkoutRequestID string) (*models.Transaction, error) {
+// expireUnacknowledged marks stale PENDING STK Pushes without a checkout ID
+// as EXPIRED. Payouts are left alone: they are flagged in orphaned_checkouts
+// because the money may still have moved
+func (p *Processor) expireUnacknowledged(ctx context.Context) error {
+	query := `
+		UPDATE transactions
+		SET status = 'EXPIRED',
+		    completed_at = NOW(),
+		    error_message = COALESCE(error_message, 'STK Push not acknowledged by Safaricom')
+		WHERE id IN (
+			SELECT id
+			FROM transactions
+			WHERE status = 'PENDING'
+			  AND direction = 'C2B'
+			  AND checkout_request_id IS NULL
+			  AND created_at < NOW() - make_interval(secs => $1)
+			ORDER BY created_at
+			LIMIT $2
+		)
+	`
+
+	result, err := p.db.Exec(ctx, query, p.reconcileCfg.PendingAge.Seconds(), p.reconcileCfg.BatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to expire unacknowledged transactions: %w", err)
+	}
+	if n := result.RowsAffected(); n > 0 {
+		logging.Printf("Reconciliation expired %d STK Pushes never acknowledged by Safaricom", n)
+	}
+	return nil
+}
+
+// purgeBatchSize bounds the rows updated per statement by
+// PurgeIdempotencyKeys, keeping row locks short
+const purgeBatchSize = 1000
+
+// NewPurgeIdempotencyKeysTask creates a new idempotency key cleanup task
+func NewPurgeIdempotencyKeysTask() *asynq.Task {
+	return asynq.NewTask(TypePurgeIdempotencyKeys, nil)
+}
+
+// PurgeIdempotencyKeys clears the idempotency keys of settled transactions
+// older than IdempotencyKeyTTL, keeping the unique index bounded. PENDING
+// transactions keep their keys so retries still conflict while in flight.
+func (p *Processor) PurgeIdempotencyKeys(ctx context.Context, t *asynq.Task) error {
+	if p.retentionCfg.IdempotencyKeyTTL <= 0 {
+		return nil
+	}
+
+	query := `
+		UPDATE transactions SET idempotency_key = NULL
+		WHERE id IN (
+			SELECT id FROM transactions
+			WHERE idempotency_key IS NOT NULL
+			  AND status <> 'PENDING'
+			  AND created_at < NOW() - make_interval(secs => $1)
+			ORDER BY created_at
+			LIMIT $2
+		)
+	`
+
+	var purged int64
+	for {
+		result, err := p.db.Exec(ctx, query, p.retentionCfg.IdempotencyKeyTTL.Seconds(), purgeBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to purge idempotency keys: %w", err)
+		}
+		purged += result.RowsAffected()
+		if result.RowsAffected() < purgeBatchSize {
+			break
+		}
+	}
+
+	if purged > 0 {
+		logging.Printf("Purged idempotency keys of %d settled transactions", purged)
+	}
+	return nil
+}
+
+// NewPurgeAPILogsTask creates a new mpesa_api_logs cleanup task
+func NewPurgeAPILogsTask() *asynq.Task {
+	return asynq.NewTask(TypePurgeAPILogs, nil)
+}
+
+// PurgeAPILogs deletes mpesa_api_logs rows older than APILogTTL. The rows
+// hold request payloads, so they are not kept past the debugging window.
+func (p *Processor) PurgeAPILogs(ctx context.Context, t *asynq.Task) error {
+	if p.retentionCfg.APILogTTL <= 0 {
+		return nil
+	}
+
 	query := `
-		SELECT id, internal_transaction_id, idempotency_key, checkout_request_id, 
-		       amount, phone, status, tenant_webhook_url, created_at, updated_at
-		FROM transactions 
-		WHERE checkout_request_id = $1
+		DELETE FROM mpesa_api_logs
+		WHERE id IN (
+			SELECT id FROM mpesa_api_logs
+			WHERE created_at < NOW() - make_interval(secs => $1)
+			ORDER BY created_at
+			LIMIT $2
+		)
 	`
 
-	var tx models.Transaction
-	err := p.db.QueryRow(ctx, query, checkoutRequestID).Scan(
-		&tx.ID,
-		&tx.InternalTransactionID,
-		&tx.IdempotencyKey,
-		&tx.CheckoutRequestID,
-		&tx.Amount,
-		&tx.Phone,
-		&tx.Status,
-		&tx.TenantWebhookURL,
-		&tx.CreatedAt,
-		&tx.UpdatedAt,
+	var purged int64
+	for {
+		result, err := p.db.Exec(ctx, query, p.retentionCfg.APILogTTL.Seconds(), purgeBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to purge API logs: %w", err)
+		}
+		purged += result.RowsAffected()
+		if result.RowsAffected() < purgeBatchSize {
+			break
+		}
+	}
+
+	if purged > 0 {
+		logging.Printf("Purged %d Safaricom API log rows", purged)
+	}
+	return nil
+}
+
+// recordCallback stores the raw callback body in the callbacks audit table
+func (p *Processor) recordCallback(ctx context.Context, payload []byte, callback *CallbackPayload) {
+	taskID, _ := asynq.GetTaskID(ctx)
+
+	insertSQL := `
+		INSERT INTO callbacks (
+			task_id, checkout_request_id, merchant_request_id,
+			result_code, result_desc, raw_payload
+		) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (task_id) DO NOTHING
+	`
+
+	stk := callback.Body.StkCallback
+	_, err := p.db.Exec(ctx, insertSQL,
+		taskID, stk.CheckoutRequestID, stk.MerchantRequestID,
+		stk.ResultCode, stk.ResultDesc, payload,
 	)
 
 	if err != nil {
-		return nil, err
+		logging.Printf("Failed to record callback: %v", err)
 	}
+}
 
-	return &tx, nil
+// getTransactionByCheckoutID fetches transaction from database, bypassing
+// the callback cache for callers that must see the current status
+func (p *Processor) getTransactionByCheckoutID(ctx context.Context, checkoutRequestID string) (*models.Transaction, error) {
+	return txcache.Load(ctx, p.db, checkoutRequestID)
 }
 
-// sendWebhook delivers the result to tenant's webhook URL
-func (p *Processor) sendWebhook(ctx context.Context, tx *models.Transaction, status models.TransactionStatus, metadata map[string]interface{}) error {
+// enqueueWebhook builds the tenant webhook payload and queues it for delivery
+func (p *Processor) enqueueWebhook(ctx context.Context, tx *models.Transaction, status models.TransactionStatus, metadata map[string]interface{}, failure *mpesa.Failure) error {
 	webhookPayload := map[string]interface{}{
 		"transaction_id": tx.InternalTransactionID,
 		"status":         string(status),
+		"direction":      tx.Direction,
 		"amount":         tx.Amount,
 		"phone":          tx.Phone,
 		"metadata":       metadata,
 		"timestamp":      time.Now().UTC().Format(time.RFC3339),
 	}
+	if tx.CheckoutRequestID != nil {
+		webhookPayload["checkout_request_id"] = *tx.CheckoutRequestID
+	}
+	// amount is what was charged; the tenant's original only appears when
+	// the amount policy rounded it
+	if tx.RequestedAmount != nil {
+		webhookPayload["requested_amount"] = *tx.RequestedAmount
+	}
+	var requestID string
+	if tx.RequestID != nil {
+		requestID = *tx.RequestID
+		webhookPayload["request_id"] = requestID
+	}
+	if failure != nil {
+		webhookPayload["failure_reason"] = failure.Reason
+		webhookPayload["result_code"] = failure.ResultCode
+		webhookPayload["result_desc"] = failure.ResultDesc
+	}
 
 	payloadBytes, err := json.Marshal(webhookPayload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal webhook payload: %w", err)
 	}
 
-	// Create signature (HMAC-SHA256)
-	signature := generateSignature(payloadBytes, []byte(tx.InternalTransactionID.String()))
+	task, err := NewDeliverWebhookTask(DeliverWebhookPayload{
+		TransactionID:         tx.ID,
+		InternalTransactionID: tx.InternalTransactionID,
+		WebhookURL:            tx.TenantWebhookURL,
+		Body:                  payloadBytes,
+		RequestID:             requestID,
+		Pending:               status == models.StatusPending,
+		TraceContext:          tracing.Inject(ctx),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = p.queueClient.Enqueue(task, asynq.Queue("default"), asynq.MaxRetry(p.webhookCfg.MaxRetries))
+	return err
+}
 
-	// Send webhook with retries
-	attemptNumber := 1
-	maxRetries := 4
-	backoff := []time.Duration{0, 1 * time.Minute, 5 * time.Minute, 15 * time.Minute}
+// NotifyPending queues the PENDING acknowledgement webhook. It is skipped
+// once the transaction is terminal, and DeliverWebhook checks again before
+// every attempt. The two deliveries are not ordered, though: one already in
+// flight when the result lands can still arrive after the final webhook, so
+// tenants must ignore PENDING for a transaction they saw finish.
+func (p *Processor) NotifyPending(ctx context.Context, t *asynq.Task) error {
+	var payload NotifyPendingPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal notify pending task: %w: %w", err, asynq.SkipRetry)
+	}
+	ctx = tracing.Extract(ctx, payload.TraceContext)
 
-	for attemptNumber <= maxRetries {
-		if attemptNumber > 1 {
-			log.Printf("Webhook retry %d/%d for %s", attemptNumber, maxRetries, tx.InternalTransactionID)
-			time.Sleep(backoff[attemptNumber-1])
-		}
+	tx, err := p.getTransactionByCheckoutID(ctx, payload.CheckoutRequestID)
+	if err != nil {
+		return fmt.Errorf("failed to find transaction: %w", err)
+	}
 
-		success, statusCode, responseBody, responseTime := p.deliverWebhook(ctx, tx.TenantWebhookURL, payloadBytes, signature)
+	if models.TransactionStatus(tx.Status) != models.StatusPending {
+		logging.Printf("Skipping PENDING webhook for %s: already %s", tx.InternalTransactionID, tx.Status)
+		return nil
+	}
 
-		// Record attempt
-		p.recordWebhookAttempt(ctx, tx.ID, attemptNumber, tx.TenantWebhookURL, webhookPayload, success, statusCode, responseBody, responseTime)
+	return p.enqueueWebhook(ctx, tx, models.StatusPending, nil, nil)
+}
 
-		if success {
-			log.Printf("Webhook delivered successfully to %s", tx.TenantWebhookURL)
+// notifyReconciled queues the tenant webhook for a transaction resolved by
+// reconciliation
+func (p *Processor) notifyReconciled(ctx context.Context, checkoutRequestID string, result *payment.STKStatus) {
+	tx, err := p.getTransactionByCheckoutID(ctx, checkoutRequestID)
+	if err != nil {
+		logging.Printf("Failed to load reconciled transaction %s: %v", checkoutRequestID, err)
+		return
+	}
+
+	// STK Query carries no receipt metadata
+	if err := p.enqueueWebhook(ctx, tx, result.Status, nil, result.Failure); err != nil {
+		logging.Printf("Failed to queue webhook for %s: %v", tx.InternalTransactionID, err)
+	}
+}
+
+// DeliverWebhook delivers a transaction result to the tenant's webhook URL.
+// Failed attempts return an error so asynq retries them per RetryDelay.
+func (p *Processor) DeliverWebhook(ctx context.Context, t *asynq.Task) error {
+	var payload DeliverWebhookPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal webhook task: %w: %w", err, asynq.SkipRetry)
+	}
+	ctx = tracing.Extract(ctx, payload.TraceContext)
+
+	// A PENDING acknowledgement still being retried is stale once the
+	// final result exists
+	if payload.Pending {
+		var status string
+		if err := p.db.QueryRow(ctx, `SELECT status FROM transactions WHERE id = $1`, payload.TransactionID).Scan(&status); err != nil {
+			return fmt.Errorf("failed to load transaction status: %w", err)
+		}
+		if models.TransactionStatus(status) != models.StatusPending {
+			logging.Printf("Dropping PENDING webhook for %s: already %s", payload.InternalTransactionID, status)
 			return nil
 		}
+	}
+
+	// Queue the delivery behind the ones already hitting this host
+	host, release, ok := p.hostLimiter.tryAcquire(payload.WebhookURL)
+	if !ok {
+		return fmt.Errorf("%w: %s", errWebhookHostBusy, host)
+	}
+	defer release()
+
+	retryCount, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	attemptNumber := retryCount + 1
+
+	secret, tenantID, err := p.getWebhookSecret(ctx, payload.TransactionID)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook secret: %w", err)
+	}
+	headers := p.webhookCfg.TenantHeaders[tenantID][payload.WebhookURL]
 
-		attemptNumber++
+	// Sign "<timestamp>.<body>" so receivers can reject replays
+	algorithm := p.webhookCfg.TenantSignatureAlgorithms[tenantID]
+	if algorithm == "" {
+		algorithm = signatureHMACSHA256
 	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := generateSignature(algorithm, signedPayload(timestamp, payload.Body), []byte(secret))
 
-	return fmt.Errorf("webhook delivery failed after %d attempts", maxRetries)
+	success, statusCode, responseBody, responseTime := p.deliverWebhook(ctx, payload.WebhookURL, payload.Body, headers, webhookSignature{
+		value:     signature,
+		algorithm: algorithm,
+		timestamp: timestamp,
+	}, payload.RequestID)
+
+	// Record attempt
+	// Endpoints that echo requests back must not leak the tenant's headers
+	responseBody = redactHeaderValues(responseBody, headers)
+	p.recordWebhookAttempt(ctx, payload.TransactionID, attemptNumber, payload.WebhookURL, payload.Body, success, statusCode, responseBody, responseTime)
+
+	if p.onWebhookResult != nil {
+		p.onWebhookResult(WebhookEvent{
+			TransactionID: payload.InternalTransactionID,
+			Attempt:       attemptNumber,
+			StatusCode:    statusCode,
+			Success:       success,
+			Final:         success || retryCount >= maxRetry,
+		})
+	}
+
+	if success {
+		logging.Printf("Webhook delivered successfully to %s", payload.WebhookURL)
+		return nil
+	}
+
+	if retryCount >= maxRetry {
+		logging.Printf("Webhook delivery failed after %d attempts for %s", attemptNumber, payload.InternalTransactionID)
+	}
+
+	return fmt.Errorf("webhook attempt %d failed for %s (status %d)", attemptNumber, payload.InternalTransactionID, statusCode)
 }
 
-// deliverWebhook performs the actual HTTP POST
-func (p *Processor) deliverWebhook(ctx context.Context, url string, payload []byte, signature string) (bool, int, string, int64) {
+// webhookBodyTruncated marks a recorded response body cut at MaxBody
+const webhookBodyTruncated = "...[truncated]"
+
+// deliverWebhook performs the actual HTTP POST. headers are the tenant's
+// custom headers; they may replace Content-Type but never the signature or
+// X-Request-ID.
+func (p *Processor) deliverWebhook(ctx context.Context, url string, payload []byte, headers map[string]string, signature webhookSignature, requestID string) (success bool, statusCode int, responseBody string, responseTime int64) {
+	ctx, span := tracing.Tracer().Start(ctx, "webhook.deliver", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", statusCode),
+			attribute.Bool("webhook.success", success),
+		)
+		if !success {
+			span.SetStatus(codes.Error, responseBody)
+		}
+		span.End()
+	}()
+
+	// DNS may have changed since registration; the dialer re-checks the
+	// connected address as well
+	if err := p.webhookCfg.Policy.ValidateURL(ctx, url); err != nil {
+		return false, 0, err.Error(), 0
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, p.webhookCfg.Timeout)
+	defer cancel()
+
 	startTime := time.Now()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodPost, url, bytes.NewReader(payload))
 	if err != nil {
 		return false, 0, err.Error(), 0
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Signature", signature)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("X-Signature", signature.value)
+	req.Header.Set("X-Signature-Scheme", signature.algorithm)
+	req.Header.Set("X-Signature-Algorithm", signature.algorithm)
+	req.Header.Set("X-Signature-Timestamp", signature.timestamp)
+	if requestID != "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+	tracing.InjectHTTP(ctx, req.Header)
 
 	resp, err := p.client.Do(req)
-	responseTime := time.Since(startTime).Milliseconds()
+	elapsed := time.Since(startTime)
+	responseTime = elapsed.Milliseconds()
+	metrics.WebhookDeliveryDuration.Observe(elapsed.Seconds())
 
 	if err != nil {
-		return false, 0, err.Error(), responseTime
+		metrics.WebhookAttempts.WithLabelValues("false").Inc()
+		return false, 0, p.describeDeliveryError(ctx, attemptCtx, err), responseTime
 	}
 	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+	// Read one byte past the cap to tell whether anything was cut
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, p.webhookCfg.MaxBody+1))
+	responseBody = responseBodyText(body, p.webhookCfg.MaxBody)
+	success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	metrics.WebhookAttempts.WithLabelValues(strconv.FormatBool(success)).Inc()
+
+	return success, resp.StatusCode, responseBody, responseTime
+}
+
+// responseBodyText makes a webhook response body storable in the
+// webhook_attempts.response_body TEXT column, which rejects invalid UTF-8
+// and NUL bytes. Bodies over max bytes are cut on a character boundary.
+func responseBodyText(body []byte, max int64) string {
+	truncated := int64(len(body)) > max
+	if truncated {
+		body = body[:max]
+		// Drop a multi-byte character cut in half
+		for i := 0; i < utf8.UTFMax-1 && len(body) > 0; i++ {
+			if r, size := utf8.DecodeLastRune(body); r != utf8.RuneError || size != 1 {
+				break
+			}
+			body = body[:len(body)-1]
+		}
+	}
 
-	return success, resp.StatusCode, string(body), responseTime
+	text := strings.ReplaceAll(strings.ToValidUTF8(string(body), "\uFFFD"), "\x00", "")
+	if truncated {
+		text += webhookBodyTruncated
+	}
+	return text
+}
+
+// describeDeliveryError classifies a failed delivery so recorded attempts
+// show whether the tenant was slow, refused the connection, or was
+// unreachable. ctx is the task context; attemptCtx carries the per-attempt
+// deadline.
+func (p *Processor) describeDeliveryError(ctx, attemptCtx context.Context, err error) string {
+	switch {
+	case errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil:
+		return fmt.Sprintf("timeout: no response within %s", p.webhookCfg.Timeout)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused: " + err.Error()
+	default:
+		return err.Error()
+	}
 }
 
 // recordWebhookAttempt logs webhook delivery attempt
-func (p *Processor) recordWebhookAttempt(ctx context.Context, txID interface{}, attemptNum int, url string, payload map[string]interface{}, success bool, statusCode int, responseBody string, responseTime int64) {
+func (p *Processor) recordWebhookAttempt(ctx context.Context, txID uuid.UUID, attemptNum int, url string, payload []byte, success bool, statusCode int, responseBody string, responseTime int64) {
 	insertSQL := `
 		INSERT INTO webhook_attempts (
 			transaction_id, attempt_number, webhook_url, 
@@ -248,8 +951,6 @@ func (p *Processor) recordWebhookAttempt(ctx context.Context, txID interface{},
 		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
 
-	payloadJSON, _ := json.Marshal(payload)
-
 	var errMsg *string
 	if !success {
 		msg := responseBody
@@ -257,18 +958,73 @@ func (p *Processor) recordWebhookAttempt(ctx context.Context, txID interface{},
 	}
 
 	_, err := p.db.Exec(ctx, insertSQL,
-		txID, attemptNum, url, payloadJSON,
+		txID, attemptNum, url, payload,
 		statusCode, responseBody, responseTime, success, errMsg,
 	)
 
 	if err != nil {
-		log.Printf("Failed to record webhook attempt: %v", err)
+		logging.Printf("Failed to record webhook attempt: %v", err)
+	}
+}
+
+// redactHeaderValues masks every custom header value occurring in s
+func redactHeaderValues(s string, headers map[string]string) string {
+	for _, value := range headers {
+		if value != "" {
+			s = strings.ReplaceAll(s, value, "[REDACTED]")
+		}
+	}
+	return s
+}
+
+// getWebhookSecret returns the transaction's webhook secret, or the gateway
+// default when the tenant did not supply one, and the transaction's tenant
+func (p *Processor) getWebhookSecret(ctx context.Context, txID uuid.UUID) (secret, tenantID string, err error) {
+	var txSecret, txTenant *string
+	err = p.db.QueryRow(ctx, `SELECT webhook_secret, tenant_id FROM transactions WHERE id = $1`, txID).Scan(&txSecret, &txTenant)
+	if err != nil {
+		return "", "", err
+	}
+	if txTenant != nil {
+		tenantID = *txTenant
 	}
+	if txSecret != nil && *txSecret != "" {
+		return *txSecret, tenantID, nil
+	}
+	return p.webhookCfg.DefaultSecret, tenantID, nil
+}
+
+// Webhook signature algorithms, sent in X-Signature-Algorithm (and, for
+// receivers written before it existed, X-Signature-Scheme)
+const (
+	signatureHMACSHA256 = "hmac-sha256"
+	signatureHMACSHA512 = "hmac-sha512"
+)
+
+// webhookSignature is what deliverWebhook sends in the signature headers
+type webhookSignature struct {
+	value     string // Hex-encoded HMAC
+	algorithm string
+	timestamp string // Unix seconds, covered by the HMAC
 }
 
-// generateSignature creates HMAC-SHA256 signature
-func generateSignature(payload, secret []byte) string {
-	h := hmac.New(sha256.New, secret)
+// signedPayload builds the exact bytes covered by the webhook signature:
+// the X-Signature-Timestamp value, a literal ".", then the raw request body
+func signedPayload(timestamp string, body []byte) []byte {
+	signed := make([]byte, 0, len(timestamp)+1+len(body))
+	signed = append(signed, timestamp...)
+	signed = append(signed, '.')
+	return append(signed, body...)
+}
+
+// generateSignature returns the hex-encoded HMAC of payload using
+// algorithm, falling back to HMAC-SHA256 for unknown values
+func generateSignature(algorithm string, payload, secret []byte) string {
+	hash := sha256.New
+	if algorithm == signatureHMACSHA512 {
+		hash = sha512.New
+	}
+	h := hmac.New(hash, secret)
 	h.Write(payload)
 	return hex.EncodeToString(h.Sum(nil))
 }
@@ -287,3 +1043,61 @@ type CallbackPayload struct {
 		} `json:"stkCallback"`
 	} `json:"Body"`
 }
+
+// Callback envelopes Safaricom posts, as told apart by DetectCallbackKind
+const (
+	CallbackKindUnknown   = ""
+	CallbackKindSTK       = "stk"        // {"Body": {"stkCallback": ...}}
+	CallbackKindB2CResult = "b2c_result" // {"Result": ...}, B2C results and queue timeouts
+)
+
+// DetectCallbackKind reports which envelope raw uses, so a callback posted
+// to the wrong URL still reaches the right processing
+func DetectCallbackKind(raw []byte) string {
+	var shape struct {
+		Body *struct {
+			StkCallback json.RawMessage `json:"stkCallback"`
+		} `json:"Body"`
+		Result json.RawMessage `json:"Result"`
+	}
+	if err := json.Unmarshal(raw, &shape); err != nil {
+		return CallbackKindUnknown
+	}
+
+	switch {
+	case shape.Body != nil && len(shape.Body.StkCallback) > 0:
+		return CallbackKindSTK
+	case len(shape.Result) > 0 && string(shape.Result) != "null":
+		return CallbackKindB2CResult
+	}
+	return CallbackKindUnknown
+}
+
+// ValidateCallbackShape checks that a callback carries the fields processing
+// depends on. Missing fields would otherwise decode as zero values, and a
+// missing ResultCode would read as success.
+func ValidateCallbackShape(raw []byte) error {
+	var shape struct {
+		Body *struct {
+			StkCallback *struct {
+				CheckoutRequestID *string `json:"CheckoutRequestID"`
+				ResultCode        *int    `json:"ResultCode"`
+			} `json:"stkCallback"`
+		} `json:"Body"`
+	}
+	if err := json.Unmarshal(raw, &shape); err != nil {
+		return err
+	}
+
+	switch {
+	case shape.Body == nil:
+		return errors.New("missing Body")
+	case shape.Body.StkCallback == nil:
+		return errors.New("missing Body.stkCallback")
+	case shape.Body.StkCallback.CheckoutRequestID == nil || *shape.Body.StkCallback.CheckoutRequestID == "":
+		return errors.New("missing Body.stkCallback.CheckoutRequestID")
+	case shape.Body.StkCallback.ResultCode == nil:
+		return errors.New("missing Body.stkCallback.ResultCode")
+	}
+	return nil
+}
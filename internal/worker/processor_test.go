@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mpesa-gateway/internal/urlguard"
+)
+
+func TestWebhookBackoffGrowsToCeiling(t *testing.T) {
+	const (
+		base    = time.Minute
+		ceiling = 30 * time.Minute
+		samples = 500
+	)
+	bounds := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 30 * time.Minute, 30 * time.Minute}
+
+	for n, bound := range bounds {
+		var longest time.Duration
+		for i := 0; i < samples; i++ {
+			d := webhookBackoff(n, base, ceiling)
+			if d < 0 || d >= bound {
+				t.Fatalf("webhookBackoff(%d) = %s, want within [0, %s)", n, d, bound)
+			}
+			longest = max(longest, d)
+		}
+
+		// With full jitter the longest of many samples lands in the top half
+		// of the range, above every delay the previous retry could draw
+		if longest < bound/2 {
+			t.Errorf("longest webhookBackoff(%d) over %d samples = %s, want at least %s", n, samples, longest, bound/2)
+		}
+	}
+}
+
+func TestWebhookBackoffIsJittered(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		seen[webhookBackoff(3, time.Minute, 30*time.Minute)] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("webhookBackoff(3) returned %d distinct delays in 100 calls, want them spread out", len(seen))
+	}
+}
+
+func TestWebhookBackoffLargeRetryCount(t *testing.T) {
+	// The doubling stops at the ceiling, so a large n cannot overflow
+	if d := webhookBackoff(1000, time.Second, time.Hour); d < 0 || d >= time.Hour {
+		t.Errorf("webhookBackoff(1000) = %s, want within [0, 1h)", d)
+	}
+}
+
+func TestGenerateSignature(t *testing.T) {
+	// RFC 4231 test case 2
+	key := []byte("Jefe")
+	data := []byte("what do ya want for nothing?")
+
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{signatureHMACSHA256, "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{signatureHMACSHA512, "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea2505549758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737"},
+		// Unknown algorithms fall back to HMAC-SHA256
+		{"", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"hmac-md5", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			if got := generateSignature(tt.algorithm, data, key); got != tt.want {
+				t.Errorf("generateSignature(%q) = %s, want %s", tt.algorithm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedPayload(t *testing.T) {
+	got := signedPayload("1700000000", []byte(`{"status":"COMPLETED"}`))
+	if want := `1700000000.{"status":"COMPLETED"}`; string(got) != want {
+		t.Errorf("signedPayload() = %s, want %s", got, want)
+	}
+}
+
+func TestDeliverWebhookSignatureHeaders(t *testing.T) {
+	const secret = "whsec_test"
+	body := []byte(`{"transaction_id":"0b7c3f9e-4c1e-4e8a-9d0a-1f2e3d4c5b6a","status":"COMPLETED"}`)
+
+	for _, algorithm := range []string{signatureHMACSHA256, signatureHMACSHA512} {
+		t.Run(algorithm, func(t *testing.T) {
+			var got http.Header
+			var received []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Clone()
+				received, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			p := NewProcessor(nil, nil, nil, ReconcileConfig{}, RetentionConfig{}, WebhookConfig{
+				Timeout:   5 * time.Second,
+				MaxBody:   1024,
+				Policy:    urlguard.Policy{AllowPrivate: true},
+				Transport: http.DefaultTransport,
+			}, CallbackConfig{})
+
+			timestamp := "1700000000"
+			signature := webhookSignature{
+				value:     generateSignature(algorithm, signedPayload(timestamp, body), []byte(secret)),
+				algorithm: algorithm,
+				timestamp: timestamp,
+			}
+			// Tenant headers cannot replace the signature headers
+			headers := map[string]string{"X-Signature-Algorithm": "none", "Authorization": "Bearer tenant"}
+
+			success, status, _, _ := p.deliverWebhook(context.Background(), srv.URL, body, headers, signature, "req-1")
+			if !success || status != http.StatusOK {
+				t.Fatalf("deliverWebhook() = %t, %d, want a successful delivery", success, status)
+			}
+
+			if v := got.Get("X-Signature-Algorithm"); v != algorithm {
+				t.Errorf("X-Signature-Algorithm = %q, want %q", v, algorithm)
+			}
+			if v := got.Get("X-Signature-Scheme"); v != algorithm {
+				t.Errorf("X-Signature-Scheme = %q, want %q", v, algorithm)
+			}
+			if v := got.Get("Authorization"); v != "Bearer tenant" {
+				t.Errorf("Authorization = %q, want the tenant header", v)
+			}
+
+			// Verify the way a receiver would, from the headers alone
+			var newHash func() hash.Hash
+			switch got.Get("X-Signature-Algorithm") {
+			case signatureHMACSHA256:
+				newHash = sha256.New
+			case signatureHMACSHA512:
+				newHash = sha512.New
+			default:
+				t.Fatalf("unexpected X-Signature-Algorithm %q", got.Get("X-Signature-Algorithm"))
+			}
+			mac := hmac.New(newHash, []byte(secret))
+			mac.Write([]byte(got.Get("X-Signature-Timestamp") + "."))
+			mac.Write(received)
+			if want := hex.EncodeToString(mac.Sum(nil)); got.Get("X-Signature") != want {
+				t.Errorf("X-Signature = %s, want %s", got.Get("X-Signature"), want)
+			}
+		})
+	}
+}
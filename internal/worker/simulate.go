@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hibiken/asynq"
+
+	"github.com/mpesa-gateway/internal/logging"
+	"github.com/mpesa-gateway/internal/mpesa"
+)
+
+// SimulatedCallbackScheduler returns an mpesa.Simulator OnSTKPush hook that
+// enqueues the callback Safaricom would have sent, carrying resultCode, to be
+// processed after delay. The delay gives the payment service time to record
+// the checkout before its callback arrives.
+func SimulatedCallbackScheduler(client *asynq.Client, queue string, delay time.Duration, resultCode int) func(context.Context, mpesa.STKPushRequest, *mpesa.STKPushResponse) {
+	return func(ctx context.Context, req mpesa.STKPushRequest, resp *mpesa.STKPushResponse) {
+		body, err := json.Marshal(simulatedCallback(req, resp, resultCode))
+		if err != nil {
+			logging.Printf("Failed to build simulated callback for %s: %v", resp.CheckoutRequestID, err)
+			return
+		}
+
+		task, err := NewProcessCallbackTask(ctx, body)
+		if err != nil {
+			logging.Printf("Failed to create simulated callback task for %s: %v", resp.CheckoutRequestID, err)
+			return
+		}
+
+		_, err = client.EnqueueContext(ctx, task,
+			asynq.Queue(queue),
+			asynq.MaxRetry(3),
+			asynq.TaskID(CallbackTaskID(resp.CheckoutRequestID)),
+			asynq.ProcessIn(delay),
+		)
+		if err != nil {
+			logging.Printf("Failed to enqueue simulated callback for %s: %v", resp.CheckoutRequestID, err)
+			return
+		}
+
+		logging.Printf("Simulated callback for %s scheduled in %s with ResultCode %d", resp.CheckoutRequestID, delay, resultCode)
+	}
+}
+
+// simulatedCallback builds an STK callback for resp. Successful callbacks
+// carry the metadata items Safaricom sends on completion.
+func simulatedCallback(req mpesa.STKPushRequest, resp *mpesa.STKPushResponse, resultCode int) CallbackPayload {
+	var callback CallbackPayload
+	stk := &callback.Body.StkCallback
+	stk.MerchantRequestID = resp.MerchantRequestID
+	stk.CheckoutRequestID = resp.CheckoutRequestID
+	stk.ResultCode = resultCode
+	stk.ResultDesc = mpesa.SimulatedResultDesc(resultCode)
+
+	if resultCode == 0 {
+		stk.CallbackMetadata.Item = []mpesa.Item{
+			{Name: "Amount", Value: json.Number(req.Amount)},
+			{Name: "MpesaReceiptNumber", Value: mpesa.SimulatedReceipt()},
+			{Name: "TransactionDate", Value: json.Number(time.Now().Format("20060102150405"))},
+			{Name: "PhoneNumber", Value: json.Number(req.PhoneNumber)},
+		}
+	}
+	return callback
+}
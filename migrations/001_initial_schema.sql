@@ -5,7 +5,7 @@
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
 -- Transactions table: Core payment transaction records
-CREATE TABLE transactions (
+CREATE TABLE IF NOT EXISTS transactions (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     internal_transaction_id UUID UNIQUE NOT NULL,
     idempotency_key UUID UNIQUE NOT NULL,
@@ -38,7 +38,7 @@ CREATE TABLE transactions (
 );
 
 -- Webhook delivery attempts audit trail
-CREATE TABLE webhook_attempts (
+CREATE TABLE IF NOT EXISTS webhook_attempts (
     id BIGSERIAL PRIMARY KEY,
     transaction_id UUID NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
     
@@ -61,18 +61,18 @@ CREATE TABLE webhook_attempts (
 );
 
 -- Performance Indexes
-CREATE INDEX idx_transactions_checkout_request 
+CREATE INDEX IF NOT EXISTS idx_transactions_checkout_request 
     ON transactions(checkout_request_id) 
     WHERE checkout_request_id IS NOT NULL;
 
-CREATE INDEX idx_transactions_status 
+CREATE INDEX IF NOT EXISTS idx_transactions_status 
     ON transactions(status) 
     WHERE status = 'PENDING';
 
-CREATE INDEX idx_transactions_created_at 
+CREATE INDEX IF NOT EXISTS idx_transactions_created_at 
     ON transactions(created_at DESC);
 
-CREATE INDEX idx_webhook_attempts_transaction 
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_transaction 
     ON webhook_attempts(transaction_id, attempted_at DESC);
 
 -- Updated timestamp trigger
@@ -84,6 +84,7 @@ BEGIN
 END;
 $$ language 'plpgsql';
 
+DROP TRIGGER IF EXISTS update_transactions_updated_at ON transactions;
 CREATE TRIGGER update_transactions_updated_at 
     BEFORE UPDATE ON transactions
     FOR EACH ROW
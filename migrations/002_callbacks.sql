@@ -0,0 +1,31 @@
+-- M-Pesa Payment Gateway - Raw callback audit log
+
+-- Callbacks table: Every callback body exactly as Safaricom sent it
+CREATE TABLE IF NOT EXISTS callbacks (
+    id BIGSERIAL PRIMARY KEY,
+
+    -- Queue task that processed the callback (dedupes task retries)
+    task_id VARCHAR(100) UNIQUE NOT NULL,
+
+    -- Safaricom identifiers
+    checkout_request_id VARCHAR(100),
+    merchant_request_id VARCHAR(100),
+
+    -- Result as reported by Safaricom
+    result_code INTEGER,
+    result_desc TEXT,
+
+    -- Original request body
+    raw_payload JSONB NOT NULL,
+
+    -- Timestamp
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_callbacks_checkout_request 
+    ON callbacks(checkout_request_id, received_at DESC);
+
+-- Comments for documentation
+COMMENT ON TABLE callbacks IS 'Audit trail of raw Safaricom callbacks for disputes and replay';
+COMMENT ON COLUMN callbacks.task_id IS 'Asynq task ID that processed the callback';
+COMMENT ON COLUMN callbacks.raw_payload IS 'Callback body exactly as received from Safaricom';
@@ -0,0 +1,5 @@
+-- M-Pesa Payment Gateway - Per-tenant webhook signing secret
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS webhook_secret TEXT;
+
+COMMENT ON COLUMN transactions.webhook_secret IS 'Tenant-supplied HMAC key for webhook signatures (NULL = gateway default secret)';
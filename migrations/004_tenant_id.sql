@@ -0,0 +1,5 @@
+-- M-Pesa Payment Gateway - Tenant credential routing
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(64);
+
+COMMENT ON COLUMN transactions.tenant_id IS 'Tenant whose Safaricom credentials initiated the payment (NULL = default credentials)';
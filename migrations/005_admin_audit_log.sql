@@ -0,0 +1,28 @@
+-- M-Pesa Payment Gateway - Operator action audit log
+
+-- Admin audit log: Who did what to which transaction, and when
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+    id BIGSERIAL PRIMARY KEY,
+
+    -- Action performed (e.g. callback_reprocess)
+    action VARCHAR(50) NOT NULL,
+
+    -- Operator identity as supplied in X-Operator
+    actor VARCHAR(100) NOT NULL,
+
+    -- Affected transaction
+    transaction_id UUID REFERENCES transactions(internal_transaction_id),
+
+    -- Action-specific context (force flag, task ID, reason)
+    details JSONB,
+
+    -- Timestamp
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_transaction 
+    ON admin_audit_log(transaction_id, created_at DESC);
+
+-- Comments for documentation
+COMMENT ON TABLE admin_audit_log IS 'Audit trail of manual operator actions';
+COMMENT ON COLUMN admin_audit_log.actor IS 'Operator identity from the X-Operator header';
@@ -0,0 +1,7 @@
+-- M-Pesa Payment Gateway - EXPIRED status for unanswered STK prompts
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_status_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_status_check
+    CHECK (status IN ('PENDING', 'COMPLETED', 'FAILED', 'EXPIRED'));
+
+COMMENT ON COLUMN transactions.status IS 'Transaction state: PENDING, COMPLETED, FAILED, or EXPIRED';
@@ -0,0 +1,15 @@
+-- M-Pesa Payment Gateway - B2C payouts
+
+-- Money flow: C2B = STK Push collection, B2C = payout to customer
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS direction VARCHAR(3) NOT NULL DEFAULT 'C2B'
+    CHECK (direction IN ('C2B', 'B2C'));
+
+-- Safaricom identifier for B2C requests (STK Push uses checkout_request_id)
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS conversation_id VARCHAR(100);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_conversation 
+    ON transactions(conversation_id) 
+    WHERE conversation_id IS NOT NULL;
+
+COMMENT ON COLUMN transactions.direction IS 'C2B (STK Push collection) or B2C (payout)';
+COMMENT ON COLUMN transactions.conversation_id IS 'Safaricom B2C ConversationID';
@@ -0,0 +1,15 @@
+-- M-Pesa Payment Gateway - Receipt number column
+
+-- Receipt number from the callback metadata, promoted for support lookups
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS mpesa_receipt_number VARCHAR(20);
+
+-- Backfill transactions completed before the column existed
+UPDATE transactions
+SET mpesa_receipt_number = COALESCE(mpesa_metadata->>'MpesaReceiptNumber', mpesa_metadata->>'TransactionReceipt')
+WHERE mpesa_receipt_number IS NULL AND mpesa_metadata IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_transactions_receipt 
+    ON transactions(mpesa_receipt_number) 
+    WHERE mpesa_receipt_number IS NOT NULL;
+
+COMMENT ON COLUMN transactions.mpesa_receipt_number IS 'M-Pesa receipt (MpesaReceiptNumber, or TransactionReceipt for B2C)';
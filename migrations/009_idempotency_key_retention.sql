@@ -0,0 +1,15 @@
+-- M-Pesa Payment Gateway - Idempotency key retention
+
+-- Keys of settled transactions older than MPESA_IDEMPOTENCY_KEY_TTL are
+-- cleared by the worker, so the column becomes nullable and the unique
+-- constraint is replaced by a partial unique index of the same name
+-- (payment.Service matches duplicate-key errors on it)
+ALTER TABLE transactions ALTER COLUMN idempotency_key DROP NOT NULL;
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_idempotency_key_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_idempotency_key_key 
+    ON transactions(idempotency_key) 
+    WHERE idempotency_key IS NOT NULL;
+
+COMMENT ON COLUMN transactions.idempotency_key IS 'Client-provided idempotency key to prevent duplicate requests; NULL once past retention';
@@ -0,0 +1,16 @@
+-- M-Pesa Payment Gateway - C2B confirmations
+
+-- Payments made directly to the paybill/till are recorded from the C2B
+-- confirmation callback. Safaricom masks or hashes the payer's MSISDN on
+-- confirmations, so phone may be empty when it cannot be normalized
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_phone_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_phone_check
+    CHECK (phone ~ '^254[0-9]{9}$' OR phone = '');
+
+-- One row per confirmed TransID. STK Push rows carry the same receipt once
+-- completed, so only rows without a Safaricom request ID are constrained
+CREATE UNIQUE INDEX IF NOT EXISTS idx_transactions_c2b_receipt 
+    ON transactions(mpesa_receipt_number) 
+    WHERE checkout_request_id IS NULL AND conversation_id IS NULL AND mpesa_receipt_number IS NOT NULL;
+
+COMMENT ON COLUMN transactions.phone IS 'Customer phone number in format 254XXXXXXXXX; empty when a C2B confirmation masked it';
@@ -0,0 +1,5 @@
+-- M-Pesa Payment Gateway - Per-tenant STK callback URL
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS callback_url TEXT;
+
+COMMENT ON COLUMN transactions.callback_url IS 'CallBackURL sent with the STK Push (tenant callback_url or MPESA_SAFARICOM_CALLBACK_URL)';
@@ -0,0 +1,34 @@
+-- M-Pesa Payment Gateway - Orphaned STK Push checkouts
+
+-- STK Pushes Safaricom accepted whose checkout ID could not be saved on the
+-- transaction, so their callbacks cannot be matched. Kept for manual
+-- reconciliation; no foreign key so the row is written whatever state the
+-- transaction is in.
+CREATE TABLE IF NOT EXISTS orphaned_checkouts (
+    id BIGSERIAL PRIMARY KEY,
+
+    -- Transaction the STK Push was sent for
+    transaction_id UUID NOT NULL,
+    tenant_id VARCHAR(64),
+
+    -- Identifiers returned by Safaricom
+    checkout_request_id VARCHAR(100) NOT NULL,
+    merchant_request_id VARCHAR(100),
+
+    -- Why the checkout ID could not be recorded
+    error_message TEXT,
+
+    -- Set once an operator has reconciled the transaction
+    resolved_at TIMESTAMPTZ,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_orphaned_checkouts_unresolved 
+    ON orphaned_checkouts(created_at) 
+    WHERE resolved_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_orphaned_checkouts_checkout 
+    ON orphaned_checkouts(checkout_request_id);
+
+COMMENT ON TABLE orphaned_checkouts IS 'Accepted STK Pushes whose checkout ID was not saved on the transaction';
@@ -0,0 +1,25 @@
+-- M-Pesa Payment Gateway - API keys
+
+-- Per-caller API keys, an alternative to the shared X-Internal-Secret.
+-- Only the SHA-256 of each key is stored.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id BIGSERIAL PRIMARY KEY,
+
+    -- Who the key was issued to (e.g. "acme-erp")
+    label VARCHAR(100) NOT NULL,
+
+    -- Hex SHA-256 of the key
+    key_hash CHAR(64) NOT NULL UNIQUE,
+
+    -- Tenant the key is pinned to (NULL = any tenant and the admin API)
+    tenant_id VARCHAR(64),
+
+    -- Disabled keys are rejected; rows are kept for the audit trail
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    disabled_at TIMESTAMPTZ
+);
+
+COMMENT ON TABLE api_keys IS 'API keys accepted in X-API-Key when MPESA_AUTH_MODE allows them';
+COMMENT ON COLUMN api_keys.key_hash IS 'Hex SHA-256 of the key; the key itself is only shown once';
@@ -0,0 +1,10 @@
+-- M-Pesa Payment Gateway - Fleet-wide webhook attempt listing
+
+-- GET /admin/webhook-attempts pages through attempts newest first, usually
+-- restricted to failures
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_recent 
+    ON webhook_attempts(attempted_at DESC, id DESC);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_recent_failed 
+    ON webhook_attempts(attempted_at DESC, id DESC) 
+    WHERE NOT success;
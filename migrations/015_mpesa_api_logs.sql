@@ -0,0 +1,33 @@
+-- M-Pesa Payment Gateway - Safaricom API debug log
+
+-- Outbound STK Push requests and Safaricom's raw responses, written only
+-- when MPESA_LOG_API_CALLS is enabled. The request Password is redacted.
+-- No foreign key so a row survives the transaction being discarded.
+CREATE TABLE IF NOT EXISTS mpesa_api_logs (
+    id BIGSERIAL PRIMARY KEY,
+
+    -- Transaction the call was made for
+    transaction_id UUID NOT NULL,
+    tenant_id VARCHAR(64),
+
+    operation VARCHAR(32) NOT NULL,
+    request JSONB NOT NULL,
+
+    -- Response as received; NULL when no response arrived
+    status_code INTEGER,
+    response TEXT,
+
+    -- Transport or decoding error, if any
+    error_message TEXT,
+
+    duration_ms INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_mpesa_api_logs_transaction 
+    ON mpesa_api_logs(transaction_id);
+
+CREATE INDEX IF NOT EXISTS idx_mpesa_api_logs_created 
+    ON mpesa_api_logs(created_at);
+
+COMMENT ON TABLE mpesa_api_logs IS 'Debug log of Safaricom API calls (MPESA_LOG_API_CALLS)';
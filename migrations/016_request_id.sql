@@ -0,0 +1,5 @@
+-- M-Pesa Payment Gateway - Originating request ID
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS request_id VARCHAR(128);
+
+COMMENT ON COLUMN transactions.request_id IS 'X-Request-ID of the /initiate or /payouts request that created the transaction; sent with its webhooks';
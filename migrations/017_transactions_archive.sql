@@ -0,0 +1,36 @@
+-- M-Pesa Payment Gateway - Transaction archive
+
+-- Settled transactions older than MPESA_ARCHIVE_AFTER are moved here by the
+-- worker, together with their webhook attempts. Rows are copied with
+-- SELECT *, so the columns mirror the live tables at this point; a later
+-- migration adding a column to transactions or webhook_attempts must add it
+-- to the archive table as well.
+CREATE TABLE IF NOT EXISTS transactions_archive (LIKE transactions);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts_archive (LIKE webhook_attempts);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'transactions_archive_pkey') THEN
+        ALTER TABLE transactions_archive ADD CONSTRAINT transactions_archive_pkey PRIMARY KEY (id);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'webhook_attempts_archive_pkey') THEN
+        ALTER TABLE webhook_attempts_archive ADD CONSTRAINT webhook_attempts_archive_pkey PRIMARY KEY (id);
+    END IF;
+END $$;
+
+-- GET /transactions/export?include_archive=true reads by creation time
+CREATE INDEX IF NOT EXISTS idx_transactions_archive_created_at 
+    ON transactions_archive(created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_archive_internal_id 
+    ON transactions_archive(internal_transaction_id);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_archive_transaction 
+    ON webhook_attempts_archive(transaction_id, attempted_at DESC);
+
+-- Operator actions stay on record after their transaction is archived
+ALTER TABLE admin_audit_log DROP CONSTRAINT IF EXISTS admin_audit_log_transaction_id_fkey;
+
+COMMENT ON TABLE transactions_archive IS 'Settled transactions moved out of transactions after MPESA_ARCHIVE_AFTER';
+COMMENT ON TABLE webhook_attempts_archive IS 'Webhook attempts of archived transactions';
@@ -0,0 +1,11 @@
+-- M-Pesa Payment Gateway - Requested amount
+
+-- amount is what the customer is charged. When MPESA_AMOUNT_ROUNDING
+-- changed the amount the tenant asked for, the original is kept here,
+-- unscaled so sub-cent inputs are recorded exactly.
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS requested_amount NUMERIC;
+
+-- Keep the archive's columns in the same order as transactions
+ALTER TABLE transactions_archive ADD COLUMN IF NOT EXISTS requested_amount NUMERIC;
+
+COMMENT ON COLUMN transactions.requested_amount IS 'Amount in the API request when the amount policy rounded it; NULL when it was charged as requested';
@@ -0,0 +1,16 @@
+-- M-Pesa Payment Gateway - Orphaned B2C payouts
+
+-- Payouts whose outcome is unknown are kept in orphaned_checkouts too:
+-- accepted ones whose ConversationID could not be saved, and requests that
+-- failed in a way that may still have reached Safaricom's queue (timeouts,
+-- 5xx). The latter have no Safaricom identifier at all.
+ALTER TABLE orphaned_checkouts ALTER COLUMN checkout_request_id DROP NOT NULL;
+
+ALTER TABLE orphaned_checkouts ADD COLUMN IF NOT EXISTS conversation_id VARCHAR(100);
+
+CREATE INDEX IF NOT EXISTS idx_orphaned_checkouts_conversation 
+    ON orphaned_checkouts(conversation_id) 
+    WHERE conversation_id IS NOT NULL;
+
+COMMENT ON TABLE orphaned_checkouts IS 'Accepted STK Pushes and B2C payouts whose Safaricom ID was not saved on the transaction, and payouts with an unknown outcome';
+COMMENT ON COLUMN orphaned_checkouts.conversation_id IS 'Safaricom B2C ConversationID; NULL for STK Pushes and payouts Safaricom never acknowledged';